@@ -0,0 +1,518 @@
+package gasync
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrActivityToken is returned when activity is completed with a token of another attempt or worker
+var ErrActivityToken = errors.New("activity token is invalid or expired")
+
+// ErrNoActivity is returned by PollActivity when there are no pending activities
+var ErrNoActivity = errors.New("no pending activities")
+
+// Activity statuses
+const (
+	ActivityPending   = "pending"
+	ActivityRunning   = "running"
+	ActivityCompleted = "completed"
+	ActivityFailed    = "failed"
+	ActivityCancelled = "cancelled"
+)
+
+// DefaultActivityTimeout is used when ActivityHandler.Timeout is not set
+const DefaultActivityTimeout = time.Minute * 10
+
+// DBActivity is a task executed by external worker. Stored in Collection+"_activities".
+type DBActivity struct {
+	ID          string
+	Type        string
+	Status      string
+	Input       interface{}
+	Output      interface{}
+	Error       string
+	Attempt     int
+	Worker      string
+	Token       string // issued to the worker that claimed current attempt
+	Callback    async.CallbackRequest
+	Created     time.Time
+	NotBefore   time.Time // retries are not handed out before this time
+	Deadline    time.Time // attempt times out after this time
+	TimeoutTask string    // setup data of scheduled timeout
+
+	HeartbeatTimeout time.Duration // attempt fails if worker doesn't send heartbeat within this period
+	LastHeartbeat    time.Time
+	Details          interface{} // progress details sent with the last heartbeat
+	HeartbeatTask    string      // setup data of scheduled heartbeat check
+}
+
+// ActivityTask is sent to workers
+type ActivityTask struct {
+	ID       string
+	Type     string
+	Input    interface{}
+	Attempt  int
+	Token    string
+	Deadline time.Time
+
+	HeartbeatTimeout time.Duration `json:",omitempty"` // worker should send heartbeats more often than this
+}
+
+// ActivityResult is reported by workers. If Error is set - activity is retried according to retry policy.
+type ActivityResult struct {
+	Token  string
+	Output json.RawMessage
+	Error  string
+}
+
+// ActivityHandler hands step execution to external workers.
+// Workers poll /activity/poll?type=... (or receive a push to PushURL) and report results to /activity/{id}/complete.
+// Attempt that is not completed within Timeout is failed and retried according to Retry policy.
+type ActivityHandler struct {
+	Type    string             // workers poll activities by type
+	Input   func() interface{} // evaluated on setup, so that it can reference workflow state
+	Output  interface{}        // pointer, receives output of successful activity
+	Error   *string            // receives error if all attempts failed. If not set - last error is returned from the event
+	Timeout time.Duration
+	Retry   RetryPolicy
+	PushURL string // optional, activity is POSTed to this URL when it's ready
+	// HeartbeatTimeout fails the attempt if worker doesn't report heartbeat within this period,
+	// so that crashed workers are detected before Timeout
+	HeartbeatTimeout time.Duration
+
+	engine    *FirestoreEngine
+	scheduler TimerScheduler
+}
+
+type ActivityData struct {
+	ID string
+}
+
+// Activity waits until activity is executed by external worker
+func (s *Server) Activity(name string, h ActivityHandler, stmts ...async.Stmt) async.Event {
+	h.engine = s.Engine
+	h.scheduler = s.timers
+	return async.On(name, &h, stmts...)
+}
+
+func (h ActivityHandler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type     string
+		Activity string
+		Timeout  string
+	}{
+		Type:     "activity",
+		Activity: h.Type,
+		Timeout:  fmt.Sprintf("%v sec", h.timeout().Seconds()),
+	})
+}
+
+func (h *ActivityHandler) timeout() time.Duration {
+	if h.Timeout <= 0 {
+		return DefaultActivityTimeout
+	}
+	return h.Timeout
+}
+
+func (fs FirestoreEngine) activities() *firestore.CollectionRef {
+	return fs.DB.Collection(fs.Collection + "_activities")
+}
+
+func activityID(req async.CallbackRequest) string {
+	return fmt.Sprintf("%v_%v_%v", req.WorkflowID, req.Name, req.PC)
+}
+
+func (h *ActivityHandler) Setup(ctx context.Context, req async.CallbackRequest) (string, error) {
+	defer logTime("activity setup")()
+	a := DBActivity{
+		ID:       activityID(req),
+		Type:     h.Type,
+		Status:   ActivityPending,
+		Attempt:  1,
+		Callback: req,
+		Created:  time.Now(),
+		Deadline: time.Now().Add(h.timeout()),
+
+		HeartbeatTimeout: h.HeartbeatTimeout,
+	}
+	if h.Input != nil {
+		a.Input = h.Input()
+	}
+	var err error
+	a.TimeoutTask, err = h.scheduler.Setup(ctx, req, h.timeout())
+	if err != nil {
+		return "", fmt.Errorf("err scheduling activity timeout: %v", err)
+	}
+	_, err = h.engine.activities().Doc(a.ID).Set(ctx, a)
+	if err != nil {
+		return "", fmt.Errorf("err creating activity: %v", err)
+	}
+	h.push(ctx, a)
+	d, err := json.Marshal(ActivityData{
+		ID: a.ID,
+	})
+	return string(d), err
+}
+
+// push notifies worker about the new activity. If push fails - activity is still available for polling.
+func (h *ActivityHandler) push(ctx context.Context, a DBActivity) {
+	if h.PushURL == "" {
+		return
+	}
+	d, err := json.Marshal(ActivityTask{
+		ID:       a.ID,
+		Type:     a.Type,
+		Input:    a.Input,
+		Attempt:  a.Attempt,
+		Deadline: a.Deadline,
+
+		HeartbeatTimeout: a.HeartbeatTimeout,
+	})
+	if err != nil {
+		log.Printf("err marshaling activity push: %v", err)
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", h.PushURL, bytes.NewReader(d))
+	if err != nil {
+		log.Printf("err pushing activity %v: %v", a.ID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("err pushing activity %v: %v", a.ID, err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("err pushing activity %v: status %v", a.ID, resp.StatusCode)
+	}
+}
+
+// Handle is called with ActivityResult when worker completes activity and with nil input when attempt times out
+// or heartbeat has to be checked
+func (h *ActivityHandler) Handle(ctx context.Context, req async.CallbackRequest, input interface{}) (interface{}, error) {
+	defer logTime("activity handle")()
+	ref := h.engine.activities().Doc(activityID(req))
+	doc, err := ref.Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("err getting activity: %v", err)
+	}
+	var a DBActivity
+	err = doc.DataTo(&a)
+	if err != nil {
+		return nil, fmt.Errorf("err unmarshaling activity: %v", err)
+	}
+	var failure string
+	switch in := input.(type) {
+	case nil:
+		if !time.Now().Before(a.Deadline) {
+			failure = fmt.Sprintf("attempt %v timed out", a.Attempt)
+			break
+		}
+		if a.Status != ActivityRunning || a.HeartbeatTimeout <= 0 {
+			return nil, ErrPollPending // timeout of previous attempt
+		}
+		missed := a.LastHeartbeat.Add(a.HeartbeatTimeout)
+		if !time.Now().Before(missed) {
+			failure = fmt.Sprintf("attempt %v missed heartbeat", a.Attempt)
+			break
+		}
+		// heartbeat was received, check again later
+		a.HeartbeatTask, err = h.scheduler.Setup(ctx, req, time.Until(missed))
+		if err != nil {
+			return nil, fmt.Errorf("err scheduling heartbeat check: %v", err)
+		}
+		_, err = ref.Set(ctx, a)
+		if err != nil {
+			return nil, fmt.Errorf("err updating activity: %v", err)
+		}
+		return nil, ErrPollPending
+	case []byte:
+		var res ActivityResult
+		err = json.Unmarshal(in, &res)
+		if err != nil {
+			return nil, fmt.Errorf("err unmarshaling activity result: %v", err)
+		}
+		if a.Token == "" || subtle.ConstantTimeCompare([]byte(a.Token), []byte(res.Token)) != 1 {
+			return nil, ErrActivityToken
+		}
+		if res.Error == "" {
+			if h.Output != nil && len(res.Output) > 0 {
+				err = json.Unmarshal(res.Output, h.Output)
+				if err != nil {
+					return nil, fmt.Errorf("err unmarshaling activity output: %v", err)
+				}
+			}
+			a.Status = ActivityCompleted
+			a.Output = pjson(res.Output)
+			a.Token = ""
+			h.teardownTasks(ctx, &a)
+			_, err = ref.Set(ctx, a)
+			if err != nil {
+				return nil, fmt.Errorf("err completing activity: %v", err)
+			}
+			return nil, nil
+		}
+		failure = res.Error
+	default:
+		return nil, fmt.Errorf("unexpected activity input type %T", input)
+	}
+
+	a.Error = failure
+	a.Token = ""
+	if a.Attempt < h.Retry.Attempts() {
+		delay := h.Retry.Delay(a.Attempt)
+		h.teardownTasks(ctx, &a)
+		a.Attempt++
+		a.Status = ActivityPending
+		a.Worker = ""
+		a.NotBefore = time.Now().Add(delay)
+		a.Deadline = a.NotBefore.Add(h.timeout())
+		a.TimeoutTask, err = h.scheduler.Setup(ctx, req, delay+h.timeout())
+		if err != nil {
+			return nil, fmt.Errorf("err scheduling activity timeout: %v", err)
+		}
+		_, err = ref.Set(ctx, a)
+		if err != nil {
+			return nil, fmt.Errorf("err retrying activity: %v", err)
+		}
+		log.Printf("activity %v failed, retrying in %v: %v", a.ID, delay, failure)
+		return nil, ErrPollPending
+	}
+	a.Status = ActivityFailed
+	h.teardownTasks(ctx, &a)
+	_, err = ref.Set(ctx, a)
+	if err != nil {
+		return nil, fmt.Errorf("err failing activity: %v", err)
+	}
+	if h.Error == nil {
+		return nil, fmt.Errorf("activity %v failed: %v", a.ID, failure)
+	}
+	*h.Error = failure
+	return nil, nil
+}
+
+// teardownTasks deletes scheduled timeout and heartbeat checks of the activity
+func (h *ActivityHandler) teardownTasks(ctx context.Context, a *DBActivity) {
+	for _, t := range []string{a.TimeoutTask, a.HeartbeatTask} {
+		if t != "" {
+			_ = h.scheduler.Teardown(ctx, async.CallbackRequest{SetupData: t}, false)
+		}
+	}
+	a.TimeoutTask = ""
+	a.HeartbeatTask = ""
+}
+
+// Teardown cancels activity if workflow stopped waiting for it, i.e. another event was handled first
+func (h *ActivityHandler) Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error {
+	defer logTime("activity teardown")()
+	ref := h.engine.activities().Doc(activityID(req))
+	doc, err := ref.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("err getting activity: %v", err)
+	}
+	var a DBActivity
+	err = doc.DataTo(&a)
+	if err != nil {
+		return fmt.Errorf("err unmarshaling activity: %v", err)
+	}
+	h.teardownTasks(ctx, &a)
+	if a.Status != ActivityPending && a.Status != ActivityRunning {
+		return nil
+	}
+	_, err = ref.Update(ctx, []firestore.Update{
+		{
+			Path:  "Status",
+			Value: ActivityCancelled,
+		},
+		{
+			Path:  "Token",
+			Value: "",
+		},
+	})
+	return err
+}
+
+// PollActivity claims pending activity of the given type for the worker
+func (fs FirestoreEngine) PollActivity(ctx context.Context, typ, worker string) (*ActivityTask, error) {
+	defer logTime("poll activity")()
+	docs, err := fs.activities().
+		Where("Type", "==", typ).
+		Where("Status", "==", ActivityPending).
+		Limit(20).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		var task *ActivityTask
+		var claimed DBActivity
+		err = fs.DB.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			task = nil
+			d, err := tx.Get(doc.Ref)
+			if err != nil {
+				return err
+			}
+			var a DBActivity
+			err = d.DataTo(&a)
+			if err != nil {
+				return err
+			}
+			if a.Status != ActivityPending || time.Now().Before(a.NotBefore) {
+				return nil
+			}
+			a.Status = ActivityRunning
+			a.Worker = worker
+			a.Token = newID()
+			a.LastHeartbeat = time.Now()
+			claimed = a
+			task = &ActivityTask{
+				ID:       a.ID,
+				Type:     a.Type,
+				Input:    a.Input,
+				Attempt:  a.Attempt,
+				Token:    a.Token,
+				Deadline: a.Deadline,
+
+				HeartbeatTimeout: a.HeartbeatTimeout,
+			}
+			return tx.Set(doc.Ref, a)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("err claiming activity: %v", err)
+		}
+		if task == nil {
+			continue
+		}
+		// heartbeat check is scheduled after claim is committed, so retried transactions don't create duplicate tasks
+		if claimed.HeartbeatTimeout > 0 && fs.Callbacks != nil && claimed.HeartbeatTask == "" {
+			err = fs.scheduleHeartbeat(ctx, doc.Ref, claimed)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return task, nil
+	}
+	return nil, ErrNoActivity
+}
+
+// scheduleHeartbeat schedules heartbeat check of the claimed activity and saves it, if the claim is still valid.
+// Claim is released if check can't be scheduled, so the activity is polled again instead of being stuck.
+func (fs FirestoreEngine) scheduleHeartbeat(ctx context.Context, ref *firestore.DocumentRef, claimed DBActivity) error {
+	t, setupErr := fs.Callbacks.Setup(ctx, claimed.Callback, claimed.HeartbeatTimeout)
+	err := fs.DB.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		d, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var a DBActivity
+		err = d.DataTo(&a)
+		if err != nil {
+			return err
+		}
+		if a.Status != ActivityRunning || a.Token != claimed.Token {
+			return nil // activity was cancelled or completed meanwhile, scheduled check will be ignored
+		}
+		if setupErr != nil {
+			return tx.Update(ref, []firestore.Update{
+				{Path: "Status", Value: ActivityPending},
+				{Path: "Worker", Value: ""},
+				{Path: "Token", Value: ""},
+			})
+		}
+		return tx.Update(ref, []firestore.Update{{Path: "HeartbeatTask", Value: t}})
+	})
+	if setupErr != nil {
+		return fmt.Errorf("err scheduling heartbeat check: %v", setupErr)
+	}
+	if err != nil {
+		return fmt.Errorf("err saving heartbeat check: %v", err)
+	}
+	return nil
+}
+
+// CompleteActivity reports result of the activity attempt to the workflow
+func (fs FirestoreEngine) CompleteActivity(ctx context.Context, id string, res ActivityResult) error {
+	defer logTime("complete activity")()
+	doc, err := fs.activities().Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	var a DBActivity
+	err = doc.DataTo(&a)
+	if err != nil {
+		return fmt.Errorf("err unmarshaling activity: %v", err)
+	}
+	if a.Status != ActivityRunning {
+		return ErrActivityToken
+	}
+	d, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	_, err = fs.HandleCallback(ctx, a.Callback.WorkflowID, a.Callback, d)
+	if errors.Is(err, ErrPollPending) {
+		return nil // activity is retried
+	}
+	return err
+}
+
+// ActivityHeartbeat is reported by workers periodically while activity is running
+type ActivityHeartbeat struct {
+	Token   string
+	Details json.RawMessage // optional progress details
+}
+
+// HeartbeatActivity records heartbeat of the running activity.
+// ErrActivityToken is returned if attempt is not running anymore, so worker should stop executing it.
+func (fs FirestoreEngine) HeartbeatActivity(ctx context.Context, id string, hb ActivityHeartbeat) error {
+	ref := fs.activities().Doc(id)
+	return fs.DB.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var a DBActivity
+		err = doc.DataTo(&a)
+		if err != nil {
+			return fmt.Errorf("err unmarshaling activity: %v", err)
+		}
+		if a.Status != ActivityRunning || a.Token == "" || subtle.ConstantTimeCompare([]byte(a.Token), []byte(hb.Token)) != 1 {
+			return ErrActivityToken
+		}
+		updates := []firestore.Update{
+			{
+				Path:  "LastHeartbeat",
+				Value: time.Now(),
+			},
+		}
+		if len(hb.Details) > 0 {
+			updates = append(updates, firestore.Update{
+				Path:  "Details",
+				Value: pjson(hb.Details),
+			})
+		}
+		return tx.Update(ref, updates)
+	})
+}
@@ -0,0 +1,69 @@
+package gasync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gorchestrate/async"
+)
+
+// StatusStuck selects runnable workflows that were not updated for a while, i.e. lost their resume tasks.
+const StatusStuck = "stuck"
+
+// ResumeAllQuery selects workflows for ResumeAll
+type ResumeAllQuery struct {
+	Workflow   string        // workflow name, all workflows if empty
+	Status     string        // workflow status or StatusStuck. All active workflows if empty
+	StaleAfter time.Duration // used with StatusStuck
+	RatePerSec float64       // resumes are spread in time, so that they don't overload the service
+}
+
+// ResumeAll schedules resume of all matching workflows and returns number of scheduled workflows.
+func (fs FirestoreEngine) ResumeAll(ctx context.Context, q ResumeAllQuery) (int, error) {
+	defer logTime("resume all")()
+	if q.RatePerSec <= 0 {
+		return 0, ValidationError{Path: "rate", Msg: "rate should be positive"}
+	}
+	query := fs.DB.Collection(fs.Collection).Select("Meta.Status", "Meta.Threads")
+	if q.Workflow != "" {
+		query = query.Where("Meta.Workflow", "==", q.Workflow)
+	}
+	switch q.Status {
+	case "", StatusStuck:
+		query = query.Where("Meta.Status", "in", []string{string(async.WorkflowResuming), string(async.WorkflowWaiting)})
+	case string(async.WorkflowResuming), string(async.WorkflowWaiting), string(async.WorkflowFinished):
+		query = query.Where("Meta.Status", "==", q.Status)
+	default:
+		return 0, ValidationError{Path: "status", Msg: fmt.Sprintf("unknown status %q", q.Status)}
+	}
+	docs, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+	delays := map[string]time.Duration{}
+	ids := []string{}
+	for _, doc := range docs {
+		if q.Status == StatusStuck {
+			var wf DBWorkflow
+			err = doc.DataTo(&wf)
+			if err != nil {
+				return 0, fmt.Errorf("err unmarshaling workflow %v: %v", doc.Ref.ID, err)
+			}
+			if !runnable(wf.Meta) || time.Since(doc.UpdateTime) < q.StaleAfter {
+				continue
+			}
+		}
+		delays[doc.Ref.ID] = time.Duration(float64(len(ids)) / q.RatePerSec * float64(time.Second))
+		ids = append(ids, doc.Ref.ID)
+	}
+	err = scheduleBatch(ctx, ids, 0, func(ctx context.Context, id string) error {
+		return fs.Scheduler.Schedule(ctx, id, delays[id])
+	})
+	var bErr BatchError
+	if errors.As(err, &bErr) {
+		return len(ids) - len(bErr.Failed), err
+	}
+	return len(ids), err
+}
@@ -0,0 +1,68 @@
+package gasync
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// EventAlias routes deprecated event name to the current one, so that events can be renamed without breaking callers
+type EventAlias struct {
+	Event   string    // current event name
+	Sunset  time.Time // optional date when alias is removed, reported in Sunset header
+	Message string    // optional deprecation notice for swagger
+}
+
+// EventAliases are keyed by deprecated event name or "workflow/event"
+type EventAliases map[string]EventAlias
+
+func (a EventAliases) get(wfName, event string) (EventAlias, bool) {
+	if alias, ok := a[wfName+"/"+event]; ok {
+		return alias, true
+	}
+	alias, ok := a[event]
+	return alias, ok
+}
+
+// forEvent returns deprecated names of the event
+func (a EventAliases) forEvent(wfName, event string) map[string]EventAlias {
+	ret := map[string]EventAlias{}
+	for k, v := range a {
+		if v.Event != event {
+			continue
+		}
+		name := strings.TrimPrefix(k, wfName+"/")
+		if name == k && strings.Contains(k, "/") {
+			continue // alias of another workflow
+		}
+		if _, scoped := a[wfName+"/"+k]; name == k && scoped {
+			continue // workflow-specific alias takes precedence
+		}
+		ret[name] = v
+	}
+	return ret
+}
+
+// resolve rewrites deprecated event name and sets Deprecation and Sunset headers
+func (a EventAliases) resolve(w http.ResponseWriter, wfName, event string) string {
+	alias, ok := a.get(wfName, event)
+	if !ok {
+		return event
+	}
+	w.Header().Set("Deprecation", "true")
+	if !alias.Sunset.IsZero() {
+		w.Header().Set("Sunset", alias.Sunset.UTC().Format(http.TimeFormat))
+	}
+	return alias.Event
+}
+
+func (m *Metrics) deprecatedEvent(ctx context.Context, workflow, event string) {
+	if m == nil {
+		return
+	}
+	m.deprecated.Add(ctx, 1, metric.WithAttributes(attribute.String("workflow", workflow), attribute.String("event", event)))
+}
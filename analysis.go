@@ -0,0 +1,157 @@
+package gasync
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gorchestrate/async"
+)
+
+// Finding is a problem found by static analysis of workflow definition
+type Finding struct {
+	Kind    string // unreachable, wait_without_events, duplicate_event, event_never_awaited or loop_without_break
+	Stmt    string // name of the statement
+	Message string
+}
+
+// Analyze walks workflow definition and reports dead paths: statements unreachable due to preceding return/break/continue,
+// waits that can never be resumed and loops that can't be exited.
+// Conditions are evaluated for the state definition was built for, so loops are checked only if their condition is true.
+func Analyze(def async.Section) []Finding {
+	a := analyzer{findings: []Finding{}}
+	a.walk(def)
+	return a.findings
+}
+
+// AnalyzeEvents reports events that are referenced outside of definition (i.e. in EventRoles), but never awaited by workflow
+func AnalyzeEvents(def async.Section, events []string) []Finding {
+	awaited := map[string]bool{}
+	_, _ = async.Walk(def, func(s async.Stmt) bool {
+		if x, ok := s.(async.WaitEventsStmt); ok {
+			for _, c := range x.Cases {
+				awaited[c.Callback.Name] = true
+			}
+		}
+		return false
+	})
+	ret := []Finding{}
+	for _, e := range events {
+		if !awaited[e] {
+			ret = append(ret, Finding{Kind: "event_never_awaited", Stmt: e, Message: fmt.Sprintf("event %v is never awaited", e)})
+		}
+	}
+	return ret
+}
+
+type analyzer struct {
+	findings []Finding
+}
+
+func (a *analyzer) add(kind string, s async.Stmt, msg string, args ...interface{}) {
+	a.findings = append(a.findings, Finding{Kind: kind, Stmt: stmtName(s), Message: fmt.Sprintf(msg, args...)})
+}
+
+// walk returns true if execution never continues after the statement
+func (a *analyzer) walk(s async.Stmt) bool {
+	switch x := s.(type) {
+	case async.ReturnStmt, async.BreakStmt, async.ContinueStmt:
+		return true
+	case async.WaitEventsStmt:
+		if len(x.Cases) == 0 {
+			a.add("wait_without_events", x, "%v waits without events and will never resume", x.Name)
+		}
+		seen := map[string]bool{}
+		for _, c := range x.Cases {
+			if seen[c.Callback.Name] {
+				a.add("duplicate_event", x, "event %v is awaited twice in %v, only first case is handled", c.Callback.Name, x.Name)
+			}
+			seen[c.Callback.Name] = true
+			a.walk(c.Stmt)
+		}
+	case *async.GoStmt:
+		a.walk(x.Stmt)
+	case async.ForStmt:
+		a.walk(x.Section)
+		if x.Cond && !exits(x.Section) {
+			a.add("loop_without_break", x, "loop %v has no break or return and never exits", x.Name)
+			return true
+		}
+	case *async.SwitchStmt:
+		for _, c := range x.Cases {
+			a.walk(c.Stmt)
+		}
+	case async.Section:
+		for i, v := range x {
+			if a.walk(v) {
+				if i+1 < len(x) {
+					a.add("unreachable", x[i+1], "%v is unreachable after %v", stmtName(x[i+1]), stmtName(v))
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exits checks if loop body has break for this loop or return
+func exits(s async.Stmt) bool {
+	switch x := s.(type) {
+	case async.ReturnStmt, async.BreakStmt:
+		return true
+	case async.WaitEventsStmt:
+		for _, c := range x.Cases {
+			if exits(c.Stmt) {
+				return true
+			}
+		}
+	case *async.SwitchStmt:
+		for _, c := range x.Cases {
+			if exits(c.Stmt) {
+				return true
+			}
+		}
+	case async.ForStmt:
+		return returns(x.Section) // breaks of nested loop don't exit this one
+	case async.Section:
+		for _, v := range x {
+			if exits(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func returns(s async.Stmt) bool {
+	found, _ := async.Walk(s, func(s async.Stmt) bool {
+		_, ok := s.(async.ReturnStmt)
+		return ok
+	})
+	return found
+}
+
+// stmtName returns name of the statement or its type for unnamed statements
+func stmtName(s async.Stmt) string {
+	switch x := s.(type) {
+	case async.StmtStep:
+		return x.Name
+	case async.WaitCondStmt:
+		return x.Name
+	case async.WaitEventsStmt:
+		return x.Name
+	case *async.GoStmt:
+		return x.Name
+	case async.ForStmt:
+		return x.Name
+	case async.ReturnStmt:
+		return "return"
+	case async.BreakStmt:
+		return "break"
+	case async.ContinueStmt:
+		return "continue"
+	case nil:
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(reflect.Indirect(reflect.ValueOf(s)).Type().Name(), "Stmt"))
+}
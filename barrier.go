@@ -0,0 +1,160 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DBBarrier is a join point for multiple workflows. Stored in Collection+"_barriers".
+type DBBarrier struct {
+	ID           string
+	Count        int                     // number of participants needed to complete barrier
+	Participants []async.CallbackRequest // workflows waiting on the barrier
+	Done         bool
+	Created      time.Time
+	Completed    time.Time
+}
+
+// BarrierHandler waits until Count workflows arrive at the barrier with the same ID.
+// When barrier completes - event is delivered to all participants.
+type BarrierHandler struct {
+	ID    string
+	Count int
+
+	engine *FirestoreEngine
+}
+
+// Barrier waits until count workflows arrive at barrier id.
+func (s *Server) Barrier(name, id string, count int, stmts ...async.Stmt) async.Event {
+	return async.On(name, &BarrierHandler{
+		ID:     id,
+		Count:  count,
+		engine: s.Engine,
+	}, stmts...)
+}
+
+func (h BarrierHandler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type  string
+		ID    string
+		Count int
+	}{
+		Type:  "barrier",
+		ID:    h.ID,
+		Count: h.Count,
+	})
+}
+
+func (fs FirestoreEngine) barriers() *firestore.CollectionRef {
+	return fs.DB.Collection(fs.Collection + "_barriers")
+}
+
+// GetBarrier returns current state of the barrier
+func (fs FirestoreEngine) GetBarrier(ctx context.Context, id string) (*DBBarrier, error) {
+	doc, err := fs.barriers().Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var b DBBarrier
+	err = doc.DataTo(&b)
+	return &b, err
+}
+
+func sameParticipant(a, b async.CallbackRequest) bool {
+	return a.WorkflowID == b.WorkflowID && a.ThreadID == b.ThreadID && a.Name == b.Name && a.PC == b.PC
+}
+
+// Setup registers workflow at the barrier. Last participant completes the barrier.
+func (h *BarrierHandler) Setup(ctx context.Context, req async.CallbackRequest) (string, error) {
+	defer logTime("barrier arrive")()
+	var notify []async.CallbackRequest
+	ref := h.engine.barriers().Doc(h.ID)
+	err := h.engine.DB.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		notify = nil
+		b := DBBarrier{
+			ID:      h.ID,
+			Count:   h.Count,
+			Created: time.Now(),
+		}
+		doc, err := tx.Get(ref)
+		if err == nil {
+			err = doc.DataTo(&b)
+		}
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if b.Done {
+			// late arrival, barrier is already completed
+			notify = []async.CallbackRequest{req}
+			return nil
+		}
+		for _, p := range b.Participants {
+			if sameParticipant(p, req) {
+				return nil
+			}
+		}
+		b.Participants = append(b.Participants, req)
+		if len(b.Participants) >= b.Count {
+			b.Done = true
+			b.Completed = time.Now()
+			notify = b.Participants
+		}
+		return tx.Set(ref, b)
+	})
+	if err != nil {
+		return "", fmt.Errorf("err arriving at barrier %v: %v", h.ID, err)
+	}
+	for _, p := range notify {
+		_, err := h.engine.Callbacks.Setup(ctx, p, 0)
+		if err != nil {
+			return "", fmt.Errorf("err notifying barrier participant %v: %v", p.WorkflowID, err)
+		}
+	}
+	return "", nil
+}
+
+func (h *BarrierHandler) Handle(ctx context.Context, req async.CallbackRequest, input interface{}) (interface{}, error) {
+	return h.engine.GetBarrier(ctx, h.ID)
+}
+
+// Teardown removes workflow from barrier if it stopped waiting before barrier was completed
+func (h *BarrierHandler) Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error {
+	if handled {
+		return nil
+	}
+	ref := h.engine.barriers().Doc(h.ID)
+	return h.engine.DB.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var b DBBarrier
+		err = doc.DataTo(&b)
+		if err != nil {
+			return err
+		}
+		if b.Done {
+			return nil
+		}
+		for i, p := range b.Participants {
+			if sameParticipant(p, req) {
+				b.Participants = append(b.Participants[:i], b.Participants[i+1:]...)
+				return tx.Set(ref, b)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,148 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// BigQueryHistory streams history entries into BigQuery table with the following schema:
+//
+//	id STRING, workflow_id STRING, workflow STRING, status STRING, pc INTEGER, time TIMESTAMP,
+//	exec_duration_ms FLOAT, callback STRING, input JSON, output JSON, state JSON, meta JSON
+//
+// Entries are appended to the default stream of the table via Storage Write API, which is at-least-once:
+// appends retried after a lost response are written twice. Entry id is the same unique id as of history entry
+// in Firestore, so consumers requiring exact counts should group by it.
+type BigQueryHistory struct {
+	C         *managedwriter.Client
+	ProjectID string
+	DatasetID string
+	TableID   string
+
+	stream *managedwriter.ManagedStream
+	row    protoreflect.MessageDescriptor
+}
+
+// bigQueryHistorySchema is the schema rows are encoded with, JSON columns are written as strings
+var bigQueryHistorySchema = &storagepb.TableSchema{
+	Fields: []*storagepb.TableFieldSchema{
+		{Name: "id", Type: storagepb.TableFieldSchema_STRING, Mode: storagepb.TableFieldSchema_NULLABLE},
+		{Name: "workflow_id", Type: storagepb.TableFieldSchema_STRING, Mode: storagepb.TableFieldSchema_NULLABLE},
+		{Name: "workflow", Type: storagepb.TableFieldSchema_STRING, Mode: storagepb.TableFieldSchema_NULLABLE},
+		{Name: "status", Type: storagepb.TableFieldSchema_STRING, Mode: storagepb.TableFieldSchema_NULLABLE},
+		{Name: "pc", Type: storagepb.TableFieldSchema_INT64, Mode: storagepb.TableFieldSchema_NULLABLE},
+		{Name: "time", Type: storagepb.TableFieldSchema_TIMESTAMP, Mode: storagepb.TableFieldSchema_NULLABLE},
+		{Name: "exec_duration_ms", Type: storagepb.TableFieldSchema_DOUBLE, Mode: storagepb.TableFieldSchema_NULLABLE},
+		{Name: "callback", Type: storagepb.TableFieldSchema_STRING, Mode: storagepb.TableFieldSchema_NULLABLE},
+		{Name: "input", Type: storagepb.TableFieldSchema_STRING, Mode: storagepb.TableFieldSchema_NULLABLE},
+		{Name: "output", Type: storagepb.TableFieldSchema_STRING, Mode: storagepb.TableFieldSchema_NULLABLE},
+		{Name: "state", Type: storagepb.TableFieldSchema_STRING, Mode: storagepb.TableFieldSchema_NULLABLE},
+		{Name: "meta", Type: storagepb.TableFieldSchema_STRING, Mode: storagepb.TableFieldSchema_NULLABLE},
+	},
+}
+
+// NewBigQueryHistory opens write stream to the table, it should be closed with Close on shutdown
+func NewBigQueryHistory(ctx context.Context, projectID, datasetID, tableID string, opts ...option.ClientOption) (*BigQueryHistory, error) {
+	d, err := adapt.StorageSchemaToProto2Descriptor(bigQueryHistorySchema, "root")
+	if err != nil {
+		return nil, fmt.Errorf("err converting history schema: %v", err)
+	}
+	row, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("history schema is not a message")
+	}
+	dp, err := adapt.NormalizeDescriptor(row)
+	if err != nil {
+		return nil, fmt.Errorf("err normalizing history schema: %v", err)
+	}
+	c, err := managedwriter.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := c.NewManagedStream(ctx,
+		managedwriter.WithDestinationTable(managedwriter.TableParentFromParts(projectID, datasetID, tableID)),
+		managedwriter.WithType(managedwriter.DefaultStream),
+		managedwriter.WithSchemaDescriptor(dp),
+		managedwriter.EnableWriteRetries(true),
+	)
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("err opening bigquery write stream: %v", err)
+	}
+	return &BigQueryHistory{
+		C:         c,
+		ProjectID: projectID,
+		DatasetID: datasetID,
+		TableID:   tableID,
+		stream:    stream,
+		row:       row,
+	}, nil
+}
+
+// Close flushes pending appends and closes write stream
+func (h *BigQueryHistory) Close() error {
+	err := h.stream.Close()
+	if cErr := h.C.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+func jsonString(in interface{}) (string, error) {
+	d, err := json.Marshal(in)
+	return string(d), err
+}
+
+func (h *BigQueryHistory) Write(ctx context.Context, l DBWorkflowLog) error {
+	row := dynamicpb.NewMessage(h.row)
+	set := func(name string, v interface{}) {
+		row.Set(h.row.Fields().ByName(protoreflect.Name(name)), protoreflect.ValueOf(v))
+	}
+	set("id", l.entryID())
+	set("workflow_id", l.Meta.ID)
+	set("workflow", l.Meta.Workflow)
+	set("status", string(l.Meta.Status))
+	set("pc", int64(l.Meta.PC))
+	set("time", l.Time.UnixNano()/1000)
+	set("exec_duration_ms", float64(l.ExecDuration.Microseconds())/1000)
+	if l.Callback != nil {
+		set("callback", l.Callback.Name)
+	}
+	for k, v := range map[string]interface{}{
+		"input":  l.Input,
+		"output": l.Output,
+		"state":  l.State,
+		"meta":   l.Meta,
+	} {
+		s, err := jsonString(v)
+		if err != nil {
+			return fmt.Errorf("err marshaling %v: %v", k, err)
+		}
+		set(k, s)
+	}
+	d, err := proto.Marshal(row)
+	if err != nil {
+		return fmt.Errorf("err encoding history row: %v", err)
+	}
+	res, err := h.stream.AppendRows(ctx, [][]byte{d})
+	if err != nil {
+		return fmt.Errorf("bigquery append: %v", err)
+	}
+	resp, err := res.FullResponse(ctx)
+	if err != nil {
+		return fmt.Errorf("bigquery append: %v", err)
+	}
+	if rErr := resp.GetRowErrors(); len(rErr) > 0 {
+		return fmt.Errorf("bigquery append: %v", rErr[0].GetMessage())
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package gasync
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Cache stores rendered responses. It can be backed by in-memory LRU, Redis or any other KV store.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, val []byte)
+	Delete(key string)
+}
+
+// LRUCache is an in-memory Cache with limited size and TTL.
+type LRUCache struct {
+	Size int
+	TTL  time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	val     []byte
+	expires time.Time
+}
+
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		Size:  size,
+		TTL:   ttl,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (c *LRUCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if c.TTL > 0 && time.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e.val, true
+}
+
+func (c *LRUCache) Set(key string, val []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{
+		key:     key,
+		val:     val,
+		expires: time.Now().Add(c.TTL),
+	})
+	for c.Size > 0 && c.ll.Len() > c.Size {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*lruEntry).key)
+	}
+}
+
+func (c *LRUCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.ll.Remove(el)
+		delete(c.items, key)
+	}
+}
+
+func workflowCacheKey(id string) string {
+	return "wf/" + id
+}
+
+// invalidate removes cached workflow after it was modified
+func (fs FirestoreEngine) invalidate(id string) {
+	if fs.Cache != nil {
+		fs.Cache.Delete(workflowCacheKey(id))
+	}
+}
+
+// serveCached writes response produced by render, using cache if it's available.
+// ETag is set from response body hash, so clients can use If-None-Match to skip the body.
+func serveCached(w http.ResponseWriter, r *http.Request, cache Cache, key string, contentType string, render func() ([]byte, error)) {
+	var body []byte
+	ok := false
+	if cache != nil {
+		body, ok = cache.Get(key)
+	}
+	if !ok {
+		var err error
+		body, err = render()
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		if cache != nil {
+			cache.Set(key, body)
+		}
+	}
+	writeETagged(w, r, contentType, body)
+}
+
+// writeETagged writes body with ETag derived from its hash, or 304 if client already has it
+func writeETagged(w http.ResponseWriter, r *http.Request, contentType string, body []byte) {
+	h := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(h[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,97 @@
+package gasync
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// CallbackAuth restricts access to resume and timeout callback endpoints of all path versions in addition to HMAC signatures
+type CallbackAuth struct {
+	// ClientCAFile requires client certificates signed by CA from this PEM file.
+	// TLS has to be terminated by Server.ListenAndServe, i.e. HTTP.TLSCertFile and HTTP.TLSKeyFile are set.
+	ClientCAFile string
+	// AllowedCIDRs restricts source IPs, i.e. "10.0.0.0/8"
+	AllowedCIDRs []string
+	// TrustForwardedFor uses the last address of X-Forwarded-For header as source IP, when running behind load balancer
+	TrustForwardedFor bool
+}
+
+type callbackGuard struct {
+	auth    CallbackAuth
+	clients *x509.CertPool
+	nets    []*net.IPNet
+}
+
+func newCallbackGuard(auth CallbackAuth) (*callbackGuard, error) {
+	g := &callbackGuard{
+		auth: auth,
+	}
+	if auth.ClientCAFile != "" {
+		d, err := ioutil.ReadFile(auth.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("err reading client CA: %v", err)
+		}
+		g.clients = x509.NewCertPool()
+		if !g.clients.AppendCertsFromPEM(d) {
+			return nil, fmt.Errorf("no certificates found in %v", auth.ClientCAFile)
+		}
+	}
+	for _, c := range auth.AllowedCIDRs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %v: %v", c, err)
+		}
+		g.nets = append(g.nets, n)
+	}
+	return g, nil
+}
+
+// sourceIP returns address request came from
+func (g *callbackGuard) sourceIP(r *http.Request) net.IP {
+	if g.auth.TrustForwardedFor {
+		if f := r.Header.Get("X-Forwarded-For"); f != "" {
+			parts := strings.Split(f, ",")
+			// last address is added by our load balancer, others can be spoofed by the client
+			return net.ParseIP(strings.TrimSpace(parts[len(parts)-1]))
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func (g *callbackGuard) check(r *http.Request) error {
+	if g.clients != nil && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return fmt.Errorf("client certificate is required")
+	}
+	if len(g.nets) == 0 {
+		return nil
+	}
+	ip := g.sourceIP(r)
+	for _, n := range g.nets {
+		if ip != nil && n.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("source ip %v is not allowed", ip)
+}
+
+func (g *callbackGuard) wrap(h http.HandlerFunc) http.HandlerFunc {
+	if g.clients == nil && len(g.nets) == 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := g.check(r)
+		if err != nil {
+			jsonErr(w, err, http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
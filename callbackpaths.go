@@ -0,0 +1,34 @@
+package gasync
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// CallbackPathVersion is a version of callback paths embedded in Cloud Tasks created by this release.
+// Paths of previous versions stay routed, so that tasks created before deploy are still delivered.
+const CallbackPathVersion = "v1"
+
+// callbackVersions are all path versions that are served. Empty version is the original unversioned layout.
+var callbackVersions = []string{"", "v1"}
+
+// callbackPaths returns resume and timeout callback paths of the version
+func callbackPaths(version string) (resume, timeout string) {
+	if version == "" {
+		return "/resume", "/callback/timeout"
+	}
+	return "/callbacks/" + version + "/resume", "/callbacks/" + version + "/timeout"
+}
+
+// routeCallbacks registers resume and timeout handlers under paths of all versions and under legacy prefixes.
+// Signatures of tasks don't depend on URL, so tasks are accepted regardless of the path they were created with.
+func routeCallbacks(mr *mux.Router, legacyPrefixes []string, resume, timeout http.HandlerFunc) {
+	for _, prefix := range append([]string{""}, legacyPrefixes...) {
+		for _, v := range callbackVersions {
+			r, t := callbackPaths(v)
+			mr.HandleFunc(prefix+r, resume)
+			mr.HandleFunc(prefix+t, timeout)
+		}
+	}
+}
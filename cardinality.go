@@ -0,0 +1,158 @@
+package gasync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Cardinality limits number of running instances of the workflow sharing the same key,
+// i.e. at most one active payroll workflow per employee ID.
+type Cardinality struct {
+	// Key returns uniqueness key from initial state. Workflows with empty key are not limited.
+	Key func(state interface{}) (string, error)
+	Max int // 1 by default
+}
+
+// DBUniqueKey tracks instances holding the key. Stored in Collection+"_unique".
+// Finished and deleted instances are released lazily, when the next instance with the same key is created.
+type DBUniqueKey struct {
+	Workflow string
+	Key      string
+	Active   map[string]time.Time // instance id -> time key was acquired
+}
+
+// CardinalityError is returned when workflow can't be created because of running instances with the same key
+type CardinalityError struct {
+	Workflow string
+	Key      string
+	Active   []string // conflicting instances
+}
+
+func (e CardinalityError) Error() string {
+	return fmt.Sprintf("workflow %v with key %q is already running: %v", e.Workflow, e.Key, e.Active)
+}
+
+func (e CardinalityError) StatusCode() int {
+	return 409
+}
+
+func (e CardinalityError) Body() interface{} {
+	return struct {
+		Msg    string
+		Type   string
+		Active []string
+	}{
+		Msg:    e.Error(),
+		Type:   "cardinality",
+		Active: e.Active,
+	}
+}
+
+// reservationTimeout is how long key is held for instance that is not saved yet
+const reservationTimeout = time.Minute
+
+func (fs FirestoreEngine) uniqueKeys() *firestore.CollectionRef {
+	return fs.DB.Collection(fs.Collection + "_unique")
+}
+
+// acquireKey transactionally reserves uniqueness key for the new workflow.
+// It returns a function releasing the key, which should be called if workflow was not created.
+func (fs FirestoreEngine) acquireKey(ctx context.Context, wf *DBWorkflow, state interface{}) (func(), error) {
+	c, ok := fs.Cardinality[wf.Meta.Workflow]
+	if !ok {
+		return func() {}, nil
+	}
+	key, err := c.Key(state)
+	if err != nil {
+		return nil, ValidationError{Path: "key", Msg: err.Error()}
+	}
+	if key == "" {
+		return func() {}, nil
+	}
+	max := c.Max
+	if max <= 0 {
+		max = 1
+	}
+	defer logTime("acquire key")()
+	// keys are hashed, since they may contain characters not allowed in document ids
+	h := sha256.Sum256([]byte(wf.Meta.Workflow + "\x00" + key))
+	ref := fs.uniqueKeys().Doc(hex.EncodeToString(h[:]))
+	err = fs.DB.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		u := DBUniqueKey{}
+		doc, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			err = doc.DataTo(&u)
+			if err != nil {
+				return fmt.Errorf("err unmarshaling unique key: %v", err)
+			}
+		}
+		ids := []string{}
+		refs := []*firestore.DocumentRef{}
+		for id := range u.Active {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			refs = append(refs, fs.DB.Collection(fs.Collection).Doc(id))
+		}
+		docs := []*firestore.DocumentSnapshot{}
+		if len(refs) > 0 {
+			docs, err = tx.GetAll(refs)
+			if err != nil {
+				return err
+			}
+		}
+		active := map[string]time.Time{}
+		conflicts := []string{}
+		for i, d := range docs {
+			acquired := u.Active[ids[i]]
+			if !d.Exists() {
+				// instance may be created concurrently
+				if time.Since(acquired) < reservationTimeout {
+					active[ids[i]] = acquired
+					conflicts = append(conflicts, ids[i])
+				}
+				continue
+			}
+			st, err := d.DataAt("Meta.Status")
+			if err != nil || st == string(async.WorkflowFinished) {
+				continue
+			}
+			active[ids[i]] = acquired
+			conflicts = append(conflicts, ids[i])
+		}
+		if len(active) >= max {
+			return CardinalityError{Workflow: wf.Meta.Workflow, Key: key, Active: conflicts}
+		}
+		active[wf.Meta.ID] = time.Now()
+		return tx.Set(ref, DBUniqueKey{
+			Workflow: wf.Meta.Workflow,
+			Key:      key,
+			Active:   active,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		_, err := ref.Update(ctx, []firestore.Update{
+			{FieldPath: firestore.FieldPath{"Active", wf.Meta.ID}, Value: firestore.Delete},
+		})
+		if err != nil {
+			log.Printf("err releasing key of %v: %v", wf.Meta.ID, err)
+		}
+	}, nil
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -14,10 +15,11 @@ import (
 
 	"github.com/gorchestrate/async"
 	cloudtasks "google.golang.org/api/cloudtasks/v2beta3"
+	"google.golang.org/api/googleapi"
 )
 
 type GTasksScheduler struct {
-	Engine      *FirestoreEngine
+	Engine      CallbackEngine
 	C           *cloudtasks.Service
 	Collection  string
 	ProjectID   string
@@ -26,11 +28,25 @@ type GTasksScheduler struct {
 	ResumeURL   string
 	CallbackURL string
 	Secret      string
+
+	HighPriority          int    // workflows with this priority or higher are resumed without delay
+	HighPriorityQueueName string // optional queue for high-priority resumes
+
+	BatchParallelism int // concurrent task creations in ScheduleBatch, DefaultBatchParallelism by default
+
+	Metrics  *Metrics
+	Costs    *Costs
+	Timeouts Timeouts // bound Cloud Tasks calls
+	// FallbackLocationID is used to create tasks if LocationID is unavailable, overloaded or times out, i.e. during regional outage.
+	// FallbackLocationID is used to create tasks if task creation in LocationID fails, i.e. during regional outage.
+	// Queues with the same names should exist in both locations.
+	FallbackLocationID string
 }
 
 type ResumeRequest struct {
 	ID        string
 	Signature string
+	Scheduled time.Time // used to measure delivery lag
 }
 
 func (req ResumeRequest) HMAC(secret []byte) string {
@@ -41,7 +57,11 @@ func (req ResumeRequest) HMAC(secret []byte) string {
 
 func (mgr *GTasksScheduler) ResumeHandler(w http.ResponseWriter, r *http.Request) {
 	var req ResumeRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := bodyErr(json.NewDecoder(r.Body).Decode(&req))
+	if errors.Is(err, ErrBodyTooLarge) {
+		jsonErr(w, err, http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		log.Printf("err: %v", err)
 		return
@@ -52,8 +72,23 @@ func (mgr *GTasksScheduler) ResumeHandler(w http.ResponseWriter, r *http.Request
 		fmt.Fprintf(w, "signature invalid")
 		return
 	}
+	mgr.Metrics.delivered(r.Context(), "resume", req.Scheduled)
 
-	err = mgr.Engine.Resume(r.Context(), req.ID)
+	err = mgr.Engine.Resume(asCallback(r.Context()), req.ID)
+	if errors.Is(err, ErrConcurrencyLimit) {
+		// Cloud Tasks will retry the task with backoff
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	if errors.Is(err, ErrQuarantined) {
+		// don't retry, workflow has to be released manually
+		log.Printf("skipping resume of quarantined workflow %v", req.ID)
+		return
+	}
+	if err != nil && isTimeout(err) {
+		jsonErr(w, err, http.StatusRequestTimeout)
+		return
+	}
 	if err != nil {
 		log.Printf("err: %v", err)
 		w.WriteHeader(500)
@@ -61,45 +96,131 @@ func (mgr *GTasksScheduler) ResumeHandler(w http.ResponseWriter, r *http.Request
 	}
 }
 
+type workflowCtxKey struct{}
+
+// withWorkflow stores workflow name in context, so that it can be attached to created tasks
+func withWorkflow(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, workflowCtxKey{}, name)
+}
+
+// taskHeaders tag tasks with workflow ID, type and event, so that tasks can be correlated with workflows in GCP console
+func taskHeaders(ctx context.Context, id, event string) map[string]string {
+	h := map[string]string{
+		"X-Gasync-Workflow-Id": id,
+	}
+	if name, ok := ctx.Value(workflowCtxKey{}).(string); ok && name != "" {
+		h["X-Gasync-Workflow"] = name
+	}
+	if event != "" {
+		h["X-Gasync-Event"] = event
+	}
+	return h
+}
+
+// ScheduleBatch creates resume tasks concurrently, BatchParallelism at a time
+func (mgr *GTasksScheduler) ScheduleBatch(ctx context.Context, ids []string) error {
+	defer logTime("schedule batch")()
+	return scheduleBatch(ctx, ids, mgr.BatchParallelism, func(ctx context.Context, id string) error {
+		return mgr.Schedule(ctx, id, 0)
+	})
+}
+
 // in this demo we resume workflows right inside the http handler.
 // we use this scheduler only for redundancy in case resume will fail for some reason in http handler.
 func (mgr *GTasksScheduler) Schedule(ctx context.Context, id string, delay time.Duration) error {
+	return mgr.ScheduleWithPriority(ctx, id, delay, 0)
+}
+
+// ScheduleWithPriority schedules resume of high-priority workflows immediately, using separate queue if it's configured.
+func (mgr *GTasksScheduler) ScheduleWithPriority(ctx context.Context, id string, delay time.Duration, priority int) error {
 	defer logTime("schedule")()
+	queue := mgr.QueueName
+	if mgr.HighPriority > 0 && priority >= mgr.HighPriority {
+		delay = 0
+		if mgr.HighPriorityQueueName != "" {
+			queue = mgr.HighPriorityQueueName
+		}
+	}
 	req := ResumeRequest{
-		ID: id,
+		ID:        id,
+		Scheduled: time.Now().Add(delay),
 	}
 	req.Signature = req.HMAC([]byte(mgr.Secret))
 	body, err := json.Marshal(req)
 	if err != nil {
 		panic(err)
 	}
-	sTime := time.Now().Add(delay).Format(time.RFC3339)
-	_, err = mgr.C.Projects.Locations.Queues.Tasks.Create(
-		fmt.Sprintf("projects/%v/locations/%v/queues/%v",
-			mgr.ProjectID, mgr.LocationID, mgr.QueueName),
-		&cloudtasks.CreateTaskRequest{
-			Task: &cloudtasks.Task{
-				ScheduleTime: sTime,
-				HttpRequest: &cloudtasks.HttpRequest{
-					Url:        mgr.ResumeURL,
-					HttpMethod: "POST",
-					Body:       base64.StdEncoding.EncodeToString(body),
-				},
-			},
-		}).Context(ctx).Do()
+	sTime := req.Scheduled.Format(time.RFC3339)
+	_, err = mgr.createTask(ctx, queue, &cloudtasks.Task{
+		ScheduleTime: sTime,
+		HttpRequest: &cloudtasks.HttpRequest{
+			Url:        mgr.ResumeURL,
+			HttpMethod: "POST",
+			Body:       base64.StdEncoding.EncodeToString(body),
+			Headers:    taskHeaders(ctx, id, ""),
+		},
+	})
+	mgr.Metrics.scheduled(ctx, queue, err)
 	return err
 }
 
+func (mgr *GTasksScheduler) timeouts() Timeouts {
+	return mgr.Timeouts
+}
+
+// createTask creates task in the primary location, falling back to FallbackLocationID if primary location is down
+func (mgr *GTasksScheduler) createTask(ctx context.Context, queue string, task *cloudtasks.Task) (*cloudtasks.Task, error) {
+	create := func(location string) (*cloudtasks.Task, error) {
+		ctx, cancel := mgr.timeouts().tasksCall(ctx)
+		defer cancel()
+		resp, err := mgr.C.Projects.Locations.Queues.Tasks.Create(
+			fmt.Sprintf("projects/%v/locations/%v/queues/%v",
+				mgr.ProjectID, location, queue),
+			&cloudtasks.CreateTaskRequest{
+				Task: task,
+			}).Context(ctx).Do()
+		if err == nil {
+			mgr.Costs.task(ctx, "")
+		}
+		return resp, err
+	}
+	resp, err := create(mgr.LocationID)
+	if err == nil || mgr.FallbackLocationID == "" || ctx.Err() != nil || !locationDown(err) {
+		return resp, err
+	}
+	log.Printf("err creating task in %v, falling back to %v: %v", mgr.LocationID, mgr.FallbackLocationID, err)
+	resp, err = create(mgr.FallbackLocationID)
+	mgr.Metrics.failedOver(ctx, queue, mgr.FallbackLocationID, err)
+	return resp, err
+}
+
+// locationDown tells if task creation failed because of location outage or overload (Unavailable,
+// DeadlineExceeded or ResourceExhausted). Invalid, duplicate or forbidden tasks would fail in fallback location too.
+func locationDown(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true // call timeout
+	}
+	var gErr *googleapi.Error
+	if !errors.As(err, &gErr) {
+		return false
+	}
+	switch gErr.Code {
+	case http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
 func (s *Server) Timeout(name string, dur time.Duration, stmts ...async.Stmt) async.Event {
 	return async.On(name, &TimeoutHandler{
 		Duration:  dur,
-		scheduler: s.Scheduler,
+		scheduler: s.timers,
 	}, stmts...)
 }
 
 type TimeoutHandler struct {
 	Duration  time.Duration
-	scheduler *GTasksScheduler
+	scheduler TimerScheduler
 }
 
 func (s TimeoutHandler) MarshalJSON() ([]byte, error) {
@@ -129,6 +250,7 @@ func (t *TimeoutHandler) Teardown(ctx context.Context, req async.CallbackRequest
 type TimeoutReq struct {
 	Req       async.CallbackRequest
 	Signature string
+	Scheduled time.Time // used to measure delivery lag
 }
 
 func (req TimeoutReq) HMAC(secret []byte) string {
@@ -143,7 +265,11 @@ func (req TimeoutReq) HMAC(secret []byte) string {
 func (mgr *GTasksScheduler) TimeoutHandler(w http.ResponseWriter, r *http.Request) {
 	defer logTime("timeout handler")()
 	var req TimeoutReq
-	err := json.NewDecoder(r.Body).Decode(&req)
+	err := bodyErr(json.NewDecoder(r.Body).Decode(&req))
+	if errors.Is(err, ErrBodyTooLarge) {
+		jsonErr(w, err, http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(400)
 		fmt.Fprintf(w, "json parse: %v", err)
@@ -155,7 +281,25 @@ func (mgr *GTasksScheduler) TimeoutHandler(w http.ResponseWriter, r *http.Reques
 		fmt.Fprintf(w, "signature invalid")
 		return
 	}
-	_, err = mgr.Engine.HandleCallback(r.Context(), req.Req.WorkflowID, req.Req, nil)
+	mgr.Metrics.delivered(r.Context(), "callback", req.Scheduled)
+	_, err = mgr.Engine.HandleCallback(asCallback(r.Context()), req.Req.WorkflowID, req.Req, nil)
+	if errors.Is(err, ErrPollPending) {
+		return
+	}
+	if errors.Is(err, ErrEventQuarantined) {
+		// don't retry, event has to be retried or discarded manually
+		log.Printf("skipping quarantined callback %v for workflow %v", req.Req.Name, req.Req.WorkflowID)
+		return
+	}
+	if errors.Is(err, ErrStaleCallback) {
+		// workflow has moved on, retries won't help
+		log.Printf("skipping stale callback %v for workflow %v: %v", req.Req.Name, req.Req.WorkflowID, err)
+		return
+	}
+	if err != nil && isTimeout(err) {
+		jsonErr(w, err, http.StatusRequestTimeout)
+		return
+	}
 	if err != nil {
 		log.Printf("err: %v", err)
 		w.WriteHeader(500)
@@ -169,27 +313,24 @@ type GTasksSchedulerData struct {
 
 func (mgr *GTasksScheduler) Setup(ctx context.Context, r async.CallbackRequest, del time.Duration) (string, error) {
 	req := TimeoutReq{
-		Req: r,
+		Req:       r,
+		Scheduled: time.Now().Add(del),
 	}
 	req.Signature = req.HMAC([]byte(mgr.Secret))
 	body, err := json.Marshal(req)
 	if err != nil {
 		panic(err)
 	}
-	sTime := time.Now().Add(del).Format(time.RFC3339)
-	resp, err := mgr.C.Projects.Locations.Queues.Tasks.Create(
-		fmt.Sprintf("projects/%v/locations/%v/queues/%v",
-			mgr.ProjectID, mgr.LocationID, mgr.QueueName),
-		&cloudtasks.CreateTaskRequest{
-			Task: &cloudtasks.Task{
-				ScheduleTime: sTime,
-				HttpRequest: &cloudtasks.HttpRequest{
-					Url:        mgr.CallbackURL,
-					HttpMethod: "POST",
-					Body:       base64.StdEncoding.EncodeToString(body),
-				},
-			},
-		}).Do()
+	sTime := req.Scheduled.Format(time.RFC3339)
+	resp, err := mgr.createTask(ctx, mgr.QueueName, &cloudtasks.Task{
+		ScheduleTime: sTime,
+		HttpRequest: &cloudtasks.HttpRequest{
+			Url:        mgr.CallbackURL,
+			HttpMethod: "POST",
+			Body:       base64.StdEncoding.EncodeToString(body),
+			Headers:    taskHeaders(ctx, r.WorkflowID, r.Name),
+		},
+	})
 	if err != nil {
 		return "", err
 	}
@@ -209,7 +350,9 @@ func (mgr *GTasksScheduler) Teardown(ctx context.Context, req async.CallbackRequ
 	if err != nil {
 		return err
 	}
-	_, err = mgr.C.Projects.Locations.Queues.Tasks.Delete(data.ID).Do()
+	ctx, cancel := mgr.timeouts().tasksCall(ctx)
+	defer cancel()
+	_, err = mgr.C.Projects.Locations.Queues.Tasks.Delete(data.ID).Context(ctx).Do()
 	if err != nil {
 		log.Printf("delete task err: %v", err)
 	}
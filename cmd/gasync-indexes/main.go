@@ -0,0 +1,42 @@
+// Command gasync-indexes creates Firestore composite indexes required by gasync queries.
+//
+//	gasync-indexes -project my-project -collection workflows
+//
+// Use -dry-run to print indexes without creating them.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/gasync"
+)
+
+func main() {
+	project := flag.String("project", "", "GCP project")
+	collection := flag.String("collection", "workflows", "workflows collection")
+	dryRun := flag.Bool("dry-run", false, "print required indexes without creating them")
+	flag.Parse()
+	if *project == "" {
+		log.Fatal("-project is required")
+	}
+	ctx := context.Background()
+	db, err := firestore.NewClient(ctx, *project)
+	if err != nil {
+		log.Fatalf("err connecting to firestore: %v", err)
+	}
+	engine := gasync.FirestoreEngine{DB: db, Collection: *collection}
+	if *dryRun {
+		_ = json.NewEncoder(os.Stdout).Encode(engine.RequiredIndexes())
+		return
+	}
+	created, err := engine.EnsureIndexes(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%v indexes created", created)
+}
@@ -0,0 +1,96 @@
+// Command gasync-migrate copies workflow instances between Firestore collections or GCP projects.
+//
+//	gasync-migrate -from-project old -to-project new -collection workflows \
+//		-tasks-location us-central1 -tasks-queue timeouts -callback-url https://new.example.com/callbacks/v1/timeout -secret ...
+//
+// Timers are migrated only if Cloud Tasks flags are set.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/gasync"
+	cloudtasks "google.golang.org/api/cloudtasks/v2beta3"
+)
+
+func main() {
+	fromProject := flag.String("from-project", "", "source GCP project")
+	toProject := flag.String("to-project", "", "destination GCP project, same as source by default")
+	collection := flag.String("collection", "workflows", "source collection")
+	toCollection := flag.String("to-collection", "", "destination collection, same as source by default")
+	workflow := flag.String("workflow", "", "migrate only instances of this workflow")
+	deleteSource := flag.Bool("delete-source", false, "delete source instances instead of quarantining them")
+	noHistory := flag.Bool("no-history", false, "don't copy history")
+	location := flag.String("tasks-location", "", "Cloud Tasks location of timers")
+	queue := flag.String("tasks-queue", "", "Cloud Tasks queue for timers in destination")
+	callbackURL := flag.String("callback-url", "", "timeout callback URL of destination server")
+	secret := flag.String("secret", "", "SignSecret of destination server")
+	flag.Parse()
+	if *fromProject == "" {
+		log.Fatal("-from-project is required")
+	}
+	if *toProject == "" {
+		*toProject = *fromProject
+	}
+	if *toCollection == "" {
+		*toCollection = *collection
+	}
+	if *toProject == *fromProject && *toCollection == *collection {
+		log.Fatal("source and destination are the same")
+	}
+	ctx := context.Background()
+	fromDB, err := firestore.NewClient(ctx, *fromProject)
+	if err != nil {
+		log.Fatalf("err connecting to source: %v", err)
+	}
+	toDB, err := firestore.NewClient(ctx, *toProject)
+	if err != nil {
+		log.Fatalf("err connecting to destination: %v", err)
+	}
+	m := gasync.Migration{
+		From: &gasync.FirestoreEngine{
+			DB:         fromDB,
+			Collection: *collection,
+			History:    []gasync.HistorySink{&gasync.FirestoreHistory{DB: fromDB, Collection: *collection + "_log"}},
+		},
+		To: &gasync.FirestoreEngine{
+			DB:         toDB,
+			Collection: *toCollection,
+		},
+		Workflow:     *workflow,
+		DeleteSource: *deleteSource,
+	}
+	if !*noHistory {
+		m.To.History = []gasync.HistorySink{&gasync.FirestoreHistory{DB: toDB, Collection: *toCollection + "_log"}}
+	}
+	if *location != "" && *queue != "" && *callbackURL != "" {
+		tasks, err := cloudtasks.NewService(ctx)
+		if err != nil {
+			log.Fatalf("err connecting to cloud tasks: %v", err)
+		}
+		m.FromTasks = &gasync.GTasksScheduler{C: tasks, ProjectID: *fromProject, LocationID: *location}
+		m.To.Callbacks = &gasync.GTasksScheduler{
+			C:           tasks,
+			ProjectID:   *toProject,
+			LocationID:  *location,
+			QueueName:   *queue,
+			CallbackURL: *callbackURL,
+			Secret:      *secret,
+		}
+	} else {
+		log.Printf("cloud tasks flags are not set, timers won't be migrated")
+	}
+	stats, err := m.Run(ctx)
+	_ = json.NewEncoder(os.Stdout).Encode(stats)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(stats.Failed) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,68 @@
+// Command gasyncload runs synthetic workflows against a gasync server and reports throughput and latency percentiles.
+// Server under test should register synthetic workflow via gasyncload.Register.
+//
+//	gasyncload -url https://wf.example.com -workflows 1000 -concurrency 50 -steps 1-20 -events 0-5 -timers 0-2
+//
+// Report is printed to stdout as json.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorchestrate/gasync/gasyncload"
+)
+
+// parseRange parses "N" or "MIN-MAX"
+func parseRange(name, v string) (int, int) {
+	parts := strings.SplitN(v, "-", 2)
+	min, err := strconv.Atoi(parts[0])
+	if err != nil {
+		log.Fatalf("invalid -%v: %v", name, err)
+	}
+	if len(parts) == 1 {
+		return min, min
+	}
+	max, err := strconv.Atoi(parts[1])
+	if err != nil {
+		log.Fatalf("invalid -%v: %v", name, err)
+	}
+	return min, max
+}
+
+func main() {
+	cfg := gasyncload.Config{Header: http.Header{}}
+	flag.StringVar(&cfg.URL, "url", "", "base URL of the server under test")
+	flag.IntVar(&cfg.Workflows, "workflows", 100, "total number of workflows")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 10, "workflows running at the same time")
+	flag.DurationVar(&cfg.Timeout, "timeout", 0, "max duration of a single workflow, 1m by default")
+	flag.DurationVar(&cfg.TimerDelay, "timer-delay", 0, "delay of each timer")
+	flag.DurationVar(&cfg.PollInterval, "poll", 0, "interval of polling workflow status")
+	steps := flag.String("steps", "10", "steps per workflow, N or MIN-MAX")
+	events := flag.String("events", "1", "events sent concurrently to each workflow, N or MIN-MAX")
+	timers := flag.String("timers", "0", "timers per workflow, N or MIN-MAX")
+	auth := flag.String("auth", "", "Authorization header sent with requests")
+	flag.Parse()
+	if cfg.URL == "" {
+		log.Fatal("-url is required")
+	}
+	cfg.MinSteps, cfg.MaxSteps = parseRange("steps", *steps)
+	cfg.MinEvents, cfg.MaxEvents = parseRange("events", *events)
+	cfg.MinTimers, cfg.MaxTimers = parseRange("timers", *timers)
+	if *auth != "" {
+		cfg.Header.Set("Authorization", *auth)
+	}
+	report, err := gasyncload.Run(context.Background(), cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(report)
+}
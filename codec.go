@@ -0,0 +1,106 @@
+package gasync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorchestrate/async"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec serializes workflow state before it's saved to the database.
+// If no Codec is set - state is stored as a native Firestore map, which keeps it readable in Firestore console.
+// Setting Codec stores state as bytes, which is more compact and avoids double-marshaling of large states.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type JSONCodec struct{}
+
+func (c JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// MsgpackCodec uses json struct tags, so state types don't need separate msgpack tags.
+type MsgpackCodec struct{}
+
+func (c MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+
+func (c MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// ProtoCodec requires workflow state to be a generated protobuf message.
+type ProtoCodec struct{}
+
+func (c ProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("state %T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (c ProtoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("state %T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// encodeState prepares workflow state to be saved into the database
+func (fs FirestoreEngine) encodeState(state interface{}) (interface{}, error) {
+	if fs.Codec == nil {
+		return state, nil
+	}
+	d, err := fs.Codec.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("err encoding state: %v", err)
+	}
+	return d, nil
+}
+
+// decodeState unmarshals workflow state from the database into workflow type
+func (fs FirestoreEngine) decodeState(wf *DBWorkflow) (async.WorkflowState, error) {
+	w, ok := resolve(fs.Workflows, wf.Meta.Workflow, wf.Version)
+	if !ok {
+		return nil, fmt.Errorf("workflow not found: %v %v", wf.Meta.Workflow, wf.Version)
+	}
+	state := w()
+	d, ok := wf.State.([]byte)
+	if ok {
+		if fs.Codec == nil {
+			return nil, fmt.Errorf("state is encoded, but no codec is set")
+		}
+		err := fs.Codec.Unmarshal(d, state)
+		if err != nil {
+			return nil, fmt.Errorf("err decoding state: %v", err)
+		}
+		return state, nil
+	}
+	d, err := json.Marshal(wf.State)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(d, &state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
@@ -0,0 +1,184 @@
+package gasync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DBCorrelation routes awaited event with correlation key to the workflow waiting for it.
+// Stored in Collection+"_correlation" while the event is awaited.
+type DBCorrelation struct {
+	Key        string
+	Event      string
+	WorkflowID string
+	Workflow   string
+}
+
+// CorrelatedEvent is an event that can be delivered by correlation key instead of workflow ID,
+// i.e. payment notification that carries only order number. Key is indexed when the wait is set up
+// and removed on teardown, so that POST /event/by-key/{key}/{event} is routed to the waiting workflow.
+type CorrelatedEvent struct {
+	async.ReflectEvent
+	Key string
+
+	engine *FirestoreEngine
+}
+
+// OnCorrelatedEvent is the same as async.OnEvent, but event can also be delivered by key.
+// Key is usually derived from workflow state, i.e. "order:"+wf.OrderNumber. Empty key is not indexed.
+func (s *Server) OnCorrelatedEvent(name, key string, h interface{}, stmts ...async.Stmt) async.Event {
+	return async.Event{
+		Callback: async.CallbackRequest{
+			Name: name,
+		},
+		Handler: &CorrelatedEvent{
+			ReflectEvent: async.ReflectEvent{Handler: h},
+			Key:          key,
+			engine:       s.Engine,
+		},
+		Stmt: async.Section(stmts),
+	}
+}
+
+func correlationRef(fs *FirestoreEngine, key, event string) *firestore.DocumentRef {
+	h := sha256.New()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(event))
+	return fs.DB.Collection(fs.Collection + "_correlation").Doc(hex.EncodeToString(h.Sum(nil)))
+}
+
+// Setup indexes the key. Key awaited by another running workflow is not taken over,
+// records of finished or deleted workflows are replaced.
+func (h *CorrelatedEvent) Setup(ctx context.Context, req async.CallbackRequest) (string, error) {
+	if h.Key == "" {
+		return "", nil
+	}
+	defer logTime("correlation setup")()
+	name, _ := ctx.Value(workflowCtxKey{}).(string)
+	ref := correlationRef(h.engine, h.Key, req.Name)
+	return "", h.engine.DB.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			var c DBCorrelation
+			err = doc.DataTo(&c)
+			if err != nil {
+				return fmt.Errorf("err unmarshaling correlation: %v", err)
+			}
+			if c.WorkflowID != req.WorkflowID {
+				wf, err := tx.Get(h.engine.DB.Collection(h.engine.Collection).Doc(c.WorkflowID))
+				if err != nil && status.Code(err) != codes.NotFound {
+					return err
+				}
+				if err == nil {
+					var owner DBWorkflow
+					err = wf.DataTo(&owner)
+					if err != nil {
+						return fmt.Errorf("err unmarshaling workflow: %v", err)
+					}
+					if owner.Meta.Status != async.WorkflowFinished {
+						return fmt.Errorf("correlation key %v of event %v is awaited by workflow %v", h.Key, req.Name, c.WorkflowID)
+					}
+				}
+			}
+		}
+		return tx.Set(ref, DBCorrelation{
+			Key:        h.Key,
+			Event:      req.Name,
+			WorkflowID: req.WorkflowID,
+			Workflow:   name,
+		})
+	})
+}
+
+// Teardown removes the key, unless it was taken over by another workflow
+func (h *CorrelatedEvent) Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error {
+	if h.Key == "" {
+		return nil
+	}
+	defer logTime("correlation teardown")()
+	ref := correlationRef(h.engine, h.Key, req.Name)
+	return h.engine.DB.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var c DBCorrelation
+		err = doc.DataTo(&c)
+		if err != nil {
+			return fmt.Errorf("err unmarshaling correlation: %v", err)
+		}
+		if c.WorkflowID != req.WorkflowID {
+			return nil
+		}
+		return tx.Delete(ref)
+	})
+}
+
+// Correlate returns workflow awaiting event with the key
+func (fs FirestoreEngine) Correlate(ctx context.Context, key, event string) (DBCorrelation, error) {
+	defer logTime("correlate")()
+	var c DBCorrelation
+	doc, err := correlationRef(&fs, key, event).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return c, fmt.Errorf("%w: no workflow awaits event %v with key %v", ErrNotFound, event, key)
+	}
+	if err != nil {
+		return c, err
+	}
+	err = doc.DataTo(&c)
+	if err != nil {
+		return c, fmt.Errorf("err unmarshaling correlation: %v", err)
+	}
+	fs.Costs.read(ctx, c.Workflow, 1)
+	return c, nil
+}
+
+// correlatedEventHandler delivers event to the workflow awaiting it with the key
+func correlatedEventHandler(engine *FirestoreEngine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, event := mux.Vars(r)["key"], mux.Vars(r)["event"]
+		c, err := engine.Correlate(r.Context(), key, event)
+		if errors.Is(err, ErrNotFound) {
+			jsonErr(w, err, 404)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		d, err := readBody(r)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		out, err := engine.HandleEvent(withRequest(r.Context(), r), c.WorkflowID, event, d)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/wf/"+url.PathEscape(c.Workflow)+"/"+url.PathEscape(c.WorkflowID))
+		// resume is scheduled by HandleEvent
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(out)
+	}
+}
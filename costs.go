@@ -0,0 +1,87 @@
+package gasync
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WorkflowCost is a number of billable operations made for the workflow type
+type WorkflowCost struct {
+	FirestoreReads  int64
+	FirestoreWrites int64
+	TasksCreated    int64
+}
+
+// Costs accumulates billable operations of this process by workflow type, so that GCP costs can be attributed to workflows.
+// Operations that are not made on behalf of a specific workflow, i.e. listing, are not counted.
+type Costs struct {
+	mu      sync.Mutex
+	since   time.Time
+	totals  map[string]*WorkflowCost
+	metrics *Metrics
+}
+
+// CostStats is a response of GET /stats
+type CostStats struct {
+	Since     time.Time
+	Workflows map[string]WorkflowCost
+}
+
+func NewCosts(m *Metrics) *Costs {
+	return &Costs{
+		since:   time.Now(),
+		totals:  map[string]*WorkflowCost{},
+		metrics: m,
+	}
+}
+
+// Stats returns totals since the process started
+func (c *Costs) Stats() CostStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := CostStats{
+		Since:     c.since,
+		Workflows: map[string]WorkflowCost{},
+	}
+	for k, v := range c.totals {
+		ret.Workflows[k] = *v
+	}
+	return ret
+}
+
+func (c *Costs) add(ctx context.Context, workflow string, cost WorkflowCost) {
+	if c == nil {
+		return
+	}
+	if workflow == "" {
+		workflow, _ = ctx.Value(workflowCtxKey{}).(string)
+	}
+	if workflow == "" {
+		workflow = "unknown"
+	}
+	c.mu.Lock()
+	t, ok := c.totals[workflow]
+	if !ok {
+		t = &WorkflowCost{}
+		c.totals[workflow] = t
+	}
+	t.FirestoreReads += cost.FirestoreReads
+	t.FirestoreWrites += cost.FirestoreWrites
+	t.TasksCreated += cost.TasksCreated
+	c.mu.Unlock()
+	c.metrics.costed(ctx, workflow, cost)
+}
+
+// read and write count Firestore operations, workflow is taken from context if it's empty
+func (c *Costs) read(ctx context.Context, workflow string, n int) {
+	c.add(ctx, workflow, WorkflowCost{FirestoreReads: int64(n)})
+}
+
+func (c *Costs) write(ctx context.Context, workflow string, n int) {
+	c.add(ctx, workflow, WorkflowCost{FirestoreWrites: int64(n)})
+}
+
+func (c *Costs) task(ctx context.Context, workflow string) {
+	c.add(ctx, workflow, WorkflowCost{TasksCreated: 1})
+}
@@ -0,0 +1,55 @@
+package gasync
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/gorchestrate/async"
+)
+
+var ctxType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// ContextEvent is an event which handler has the form func(context.Context, Input) (Output, error).
+// Context is derived from the request that delivered the event and is cancelled when the caller disconnects
+// or request timeout is reached. Handler returning error because of cancellation fails the event as usual -
+// workflow is still saved and unlocked, since engine processing is protected by FirestoreEngine.ProcessingFloor.
+type ContextEvent struct {
+	async.ReflectEvent // handler with context bound to context.Background(), used for schemas
+	Handler            interface{}
+}
+
+// OnContextEvent is the same as async.OnEvent, but handler receives context of the request
+func OnContextEvent(name string, h interface{}, stmts ...async.Stmt) async.Event {
+	return async.Event{
+		Callback: async.CallbackRequest{
+			Name: name,
+		},
+		Handler: &ContextEvent{
+			ReflectEvent: async.ReflectEvent{Handler: bindContext(context.Background(), h)},
+			Handler:      h,
+		},
+		Stmt: async.Section(stmts),
+	}
+}
+
+// bindContext converts func(context.Context, In) (Out, error) to func(In) (Out, error) accepted by async.ReflectEvent.
+// Handlers of other forms are returned as is, so that ReflectEvent reports their errors.
+func bindContext(ctx context.Context, h interface{}) interface{} {
+	fv := reflect.ValueOf(h)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 2 || ft.In(0) != ctxType {
+		return h
+	}
+	out := []reflect.Type{}
+	for i := 0; i < ft.NumOut(); i++ {
+		out = append(out, ft.Out(i))
+	}
+	ctxVal := reflect.ValueOf(&ctx).Elem()
+	return reflect.MakeFunc(reflect.FuncOf([]reflect.Type{ft.In(1)}, out, false), func(args []reflect.Value) []reflect.Value {
+		return fv.Call([]reflect.Value{ctxVal, args[0]})
+	}).Interface()
+}
+
+func (h *ContextEvent) Handle(ctx context.Context, req async.CallbackRequest, input interface{}) (interface{}, error) {
+	return (&async.ReflectEvent{Handler: bindContext(ctx, h.Handler)}).Handle(ctx, req, input)
+}
@@ -0,0 +1,109 @@
+package gasync
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned for cursors that are tampered with or were issued for another query
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// listCursor is a position in the list. It's encrypted and authenticated, so clients can't see or forge document paths.
+type listCursor struct {
+	Query    string    // hash of the query cursor was issued for
+	ID       string    // last returned document
+	Priority int       `json:",omitempty"`
+	Created  time.Time `json:",omitempty"`
+	Status   string    `json:",omitempty"`
+}
+
+// processCursorKey encrypts cursors if secret is not set, so that they can't be forged with a publicly known key.
+// Such cursors are valid only in the process that issued them.
+var processCursorKey = func() []byte {
+	k := make([]byte, 32)
+	_, err := rand.Read(k)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}()
+
+func cursorKey(secret string) []byte {
+	if secret == "" {
+		return processCursorKey
+	}
+	k := sha256.Sum256([]byte("gasync-cursor:" + secret))
+	return k[:]
+}
+
+func encodeCursor(secret string, c listCursor) (string, error) {
+	d, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(cursorKey(secret))
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, d, nil)), nil
+}
+
+func decodeCursor(secret, s string) (listCursor, error) {
+	var c listCursor
+	d, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	block, err := aes.NewCipher(cursorKey(secret))
+	if err != nil {
+		return c, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return c, err
+	}
+	if len(d) < gcm.NonceSize() {
+		return c, ErrInvalidCursor
+	}
+	plain, err := gcm.Open(nil, d[:gcm.NonceSize()], d[gcm.NonceSize():], nil)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	err = json.Unmarshal(plain, &c)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// queryHash binds cursor to the query it was issued for
+func (lq ListQuery) hash(name string) string {
+	keys := []string{}
+	for k, v := range lq.Labels {
+		keys = append(keys, k+"="+v)
+	}
+	for k, v := range lq.Filter {
+		keys = append(keys, "filter["+k+"]="+v)
+	}
+	sort.Strings(keys)
+	h := sha256.Sum256([]byte(fmt.Sprintf("%v|%v|%v|%v", name, lq.OrderBy, lq.Sort, strings.Join(keys, "&"))))
+	return base64.RawURLEncoding.EncodeToString(h[:12])
+}
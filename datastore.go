@@ -0,0 +1,682 @@
+package gasync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/gorchestrate/async"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	cloudtasks "google.golang.org/api/cloudtasks/v2beta3"
+)
+
+// DatastoreEngine runs workflows on Firestore in Datastore mode, where firestore client can't be used.
+// Locking semantics are the same as in FirestoreEngine: workflow is locked by setting LockTill in a transaction.
+// Core workflow operations, deadlines, history, tracing and costs are supported - quarantine, projections
+// and admin APIs require FirestoreEngine. Used by NewServer if Config.DatastoreMode is set.
+type DatastoreEngine struct {
+	Scheduler Scheduler
+	DB        *datastore.Client
+	Kind      string
+	Workflows Registry
+	Redactor  Redactor
+	Hooks     Hooks
+
+	History   []HistorySink
+	NoHistory map[string]bool // workflows history is not written for
+
+	Timeouts Timeouts // bound Datastore calls, Firestore timeouts are used
+	Metrics  *Metrics
+	Tracer   trace.Tracer // creates spans for resumes and events, see NewTracer
+	Costs    *Costs       // Datastore entity reads and writes are counted as Firestore ones
+}
+
+var _ CallbackEngine = DatastoreEngine{}
+
+// dsWorkflow is a Datastore entity of the workflow.
+// Datastore can't store interface{} fields, so workflow is stored as json, with fields used in queries copied next to it.
+type dsWorkflow struct {
+	Workflow string
+	Status   string
+	LockTill time.Time
+	Priority int
+	Data     []byte `datastore:",noindex"` // json of DBWorkflow
+}
+
+func (ds DatastoreEngine) key(id string) *datastore.Key {
+	return datastore.NameKey(ds.Kind, id, nil)
+}
+
+func toEntity(wf *DBWorkflow) (*dsWorkflow, error) {
+	d, err := json.Marshal(wf)
+	if err != nil {
+		return nil, fmt.Errorf("err marshaling workflow: %v", err)
+	}
+	return &dsWorkflow{
+		Workflow: wf.Meta.Workflow,
+		Status:   string(wf.Meta.Status),
+		LockTill: wf.LockTill,
+		Priority: wf.Priority,
+		Data:     d,
+	}, nil
+}
+
+func fromEntity(e *dsWorkflow) (DBWorkflow, error) {
+	var wf DBWorkflow
+	err := json.Unmarshal(e.Data, &wf)
+	if err != nil {
+		return DBWorkflow{}, fmt.Errorf("err unmarshaling workflow: %v", err)
+	}
+	wf.LockTill = e.LockTill
+	return wf, nil
+}
+
+func (ds DatastoreEngine) Lock(ctx context.Context, id string) (DBWorkflow, error) {
+	defer logTime("lock")()
+	for i := 0; ; i++ {
+		var wf DBWorkflow
+		locked := false
+		callCtx, cancel := ds.Timeouts.firestoreCall(ctx)
+		_, err := ds.DB.RunInTransaction(callCtx, func(tx *datastore.Transaction) error {
+			var e dsWorkflow
+			err := tx.Get(ds.key(id), &e)
+			if err != nil {
+				return err
+			}
+			wf, err = fromEntity(&e)
+			if err != nil {
+				return err
+			}
+			ds.Costs.read(ctx, wf.Meta.Workflow, 1)
+			if wf.Quarantined {
+				return ErrQuarantined
+			}
+			if time.Since(e.LockTill) < 0 {
+				locked = true
+				return nil
+			}
+			e.LockTill = time.Now().Add(time.Minute)
+			_, err = tx.Put(ds.key(id), &e)
+			ds.Costs.write(ctx, wf.Meta.Workflow, 1)
+			return err
+		}, datastore.MaxAttempts(1))
+		cancel()
+		if errors.Is(err, datastore.ErrConcurrentTransaction) {
+			if lockWaitSkipped(ctx) {
+				// locked concurrently, lock is held for a minute
+				return DBWorkflow{}, LockedError{Until: time.Now().Add(time.Minute)}
+			}
+			log.Printf("workflow was locked concurrently, waiting and trying again...")
+			continue
+		}
+		if errors.Is(err, datastore.ErrNoSuchEntity) {
+			return DBWorkflow{}, ErrNotFound
+		}
+		if errors.Is(err, ErrQuarantined) {
+			return DBWorkflow{}, err
+		}
+		if err != nil {
+			return DBWorkflow{}, fmt.Errorf("err locking workflow: %v", err)
+		}
+		if locked {
+			if lockWaitSkipped(ctx) {
+				return DBWorkflow{}, LockedError{Until: wf.LockTill}
+			}
+			if i > 50 {
+				return DBWorkflow{}, fmt.Errorf("workflow is locked. can't unlock with 50 retries")
+			}
+			log.Printf("workflow is locked, waiting and trying again...")
+			select {
+			case <-ctx.Done():
+				return DBWorkflow{}, fmt.Errorf("workflow is locked: %w", ctx.Err())
+			case <-time.After(time.Millisecond * 100 * time.Duration(i)):
+			}
+			continue
+		}
+		return wf, nil
+	}
+}
+
+func (ds DatastoreEngine) Unlock(ctx context.Context, id string) error {
+	defer logTime("unlock")()
+	ctx, cancel := ds.Timeouts.firestoreCall(ctx)
+	defer cancel()
+	_, err := ds.DB.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var e dsWorkflow
+		err := tx.Get(ds.key(id), &e)
+		if err != nil {
+			return err
+		}
+		e.LockTill = time.Time{}
+		_, err = tx.Put(ds.key(id), &e)
+		return err
+	})
+	ds.Costs.read(ctx, "", 1)
+	ds.Costs.write(ctx, "", 1)
+	if err != nil {
+		return fmt.Errorf("err unlocking workflow: %v", err)
+	}
+	return nil
+}
+
+// Save stores workflow locked by Lock
+func (ds DatastoreEngine) Save(ctx context.Context, wf *DBWorkflow, s *async.WorkflowState, unlock bool) error {
+	defer logTime("save")()
+	wf.State = *s
+	wf.trackThreads()
+	if unlock {
+		wf.LockTill = time.Time{}
+	}
+	e, err := toEntity(wf)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := ds.Timeouts.firestoreCall(ctx)
+	defer cancel()
+	_, err = ds.DB.Put(ctx, ds.key(wf.Meta.ID), e)
+	ds.Costs.write(ctx, wf.Meta.Workflow, 1)
+	return err
+}
+
+func (ds DatastoreEngine) decodeState(wf *DBWorkflow) (async.WorkflowState, error) {
+	w, ok := resolve(ds.Workflows, wf.Meta.Workflow, wf.Version)
+	if !ok {
+		return nil, fmt.Errorf("workflow not found: %v %v", wf.Meta.Workflow, wf.Version)
+	}
+	state := w()
+	d, err := json.Marshal(wf.State)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(d, &state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Redact returns a copy of workflow with sensitive state fields masked, same as FirestoreEngine.Redact
+func (ds DatastoreEngine) Redact(wf *DBWorkflow) (*DBWorkflow, error) {
+	var r Redactor = TagRedactor{}
+	if ds.Redactor != nil {
+		r = ds.Redactor
+	}
+	state, err := ds.decodeState(wf)
+	if err != nil {
+		return nil, err
+	}
+	err = r.Redact(state)
+	if err != nil {
+		return nil, fmt.Errorf("err redacting workflow: %v", err)
+	}
+	ret := *wf
+	ret.State = state
+	return &ret, nil
+}
+
+func (ds DatastoreEngine) Get(ctx context.Context, id string) (*DBWorkflow, error) {
+	defer logTime("get")()
+	var e dsWorkflow
+	callCtx, cancel := ds.Timeouts.firestoreCall(ctx)
+	err := ds.DB.Get(callCtx, ds.key(id), &e)
+	cancel()
+	ds.Costs.read(ctx, e.Workflow, 1)
+	if errors.Is(err, datastore.ErrNoSuchEntity) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	wf, err := fromEntity(&e)
+	return &wf, err
+}
+
+// GetState returns redacted workflow state without Meta
+func (ds DatastoreEngine) GetState(ctx context.Context, id string) (interface{}, error) {
+	defer logTime("get state")()
+	wf, err := ds.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	wf, err = ds.Redact(wf)
+	if err != nil {
+		return nil, err
+	}
+	return wf.State, nil
+}
+
+// writeHistory redacts state and sends history entry to all sinks, same as FirestoreEngine does
+func (ds DatastoreEngine) writeHistory(ctx context.Context, wf *DBWorkflow, state interface{}, start time.Time, cb *async.CallbackRequest, input, output interface{}) {
+	if len(ds.History) == 0 || ds.NoHistory[wf.Meta.Workflow] {
+		return
+	}
+	defer logTime("history")()
+	redacted, err := ds.Redact(&DBWorkflow{Meta: wf.Meta, State: state, Version: wf.Version})
+	if err != nil {
+		log.Printf("history entry of %v is not written: %v", wf.Meta.ID, err)
+		return
+	}
+	l := DBWorkflowLog{
+		Meta:         wf.Meta,
+		State:        redacted.State,
+		Time:         time.Now(),
+		ExecDuration: time.Since(start),
+		Output:       redactPayload(ds.Redactor, output),
+		Callback:     cb,
+	}
+	l.Input, l.InputRedacted = redactInput(ds.Redactor, input)
+	if id, ok := IdentityFromContext(ctx); ok {
+		l.Identity = &id
+	}
+	for _, s := range ds.History {
+		err := s.Write(ctx, l)
+		if _, ok := s.(*FirestoreHistory); ok {
+			ds.Costs.write(ctx, wf.Meta.Workflow, 1)
+		}
+		if err != nil {
+			log.Printf("err writing history of %v to %T: %v", wf.Meta.ID, s, err)
+		}
+	}
+}
+
+func (ds DatastoreEngine) HandleCallback(ctx context.Context, id string, cb async.CallbackRequest, input interface{}) (_ interface{}, err error) {
+	defer logTime("handle callback")()
+	start := time.Now()
+	ctx, span := startSpan(ctx, ds.Tracer, "gasync.callback", id, attribute.String("event", cb.Name))
+	defer func() { endSpan(span, err) }()
+	wf, err := ds.Lock(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withWorkflow(ctx, wf.Meta.Workflow)
+	defer func() { ds.Metrics.handled(ctx, wf.Meta.Workflow, cb.Name, start, err) }()
+	state, err := ds.decodeState(&wf)
+	if err != nil {
+		_ = ds.Unlock(ctx, id)
+		return nil, err
+	}
+	out, err := safeHandleCallback(ctx, cb, state, &wf.Meta, input)
+	if errors.Is(err, ErrPollPending) {
+		// setup data of the next poll is not stored, so teardown of polls relies on stale callbacks being dropped
+		_ = ds.Unlock(ctx, id)
+		return nil, err
+	}
+	if staleCallback(err) {
+		_ = ds.Unlock(ctx, id)
+		return nil, fmt.Errorf("%w: %v", ErrStaleCallback, err)
+	}
+	if err != nil {
+		_ = ds.Unlock(ctx, id)
+		ds.Hooks.failed(ctx, wf.Meta, state, err)
+		return out, fmt.Errorf("err during workflow processing: %w", err)
+	}
+	var g errgroup.Group
+	if !scheduleSkipped(ctx) {
+		id, priority := wf.Meta.ID, wf.Priority
+		g.Go(func() error {
+			err := ds.Scheduler.ScheduleWithPriority(ctx, id, 0, priority)
+			if err != nil {
+				return ScheduleError{WorkflowID: id, Err: err}
+			}
+			return nil
+		})
+	}
+	err = ds.Save(ctx, &wf, &state, true)
+	sErr := g.Wait()
+	if err != nil {
+		return out, fmt.Errorf("err during workflow saving: %w", err)
+	}
+	ds.writeHistory(ctx, &wf, state, start, &cb, input, out)
+	return out, sErr
+}
+
+func (ds DatastoreEngine) HandleEvent(ctx context.Context, id string, name string, input interface{}) (interface{}, error) {
+	return ds.HandleCallback(ctx, id, async.CallbackRequest{Name: name}, input)
+}
+
+func (ds DatastoreEngine) Resume(ctx context.Context, id string) (err error) {
+	defer logTime("resume func")()
+	start := time.Now()
+	ctx, span := startSpan(ctx, ds.Tracer, "gasync.resume", id)
+	defer func() { endSpan(span, err) }()
+	wf, err := ds.Lock(ctx, id)
+	if err != nil {
+		return err
+	}
+	ctx = withWorkflow(ctx, wf.Meta.Workflow)
+	defer func() { ds.Metrics.resumed(ctx, wf.Meta.Workflow, start, err) }()
+	if !wf.Deadline.IsZero() && time.Now().After(wf.Deadline) && wf.Meta.Status != async.WorkflowFinished {
+		_ = ds.Unlock(ctx, id)
+		log.Printf("workflow %v exceeded deadline %v, cancelling", id, wf.Deadline)
+		return ds.Cancel(ctx, id)
+	}
+	state, err := ds.decodeState(&wf)
+	if err != nil {
+		_ = ds.Unlock(ctx, id)
+		return err
+	}
+	err = safeResume(ctx, state, &wf.Meta, ds.Hooks.checkpoint(ctx, &wf.Meta, state))
+	if err != nil {
+		_ = ds.Unlock(ctx, id)
+		ds.Hooks.failed(ctx, wf.Meta, state, err)
+		return fmt.Errorf("err during workflow processing: %w", err)
+	}
+	err = ds.Save(ctx, &wf, &state, true)
+	if err != nil {
+		ds.Hooks.failed(ctx, wf.Meta, state, err)
+		return err
+	}
+	ds.writeHistory(ctx, &wf, state, start, nil, nil, nil)
+	ds.Hooks.resumed(ctx, wf.Meta, state)
+	return nil
+}
+
+func (ds DatastoreEngine) ScheduleAndCreate(ctx context.Context, id, name string, state interface{}, opts CreateOptions) error {
+	defer logTime("schedule and create")()
+	start := time.Now()
+	ctx = withWorkflow(ctx, name)
+	wf := DBWorkflow{
+		Meta:     async.NewState(id, name),
+		Labels:   opts.Labels,
+		Priority: opts.Priority,
+		Parent:   opts.Parent,
+		Created:  time.Now(),
+	}
+	if opts.Deadline > 0 {
+		wf.Deadline = time.Now().Add(opts.Deadline)
+	}
+	w, version, ok := ds.Workflows.Get(name)
+	if opts.Version != "" {
+		w, ok = ds.Workflows.GetVersion(name, opts.Version)
+		version = opts.Version
+	}
+	if !ok {
+		return fmt.Errorf("workflow not found: %v %v", name, opts.Version)
+	}
+	wf.Version = version
+	// check before resuming, so that steps are not executed for duplicate workflows
+	callCtx, cancel := ds.Timeouts.firestoreCall(ctx)
+	err := ds.DB.Get(callCtx, ds.key(id), &dsWorkflow{})
+	cancel()
+	ds.Costs.read(ctx, name, 1)
+	var mismatch *datastore.ErrFieldMismatch
+	if err == nil || errors.As(err, &mismatch) {
+		return ErrAlreadyExists
+	}
+	if !errors.Is(err, datastore.ErrNoSuchEntity) {
+		return fmt.Errorf("err checking if workflow exists: %v", err)
+	}
+	s := w()
+	if ws, ok := state.(async.WorkflowState); ok {
+		s = ws // initial state supplied by caller
+	}
+	err = safeResume(ctx, s, &wf.Meta, ds.Hooks.checkpoint(ctx, &wf.Meta, s))
+	if err != nil {
+		ds.Hooks.failed(ctx, wf.Meta, s, err)
+		return fmt.Errorf("err during workflow processing: %w", err)
+	}
+	wf.State = s
+	wf.trackThreads()
+	e, err := toEntity(&wf)
+	if err != nil {
+		return err
+	}
+	callCtx, cancel = ds.Timeouts.firestoreCall(ctx)
+	_, err = ds.DB.RunInTransaction(callCtx, func(tx *datastore.Transaction) error {
+		err := tx.Get(ds.key(id), &dsWorkflow{})
+		if err == nil || errors.As(err, &mismatch) {
+			return ErrAlreadyExists
+		}
+		if !errors.Is(err, datastore.ErrNoSuchEntity) {
+			return fmt.Errorf("err checking if workflow exists: %v", err)
+		}
+		_, err = tx.Put(ds.key(id), e)
+		return err
+	})
+	cancel()
+	ds.Costs.read(ctx, name, 1)
+	ds.Costs.write(ctx, name, 1)
+	if err != nil {
+		return err
+	}
+	ds.writeHistory(ctx, &wf, s, start, nil, state, nil)
+	if opts.Deadline > 0 && wf.Meta.Status != async.WorkflowFinished {
+		// resume after deadline cancels the workflow
+		err = ds.Scheduler.Schedule(ctx, id, opts.Deadline)
+		if err != nil {
+			log.Printf("err scheduling deadline of %v: %v", id, err)
+		}
+	}
+	ds.Hooks.created(ctx, wf.Meta, s)
+	ds.Hooks.resumed(ctx, wf.Meta, s)
+	return nil
+}
+
+// Cancel finishes workflow without executing remaining steps. Events workflow is waiting for are torn down.
+func (ds DatastoreEngine) Cancel(ctx context.Context, id string) error {
+	defer logTime("cancel")()
+	wf, err := ds.Lock(ctx, id)
+	if err != nil {
+		return err
+	}
+	state, err := ds.decodeState(&wf)
+	if err != nil {
+		_ = ds.Unlock(ctx, id)
+		return err
+	}
+	teardownEvents(ctx, &wf.Meta, state)
+	wf.Meta.Status = async.WorkflowFinished
+	return ds.Save(ctx, &wf, &state, true)
+}
+
+// newDatastoreServer serves core workflow API on DatastoreEngine: create, get, events and Cloud Tasks callbacks.
+// Server.Engine is nil in Datastore mode, so methods and routes relying on FirestoreEngine are not available.
+func newDatastoreServer(cfg Config, registry Registry) (*Server, error) {
+	ctx := context.Background()
+	db, err := datastore.NewClient(ctx, cfg.GCloudProjectID, cfg.FirestoreOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("err creating datastore client: %v", err)
+	}
+	cTasks, err := cloudtasks.NewService(ctx, cfg.CloudTasksOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("err creating cloud tasks client: %v", err)
+	}
+	guard, err := newCallbackGuard(cfg.CallbackAuth)
+	if err != nil {
+		return nil, err
+	}
+	mr := mux.NewRouter()
+	if cfg.JWT != nil {
+		mr.Use(cfg.JWT.Middleware)
+	}
+	resumePath, timeoutPath := callbackPaths(CallbackPathVersion)
+	resumeURL := strings.Trim(cfg.BasePublicURL, "/") + resumePath
+	if cfg.ResumeURL != "" {
+		resumeURL = cfg.ResumeURL
+	}
+	timeoutURL := strings.Trim(cfg.BasePublicURL, "/") + timeoutPath
+	if cfg.TimeoutURL != "" {
+		timeoutURL = cfg.TimeoutURL
+	}
+	engine := &DatastoreEngine{
+		DB:        db,
+		Kind:      cfg.Collection,
+		Workflows: registry,
+		Redactor:  cfg.Redactor,
+		Hooks:     cfg.Hooks,
+		History:   cfg.History,
+		NoHistory: map[string]bool{},
+		Timeouts:  cfg.Timeouts,
+	}
+	for _, name := range cfg.NoHistory {
+		engine.NoHistory[name] = true
+	}
+	if cfg.TracerProvider != nil {
+		engine.Tracer = NewTracer(cfg.TracerProvider)
+	}
+	s := &GTasksScheduler{
+		Engine:     engine,
+		C:          cTasks,
+		ProjectID:  cfg.GCloudProjectID,
+		LocationID: cfg.GCloudLocationID,
+		QueueName:  cfg.GCloudTasksQueueName,
+		ResumeURL:  resumeURL,
+		Secret:     cfg.SignSecret,
+
+		HighPriority:          cfg.HighPriority,
+		HighPriorityQueueName: cfg.GCloudTasksHighPriorityQueueName,
+		FallbackLocationID:    cfg.GCloudFallbackLocationID,
+		Timeouts:              cfg.Timeouts,
+	}
+	engine.Scheduler = s
+	gTaskMgr := &GTasksScheduler{
+		Engine:      engine,
+		C:           cTasks,
+		ProjectID:   cfg.GCloudProjectID,
+		LocationID:  cfg.GCloudLocationID,
+		QueueName:   cfg.GCloudTasksQueueName,
+		CallbackURL: timeoutURL,
+		Secret:      cfg.SignSecret,
+
+		FallbackLocationID: cfg.GCloudFallbackLocationID,
+		Timeouts:           cfg.Timeouts,
+	}
+	resumeHandler := guard.wrap(limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, s.ResumeHandler))
+	timeoutHandler := guard.wrap(limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, gTaskMgr.TimeoutHandler))
+	routeCallbacks(mr, cfg.LegacyCallbackPrefixes, resumeHandler, timeoutHandler)
+
+	create := func(w http.ResponseWriter, r *http.Request, id string) {
+		err := cfg.IDRules.Validate(id)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		name := mux.Vars(r)["name"]
+		wf, _, ok := registry.Get(name)
+		if !ok {
+			jsonErr(w, fmt.Errorf("workflow %v not found", name), 404)
+			return
+		}
+		state := wf()
+		body, err := readBody(r)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		if len(bytes.TrimSpace(body)) > 0 {
+			err = decodeInitialState(body, state)
+			if err != nil {
+				jsonErr(w, err, 400)
+				return
+			}
+		}
+		labels, err := parseLabels(r.URL.Query()["label"])
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		err = engine.ScheduleAndCreate(r.Context(), id, name, state, CreateOptions{Labels: labels, Version: r.URL.Query().Get("version")})
+		if errors.Is(err, ErrAlreadyExists) {
+			jsonErr(w, err, 409)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		err = s.Schedule(r.Context(), id, 0)
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(struct {
+			ID string
+		}{
+			ID: id,
+		})
+	}
+	mr.HandleFunc("/wf/{name}/{id}", limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		create(w, r, mux.Vars(r)["id"])
+	})).Methods("POST")
+	mr.HandleFunc("/wf/{name}", limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		id := newID()
+		w.Header().Set("Location", "/wf/"+mux.Vars(r)["name"]+"/"+id)
+		create(w, r, id)
+	})).Methods("POST")
+	mr.HandleFunc("/wf/{name}/{id}", func(w http.ResponseWriter, r *http.Request) {
+		wf, err := engine.Get(r.Context(), mux.Vars(r)["id"])
+		if err == nil {
+			wf, err = engine.Redact(wf)
+		}
+		if errors.Is(err, ErrNotFound) {
+			jsonErr(w, err, 404)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(wf)
+	}).Methods("GET")
+	mr.HandleFunc("/wf/{name}/{id}/{event}", limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		err := cfg.IDRules.Validate(mux.Vars(r)["id"])
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		d, err := readBody(r)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		event := mux.Vars(r)["event"]
+		if resolved := cfg.EventAliases.resolve(w, mux.Vars(r)["name"], event); resolved != event {
+			log.Printf("deprecated event %v/%v is used, should be %v", mux.Vars(r)["name"], event, resolved)
+			event = resolved
+		}
+		var h EventHandler = func(ctx context.Context, req EventRequest) (interface{}, error) {
+			return engine.HandleEvent(ctx, req.WorkflowID, req.Callback.Name, req.Input)
+		}
+		if len(cfg.EventRoles) > 0 {
+			h = EventRoles(cfg.EventRoles, engine)(h)
+		}
+		out, err := h(withRequest(r.Context(), r), EventRequest{
+			WorkflowID: mux.Vars(r)["id"],
+			Callback:   async.CallbackRequest{Name: event},
+			Input:      d,
+		})
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// resume is scheduled by HandleEvent
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(out)
+	})).Methods("POST")
+
+	return &Server{
+		Router:          mr,
+		Datastore:       engine,
+		Scheduler:       gTaskMgr,
+		ResumeScheduler: s,
+		baseURL:         cfg.BasePublicURL,
+		clientCAs:       guard.clients,
+		http:            cfg.HTTP,
+		resumeHandler:   resumeHandler,
+		timeoutHandler:  timeoutHandler,
+	}, nil
+}
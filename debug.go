@@ -0,0 +1,104 @@
+package gasync
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	cloudtasks "google.golang.org/api/cloudtasks/v2beta3"
+)
+
+// AdminToken authorizes admin requests with "Authorization: Bearer <token>" header
+func AdminToken(token string) func(r *http.Request) error {
+	return func(r *http.Request) error {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			return errors.New("invalid admin token")
+		}
+		return nil
+	}
+}
+
+// LockInfo describes workflow that is currently locked
+type LockInfo struct {
+	ID       string
+	Workflow string
+	LockTill time.Time
+}
+
+// Diagnostics is a snapshot of engine internals served at /debug/diagnostics
+type Diagnostics struct {
+	Locks              []LockInfo
+	InlineResumes      int64 // resumes running inside http handlers of this instance
+	LimitedResumes     int   // resumes running under ConcurrencyLimiter of this instance
+	LimitedPerWorkflow map[string]int
+	Queues             map[string]*cloudtasks.QueueStats
+}
+
+// ActiveLocks returns workflows that are locked right now
+func (fs FirestoreEngine) ActiveLocks(ctx context.Context) ([]LockInfo, error) {
+	docs, err := fs.DB.Collection(fs.Collection).
+		Where("LockTill", ">", time.Now()).
+		Select("Meta.Workflow", "LockTill").
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	ret := []LockInfo{}
+	for _, doc := range docs {
+		var wf DBWorkflow
+		err = doc.DataTo(&wf)
+		if err != nil {
+			return nil, fmt.Errorf("err unmarshaling workflow %v: %v", doc.Ref.ID, err)
+		}
+		ret = append(ret, LockInfo{
+			ID:       doc.Ref.ID,
+			Workflow: wf.Meta.Workflow,
+			LockTill: wf.LockTill,
+		})
+	}
+	return ret, nil
+}
+
+// QueueStats returns stats of Cloud Tasks queues used by scheduler
+func (mgr *GTasksScheduler) QueueStats(ctx context.Context) (map[string]*cloudtasks.QueueStats, error) {
+	ret := map[string]*cloudtasks.QueueStats{}
+	for _, q := range []string{mgr.QueueName, mgr.HighPriorityQueueName} {
+		if q == "" {
+			continue
+		}
+		queue, err := mgr.C.Projects.Locations.Queues.Get(
+			fmt.Sprintf("projects/%v/locations/%v/queues/%v", mgr.ProjectID, mgr.LocationID, q),
+		).ReadMask("stats").Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("err getting stats of queue %v: %v", q, err)
+		}
+		ret[q] = queue.Stats
+	}
+	return ret, nil
+}
+
+// mountDebug serves pprof and engine diagnostics under /debug
+func mountDebug(mr *mux.Router, auth func(r *http.Request) error, diagnostics func(ctx context.Context) (Diagnostics, error)) {
+	mr.HandleFunc("/debug/pprof/cmdline", adminOnly(auth, pprof.Cmdline))
+	mr.HandleFunc("/debug/pprof/profile", adminOnly(auth, pprof.Profile))
+	mr.HandleFunc("/debug/pprof/symbol", adminOnly(auth, pprof.Symbol))
+	mr.HandleFunc("/debug/pprof/trace", adminOnly(auth, pprof.Trace))
+	mr.PathPrefix("/debug/pprof/").HandlerFunc(adminOnly(auth, pprof.Index))
+	mr.HandleFunc("/debug/diagnostics", adminOnly(auth, func(w http.ResponseWriter, r *http.Request) {
+		d, err := diagnostics(r.Context())
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(d)
+	})).Methods("GET")
+}
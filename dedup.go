@@ -0,0 +1,142 @@
+package gasync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrDuplicateInFlight is returned for duplicate event while the original is still handled, so that it's retried later
+var ErrDuplicateInFlight = errors.New("duplicate event is being handled")
+
+// DedupClaimLease is how long event is considered in-flight by its dedup record.
+// Claims of handlers that crashed before finishing are taken over after it, same as workflow locks.
+const DedupClaimLease = time.Minute
+
+// DBDedup is a handled event remembered for dedup window. Stored in Collection+"_dedup",
+// or in Collection+"_dedup"/{shard}/entries if FirestoreEngine.EventShards is set.
+// ExpireAt can be used for Firestore TTL policy, expired records are ignored anyway.
+type DBDedup struct {
+	WorkflowID  string
+	Event       string
+	Output      interface{}
+	Done        bool
+	ClaimedTill time.Time // duplicates are retried until event is done or claim expires
+	ExpireAt    time.Time
+}
+
+func (fs FirestoreEngine) dedupWindow(event string) time.Duration {
+	if w, ok := fs.DedupWindows[event]; ok {
+		return w
+	}
+	return fs.DedupWindows["*"]
+}
+
+func (fs FirestoreEngine) dedupRef(id string, hash []byte) *firestore.DocumentRef {
+	col := fs.DB.Collection(fs.Collection + "_dedup")
+	if fs.EventShards != nil {
+		// duplicate is handled at another PC, so shard is selected by hash of the event instead
+		shard := fs.EventShards.Shard(id, int(binary.BigEndian.Uint32(hash)&math.MaxInt32))
+		col = col.Doc(shard).Collection("entries")
+	}
+	return col.Doc(hex.EncodeToString(hash))
+}
+
+type dedupState int
+
+const (
+	dedupTakeOver  dedupState = iota // record expired or claim was abandoned
+	dedupDuplicate                   // event was handled within dedup window
+	dedupInFlight                    // event is being handled
+)
+
+// dedupCheck tells what to do with event that already has dedup record
+func dedupCheck(d DBDedup, now time.Time) dedupState {
+	if d.Done && now.Before(d.ExpireAt) {
+		return dedupDuplicate
+	}
+	if !d.Done && now.Before(d.ClaimedTill) {
+		return dedupInFlight
+	}
+	return dedupTakeOver
+}
+
+// dedupEvent calls h unless the same event with the same payload was handled within dedup window.
+// Output of the original event is returned for duplicates.
+func (fs FirestoreEngine) dedupEvent(ctx context.Context, id, event string, input interface{}, h func() (interface{}, error)) (interface{}, error) {
+	window := fs.dedupWindow(event)
+	payload, ok := input.([]byte)
+	if window <= 0 || !ok {
+		return h()
+	}
+	hash := sha256.New()
+	for _, v := range [][]byte{[]byte(id), []byte(event), payload} {
+		hash.Write(v)
+		hash.Write([]byte{0})
+	}
+	ref := fs.dedupRef(id, hash.Sum(nil))
+	claim := DBDedup{
+		WorkflowID:  id,
+		Event:       event,
+		ClaimedTill: time.Now().Add(DedupClaimLease),
+		ExpireAt:    time.Now().Add(window),
+	}
+	_, err := ref.Create(ctx, claim)
+	if status.Code(err) == codes.AlreadyExists {
+		var d DBDedup
+		doc, gErr := ref.Get(ctx)
+		if gErr == nil {
+			gErr = doc.DataTo(&d)
+		}
+		if gErr != nil {
+			return nil, fmt.Errorf("err reading dedup record: %v", gErr)
+		}
+		switch dedupCheck(d, time.Now()) {
+		case dedupDuplicate:
+			fs.Metrics.deduplicated(ctx, event)
+			log.Printf("duplicate event %v of %v is ignored", event, id)
+			return d.Output, nil
+		case dedupInFlight:
+			return nil, ErrDuplicateInFlight
+		}
+		// expired record or abandoned claim is taken over, unless it was claimed concurrently
+		_, err = ref.Update(ctx, []firestore.Update{
+			{Path: "Done", Value: false},
+			{Path: "Output", Value: nil},
+			{Path: "ClaimedTill", Value: claim.ClaimedTill},
+			{Path: "ExpireAt", Value: claim.ExpireAt},
+		}, firestore.LastUpdateTime(doc.UpdateTime))
+		if status.Code(err) == codes.FailedPrecondition {
+			return nil, ErrDuplicateInFlight
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("err recording event for dedup: %v", err)
+	}
+	out, err := h()
+	if err != nil {
+		// failed events are not deduplicated, so that they can be retried
+		if _, dErr := ref.Delete(ctx); dErr != nil {
+			log.Printf("err deleting dedup record of %v: %v", id, dErr)
+		}
+		return out, err
+	}
+	_, err = ref.Update(ctx, []firestore.Update{
+		{Path: "Done", Value: true},
+		{Path: "Output", Value: pjson(out)},
+	})
+	if err != nil {
+		log.Printf("err updating dedup record of %v: %v", id, err)
+	}
+	return out, nil
+}
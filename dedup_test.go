@@ -0,0 +1,129 @@
+package gasync
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+func TestDedupCheck(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		name string
+		d    DBDedup
+		want dedupState
+	}{
+		{"handled", DBDedup{Done: true, ExpireAt: now.Add(time.Minute)}, dedupDuplicate},
+		{"handled expired", DBDedup{Done: true, ExpireAt: now.Add(-time.Minute)}, dedupTakeOver},
+		{"in flight", DBDedup{ClaimedTill: now.Add(time.Second), ExpireAt: now.Add(time.Minute)}, dedupInFlight},
+		{"abandoned claim", DBDedup{ClaimedTill: now.Add(-time.Second), ExpireAt: now.Add(time.Minute)}, dedupTakeOver},
+		{"claim without lease", DBDedup{ExpireAt: now.Add(time.Minute)}, dedupTakeOver},
+	} {
+		if got := dedupCheck(c.d, now); got != c.want {
+			t.Errorf("%v: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+// dedupEngine returns engine using Firestore emulator, records are stored in separate collection for every test
+func dedupEngine(t *testing.T) *FirestoreEngine {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+	db, err := firestore.NewClient(context.Background(), "gasync-test")
+	if err != nil {
+		t.Fatalf("err creating firestore client: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return &FirestoreEngine{
+		DB:           db,
+		Collection:   "dedup_" + newID(),
+		DedupWindows: map[string]time.Duration{"*": time.Hour},
+	}
+}
+
+func dedupRecord(fs *FirestoreEngine, id, event string, payload []byte) *firestore.DocumentRef {
+	hash := sha256.New()
+	for _, v := range [][]byte{[]byte(id), []byte(event), payload} {
+		hash.Write(v)
+		hash.Write([]byte{0})
+	}
+	return fs.dedupRef(id, hash.Sum(nil))
+}
+
+func TestDedupEvent(t *testing.T) {
+	ctx := context.Background()
+	payload := []byte(`{"Amount":1}`)
+	handle := func(calls *int) func() (interface{}, error) {
+		return func() (interface{}, error) {
+			*calls++
+			return "ok", nil
+		}
+	}
+	t.Run("Duplicate", func(t *testing.T) {
+		fs := dedupEngine(t)
+		calls := 0
+		for i := 0; i < 2; i++ {
+			out, err := fs.dedupEvent(ctx, "wf", "pay", payload, handle(&calls))
+			if err != nil || out != "ok" {
+				t.Fatalf("expected output of the original event, got %v %v", out, err)
+			}
+		}
+		if calls != 1 {
+			t.Fatalf("expected event to be handled once, got %v", calls)
+		}
+	})
+	t.Run("InFlight", func(t *testing.T) {
+		fs := dedupEngine(t)
+		_, err := dedupRecord(fs, "wf", "pay", payload).Set(ctx, DBDedup{
+			WorkflowID:  "wf",
+			Event:       "pay",
+			ClaimedTill: time.Now().Add(time.Minute),
+			ExpireAt:    time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls := 0
+		_, err = fs.dedupEvent(ctx, "wf", "pay", payload, handle(&calls))
+		if !errors.Is(err, ErrDuplicateInFlight) || calls != 0 {
+			t.Fatalf("expected ErrDuplicateInFlight without handling, got %v, %v calls", err, calls)
+		}
+	})
+	for name, d := range map[string]DBDedup{
+		"TakeOverAbandoned": {ClaimedTill: time.Now().Add(-time.Second), ExpireAt: time.Now().Add(time.Hour)},
+		"TakeOverExpired":   {Done: true, Output: "old", ExpireAt: time.Now().Add(-time.Second)},
+	} {
+		d := d
+		t.Run(name, func(t *testing.T) {
+			fs := dedupEngine(t)
+			ref := dedupRecord(fs, "wf", "pay", payload)
+			_, err := ref.Set(ctx, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			calls := 0
+			out, err := fs.dedupEvent(ctx, "wf", "pay", payload, handle(&calls))
+			if err != nil || out != "ok" || calls != 1 {
+				t.Fatalf("expected event to be handled, got %v %v, %v calls", out, err, calls)
+			}
+			doc, err := ref.Get(ctx)
+			if err != nil {
+				t.Fatalf("dedup record should be kept after takeover: %v", err)
+			}
+			var after DBDedup
+			err = doc.DataTo(&after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !after.Done || !after.ExpireAt.After(time.Now()) {
+				t.Fatalf("expected record to be done within new window, got %+v", after)
+			}
+		})
+	}
+}
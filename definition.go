@@ -0,0 +1,146 @@
+package gasync
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gorchestrate/async"
+)
+
+// StepMeta describes workflow step for UIs
+type StepMeta struct {
+	Name   string
+	Type   string   // step, wait_cond or wait_events
+	Events []string `json:",omitempty"` // events step is waiting for
+}
+
+// definitionMeta returns metadata of steps in definition order
+func definitionMeta(def async.Section) []StepMeta {
+	ret := []StepMeta{}
+	_, _ = async.Walk(def, func(s async.Stmt) bool {
+		switch x := s.(type) {
+		case async.StmtStep:
+			ret = append(ret, StepMeta{Name: x.Name, Type: "step"})
+		case async.WaitCondStmt:
+			ret = append(ret, StepMeta{Name: x.Name, Type: "wait_cond"})
+		case async.WaitEventsStmt:
+			m := StepMeta{Name: x.Name, Type: "wait_events"}
+			for _, c := range x.Cases {
+				m.Events = append(m.Events, c.Callback.Name)
+			}
+			ret = append(ret, m)
+		}
+		return false
+	})
+	return ret
+}
+
+// exampleState generates example of initial workflow state.
+// Values set by workflow constructor are used first, then `jsonschema:"default=..."` and `jsonschema:"example=..."` tags.
+func exampleState(state interface{}) interface{} {
+	return example(reflect.ValueOf(state))
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func example(v reflect.Value) interface{} {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			if v.Kind() == reflect.Interface {
+				return nil
+			}
+			v = reflect.New(v.Type().Elem()).Elem()
+			continue
+		}
+		v = v.Elem()
+	}
+	if v.Type() == timeType {
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		ret := map[string]interface{}{}
+		exampleFields(v, ret)
+		return ret
+	case reflect.Slice, reflect.Array:
+		ret := []interface{}{}
+		for i := 0; i < v.Len(); i++ {
+			ret = append(ret, example(v.Index(i)))
+		}
+		return ret
+	case reflect.Map:
+		if v.IsNil() {
+			return map[string]interface{}{}
+		}
+		return v.Interface()
+	case reflect.Func, reflect.Chan:
+		return nil
+	}
+	return v.Interface()
+}
+
+func exampleFields(v reflect.Value, ret map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue // unexported
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+		fv := v.Field(i)
+		if f.Anonymous && f.Tag.Get("json") == "" && reflect.Indirect(fv).Kind() == reflect.Struct {
+			if fv.Kind() == reflect.Ptr && fv.IsNil() {
+				fv = reflect.New(f.Type.Elem())
+			}
+			exampleFields(reflect.Indirect(fv), ret)
+			continue
+		}
+		if f.PkgPath != "" || f.Type.Kind() == reflect.Func || f.Type.Kind() == reflect.Chan {
+			continue
+		}
+		if fv.IsZero() {
+			if val, ok := tagExample(f.Tag.Get("jsonschema")); ok {
+				ret[name] = val
+				continue
+			}
+		}
+		ret[name] = example(fv)
+	}
+}
+
+// tagExample returns default or example value specified in jsonschema tag
+func tagExample(tag string) (interface{}, bool) {
+	var ex string
+	found := false
+	for _, part := range strings.Split(tag, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if kv[0] == "default" {
+			ex, found = kv[1], true
+			break
+		}
+		if kv[0] == "example" && !found {
+			ex, found = kv[1], true
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	var val interface{}
+	if json.Unmarshal([]byte(ex), &val) == nil {
+		return val, true // numbers and booleans
+	}
+	return ex, true
+}
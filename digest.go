@@ -0,0 +1,265 @@
+package gasync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorchestrate/async"
+	"google.golang.org/api/iterator"
+)
+
+// Digest periodically posts counts of running, stuck and failed workflows per type to Targets.
+// Only one instance sends digests - leadership is held via lease document in Firestore, same as for Reaper.
+type Digest struct {
+	Engine     *FirestoreEngine
+	Schedule   string        // cron expression in UTC, i.e. "0 9 * * 1-5"
+	StuckAfter time.Duration // runnable workflows not updated for this long are reported as stuck, 10 minutes by default
+	Targets    []DigestTarget
+	HolderID   string // unique id of this instance
+}
+
+// DigestCounts are counts of active workflows of one type
+type DigestCounts struct {
+	Running int
+	Stuck   int // runnable, but not updated for StuckAfter
+	Failed  int // quarantined after panics
+}
+
+// DigestReport is sent to digest targets
+type DigestReport struct {
+	Time      time.Time
+	Workflows map[string]DigestCounts
+}
+
+func (r DigestReport) String() string {
+	names := []string{}
+	for name := range r.Workflows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "Workflow digest %v\n", r.Time.Format(time.RFC3339))
+	if len(names) == 0 {
+		b.WriteString("no active workflows\n")
+	}
+	for _, name := range names {
+		c := r.Workflows[name]
+		fmt.Fprintf(&b, "%v: %v running, %v stuck, %v failed\n", name, c.Running, c.Stuck, c.Failed)
+	}
+	return b.String()
+}
+
+// DigestTarget delivers digest reports
+type DigestTarget interface {
+	Send(ctx context.Context, r DigestReport) error
+}
+
+// WebhookTarget posts digest report as json
+type WebhookTarget struct {
+	URL string
+}
+
+func (t WebhookTarget) Send(ctx context.Context, r DigestReport) error {
+	return postJSON(ctx, t.URL, r)
+}
+
+// SlackTarget posts digest to Slack incoming webhook
+type SlackTarget struct {
+	WebhookURL string
+}
+
+func (t SlackTarget) Send(ctx context.Context, r DigestReport) error {
+	return postJSON(ctx, t.WebhookURL, map[string]string{"text": "```" + r.String() + "```"})
+}
+
+// EmailTarget sends digest via SMTP
+type EmailTarget struct {
+	Addr string // host:port of SMTP server
+	Auth smtp.Auth
+	From string
+	To   []string
+}
+
+func (t EmailTarget) Send(ctx context.Context, r DigestReport) error {
+	msg := fmt.Sprintf("From: %v\r\nTo: %v\r\nSubject: Workflow digest\r\n\r\n%v", t.From, strings.Join(t.To, ", "), strings.ReplaceAll(r.String(), "\n", "\r\n"))
+	return smtp.SendMail(t.Addr, t.Auth, t.From, t.To, []byte(msg))
+}
+
+func postJSON(ctx context.Context, url string, body interface{}) error {
+	d, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(d))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// Run blocks and sends digests on schedule while this instance holds the lease.
+func (d *Digest) Run(ctx context.Context) error {
+	sched, err := parseCron(d.Schedule)
+	if err != nil {
+		return fmt.Errorf("err parsing digest schedule: %v", err)
+	}
+	if d.HolderID == "" {
+		d.HolderID = newID()
+	}
+	for {
+		now := time.Now().UTC()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		}
+		now = time.Now().UTC().Truncate(time.Minute)
+		if !sched.match(now) {
+			continue
+		}
+		leader, err := acquireLease(ctx, d.Engine, "digest", d.HolderID, time.Minute*3)
+		if err != nil {
+			log.Printf("digest: err acquiring lease: %v", err)
+		}
+		if !leader {
+			continue
+		}
+		err = d.Send(ctx)
+		if err != nil {
+			log.Printf("digest: %v", err)
+		}
+	}
+}
+
+// Send collects report and sends it to all targets
+func (d *Digest) Send(ctx context.Context) error {
+	r, err := d.Report(ctx)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, t := range d.Targets {
+		err := t.Send(ctx, r)
+		if err != nil {
+			log.Printf("digest: err sending to %T: %v", t, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("digest was not sent to %v of %v targets", failed, len(d.Targets))
+	}
+	return nil
+}
+
+// Report counts active workflows per type
+func (d *Digest) Report(ctx context.Context) (DigestReport, error) {
+	defer logTime("digest report")()
+	stuckAfter := d.StuckAfter
+	if stuckAfter == 0 {
+		stuckAfter = time.Minute * 10
+	}
+	r := DigestReport{Time: time.Now(), Workflows: map[string]DigestCounts{}}
+	it := d.Engine.DB.Collection(d.Engine.Collection).
+		Where("Meta.Status", "in", []string{string(async.WorkflowResuming), string(async.WorkflowWaiting)}).
+		Select("Meta", "Quarantined").
+		Documents(ctx)
+	defer it.Stop()
+	for {
+		doc, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return r, fmt.Errorf("err scanning workflows: %v", err)
+		}
+		var wf DBWorkflow
+		err = doc.DataTo(&wf)
+		if err != nil {
+			return r, fmt.Errorf("err unmarshaling workflow %v: %v", doc.Ref.ID, err)
+		}
+		c := r.Workflows[wf.Meta.Workflow]
+		switch {
+		case wf.Quarantined:
+			c.Failed++
+		case runnable(wf.Meta) && time.Since(doc.UpdateTime) > stuckAfter:
+			c.Stuck++
+		default:
+			c.Running++
+		}
+		r.Workflows[wf.Meta.Workflow] = c
+	}
+	return r, nil
+}
+
+// cronSchedule is a parsed 5-field cron expression: minute, hour, day of month, month, day of week
+type cronSchedule [5]map[int]bool
+
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+func parseCron(expr string) (cronSchedule, error) {
+	var s cronSchedule
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return s, fmt.Errorf("expected 5 fields in %q", expr)
+	}
+	for i, f := range fields {
+		s[i] = map[int]bool{}
+		for _, part := range strings.Split(f, ",") {
+			step := 1
+			if p := strings.SplitN(part, "/", 2); len(p) == 2 {
+				var err error
+				step, err = strconv.Atoi(p[1])
+				if err != nil || step <= 0 {
+					return s, fmt.Errorf("invalid step in %q", part)
+				}
+				part = p[0]
+			}
+			lo, hi := cronRanges[i][0], cronRanges[i][1]
+			if part != "*" {
+				bounds := strings.SplitN(part, "-", 2)
+				var err error
+				lo, err = strconv.Atoi(bounds[0])
+				if err != nil {
+					return s, fmt.Errorf("invalid value %q", part)
+				}
+				hi = lo
+				if len(bounds) == 2 {
+					hi, err = strconv.Atoi(bounds[1])
+					if err != nil {
+						return s, fmt.Errorf("invalid range %q", part)
+					}
+				}
+			}
+			if lo < cronRanges[i][0] || hi > cronRanges[i][1] || lo > hi {
+				return s, fmt.Errorf("%q is out of range", part)
+			}
+			for v := lo; v <= hi; v += step {
+				s[i][v] = true
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s cronSchedule) match(t time.Time) bool {
+	return s[0][t.Minute()] && s[1][t.Hour()] && s[2][t.Day()] && s[3][int(t.Month())] && s[4][int(t.Weekday())]
+}
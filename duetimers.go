@@ -0,0 +1,296 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DueTimers is a Scheduler that persists resumes and timers in Firestore instead of Cloud Tasks.
+// Nothing is delivered until RunDueTimers is called, i.e. by Kubernetes CronJob calling POST /timers/run,
+// so timer precision is limited by cron interval.
+type DueTimers struct {
+	Engine     CallbackEngine
+	DB         *firestore.Client // DB of FirestoreEngine by default
+	Collection string            // Collection+"_timers" of FirestoreEngine by default, required for other engines
+	BatchSize  int               // timers fired by single RunDueTimers call, 500 by default
+	Lease      time.Duration     // timer is not fired by other runs while it's processed, 1 minute by default
+
+	// MaxAttempts is the number of attempts to fire a timer, DefaultTimerMaxAttempts by default.
+	// Timers exceeding it are moved to Collection+"_dead", so that they don't block newer timers.
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound exponential delay between attempts, 10s and 1h by default
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultTimerMaxAttempts is the number of attempts to fire a timer before it's dead-lettered
+const DefaultTimerMaxAttempts = 10
+
+// DBDueTimer is a resume or callback that should be delivered at Due time
+type DBDueTimer struct {
+	WorkflowID string
+	Priority   int
+	Callback   *async.CallbackRequest // nil for resumes
+	Due        time.Time
+	LeaseTill  time.Time
+	Attempts   int    // failed attempts
+	LastError  string // error of the last failed attempt
+}
+
+// DueTimerData is setup data of callbacks scheduled by DueTimers
+type DueTimerData struct {
+	TimerID string
+}
+
+// DueTimersStats describes single RunDueTimers call
+type DueTimersStats struct {
+	Fired        int
+	Failed       int // retried after backoff
+	DeadLettered int // failed too many times
+	Duration     time.Duration
+}
+
+// firestoreEngine returns engine if it's FirestoreEngine, defaults are taken from it
+func (t *DueTimers) firestoreEngine() *FirestoreEngine {
+	switch e := t.Engine.(type) {
+	case *FirestoreEngine:
+		return e
+	case FirestoreEngine:
+		return &e
+	}
+	return nil
+}
+
+func (t *DueTimers) db() *firestore.Client {
+	if t.DB != nil {
+		return t.DB
+	}
+	return t.firestoreEngine().DB
+}
+
+func (t *DueTimers) colName() string {
+	if t.Collection != "" {
+		return t.Collection
+	}
+	return t.firestoreEngine().Collection + "_timers"
+}
+
+func (t *DueTimers) col() *firestore.CollectionRef {
+	return t.db().Collection(t.colName())
+}
+
+// deadCol stores timers that failed MaxAttempts times, they can be inspected and re-added manually
+func (t *DueTimers) deadCol() *firestore.CollectionRef {
+	return t.db().Collection(t.colName() + "_dead")
+}
+
+// backoff returns delay before the next attempt of the timer that failed n times
+func (t *DueTimers) backoff(n int) time.Duration {
+	min, max := t.MinBackoff, t.MaxBackoff
+	if min <= 0 {
+		min = time.Second * 10
+	}
+	if max <= 0 {
+		max = time.Hour
+	}
+	d := min
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (t *DueTimers) Schedule(ctx context.Context, id string, delay time.Duration) error {
+	return t.ScheduleWithPriority(ctx, id, delay, 0)
+}
+
+func (t *DueTimers) ScheduleWithPriority(ctx context.Context, id string, delay time.Duration, priority int) error {
+	defer logTime("schedule")()
+	_, _, err := t.col().Add(ctx, DBDueTimer{
+		WorkflowID: id,
+		Priority:   priority,
+		Due:        time.Now().Add(delay),
+	})
+	if err != nil {
+		return fmt.Errorf("err scheduling resume: %v", err)
+	}
+	return nil
+}
+
+func (t *DueTimers) ScheduleBatch(ctx context.Context, ids []string) error {
+	return scheduleBatch(ctx, ids, DefaultBatchParallelism, func(ctx context.Context, id string) error {
+		return t.Schedule(ctx, id, 0)
+	})
+}
+
+// Setup persists callback that will be delivered after the delay, i.e. timeout
+func (t *DueTimers) Setup(ctx context.Context, req async.CallbackRequest, delay time.Duration) (string, error) {
+	ref, _, err := t.col().Add(ctx, DBDueTimer{
+		WorkflowID: req.WorkflowID,
+		Callback:   &req,
+		Due:        time.Now().Add(delay),
+	})
+	if err != nil {
+		return "", fmt.Errorf("err creating timer: %v", err)
+	}
+	d, err := json.Marshal(DueTimerData{TimerID: ref.ID})
+	return string(d), err
+}
+
+func (t *DueTimers) Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error {
+	if handled {
+		return nil
+	}
+	var data DueTimerData
+	err := json.Unmarshal([]byte(req.SetupData), &data)
+	if err != nil {
+		return err
+	}
+	if data.TimerID == "" {
+		return nil
+	}
+	_, err = t.col().Doc(data.TimerID).Delete(ctx)
+	if err != nil {
+		log.Printf("delete timer err: %v", err)
+	}
+	return nil
+}
+
+// RunDueTimers fires timers that are due. Timers that fail are retried with exponential backoff
+// and dead-lettered after MaxAttempts.
+// It's safe to call it concurrently - timers are leased before firing.
+func (t *DueTimers) RunDueTimers(ctx context.Context) (DueTimersStats, error) {
+	defer logTime("run due timers")()
+	start := time.Now()
+	stats := DueTimersStats{}
+	batch := t.BatchSize
+	if batch <= 0 {
+		batch = 500
+	}
+	it := t.col().Where("Due", "<=", time.Now()).OrderBy("Due", firestore.Asc).Limit(batch).Documents(ctx)
+	defer it.Stop()
+	for {
+		doc, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("err listing due timers: %v", err)
+		}
+		var timer DBDueTimer
+		err = doc.DataTo(&timer)
+		if err != nil {
+			return stats, fmt.Errorf("err unmarshaling timer %v: %v", doc.Ref.ID, err)
+		}
+		if time.Now().Before(timer.LeaseTill) {
+			continue // processed by another run
+		}
+		ok, err := t.lease(ctx, doc)
+		if err != nil {
+			return stats, err
+		}
+		if !ok {
+			continue
+		}
+		err = t.fire(asCallback(ctx), timer)
+		if err != nil {
+			log.Printf("due timers: err firing timer %v of workflow %v: %v", doc.Ref.ID, timer.WorkflowID, err)
+			dead, fErr := t.failed(ctx, doc.Ref, timer, err)
+			if fErr != nil {
+				log.Printf("due timers: err recording failure of timer %v: %v", doc.Ref.ID, fErr)
+			}
+			if dead {
+				stats.DeadLettered++
+			} else {
+				stats.Failed++
+			}
+			continue
+		}
+		_, err = doc.Ref.Delete(ctx)
+		if err != nil {
+			log.Printf("due timers: err deleting timer %v: %v", doc.Ref.ID, err)
+		}
+		stats.Fired++
+	}
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+// lease marks timer as processed, returns false if it was leased concurrently
+func (t *DueTimers) lease(ctx context.Context, doc *firestore.DocumentSnapshot) (bool, error) {
+	lease := t.Lease
+	if lease <= 0 {
+		lease = time.Minute
+	}
+	_, err := doc.Ref.Update(ctx, []firestore.Update{
+		{Path: "LeaseTill", Value: time.Now().Add(lease)},
+	}, firestore.LastUpdateTime(doc.UpdateTime))
+	switch status.Code(err) {
+	case codes.OK:
+		return true, nil
+	case codes.FailedPrecondition, codes.NotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("err leasing timer: %v", err)
+}
+
+// failed reschedules timer after backoff or moves it to dead-letter collection
+func (t *DueTimers) failed(ctx context.Context, ref *firestore.DocumentRef, timer DBDueTimer, fireErr error) (bool, error) {
+	max := t.MaxAttempts
+	if max <= 0 {
+		max = DefaultTimerMaxAttempts
+	}
+	timer.Attempts++
+	timer.LastError = fireErr.Error()
+	timer.LeaseTill = time.Time{}
+	if timer.Attempts >= max {
+		log.Printf("due timers: timer %v of workflow %v failed %v times, dead-lettering", ref.ID, timer.WorkflowID, timer.Attempts)
+		b := t.db().Batch()
+		b.Set(t.deadCol().Doc(ref.ID), timer)
+		b.Delete(ref)
+		_, err := b.Commit(ctx)
+		return true, err
+	}
+	_, err := ref.Update(ctx, []firestore.Update{
+		{Path: "Attempts", Value: timer.Attempts},
+		{Path: "LastError", Value: timer.LastError},
+		{Path: "Due", Value: time.Now().Add(t.backoff(timer.Attempts))},
+		{Path: "LeaseTill", Value: time.Time{}},
+	})
+	return false, err
+}
+
+func (t *DueTimers) fire(ctx context.Context, timer DBDueTimer) error {
+	var err error
+	if timer.Callback == nil {
+		err = t.Engine.Resume(ctx, timer.WorkflowID)
+	} else {
+		_, err = t.Engine.HandleCallback(ctx, timer.WorkflowID, *timer.Callback, nil)
+	}
+	switch {
+	case errors.Is(err, ErrPollPending):
+		return nil // next poll is scheduled
+	case errors.Is(err, ErrQuarantined), errors.Is(err, ErrEventQuarantined):
+		log.Printf("due timers: skipping quarantined workflow %v", timer.WorkflowID)
+		return nil
+	case errors.Is(err, ErrNotFound), status.Code(err) == codes.NotFound:
+		return nil // workflow was deleted
+	case errors.Is(err, ErrStaleCallback):
+		log.Printf("due timers: skipping stale callback of workflow %v: %v", timer.WorkflowID, err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package gasync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EffectKey identifies side effect of the workflow. Effects in loops need different Key for each iteration.
+type EffectKey struct {
+	WorkflowID string
+	Key        string
+}
+
+// EffectMarker is persisted before side effect is executed. Stored in Collection+"_effects".
+// Status is "started" until side effect succeeds, so "started" marker of the workflow that was retried
+// means that side effect may or may not have happened and should be checked manually.
+type EffectMarker struct {
+	WorkflowID string
+	Step       string
+	Key        string
+	Status     string // started or done
+	Started    time.Time
+	Finished   time.Time
+}
+
+func (fs FirestoreEngine) effects() *firestore.CollectionRef {
+	return fs.DB.Collection(fs.Collection + "_effects")
+}
+
+func effectID(step string, k EffectKey) string {
+	h := sha256.Sum256([]byte(k.WorkflowID + "/" + step + "/" + k.Key))
+	return hex.EncodeToString(h[:16])
+}
+
+// Exactly creates step executing side effect at most once, i.e. charging a card.
+// Marker is persisted before action runs, so if workflow is retried after crash - action is skipped.
+// Marker is removed if action returns error, so that failed actions can be retried.
+func (s *Server) Exactly(name string, key func() EffectKey, action func() error) async.StmtStep {
+	return async.Step(name, func() error {
+		return s.Engine.exactly(context.Background(), name, key(), action)
+	})
+}
+
+func (fs FirestoreEngine) exactly(ctx context.Context, step string, k EffectKey, action func() error) error {
+	ref := fs.effects().Doc(effectID(step, k))
+	_, err := ref.Create(ctx, EffectMarker{
+		WorkflowID: k.WorkflowID,
+		Step:       step,
+		Key:        k.Key,
+		Status:     "started",
+		Started:    time.Now(),
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		log.Printf("side effect %v of workflow %v was already executed, skipping", step, k.WorkflowID)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("err saving effect marker: %v", err)
+	}
+	err = action()
+	if err != nil {
+		if _, dErr := ref.Delete(ctx); dErr != nil {
+			log.Printf("err removing marker of failed effect %v: %v", step, dErr)
+		}
+		return err
+	}
+	_, err = ref.Update(ctx, []firestore.Update{
+		{Path: "Status", Value: "done"},
+		{Path: "Finished", Value: time.Now()},
+	})
+	if err != nil {
+		// side effect happened, so step should not fail
+		log.Printf("err marking effect %v as done: %v", step, err)
+	}
+	return nil
+}
+
+// Effects returns side effect markers of the workflow, oldest first
+func (fs FirestoreEngine) Effects(ctx context.Context, id string) ([]EffectMarker, error) {
+	docs, err := fs.effects().Where("WorkflowID", "==", id).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	ret := []EffectMarker{}
+	for _, d := range docs {
+		var m EffectMarker
+		err = d.DataTo(&m)
+		if err != nil {
+			return nil, fmt.Errorf("err unmarshaling effect marker: %v", err)
+		}
+		ret = append(ret, m)
+	}
+	// sorted here to avoid composite index on WorkflowID and Started
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Started.Before(ret[j].Started) })
+	return ret, nil
+}
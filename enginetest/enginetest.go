@@ -0,0 +1,344 @@
+// Package enginetest is a conformance suite for Engine, Scheduler and TimerScheduler implementations.
+//
+//	func TestEngine(t *testing.T) {
+//		enginetest.Run(t, func(t *testing.T, workflows gasync.Registry) gasync.Engine {
+//			return &MyEngine{Workflows: workflows, Table: "test_" + strings.ReplaceAll(t.Name(), "/", "_")}
+//		})
+//	}
+//
+// Suites run against real backends, so they are slow and should be excluded from -short runs if needed.
+package enginetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorchestrate/async"
+	"github.com/gorchestrate/gasync"
+)
+
+// DeliveryTimeout is how long suites wait for workflows to finish and callbacks to be delivered
+var DeliveryTimeout = time.Minute
+
+// LockTimeout is how long locks of crashed processes may be held. Lock expiry is tested only if it's set.
+// FirestoreEngine holds locks for a minute.
+var LockTimeout = time.Duration(0)
+
+// WorkflowName is a name of the workflow registered by the suite
+const WorkflowName = "enginetest"
+
+// Workflow executes first step, waits for Events in parallel threads and executes last step.
+// Workflow is finished only if all events were saved - lost updates of concurrent events leave it waiting.
+type Workflow struct {
+	Events   int
+	Received []string
+	Started  int // executions of the first step
+	Finished int // executions of the last step
+}
+
+// Event is an input of Workflow events
+type Event struct {
+	Name string
+}
+
+func eventName(i int) string {
+	return fmt.Sprintf("event%d", i)
+}
+
+func (wf *Workflow) Definition() async.Section {
+	events := async.Section{}
+	for i := 0; i < wf.Events; i++ {
+		events = append(events, async.Go(fmt.Sprintf("thread %d", i),
+			async.Wait(fmt.Sprintf("wait %d", i),
+				async.OnEvent(eventName(i), func(in Event) (Event, error) {
+					wf.Received = append(wf.Received, in.Name)
+					return in, nil
+				}),
+			),
+		))
+	}
+	return async.S(
+		async.Step("start", func() error {
+			wf.Started++
+			return nil
+		}),
+		events,
+		async.WaitFor("all events received", len(wf.Received) >= wf.Events, func() {}),
+		async.Step("finish", func() error {
+			wf.Finished++
+			return nil
+		}),
+	)
+}
+
+// Factory creates engine under test that resumes workflows of the registry.
+// Each call should use separate storage or namespace, since suite doesn't clean up created workflows.
+type Factory func(t *testing.T, workflows gasync.Registry) gasync.Engine
+
+func newID() string {
+	return fmt.Sprintf("enginetest-%x", time.Now().UnixNano())
+}
+
+func eventually(t *testing.T, msg string, f func() (bool, error)) {
+	t.Helper()
+	deadline := time.Now().Add(DeliveryTimeout)
+	for {
+		ok, err := f()
+		if err != nil {
+			t.Fatalf("%v: %v", msg, err)
+		}
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v: not done within %v", msg, DeliveryTimeout)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func getState(ctx context.Context, e gasync.Engine, id string) (Workflow, error) {
+	var wf Workflow
+	s, err := e.GetState(ctx, id)
+	if err != nil {
+		return wf, err
+	}
+	d, err := json.Marshal(s)
+	if err != nil {
+		return wf, err
+	}
+	err = json.Unmarshal(d, &wf)
+	return wf, err
+}
+
+func create(t *testing.T, e gasync.Engine, events int) string {
+	t.Helper()
+	id := newID()
+	err := e.ScheduleAndCreate(context.Background(), id, WorkflowName, &Workflow{Events: events}, gasync.CreateOptions{})
+	if err != nil {
+		t.Fatalf("err creating workflow: %v", err)
+	}
+	return id
+}
+
+func sendEvent(ctx context.Context, e gasync.Engine, id string, i int) error {
+	d, err := json.Marshal(Event{Name: eventName(i)})
+	if err != nil {
+		return err
+	}
+	_, err = e.HandleEvent(ctx, id, eventName(i), d)
+	return err
+}
+
+// waitFinished resumes workflow until it's finished. Resumes scheduled by engine itself may run concurrently.
+func waitFinished(t *testing.T, e gasync.Engine, id string) Workflow {
+	t.Helper()
+	ctx := context.Background()
+	eventually(t, "workflow is finished", func() (bool, error) {
+		err := e.Resume(gasync.WithoutLockWait(ctx), id)
+		if err != nil && !errors.Is(err, gasync.ErrLocked) {
+			return false, err
+		}
+		wf, err := e.Get(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		return wf.Meta.Status == async.WorkflowFinished, nil
+	})
+	wf, err := getState(ctx, e, id)
+	if err != nil {
+		t.Fatalf("err getting state: %v", err)
+	}
+	return wf
+}
+
+// Run runs engine conformance suite
+func Run(t *testing.T, newEngine Factory) {
+	registry := gasync.NewWorkflowRegistry(map[string]func() async.WorkflowState{
+		WorkflowName: func() async.WorkflowState {
+			return &Workflow{}
+		},
+	})
+	t.Run("Create", func(t *testing.T) {
+		e := newEngine(t, registry)
+		id := create(t, e, 0)
+		wf, err := e.Get(context.Background(), id)
+		if err != nil {
+			t.Fatalf("err getting workflow: %v", err)
+		}
+		if wf.Meta.ID != id || wf.Meta.Workflow != WorkflowName {
+			t.Fatalf("expected workflow %v/%v, got %v/%v", WorkflowName, id, wf.Meta.Workflow, wf.Meta.ID)
+		}
+		s := waitFinished(t, e, id)
+		if s.Started != 1 || s.Finished != 1 {
+			t.Fatalf("expected steps to be executed once, got start=%v finish=%v", s.Started, s.Finished)
+		}
+		err = e.ScheduleAndCreate(context.Background(), id, WorkflowName, &Workflow{}, gasync.CreateOptions{})
+		if !errors.Is(err, gasync.ErrAlreadyExists) {
+			t.Fatalf("expected ErrAlreadyExists for duplicate workflow, got %v", err)
+		}
+	})
+	t.Run("GetNotFound", func(t *testing.T) {
+		e := newEngine(t, registry)
+		_, err := e.Get(context.Background(), newID())
+		if err == nil {
+			t.Fatal("expected error for missing workflow")
+		}
+	})
+	t.Run("Lock", func(t *testing.T) {
+		e := newEngine(t, registry)
+		id := create(t, e, 1)
+		ctx := context.Background()
+		_, err := e.Lock(ctx, id)
+		if err != nil {
+			t.Fatalf("err locking: %v", err)
+		}
+		_, err = e.Lock(gasync.WithoutLockWait(ctx), id)
+		if !errors.Is(err, gasync.ErrLocked) {
+			t.Fatalf("expected ErrLocked for locked workflow, got %v", err)
+		}
+		err = e.Unlock(ctx, id)
+		if err != nil {
+			t.Fatalf("err unlocking: %v", err)
+		}
+		_, err = e.Lock(gasync.WithoutLockWait(ctx), id)
+		if err != nil {
+			t.Fatalf("err locking unlocked workflow: %v", err)
+		}
+		_ = e.Unlock(ctx, id)
+	})
+	t.Run("MutualExclusion", func(t *testing.T) {
+		e := newEngine(t, registry)
+		id := create(t, e, 1)
+		var holders, violations int32
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := e.Lock(context.Background(), id)
+				if err != nil {
+					t.Errorf("err locking: %v", err)
+					return
+				}
+				if atomic.AddInt32(&holders, 1) > 1 {
+					atomic.AddInt32(&violations, 1)
+				}
+				time.Sleep(time.Millisecond * 50)
+				atomic.AddInt32(&holders, -1)
+				err = e.Unlock(context.Background(), id)
+				if err != nil {
+					t.Errorf("err unlocking: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if violations > 0 {
+			t.Fatalf("lock was held by several callers %v times", violations)
+		}
+	})
+	t.Run("ConcurrentEvents", func(t *testing.T) {
+		e := newEngine(t, registry)
+		const events = 5
+		id := create(t, e, events)
+		var wg sync.WaitGroup
+		for i := 0; i < events; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				err := sendEvent(context.Background(), e, id, i)
+				if err != nil {
+					t.Errorf("err handling event %v: %v", i, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		s := waitFinished(t, e, id)
+		if len(s.Received) != events {
+			t.Fatalf("expected %v events to be saved, got %v", events, s.Received)
+		}
+	})
+	t.Run("UnexpectedEvent", func(t *testing.T) {
+		e := newEngine(t, registry)
+		id := create(t, e, 1)
+		d, _ := json.Marshal(Event{Name: "unknown"})
+		_, err := e.HandleEvent(context.Background(), id, "unknown", d)
+		if err == nil {
+			t.Fatal("expected error for event workflow is not waiting for")
+		}
+		err = sendEvent(context.Background(), e, id, 0)
+		if err != nil {
+			t.Fatalf("workflow should stay unlocked after failed event: %v", err)
+		}
+	})
+	t.Run("RecoverLostResume", func(t *testing.T) {
+		// event was saved, but process crashed before resume was scheduled
+		e := newEngine(t, registry)
+		id := create(t, e, 1)
+		err := sendEvent(gasync.WithoutSchedule(context.Background()), e, id, 0)
+		if err != nil {
+			t.Fatalf("err handling event: %v", err)
+		}
+		before, err := getState(context.Background(), e, id)
+		if err != nil {
+			t.Fatalf("err getting state: %v", err)
+		}
+		if len(before.Received) != 1 {
+			t.Fatalf("expected event to be saved, got %v", before.Received)
+		}
+		// resumed by Reaper
+		waitFinished(t, e, id)
+		// resumes delivered more than once don't execute steps again
+		for i := 0; i < 2; i++ {
+			err = e.Resume(context.Background(), id)
+			if err != nil {
+				t.Fatalf("err resuming finished workflow: %v", err)
+			}
+		}
+		after, err := getState(context.Background(), e, id)
+		if err != nil {
+			t.Fatalf("err getting state: %v", err)
+		}
+		if after.Started != 1 || after.Finished != 1 {
+			t.Fatalf("expected steps to be executed once, got start=%v finish=%v", after.Started, after.Finished)
+		}
+	})
+	t.Run("RecoverExpiredLock", func(t *testing.T) {
+		// process crashed while holding the lock
+		if LockTimeout == 0 {
+			t.Skip("LockTimeout is not set")
+		}
+		e := newEngine(t, registry)
+		id := create(t, e, 1)
+		_, err := e.Lock(context.Background(), id)
+		if err != nil {
+			t.Fatalf("err locking: %v", err)
+		}
+		start := time.Now()
+		for {
+			_, err = e.Lock(gasync.WithoutLockWait(context.Background()), id)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, gasync.ErrLocked) {
+				t.Fatalf("err locking: %v", err)
+			}
+			if time.Since(start) > LockTimeout+DeliveryTimeout {
+				t.Fatalf("lock is not expired after %v", time.Since(start))
+			}
+			time.Sleep(time.Second)
+		}
+		_ = e.Unlock(context.Background(), id)
+		err = sendEvent(context.Background(), e, id, 0)
+		if err != nil {
+			t.Fatalf("err handling event after lock expired: %v", err)
+		}
+		waitFinished(t, e, id)
+	})
+}
@@ -0,0 +1,118 @@
+package enginetest_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"github.com/gorchestrate/gasync"
+	"github.com/gorchestrate/gasync/enginetest"
+)
+
+// suites run against Firestore emulator:
+//
+//	gcloud emulators firestore start --host-port=localhost:8080
+//	FIRESTORE_EMULATOR_HOST=localhost:8080 go test ./enginetest
+func emulator(t *testing.T) *firestore.Client {
+	t.Helper()
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+	db, err := firestore.NewClient(context.Background(), "gasync-test")
+	if err != nil {
+		t.Fatalf("err creating firestore client: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func collection(t *testing.T) string {
+	return "enginetest_" + strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()) + "_" + time.Now().Format("150405.000")
+}
+
+// delivered records resumes and callbacks fired by DueTimers instead of applying them
+type delivered struct {
+	gasync.CallbackEngine
+	resume   func(ctx context.Context, id string)
+	callback func(ctx context.Context, req async.CallbackRequest)
+}
+
+func (d delivered) Resume(ctx context.Context, id string) error {
+	d.resume(ctx, id)
+	return nil
+}
+
+func (d delivered) HandleCallback(ctx context.Context, id string, cb async.CallbackRequest, input interface{}) (interface{}, error) {
+	d.callback(ctx, cb)
+	return nil, nil
+}
+
+// runDueTimers fires due timers until the test is finished, as CronJob calling POST /timers/run does
+func runDueTimers(t *testing.T, timers *gasync.DueTimers) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			_, err := timers.RunDueTimers(ctx)
+			if err != nil && ctx.Err() == nil {
+				t.Logf("err running due timers: %v", err)
+			}
+			time.Sleep(time.Millisecond * 200)
+		}
+	}()
+}
+
+func TestFirestoreEngine(t *testing.T) {
+	db := emulator(t)
+	enginetest.LockTimeout = time.Minute
+	enginetest.Run(t, func(t *testing.T, workflows gasync.Registry) gasync.Engine {
+		e := &gasync.FirestoreEngine{
+			DB:         db,
+			Collection: collection(t),
+			Workflows:  workflows,
+		}
+		e.Scheduler = &gasync.LocalScheduler{Engine: e}
+		return e
+	})
+}
+
+func TestLocalScheduler(t *testing.T) {
+	enginetest.RunScheduler(t, func(t *testing.T, resume func(ctx context.Context, id string)) gasync.Scheduler {
+		return &gasync.LocalScheduler{Engine: delivered{resume: resume}}
+	})
+}
+
+func TestDueTimersScheduler(t *testing.T) {
+	db := emulator(t)
+	enginetest.RunScheduler(t, func(t *testing.T, resume func(ctx context.Context, id string)) gasync.Scheduler {
+		timers := &gasync.DueTimers{
+			Engine:     delivered{resume: resume},
+			DB:         db,
+			Collection: collection(t),
+		}
+		runDueTimers(t, timers)
+		return timers
+	})
+}
+
+func TestDueTimers(t *testing.T) {
+	db := emulator(t)
+	enginetest.RunTimers(t, func(t *testing.T, deliver func(ctx context.Context, req async.CallbackRequest)) gasync.TimerScheduler {
+		timers := &gasync.DueTimers{
+			Engine:     delivered{callback: deliver},
+			DB:         db,
+			Collection: collection(t),
+		}
+		runDueTimers(t, timers)
+		return timers
+	})
+}
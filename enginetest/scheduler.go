@@ -0,0 +1,179 @@
+package enginetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorchestrate/async"
+	"github.com/gorchestrate/gasync"
+)
+
+// SchedulerFactory creates scheduler under test. Scheduler should call resume for every delivered resume,
+// i.e. via http server handling resume requests.
+type SchedulerFactory func(t *testing.T, resume func(ctx context.Context, id string)) gasync.Scheduler
+
+// TimerFactory creates timer scheduler under test. Scheduler should call deliver for every delivered callback.
+type TimerFactory func(t *testing.T, deliver func(ctx context.Context, req async.CallbackRequest)) gasync.TimerScheduler
+
+// clockSkew is tolerated difference between local clock and clock of the scheduler
+const clockSkew = time.Second
+
+// deliveries records delivery times by id. Delivery is at-least-once, so duplicates are allowed.
+type deliveries struct {
+	mu sync.Mutex
+	at map[string][]time.Time
+}
+
+func newDeliveries() *deliveries {
+	return &deliveries{at: map[string][]time.Time{}}
+}
+
+func (d *deliveries) add(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.at[id] = append(d.at[id], time.Now())
+}
+
+func (d *deliveries) first(id string) (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.at[id]) == 0 {
+		return time.Time{}, false
+	}
+	return d.at[id][0], true
+}
+
+func (d *deliveries) wait(t *testing.T, id string) time.Time {
+	t.Helper()
+	eventually(t, fmt.Sprintf("%v is delivered", id), func() (bool, error) {
+		_, ok := d.first(id)
+		return ok, nil
+	})
+	at, _ := d.first(id)
+	return at
+}
+
+// RunScheduler runs scheduler conformance suite
+func RunScheduler(t *testing.T, newScheduler SchedulerFactory) {
+	t.Run("Schedule", func(t *testing.T) {
+		d := newDeliveries()
+		s := newScheduler(t, func(ctx context.Context, id string) { d.add(id) })
+		id := newID()
+		err := s.Schedule(context.Background(), id, 0)
+		if err != nil {
+			t.Fatalf("err scheduling: %v", err)
+		}
+		d.wait(t, id)
+	})
+	t.Run("Delay", func(t *testing.T) {
+		d := newDeliveries()
+		s := newScheduler(t, func(ctx context.Context, id string) { d.add(id) })
+		id := newID()
+		start := time.Now()
+		delay := time.Second * 3
+		err := s.Schedule(context.Background(), id, delay)
+		if err != nil {
+			t.Fatalf("err scheduling: %v", err)
+		}
+		if at := d.wait(t, id); at.Sub(start) < delay-clockSkew {
+			t.Fatalf("resume is delivered after %v, expected delay %v", at.Sub(start), delay)
+		}
+	})
+	t.Run("Priority", func(t *testing.T) {
+		d := newDeliveries()
+		s := newScheduler(t, func(ctx context.Context, id string) { d.add(id) })
+		ids := []string{}
+		for _, p := range []int{0, 100} {
+			id := newID()
+			err := s.ScheduleWithPriority(context.Background(), id, 0, p)
+			if err != nil {
+				t.Fatalf("err scheduling with priority %v: %v", p, err)
+			}
+			ids = append(ids, id)
+		}
+		for _, id := range ids {
+			d.wait(t, id)
+		}
+	})
+	t.Run("Batch", func(t *testing.T) {
+		d := newDeliveries()
+		s := newScheduler(t, func(ctx context.Context, id string) { d.add(id) })
+		ids := []string{}
+		for i := 0; i < 20; i++ {
+			ids = append(ids, fmt.Sprintf("%v-%d", newID(), i))
+		}
+		err := s.ScheduleBatch(context.Background(), ids)
+		if err != nil {
+			t.Fatalf("err scheduling batch: %v", err)
+		}
+		for _, id := range ids {
+			d.wait(t, id)
+		}
+	})
+}
+
+// timerKey identifies delivered callback by fields set on Setup
+func timerKey(req async.CallbackRequest) string {
+	return fmt.Sprintf("%v/%v/%v/%v", req.WorkflowID, req.ThreadID, req.Name, req.PC)
+}
+
+// RunTimers runs timer scheduler conformance suite
+func RunTimers(t *testing.T, newTimers TimerFactory) {
+	newTimer := func(t *testing.T) (gasync.TimerScheduler, *deliveries, async.CallbackRequest) {
+		d := newDeliveries()
+		s := newTimers(t, func(ctx context.Context, req async.CallbackRequest) {
+			d.add(timerKey(req))
+		})
+		return s, d, async.CallbackRequest{
+			WorkflowID: newID(),
+			ThreadID:   async.MainThread,
+			Name:       "timeout",
+			PC:         3,
+		}
+	}
+	t.Run("Deliver", func(t *testing.T) {
+		s, d, req := newTimer(t)
+		start := time.Now()
+		delay := time.Second * 3
+		_, err := s.Setup(context.Background(), req, delay)
+		if err != nil {
+			t.Fatalf("err setting up timer: %v", err)
+		}
+		if at := d.wait(t, timerKey(req)); at.Sub(start) < delay-clockSkew {
+			t.Fatalf("timer is delivered after %v, expected delay %v", at.Sub(start), delay)
+		}
+	})
+	t.Run("Teardown", func(t *testing.T) {
+		s, d, req := newTimer(t)
+		delay := time.Second * 3
+		data, err := s.Setup(context.Background(), req, delay)
+		if err != nil {
+			t.Fatalf("err setting up timer: %v", err)
+		}
+		req.SetupData = data
+		err = s.Teardown(context.Background(), req, false)
+		if err != nil {
+			t.Fatalf("err tearing down timer: %v", err)
+		}
+		time.Sleep(delay * 3)
+		if _, ok := d.first(timerKey(req)); ok {
+			t.Fatal("timer is delivered after teardown")
+		}
+	})
+	t.Run("TeardownHandled", func(t *testing.T) {
+		s, d, req := newTimer(t)
+		data, err := s.Setup(context.Background(), req, 0)
+		if err != nil {
+			t.Fatalf("err setting up timer: %v", err)
+		}
+		d.wait(t, timerKey(req))
+		req.SetupData = data
+		err = s.Teardown(context.Background(), req, true)
+		if err != nil {
+			t.Fatalf("err tearing down handled timer: %v", err)
+		}
+	})
+}
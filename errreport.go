@@ -0,0 +1,101 @@
+package gasync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"cloud.google.com/go/errorreporting"
+	"github.com/gorchestrate/async"
+)
+
+// ErrorReport describes failure during workflow processing
+type ErrorReport struct {
+	WorkflowID string
+	Workflow   string
+	Step       string // step of the thread that was running, if any
+	Event      string // event or callback that was handled, if any
+	InputHash  string // sha256 of json-encoded input, so that input itself is not leaked into reports
+	Err        error
+}
+
+func (r ErrorReport) Error() string {
+	return fmt.Sprintf("workflow %v (%v) step %q event %q input %v: %v", r.WorkflowID, r.Workflow, r.Step, r.Event, r.InputHash, r.Err)
+}
+
+func (r ErrorReport) Unwrap() error {
+	return r.Err
+}
+
+// ErrorReporter is called whenever workflow resume or event handling fails
+type ErrorReporter interface {
+	Report(ctx context.Context, r ErrorReport)
+}
+
+func inputHash(input interface{}) string {
+	if input == nil {
+		return ""
+	}
+	d, err := json.Marshal(input)
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(d)
+	return hex.EncodeToString(h[:])
+}
+
+func curStep(meta async.State) string {
+	for _, t := range meta.Threads {
+		if t.Status == async.ThreadResuming {
+			return t.CurStep
+		}
+	}
+	if len(meta.Threads) > 0 {
+		return meta.Threads[0].CurStep
+	}
+	return ""
+}
+
+func (fs FirestoreEngine) reportError(ctx context.Context, meta async.State, event string, input interface{}, err error) {
+	r := ErrorReport{
+		WorkflowID: meta.ID,
+		Workflow:   meta.Workflow,
+		Step:       curStep(meta),
+		Event:      event,
+		InputHash:  inputHash(input),
+		Err:        err,
+	}
+	if fs.ErrorReporter == nil {
+		log.Printf("err: %v", r)
+		return
+	}
+	fs.ErrorReporter.Report(ctx, r)
+}
+
+// GoogleErrorReporter sends errors to Google Cloud Error Reporting
+type GoogleErrorReporter struct {
+	C *errorreporting.Client
+}
+
+func NewGoogleErrorReporter(ctx context.Context, projectID, serviceName string) (*GoogleErrorReporter, error) {
+	c, err := errorreporting.NewClient(ctx, projectID, errorreporting.Config{
+		ServiceName: serviceName,
+		OnError: func(err error) {
+			log.Printf("err reporting error: %v", err)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &GoogleErrorReporter{C: c}, nil
+}
+
+func (g *GoogleErrorReporter) Report(ctx context.Context, r ErrorReport) {
+	g.C.Report(errorreporting.Entry{
+		Error: r,
+		User:  r.WorkflowID,
+	})
+}
@@ -0,0 +1,193 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorchestrate/async"
+)
+
+// CallbackScheduler delivers callback to workflow after the delay. GTasksScheduler is used by default.
+type CallbackScheduler interface {
+	Setup(ctx context.Context, req async.CallbackRequest, delay time.Duration) (string, error)
+}
+
+// ParentRef links child workflow created by FanOut to the parent
+type ParentRef struct {
+	ID       string
+	Callback async.CallbackRequest // FanOut event of the parent
+	Index    int
+}
+
+// FanOutHandler spawns N child workflows and continues parent once all of them (or Quorum) are finished.
+type FanOutHandler struct {
+	N       int
+	Child   string                          // workflow name of children
+	Init    func(i int) async.WorkflowState // initial state of i-th child. Registered workflow factory is used by default
+	Quorum  int                             // number of finished children needed to continue. All children by default
+	Results *[]json.RawMessage              // states of finished children, ordered by index. Unfinished children are null
+
+	engine *FirestoreEngine
+}
+
+type FanOutData struct {
+	Children []string
+}
+
+// FanOut spawns h.N instances of h.Child workflow and waits until they are finished.
+func (s *Server) FanOut(name string, h FanOutHandler, stmts ...async.Stmt) async.Event {
+	h.engine = s.Engine
+	return async.On(name, &h, stmts...)
+}
+
+func (h FanOutHandler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type   string
+		N      int
+		Child  string
+		Quorum int
+	}{
+		Type:   "fanout",
+		N:      h.N,
+		Child:  h.Child,
+		Quorum: h.quorum(),
+	})
+}
+
+func (h *FanOutHandler) quorum() int {
+	if h.Quorum == 0 || h.Quorum > h.N {
+		return h.N
+	}
+	return h.Quorum
+}
+
+func childID(req async.CallbackRequest, i int) string {
+	return fmt.Sprintf("%v_%v_%v_%v", req.WorkflowID, req.Name, req.PC, i)
+}
+
+// Setup creates children. Already existing children are skipped, so Setup can be safely retried.
+func (h *FanOutHandler) Setup(ctx context.Context, req async.CallbackRequest) (string, error) {
+	defer logTime("fanout setup")()
+	ids := []string{}
+	for i := 0; i < h.N; i++ {
+		var state interface{}
+		if h.Init != nil {
+			state = h.Init(i)
+		} else {
+			w, _, ok := h.engine.Workflows.Get(h.Child)
+			if !ok {
+				return "", fmt.Errorf("workflow not found: %v", h.Child)
+			}
+			state = w()
+		}
+		id := childID(req, i)
+		err := h.engine.ScheduleAndCreate(ctx, id, h.Child, state, CreateOptions{
+			Parent: &ParentRef{
+				ID:       req.WorkflowID,
+				Callback: req,
+				Index:    i,
+			},
+		})
+		if err != nil && !errors.Is(err, ErrAlreadyExists) {
+			return "", fmt.Errorf("err creating child %v: %w", id, err)
+		}
+		ids = append(ids, id)
+	}
+	err := h.engine.Scheduler.ScheduleBatch(ctx, ids)
+	if err != nil {
+		return "", err
+	}
+	d, err := json.Marshal(FanOutData{Children: ids})
+	return string(d), err
+}
+
+// Handle is called when any of the children is finished. Parent continues when quorum is reached.
+func (h *FanOutHandler) Handle(ctx context.Context, req async.CallbackRequest, input interface{}) (interface{}, error) {
+	results := make([]json.RawMessage, h.N)
+	finished := 0
+	docs, err := h.engine.DB.Collection(h.engine.Collection).
+		Where("Parent.ID", "==", req.WorkflowID).
+		Where("Parent.Callback.PC", "==", req.PC).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("err fetching children: %v", err)
+	}
+	for _, doc := range docs {
+		var wf DBWorkflow
+		err = doc.DataTo(&wf)
+		if err != nil {
+			return nil, fmt.Errorf("err unmarshaling child %v: %v", doc.Ref.ID, err)
+		}
+		if wf.Parent.Callback.Name != req.Name || wf.Meta.Status != async.WorkflowFinished ||
+			wf.Parent.Index < 0 || wf.Parent.Index >= h.N {
+			continue
+		}
+		state, err := h.engine.decodeState(&wf)
+		if err != nil {
+			return nil, fmt.Errorf("err decoding child %v: %v", doc.Ref.ID, err)
+		}
+		results[wf.Parent.Index], err = json.Marshal(state)
+		if err != nil {
+			return nil, err
+		}
+		finished++
+	}
+	if finished < h.quorum() {
+		return nil, ErrPollPending
+	}
+	if h.Results != nil {
+		*h.Results = results
+	}
+	return results, nil
+}
+
+// Teardown cancels unfinished children once parent stopped waiting for them, either because quorum was reached
+// or because parent moved on without it. Cancelled children don't notify parent.
+// Children finishing concurrently still may notify it, such late callbacks are skipped as ErrStaleCallback.
+func (h *FanOutHandler) Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error {
+	ctx = withoutParentNotify(ctx)
+	var data FanOutData
+	err := json.Unmarshal([]byte(req.SetupData), &data)
+	if err != nil {
+		return err
+	}
+	for _, id := range data.Children {
+		meta, err := h.engine.GetMeta(ctx, id)
+		if err != nil {
+			return err
+		}
+		if meta.Status == async.WorkflowFinished {
+			continue
+		}
+		err = h.engine.Cancel(ctx, id)
+		if err != nil {
+			return fmt.Errorf("err cancelling child %v: %v", id, err)
+		}
+	}
+	return nil
+}
+
+type noParentNotifyCtxKey struct{}
+
+// withoutParentNotify is used when children are cancelled by the parent, which doesn't wait for them anymore
+func withoutParentNotify(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noParentNotifyCtxKey{}, true)
+}
+
+// notifyParent delivers callback to the parent when child workflow is finished
+func (fs FirestoreEngine) notifyParent(ctx context.Context, wf *DBWorkflow) {
+	if wf.Parent == nil || wf.Meta.Status != async.WorkflowFinished || fs.Callbacks == nil {
+		return
+	}
+	if skip, _ := ctx.Value(noParentNotifyCtxKey{}).(bool); skip {
+		return
+	}
+	_, err := fs.Callbacks.Setup(ctx, wf.Parent.Callback, 0)
+	if err != nil {
+		log.Printf("err notifying parent %v of %v: %v", wf.Parent.ID, wf.Meta.ID, err)
+	}
+}
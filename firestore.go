@@ -3,30 +3,195 @@ package gasync
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"github.com/gorchestrate/async"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// Engine is the storage contract of workflow processing: creation, locking, events and resumes.
+// FirestoreEngine is the reference implementation, other implementations can be verified with enginetest package.
+// Lock with WithoutLockWait context returns error wrapping ErrLocked if workflow is locked.
+type Engine interface {
+	ScheduleAndCreate(ctx context.Context, id, name string, state interface{}, opts CreateOptions) error
+	Get(ctx context.Context, id string) (*DBWorkflow, error)
+	GetState(ctx context.Context, id string) (interface{}, error)
+	Lock(ctx context.Context, id string) (DBWorkflow, error)
+	Unlock(ctx context.Context, id string) error
+	HandleEvent(ctx context.Context, id string, name string, input interface{}) (interface{}, error)
+	Resume(ctx context.Context, id string) error
+}
+
+var _ Engine = FirestoreEngine{}
+
+// CallbackEngine is an Engine that handles callbacks delivered by schedulers, i.e. timeouts and polls.
+// Schedulers depend on it instead of FirestoreEngine, so that they can be used with any engine.
+type CallbackEngine interface {
+	Engine
+	HandleCallback(ctx context.Context, id string, cb async.CallbackRequest, input interface{}) (interface{}, error)
+}
+
+var _ CallbackEngine = FirestoreEngine{}
+
 type FirestoreEngine struct {
-	Scheduler  *GTasksScheduler
+	Scheduler  Scheduler
 	DB         *firestore.Client
 	Collection string
-	Workflows  map[string]func() async.WorkflowState
+	Workflows  Registry
+	Redactor   Redactor
+	Codec      Codec
+	Cache      Cache
+	Limiter    *ConcurrencyLimiter
+	Middleware []EventMiddleware
+	Hooks      Hooks
+	Projection *Projection
+	History    []HistorySink
+	NoHistory  map[string]bool // workflows history is not written for, i.e. high-volume ones
+	// ErrorReporter receives workflow failures. If not set - errors are logged
+	ErrorReporter ErrorReporter
+	MaxPanics     int // workflow is quarantined after this number of panics, DefaultMaxPanics by default
+
+	MaxEventFailures int // event payload is quarantined after this number of failures, DefaultMaxEventFailures by default
+
+	// Callbacks deliver callbacks to parent workflows when FanOut children finish
+	Callbacks CallbackScheduler
+
+	Metrics *Metrics
+
+	CursorSecret string // encrypts pagination cursors, random per-process key is used if it's empty
+
+	// CheckpointEvery and CheckpointInterval save workflow in the middle of resume after this number of steps or time.
+	// Checkpoints are disabled by default, since each of them is an additional write.
+	CheckpointEvery    int
+	CheckpointInterval time.Duration
+
+	OutputValidation OutputValidation // validates event outputs against their schemas
+
+	Retention *Retention // sets ExpireAt of finished workflows
+
+	Timeouts Timeouts // bound Firestore and Cloud Tasks calls
+
+	SLAs map[string][]SLA // SLAs by workflow name
+
+	Cardinality map[string]Cardinality // limits of running instances by workflow name
+
+	DedupWindows map[string]time.Duration // duplicate events are ignored within window, by event name or "*"
+	EventShards  HistoryShards            // spreads dedup records of hot workflows across subcollections, see FirestoreHistory.Shards
+
+	// ProcessingFloor is how long locked workflow is processed after the caller cancelled the request, DefaultProcessingFloor by default.
+	// Event handlers observe cancellation of the request, while steps, handler setup and saving use context with this floor.
+	ProcessingFloor time.Duration
+
+	// Outbox schedules resumes that failed to be scheduled via Scheduler, i.e. DueTimers
+	Outbox Scheduler
+
+	Tracer trace.Tracer // creates spans for resumes and events, see NewTracer
+
+	Costs *Costs // counts billable operations by workflow type
+}
+
+// ErrAlreadyExists is returned when workflow with the same id was already created
+var ErrAlreadyExists = errors.New("workflow already exists")
+
+// ErrNotFound is returned when workflow with the specified id does not exist
+var ErrNotFound = errors.New("workflow not found")
+
+// ErrStaleCallback is returned for callback workflow no longer waits for, i.e. timeout of the event that was already handled.
+// Such callbacks are delivered too late and should not be retried.
+var ErrStaleCallback = errors.New("stale callback")
+
+// staleCallback tells if async.HandleCallback failed because workflow doesn't wait for the callback.
+// Errors of event handlers are wrapped by async and never match.
+func staleCallback(err error) bool {
+	if err == nil || errors.Unwrap(err) != nil {
+		return false
+	}
+	for _, msg := range []string{
+		"callback not found",
+		"received callback on workflow that is finished",
+		"stored & supplied callback PC mismatch",
+		"got callback on event with unexpected status",
+	} {
+		if strings.HasPrefix(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// LockedError is returned when workflow is locked and caller doesn't wait for it, see WithoutLockWait.
+// It wraps ErrLocked and tells when lock expires.
+type LockedError struct {
+	Until time.Time
+}
+
+func (e LockedError) Error() string {
+	return fmt.Sprintf("%v till %v", ErrLocked, e.Until.Format(time.RFC3339))
+}
+
+func (e LockedError) Unwrap() error {
+	return ErrLocked
 }
 
 type DBWorkflow struct {
 	Meta     async.State
 	State    interface{} // json body of workflow state
 	LockTill time.Time   // optimistic locking
+	Labels   map[string]string
+	Priority int    // higher priority workflows are resumed first
+	Version  string // version of workflow definition instance was created with
+
+	Panics      int    // number of times workflow code panicked
+	LastError   string // last panic
+	Quarantined bool   // workflow is not resumed after panicking too many times
+
+	Parent   *ParentRef // set for children created by FanOut
+	Deadline time.Time  // workflow is cancelled on resume after deadline
+	Created  time.Time
+
+	ThreadsStarted map[string]time.Time // start time of running threads
+
+	ExpireAt *time.Time `firestore:",omitempty"` // finished workflow is deleted by Firestore TTL policy after this time
+
+	SLAs        map[string]SLAStatus `json:",omitempty"`
+	SLABreached bool                 // at least one SLA was breached
+}
+
+// CreateOptions are optional parameters of a new workflow
+type CreateOptions struct {
+	Labels   map[string]string
+	Priority int
+	Version  string // latest version is used by default
+	Parent   *ParentRef
+	Deadline time.Duration // workflow is cancelled if it's not finished within deadline
+}
+
+// ListQuery filters and orders workflows returned by List
+type ListQuery struct {
+	Labels  map[string]string
+	Limit   int
+	OrderBy string // "priority" orders by priority, highest first
+	Cursor  string // returned by ListPage to fetch the next page
+
+	Filter map[string]string // filters by status, priority, quarantined or version
+	Sort   string            // comma separated priority, createdAt or status, "-" prefix for descending order
+	Fields []string          // sparse fieldset, i.e. Meta.ID. All fields are returned if empty
 }
 
 func logTime(section string) func() {
+	if LogLevel(atomic.LoadInt32(&logLevel)) < LogDebug {
+		return func() {}
+	}
 	start := time.Now()
 	return func() {
 		log.Printf("%v took %v ms", section, time.Since(start))
@@ -36,7 +201,9 @@ func logTime(section string) func() {
 func (fs FirestoreEngine) Lock(ctx context.Context, id string) (DBWorkflow, error) {
 	defer logTime("lock")()
 	for i := 0; ; i++ {
-		doc, err := fs.DB.Collection(fs.Collection).Doc(id).Get(ctx)
+		callCtx, cancel := fs.Timeouts.firestoreCall(ctx)
+		doc, err := fs.DB.Collection(fs.Collection).Doc(id).Get(callCtx)
+		cancel()
 		if err != nil {
 			return DBWorkflow{}, err
 		}
@@ -45,31 +212,52 @@ func (fs FirestoreEngine) Lock(ctx context.Context, id string) (DBWorkflow, erro
 		if err != nil {
 			return DBWorkflow{}, fmt.Errorf("err unmarshaling workflow: %v", err)
 		}
+		fs.Costs.read(ctx, wf.Meta.Workflow, 1)
+		if wf.Quarantined {
+			return DBWorkflow{}, ErrQuarantined
+		}
 		if time.Since(wf.LockTill) < 0 {
+			if lockWaitSkipped(ctx) {
+				return DBWorkflow{}, LockedError{Until: wf.LockTill}
+			}
 			if i > 50 {
 				return DBWorkflow{}, fmt.Errorf("workflow is locked. can't unlock with 50 retries")
 			} else {
 				log.Printf("workflow is locked, waiting and trying again...")
-				time.Sleep(time.Millisecond * 100 * time.Duration(i))
+				select {
+				case <-ctx.Done():
+					return DBWorkflow{}, fmt.Errorf("workflow is locked: %w", ctx.Err())
+				case <-time.After(time.Millisecond * 100 * time.Duration(i)):
+				}
 				continue
 			}
 		}
-		_, err = fs.DB.Collection(fs.Collection).Doc(id).Update(ctx,
+		// stored with microsecond precision, so that checkpoints can compare it with the lock they hold
+		lockTill := time.Now().Add(time.Minute).Truncate(time.Microsecond)
+		callCtx, cancel = fs.Timeouts.firestoreCall(ctx)
+		_, err = fs.DB.Collection(fs.Collection).Doc(id).Update(callCtx,
 			[]firestore.Update{
 				{
 					Path:  "LockTill",
-					Value: time.Now().Add(time.Minute),
+					Value: lockTill,
 				},
 			},
 			firestore.LastUpdateTime(doc.UpdateTime),
 		)
+		cancel()
+		fs.Costs.write(ctx, wf.Meta.Workflow, 1)
 		if err != nil && strings.Contains(err.Error(), "FailedPrecondition") {
+			if lockWaitSkipped(ctx) {
+				// locked concurrently, lock is held for a minute
+				return DBWorkflow{}, LockedError{Until: time.Now().Add(time.Minute)}
+			}
 			log.Printf("workflow was locked concurrently, waiting and trying again...")
 			continue
 		}
 		if err != nil {
 			return DBWorkflow{}, fmt.Errorf("err locking workflow: %v", err)
 		}
+		wf.LockTill = lockTill
 		return wf, nil
 	}
 }
@@ -77,6 +265,8 @@ func (fs FirestoreEngine) Lock(ctx context.Context, id string) (DBWorkflow, erro
 func (fs FirestoreEngine) Unlock(ctx context.Context, id string) error {
 	defer logTime("unlock")()
 	// always unlock, even if previous err != nil
+	ctx, cancel := fs.Timeouts.firestoreCall(ctx)
+	defer cancel()
 	_, unlockErr := fs.DB.Collection(fs.Collection).Doc(id).Update(ctx,
 		[]firestore.Update{
 			{
@@ -85,6 +275,7 @@ func (fs FirestoreEngine) Unlock(ctx context.Context, id string) error {
 			},
 		},
 	)
+	fs.Costs.write(ctx, "", 1)
 	if unlockErr != nil {
 		return fmt.Errorf("err unlocking workflow: %v", unlockErr)
 	}
@@ -99,6 +290,11 @@ type DBWorkflowLog struct {
 	Input        interface{}
 	Output       interface{}
 	Callback     *async.CallbackRequest
+	Identity     *Identity       // caller authenticated by JWTAuth
+	SLABreach    *SLABreach      `firestore:",omitempty" json:",omitempty"`
+	Operator     *OperatorAction `firestore:",omitempty" json:",omitempty"` // event skipped or injected by operator
+	// InputRedacted is set if sensitive fields of Input were masked, such entry can't be replayed
+	InputRedacted bool `firestore:",omitempty" json:",omitempty"`
 }
 
 func pjson(in interface{}) interface{} {
@@ -119,6 +315,12 @@ func pjson(in interface{}) interface{} {
 
 func (fs FirestoreEngine) Save(ctx context.Context, wf *DBWorkflow, s *async.WorkflowState, unlock bool) error {
 	defer logTime("save")()
+	state, err := fs.encodeState(*s)
+	if err != nil {
+		return err
+	}
+	wf.trackThreads()
+	fs.markReached(wf)
 	updates := []firestore.Update{
 		{
 			Path:  "Meta",
@@ -126,7 +328,11 @@ func (fs FirestoreEngine) Save(ctx context.Context, wf *DBWorkflow, s *async.Wor
 		},
 		{
 			Path:  "State",
-			Value: *s,
+			Value: state,
+		},
+		{
+			Path:  "ThreadsStarted",
+			Value: wf.ThreadsStarted,
 		},
 	}
 	if unlock {
@@ -135,10 +341,33 @@ func (fs FirestoreEngine) Save(ctx context.Context, wf *DBWorkflow, s *async.Wor
 			Value: time.Time{},
 		})
 	}
+	if len(wf.SLAs) > 0 {
+		updates = append(updates, firestore.Update{
+			Path:  "SLAs",
+			Value: wf.SLAs,
+		})
+	}
+	if d := fs.Retention.Get(); d > 0 && wf.Meta.Status == async.WorkflowFinished {
+		expire := time.Now().Add(d)
+		wf.ExpireAt = &expire
+		updates = append(updates, firestore.Update{
+			Path:  "ExpireAt",
+			Value: expire,
+		})
+	}
 	b := fs.DB.Batch()
 	b.Update(fs.DB.Collection(fs.Collection).Doc(wf.Meta.ID), updates)
-	_, err := b.Commit(ctx)
-	return err
+	callCtx, cancel := fs.Timeouts.firestoreCall(ctx)
+	_, err = b.Commit(callCtx)
+	cancel()
+	fs.Costs.write(ctx, wf.Meta.Workflow, 1)
+	fs.invalidate(wf.Meta.ID)
+	if err != nil {
+		return err
+	}
+	fs.project(ctx, wf, *s)
+	fs.notifyParent(ctx, wf)
+	return nil
 }
 
 // func (fs FirestoreEngine) Checkpoint(ctx context.Context, wf *DBWorkflow, s *async.WorkflowState, cb *async.CallbackRequest, input, output interface{}) func(bool) error {
@@ -176,92 +405,186 @@ func (fs FirestoreEngine) Save(ctx context.Context, wf *DBWorkflow, s *async.Wor
 // }
 
 func (fs FirestoreEngine) HandleCallback(ctx context.Context, id string, cb async.CallbackRequest, input interface{}) (interface{}, error) {
-	wf, err := fs.Lock(ctx, id)
+	return fs.withMiddleware(func(ctx context.Context, req EventRequest) (interface{}, error) {
+		return fs.handleCallback(ctx, req.WorkflowID, req.Callback, req.Input)
+	})(ctx, EventRequest{
+		WorkflowID: id,
+		Callback:   cb,
+		Input:      input,
+	})
+}
+
+func (fs FirestoreEngine) handleCallback(ctx context.Context, id string, cb async.CallbackRequest, input interface{}) (_ interface{}, err error) {
+	start := time.Now()
+	ctx, span := fs.startSpan(ctx, "gasync.callback", id, attribute.String("event", cb.Name))
+	defer func() { endSpan(span, err) }()
+	failed, err := fs.checkQuarantine(ctx, id, cb, input)
 	if err != nil {
 		return nil, err
 	}
-	w, ok := fs.Workflows[wf.Meta.Workflow]
-	if !ok {
-		_ = fs.Unlock(ctx, id)
-		return nil, fmt.Errorf("workflow not found: %v", wf.Meta.Workflow)
-	}
-	state := w()
-	d, err := json.Marshal(wf.State)
+	wf, err := fs.Lock(ctx, id)
 	if err != nil {
-		_ = fs.Unlock(ctx, id)
 		return nil, err
 	}
-	err = json.Unmarshal(d, &state)
+	ctx = withWorkflow(ctx, wf.Meta.Workflow)
+	handlerCtx := ctx
+	ctx, cancel := fs.detach(ctx)
+	defer cancel()
+	defer func() { fs.Metrics.handled(ctx, wf.Meta.Workflow, cb.Name, start, err) }()
+	state, err := fs.decodeState(&wf)
 	if err != nil {
 		_ = fs.Unlock(ctx, id)
 		return nil, err
 	}
-	out, err := async.HandleCallback(ctx, cb, state, &wf.Meta, input)
+	out, err := safeHandleCallback(handlerCtx, cb, state, &wf.Meta, input)
 	if err != nil {
-		_ = fs.Unlock(ctx, id)
+		if errors.Is(err, ErrPollPending) {
+			if uErr := fs.unlockPending(ctx, &wf, cb, err); uErr != nil {
+				log.Printf("workflow %v: %v", id, uErr)
+			}
+			return nil, err
+		}
+		if staleCallback(err) {
+			_ = fs.Unlock(ctx, id)
+			return nil, fmt.Errorf("%w: %v", ErrStaleCallback, err)
+		}
+		_ = fs.unlockAfter(ctx, &wf, err)
+		fs.reportError(ctx, wf.Meta, cb.Name, input, err)
+		fs.Hooks.failed(ctx, wf.Meta, state, err)
+		if qErr := fs.recordFailure(ctx, id, cb, input, err); qErr != nil {
+			log.Printf("err recording failed event: %v", qErr)
+		}
 		return out, fmt.Errorf("err during workflow processing: %w", err)
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := fs.Scheduler.Schedule(ctx, wf.Meta.ID, 0)
-		if err != nil {
-			log.Printf("err scheduling")
-		}
-	}()
-	err = fs.Save(ctx, &wf, &state, true)
+	err = fs.saveAndSchedule(ctx, &wf, &state)
+	var sErr ScheduleError
+	if err != nil && !errors.As(err, &sErr) {
+		fs.reportError(ctx, wf.Meta, cb.Name, input, err)
+		return out, err
+	}
+	fs.writeHistory(ctx, &wf, state, start, &cb, input, out)
+	if failed {
+		fs.clearFailure(ctx, id, cb, input)
+	}
 	if err != nil {
-		return out, fmt.Errorf("err during workflow saving: %w", err)
+		fs.reportError(ctx, wf.Meta, "", nil, err)
+		return out, err
 	}
-	wg.Wait()
 	return out, nil
 }
 
+// saveAndSchedule saves workflow and schedules its resume concurrently. Resume can't observe unsaved state,
+// since workflow stays locked until Save unlocks it. Save errors take precedence, ScheduleError is returned
+// only if workflow was saved and resume was not scheduled neither via Scheduler nor via Outbox.
+func (fs FirestoreEngine) saveAndSchedule(ctx context.Context, wf *DBWorkflow, state *async.WorkflowState) error {
+	var g errgroup.Group
+	if !scheduleSkipped(ctx) {
+		// wf is modified by Save, so fields are copied before it starts
+		id, priority := wf.Meta.ID, wf.Priority
+		g.Go(func() error {
+			return fs.scheduleResume(ctx, id, priority)
+		})
+	}
+	err := fs.Save(ctx, wf, state, true)
+	sErr := g.Wait()
+	if err != nil {
+		return fmt.Errorf("err during workflow saving: %w", err)
+	}
+	return sErr
+}
+
+// scheduleResume schedules resume after event, falling back to Outbox
+func (fs FirestoreEngine) scheduleResume(ctx context.Context, id string, priority int) error {
+	err := fs.Scheduler.ScheduleWithPriority(ctx, id, 0, priority)
+	if err == nil {
+		return nil
+	}
+	if fs.Outbox != nil {
+		oErr := fs.Outbox.ScheduleWithPriority(ctx, id, 0, priority)
+		if oErr == nil {
+			log.Printf("resume of %v is scheduled via outbox: %v", id, err)
+			return nil
+		}
+		err = fmt.Errorf("%v, outbox: %v", err, oErr)
+	}
+	return ScheduleError{WorkflowID: id, Err: err}
+}
+
 func (fs FirestoreEngine) HandleEvent(ctx context.Context, id string, name string, input interface{}) (interface{}, error) {
+	return fs.withMiddleware(func(ctx context.Context, req EventRequest) (interface{}, error) {
+		return fs.dedupEvent(ctx, req.WorkflowID, req.Callback.Name, req.Input, func() (interface{}, error) {
+			return fs.handleEvent(ctx, req.WorkflowID, req.Callback.Name, req.Input)
+		})
+	})(ctx, EventRequest{
+		WorkflowID: id,
+		Callback:   async.CallbackRequest{Name: name},
+		Input:      input,
+	})
+}
+
+func (fs FirestoreEngine) handleEvent(ctx context.Context, id string, name string, input interface{}) (_ interface{}, err error) {
 	defer logTime("handle event")()
-	wf, err := fs.Lock(ctx, id)
+	start := time.Now()
+	ctx, span := fs.startSpan(ctx, "gasync.event", id, attribute.String("event", name))
+	defer func() { endSpan(span, err) }()
+	failed, err := fs.checkQuarantine(ctx, id, async.CallbackRequest{Name: name}, input)
 	if err != nil {
 		return nil, err
 	}
-	w, ok := fs.Workflows[wf.Meta.Workflow]
-	if !ok {
-		_ = fs.Unlock(ctx, id)
-		return nil, fmt.Errorf("workflow not found: %v", wf.Meta.Workflow)
-	}
-	state := w()
-	d, err := json.Marshal(wf.State)
+	wf, err := fs.Lock(ctx, id)
 	if err != nil {
-		_ = fs.Unlock(ctx, id)
 		return nil, err
 	}
-	err = json.Unmarshal(d, &state)
+	ctx = withWorkflow(ctx, wf.Meta.Workflow)
+	handlerCtx := ctx
+	ctx, cancel := fs.detach(ctx)
+	defer cancel()
+	defer func() { fs.Metrics.handled(ctx, wf.Meta.Workflow, name, start, err) }()
+	state, err := fs.decodeState(&wf)
 	if err != nil {
 		_ = fs.Unlock(ctx, id)
 		return nil, err
 	}
-	out, err := async.HandleCallback(ctx, async.CallbackRequest{
+	out, err := safeHandleCallback(handlerCtx, async.CallbackRequest{
 		Name: name,
-	}, state, &wf.Meta, input)
-	if err != nil {
+	}, operatorState(ctx, state, name), &wf.Meta, input)
+	if _, ok := businessError(err); ok {
 		_ = fs.Unlock(ctx, id)
+		return nil, err
+	}
+	if err != nil {
+		_ = fs.unlockAfter(ctx, &wf, err)
+		fs.reportError(ctx, wf.Meta, name, input, err)
+		fs.Hooks.failed(ctx, wf.Meta, state, err)
+		if qErr := fs.recordFailure(ctx, id, async.CallbackRequest{Name: name}, input, err); qErr != nil {
+			log.Printf("err recording failed event: %v", qErr)
+		}
 		return out, fmt.Errorf("err during workflow processing: %w", err)
 	}
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := fs.Scheduler.Schedule(ctx, wf.Meta.ID, 0)
-		if err != nil {
-			log.Printf("err scheduling")
+	if fs.OutputValidation != OutputValidationOff && !eventSkipped(ctx) {
+		if vErr := validateOutput(state, name, out); vErr != nil {
+			if fs.OutputValidation == OutputValidationStrict {
+				_ = fs.Unlock(ctx, id)
+				return nil, vErr
+			}
+			log.Printf("workflow %v: %v", id, vErr)
 		}
-	}()
-	err = fs.Save(ctx, &wf, &state, true)
+	}
+	err = fs.saveAndSchedule(ctx, &wf, &state)
+	var sErr ScheduleError
+	if err != nil && !errors.As(err, &sErr) {
+		fs.reportError(ctx, wf.Meta, name, input, err)
+		return out, err
+	}
+	fs.writeHistory(ctx, &wf, state, start, &async.CallbackRequest{Name: name}, input, out)
+	if failed {
+		fs.clearFailure(ctx, id, async.CallbackRequest{Name: name}, input)
+	}
 	if err != nil {
-		return out, fmt.Errorf("err during workflow saving: %w", err)
+		fs.reportError(ctx, wf.Meta, "", nil, err)
+		return out, err
 	}
-	wg.Wait()
 	// _, err = async.Resume(context.Background(), state, &wf.Meta)
 	// if err != nil {
 	// 	return out, fmt.Errorf("err during workflow resuming: %w", err)
@@ -273,79 +596,580 @@ func (fs FirestoreEngine) HandleEvent(ctx context.Context, id string, name strin
 	return out, nil
 }
 
-func (fs FirestoreEngine) Resume(ctx context.Context, id string) error {
+// detach protects processing of locked workflow from cancellation of the caller, see ProcessingFloor
+func (fs FirestoreEngine) detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	floor := fs.ProcessingFloor
+	if floor <= 0 {
+		floor = DefaultProcessingFloor
+	}
+	return detach(ctx, floor)
+}
+
+func (fs FirestoreEngine) Resume(ctx context.Context, id string) (err error) {
 	defer logTime("resume func")()
+	start := time.Now()
+	ctx, span := fs.startSpan(ctx, "gasync.resume", id)
+	defer func() { endSpan(span, err) }()
 	wf, err := fs.Lock(ctx, id)
 	if err != nil {
 		return err
 	}
-	w, ok := fs.Workflows[wf.Meta.Workflow]
-	if !ok {
-		_ = fs.Unlock(ctx, id)
-		return fmt.Errorf("workflow not found: %v", err)
+	ctx = withWorkflow(ctx, wf.Meta.Workflow)
+	ctx, cancel := fs.detach(ctx)
+	defer cancel()
+	defer func() { fs.Metrics.resumed(ctx, wf.Meta.Workflow, start, err) }()
+	if sErr := fs.checkSLAs(ctx, &wf); sErr != nil {
+		log.Printf("workflow %v: %v", id, sErr)
 	}
-	state := w()
-	d, err := json.Marshal(wf.State)
-	if err != nil {
+	if !wf.Deadline.IsZero() && time.Now().After(wf.Deadline) && wf.Meta.Status != async.WorkflowFinished {
 		_ = fs.Unlock(ctx, id)
-		return err
+		log.Printf("workflow %v exceeded deadline %v, cancelling", id, wf.Deadline)
+		return fs.Cancel(ctx, id)
+	}
+	if fs.Limiter != nil {
+		release, ok := fs.Limiter.TryAcquire(wf.Meta.Workflow)
+		if !ok {
+			_ = fs.Unlock(ctx, id)
+			return ErrConcurrencyLimit
+		}
+		defer release()
 	}
-	err = json.Unmarshal(d, &state)
+	state, err := fs.decodeState(&wf)
 	if err != nil {
 		_ = fs.Unlock(ctx, id)
 		return err
 	}
 	s := logTime("resume")
-	err = async.Resume(ctx, state, &wf.Meta, func(t async.CheckpointType) error {
-		return nil // don't checkpoint for performance reasons
-	})
+	err = safeResume(ctx, state, &wf.Meta, fs.checkpoint(ctx, &wf, &state))
 	if err != nil {
-		_ = fs.Unlock(ctx, id)
+		_ = fs.unlockAfter(ctx, &wf, err)
+		fs.reportError(ctx, wf.Meta, "", nil, err)
+		fs.Hooks.failed(ctx, wf.Meta, state, err)
 		return fmt.Errorf("err during workflow processing: %w", err)
 	}
 	s()
 	s = logTime("checkpoint")
 	err = fs.Save(ctx, &wf, &state, true)
 	if err != nil {
+		fs.reportError(ctx, wf.Meta, "", nil, err)
+		fs.Hooks.failed(ctx, wf.Meta, state, err)
 		return err
 	}
 	s()
+	fs.writeHistory(ctx, &wf, state, start, nil, nil, nil)
+	fs.Hooks.resumed(ctx, wf.Meta, state)
 	return nil
 }
 
+// ResumeOrSchedule resumes workflow inline. If concurrency limit is reached - resume is scheduled instead.
+func (fs FirestoreEngine) ResumeOrSchedule(ctx context.Context, id string) error {
+	err := fs.Resume(ctx, id)
+	if errors.Is(err, ErrConcurrencyLimit) {
+		log.Printf("concurrency limit reached, scheduling resume for %v", id)
+		return fs.Scheduler.Schedule(ctx, id, time.Second)
+	}
+	return err
+}
+
+// ResumeVerified resumes workflow inline when no resume was scheduled for it.
+// Resume is scheduled if inline resume fails or if verification read shows that workflow still needs resuming.
+func (fs FirestoreEngine) ResumeVerified(ctx context.Context, id string) error {
+	err := fs.Resume(ctx, id)
+	if err == nil {
+		meta, mErr := fs.GetMeta(ctx, id)
+		if mErr == nil && meta.Status != async.WorkflowResuming {
+			return nil
+		}
+	}
+	log.Printf("inline resume of %v didn't complete, scheduling resume: %v", id, err)
+	sErr := fs.Scheduler.Schedule(ctx, id, time.Second)
+	if sErr != nil {
+		return fmt.Errorf("err scheduling resume: %v", sErr)
+	}
+	if errors.Is(err, ErrConcurrencyLimit) {
+		return nil
+	}
+	return err
+}
+
+// Cancel finishes workflow without executing remaining steps. Events workflow is waiting for are torn down.
+func (fs FirestoreEngine) Cancel(ctx context.Context, id string) error {
+	defer logTime("cancel")()
+	wf, err := fs.Lock(ctx, id)
+	if err != nil {
+		return err
+	}
+	state, err := fs.decodeState(&wf)
+	if err != nil {
+		_ = fs.Unlock(ctx, id)
+		return err
+	}
+	teardownEvents(ctx, &wf.Meta, state)
+	wf.Meta.Status = async.WorkflowFinished
+	return fs.Save(ctx, &wf, &state, true)
+}
+
+// teardownEvents tears down events workflow is waiting for. Failed teardowns are kept with the error.
+func teardownEvents(ctx context.Context, meta *async.State, state async.WorkflowState) {
+	for _, t := range meta.Threads {
+		for i := 0; i < len(t.WaitEvents); i++ {
+			if t.WaitEvents[i].Status != async.EventSetup {
+				continue
+			}
+			h, err := async.FindHandler(t.WaitEvents[i].Req, state.Definition())
+			if err == nil {
+				err = h.Teardown(ctx, t.WaitEvents[i].Req, false)
+			}
+			if err != nil {
+				t.WaitEvents[i].Error = err.Error()
+				t.WaitEvents[i].Status = async.EventTeardownError
+				continue
+			}
+			t.WaitEvents = append(t.WaitEvents[:i], t.WaitEvents[i+1:]...)
+			i--
+		}
+	}
+}
+
 func (fs FirestoreEngine) Get(ctx context.Context, id string) (*DBWorkflow, error) {
 	defer logTime("get")()
+	ctx, cancel := fs.Timeouts.firestoreCall(ctx)
+	defer cancel()
 	d, err := fs.DB.Collection(fs.Collection).Doc(id).Get(ctx)
 	if err != nil {
 		return nil, err
 	}
 	var wf DBWorkflow
 	err = d.DataTo(&wf)
+	fs.Costs.read(ctx, wf.Meta.Workflow, 1)
 	return &wf, err
 }
 
-func (fs FirestoreEngine) ScheduleAndCreate(ctx context.Context, id, name string, state interface{}) error {
+// MaxGetMany is the max number of workflows fetched by GetMany
+const MaxGetMany = 100
+
+// GetMany fetches workflows in a single Firestore call. Workflows that don't exist are not returned.
+func (fs FirestoreEngine) GetMany(ctx context.Context, ids []string) (map[string]*DBWorkflow, error) {
+	defer logTime("get many")()
+	if len(ids) > MaxGetMany {
+		return nil, fmt.Errorf("can't get more than %v workflows at once", MaxGetMany)
+	}
+	refs := []*firestore.DocumentRef{}
+	for _, id := range ids {
+		refs = append(refs, fs.DB.Collection(fs.Collection).Doc(id))
+	}
+	ctx, cancel := fs.Timeouts.firestoreCall(ctx)
+	defer cancel()
+	docs, err := fs.DB.GetAll(ctx, refs)
+	if err != nil {
+		return nil, fmt.Errorf("err getting workflows: %v", err)
+	}
+	ret := map[string]*DBWorkflow{}
+	for _, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		var wf DBWorkflow
+		err = doc.DataTo(&wf)
+		if err != nil {
+			return nil, fmt.Errorf("err unmarshaling workflow %v: %v", doc.Ref.ID, err)
+		}
+		ret[doc.Ref.ID] = &wf
+		fs.Costs.read(ctx, wf.Meta.Workflow, 1)
+	}
+	return ret, nil
+}
+
+// getFields fetches only specified top-level fields of the workflow document and time of its last update.
+func (fs FirestoreEngine) getFields(ctx context.Context, id string, fields ...string) (*DBWorkflow, time.Time, error) {
+	ctx, cancel := fs.Timeouts.firestoreCall(ctx)
+	defer cancel()
+	col := fs.DB.Collection(fs.Collection)
+	docs, err := col.Where(firestore.DocumentID, "==", col.Doc(id)).Select(fields...).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(docs) == 0 {
+		return nil, time.Time{}, ErrNotFound
+	}
+	var wf DBWorkflow
+	err = docs[0].DataTo(&wf)
+	fs.Costs.read(ctx, "", 1)
+	return &wf, docs[0].UpdateTime, err
+}
+
+// GetMeta returns workflow Meta without fetching workflow state
+func (fs FirestoreEngine) GetMeta(ctx context.Context, id string) (*async.State, error) {
+	defer logTime("get meta")()
+	wf, _, err := fs.getFields(ctx, id, "Meta")
+	if err != nil {
+		return nil, err
+	}
+	return &wf.Meta, nil
+}
+
+// GetState returns redacted workflow state without Meta
+func (fs FirestoreEngine) GetState(ctx context.Context, id string) (interface{}, error) {
+	state, _, err := fs.GetStateETag(ctx, id)
+	return state, err
+}
+
+// GetStateETag returns redacted workflow state and ETag to be used with PatchState
+func (fs FirestoreEngine) GetStateETag(ctx context.Context, id string) (interface{}, string, error) {
+	defer logTime("get state")()
+	wf, updated, err := fs.getFields(ctx, id, "Meta.Workflow", "State")
+	if err != nil {
+		return nil, "", err
+	}
+	wf, err = fs.Redact(wf)
+	if err != nil {
+		return nil, "", err
+	}
+	return wf.State, stateETag(updated), nil
+}
+
+func (fs FirestoreEngine) ScheduleAndCreate(ctx context.Context, id, name string, state interface{}, opts CreateOptions) error {
 	defer logTime("schedule and create")()
+	start := time.Now()
+	ctx = withWorkflow(ctx, name)
 	wf := DBWorkflow{
-		Meta:  async.NewState(id, name),
-		State: state,
+		Meta:     async.NewState(id, name),
+		State:    state,
+		Labels:   opts.Labels,
+		Priority: opts.Priority,
+		Parent:   opts.Parent,
+		Created:  time.Now(),
+	}
+	if opts.Deadline > 0 {
+		wf.Deadline = time.Now().Add(opts.Deadline)
+	}
+	fs.initSLAs(&wf)
+	w, version, ok := fs.Workflows.Get(wf.Meta.Workflow)
+	if opts.Version != "" {
+		w, ok = fs.Workflows.GetVersion(wf.Meta.Workflow, opts.Version)
+		version = opts.Version
 	}
-	w, ok := fs.Workflows[wf.Meta.Workflow]
 	if !ok {
 		_ = fs.Unlock(ctx, id)
-		return fmt.Errorf("workflow not found: %v", wf.Meta.Workflow)
+		return fmt.Errorf("workflow not found: %v %v", wf.Meta.Workflow, opts.Version)
 	}
+	wf.Version = version
+	// check before resuming, so that steps are not executed for duplicate workflows
+	callCtx, cancel := fs.Timeouts.firestoreCall(ctx)
+	_, err := fs.DB.Collection(fs.Collection).Doc(id).Get(callCtx)
+	cancel()
+	fs.Costs.read(ctx, name, 1)
+	if err == nil {
+		return ErrAlreadyExists
+	}
+	if status.Code(err) != codes.NotFound {
+		return err
+	}
+	release, err := fs.acquireKey(ctx, &wf, state)
+	if err != nil {
+		return err
+	}
+	created := false
+	defer func() {
+		if !created {
+			release()
+		}
+	}()
 	s := w()
-	err := async.Resume(ctx, s, &wf.Meta, func(t async.CheckpointType) error {
-		return nil // don't checkpoint for performance reasons
-	})
+	if ws, ok := state.(async.WorkflowState); ok {
+		s = ws // initial state supplied by caller
+	}
+	err = safeResume(ctx, s, &wf.Meta, fs.Hooks.checkpoint(ctx, &wf.Meta, s))
 	if err != nil {
 		_ = fs.Unlock(ctx, id)
+		fs.reportError(ctx, wf.Meta, "", state, err)
+		fs.Hooks.failed(ctx, wf.Meta, s, err)
 		return fmt.Errorf("err during workflow processing: %w", err)
 	}
-	_, err = fs.DB.Collection(fs.Collection).Doc(id).Create(ctx, wf)
+	wf.State, err = fs.encodeState(s)
+	if err != nil {
+		return err
+	}
+	wf.trackThreads()
+	fs.markReached(&wf)
+	callCtx, cancel = fs.Timeouts.firestoreCall(ctx)
+	_, err = fs.DB.Collection(fs.Collection).Doc(id).Create(callCtx, wf)
+	cancel()
+	fs.Costs.write(ctx, name, 1)
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrAlreadyExists
+	}
+	if err != nil {
+		return err
+	}
+	created = true
+	fs.project(ctx, &wf, s)
+	fs.writeHistory(ctx, &wf, s, start, nil, state, nil)
+	fs.notifyParent(ctx, &wf)
+	if opts.Deadline > 0 && wf.Meta.Status != async.WorkflowFinished {
+		// resume after deadline cancels the workflow
+		err = fs.Scheduler.Schedule(ctx, id, opts.Deadline)
+		if err != nil {
+			fs.reportError(ctx, wf.Meta, "", nil, fmt.Errorf("err scheduling deadline: %w", err))
+		}
+	}
+	fs.scheduleSLAs(ctx, &wf)
+	fs.Hooks.created(ctx, wf.Meta, s)
+	fs.Hooks.resumed(ctx, wf.Meta, s)
+	return nil
+}
+
+// CreateAndWait creates workflow, resumes it and waits until workflow is either finished or waiting for events.
+func (fs FirestoreEngine) CreateAndWait(ctx context.Context, id, name string, state interface{}, opts CreateOptions, timeout time.Duration) (*DBWorkflow, error) {
+	defer logTime("create and wait")()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := fs.ScheduleAndCreate(ctx, id, name, state, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.Resume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		wf, err := fs.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if wf.Meta.Status != async.WorkflowResuming {
+			return wf, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("workflow didn't reach wait state within %v", timeout)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
+// HasActive checks if workflow has instances that are not finished yet
+func (fs FirestoreEngine) HasActive(ctx context.Context, name string) (bool, error) {
+	docs, err := fs.DB.Collection(fs.Collection).
+		Where("Meta.Workflow", "==", name).
+		Where("Meta.Status", "in", []string{string(async.WorkflowResuming), string(async.WorkflowWaiting)}).
+		Select().Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return false, err
+	}
+	return len(docs) > 0, nil
+}
+
+// CountAwaitingResume counts workflows that are waiting to be resumed, up to the limit
+func (fs FirestoreEngine) CountAwaitingResume(ctx context.Context, limit int) (int64, error) {
+	docs, err := fs.DB.Collection(fs.Collection).
+		Where("Meta.Status", "==", string(async.WorkflowResuming)).
+		Select().Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(docs)), nil
+}
+
+// SetLabels merges labels into workflow labels. Labels with empty values are removed.
+func (fs FirestoreEngine) SetLabels(ctx context.Context, id string, labels map[string]string) error {
+	defer logTime("set labels")()
+	if len(labels) == 0 {
+		return nil
+	}
+	updates := []firestore.Update{}
+	for k, v := range labels {
+		var value interface{} = v
+		if v == "" {
+			value = firestore.Delete
+		}
+		updates = append(updates, firestore.Update{
+			FieldPath: firestore.FieldPath{"Labels", k},
+			Value:     value,
+		})
+	}
+	_, err := fs.DB.Collection(fs.Collection).Doc(id).Update(ctx, updates)
+	fs.invalidate(id)
+	return err
+}
+
+// List returns workflows of the given type that have all the labels specified.
+// Ordering by priority requires composite index on Meta.Workflow and Priority fields.
+func (fs FirestoreEngine) List(ctx context.Context, name string, lq ListQuery) ([]DBWorkflow, error) {
+	wfs, _, err := fs.ListPage(ctx, name, lq)
+	return wfs, err
+}
+
+// ListPage works like List and returns cursor of the next page. Cursor is empty on the last page.
+func (fs FirestoreEngine) ListPage(ctx context.Context, name string, lq ListQuery) ([]DBWorkflow, string, error) {
+	defer logTime("list")()
+	q := fs.DB.Collection(fs.Collection).Where("Meta.Workflow", "==", name)
+	for k, v := range lq.Labels {
+		q = q.WherePath(firestore.FieldPath{"Labels", k}, "==", v)
+	}
+	q, err := lq.applyFilters(q)
+	if err != nil {
+		return nil, "", err
+	}
+	sorts, err := lq.sorts()
+	if err != nil {
+		return nil, "", err
+	}
+	for _, s := range sorts {
+		dir := firestore.Asc
+		if s.Desc {
+			dir = firestore.Desc
+		}
+		q = q.OrderBy(listSorts[s.Field], dir)
+	}
+	// document id makes order stable, so that pages don't overlap under concurrent writes
+	q = q.OrderBy(firestore.DocumentID, firestore.Asc)
+	fields, err := lq.selectFields(sorts)
+	if err != nil {
+		return nil, "", err
+	}
+	if fields != nil {
+		q = q.Select(fields...)
+	}
+	if lq.Cursor != "" {
+		c, err := decodeCursor(fs.CursorSecret, lq.Cursor)
+		if err == nil && c.Query != lq.hash(name) {
+			err = ErrInvalidCursor
+		}
+		if err != nil {
+			return nil, "", ValidationError{Path: "cursor", Msg: err.Error()}
+		}
+		vals := []interface{}{}
+		for _, s := range sorts {
+			vals = append(vals, c.value(s.Field))
+		}
+		q = q.StartAfter(append(vals, fs.DB.Collection(fs.Collection).Doc(c.ID))...)
+	}
+	if lq.Limit > 0 {
+		q = q.Limit(lq.Limit)
+	}
+	docs, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, "", err
+	}
+	ret := []DBWorkflow{}
+	for _, d := range docs {
+		var wf DBWorkflow
+		err = d.DataTo(&wf)
+		if err != nil {
+			return nil, "", fmt.Errorf("err unmarshaling workflow: %v", err)
+		}
+		ret = append(ret, wf)
+	}
+	if lq.Limit <= 0 || len(docs) < lq.Limit {
+		return ret, "", nil
+	}
+	last := docs[len(docs)-1]
+	next, err := encodeCursor(fs.CursorSecret, newListCursor(lq.hash(name), last.Ref.ID, ret[len(ret)-1]))
+	if err != nil {
+		return nil, "", fmt.Errorf("err encoding cursor: %v", err)
+	}
+	return ret, next, nil
+}
+
+// checkpoint saves workflow during long resumes every CheckpointEvery steps or CheckpointInterval,
+// so that crash in the middle of resume doesn't redo completed steps. Lock is extended on every checkpoint.
+func (fs FirestoreEngine) checkpoint(ctx context.Context, wf *DBWorkflow, state *async.WorkflowState) async.Checkpoint {
+	hook := fs.Hooks.checkpoint(ctx, &wf.Meta, *state)
+	if len(wf.SLAs) > 0 {
+		// steps can be passed within single resume, so they are checked after each of them
+		h := hook
+		hook = func(t async.CheckpointType) error {
+			if t == async.CheckpointAfterStep {
+				fs.markReached(wf)
+			}
+			return h(t)
+		}
+	}
+	if fs.CheckpointEvery <= 0 && fs.CheckpointInterval <= 0 {
+		return hook
+	}
+	steps := 0
+	last := time.Now()
+	return func(t async.CheckpointType) error {
+		err := hook(t)
+		if err != nil || t != async.CheckpointAfterStep {
+			return err
+		}
+		steps++
+		if (fs.CheckpointEvery <= 0 || steps < fs.CheckpointEvery) &&
+			(fs.CheckpointInterval <= 0 || time.Since(last) < fs.CheckpointInterval) {
+			return nil
+		}
+		steps = 0
+		last = time.Now()
+		err = fs.saveCheckpoint(ctx, wf, *state)
+		if err != nil {
+			return fmt.Errorf("err saving checkpoint: %w", err)
+		}
+		return nil
+	}
+}
+
+// saveCheckpoint saves state and extends the lock in a single write, if the lock is still held by this resume.
+// Workflow is not projected and parent is not notified, since resume isn't finished yet.
+func (fs FirestoreEngine) saveCheckpoint(ctx context.Context, wf *DBWorkflow, s async.WorkflowState) error {
+	defer logTime("intermediate checkpoint")()
+	state, err := fs.encodeState(s)
+	if err != nil {
+		return err
+	}
+	wf.trackThreads()
+	fs.markReached(wf)
+	lockTill := time.Now().Add(time.Minute).Truncate(time.Microsecond)
+	updates := []firestore.Update{
+		{
+			Path:  "Meta",
+			Value: wf.Meta,
+		},
+		{
+			Path:  "State",
+			Value: state,
+		},
+		{
+			Path:  "ThreadsStarted",
+			Value: wf.ThreadsStarted,
+		},
+		{
+			Path:  "LockTill",
+			Value: lockTill,
+		},
+	}
+	if len(wf.SLAs) > 0 {
+		updates = append(updates, firestore.Update{
+			Path:  "SLAs",
+			Value: wf.SLAs,
+		})
+	}
+	ref := fs.DB.Collection(fs.Collection).Doc(wf.Meta.ID)
+	callCtx, cancel := fs.Timeouts.firestoreCall(ctx)
+	defer cancel()
+	err = fs.DB.RunTransaction(callCtx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var cur DBWorkflow
+		err = doc.DataTo(&cur)
+		if err != nil {
+			return fmt.Errorf("err unmarshaling workflow: %v", err)
+		}
+		if !cur.LockTill.Equal(wf.LockTill) {
+			return fmt.Errorf("%w: lock expired and was taken over", ErrLocked)
+		}
+		return tx.Update(ref, updates)
+	})
+	fs.Costs.read(ctx, wf.Meta.Workflow, 1)
+	fs.Costs.write(ctx, wf.Meta.Workflow, 1)
+	fs.invalidate(wf.Meta.ID)
 	if err != nil {
 		return err
 	}
+	wf.LockTill = lockTill
 	return nil
 }
@@ -0,0 +1,73 @@
+package gasync
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FlagProvider resolves feature flags at runtime, i.e. from config document or LaunchDarkly
+type FlagProvider interface {
+	Enabled(ctx context.Context, flag string) (bool, error)
+}
+
+// FirestoreFlags reads flags from boolean fields of Firestore document. Missing flags are disabled.
+type FirestoreFlags struct {
+	Doc *firestore.DocumentRef
+}
+
+func (f FirestoreFlags) Enabled(ctx context.Context, flag string) (bool, error) {
+	doc, err := f.Doc.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("err reading flags: %v", err)
+	}
+	v, err := doc.DataAtPath(firestore.FieldPath{flag})
+	if err != nil {
+		return false, nil
+	}
+	enabled, _ := v.(bool)
+	return enabled, nil
+}
+
+// FlagDecisions are feature flag values resolved by workflow. They should be stored in workflow state,
+// so that workflow takes the same path on every resume and decisions are recorded in history.
+type FlagDecisions map[string]bool
+
+// FeatureGate executes on branch if flag is enabled and off branch otherwise.
+// Flag is resolved once per workflow, so gates with the same flag in loops take the same branch.
+func (s *Server) FeatureGate(flag string, decisions *FlagDecisions, on, off async.Stmt) async.Stmt {
+	if off == nil {
+		off = async.Section{}
+	}
+	enabled := (*decisions)[flag]
+	return async.Section{
+		async.Step("flag "+flag, func() error {
+			if _, ok := (*decisions)[flag]; ok {
+				return nil
+			}
+			if s.flags == nil {
+				return fmt.Errorf("flag provider is not configured")
+			}
+			v, err := s.flags.Enabled(context.Background(), flag)
+			if err != nil {
+				return fmt.Errorf("err resolving flag %v: %v", flag, err)
+			}
+			if *decisions == nil {
+				*decisions = FlagDecisions{}
+			}
+			(*decisions)[flag] = v
+			return nil
+		}),
+		async.Switch(
+			async.Case(enabled, flag+" on", on),
+			async.Case(!enabled, flag+" off", off),
+		),
+	}
+}
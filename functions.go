@@ -0,0 +1,53 @@
+package gasync
+
+import (
+	"net/http"
+
+	"github.com/gorchestrate/async"
+)
+
+// Functions exposes server endpoints as separate http handlers sharing one engine,
+// so they can be deployed as individual Cloud Functions instead of a single server.
+// Set Config.ResumeURL and Config.TimeoutURL to URLs of deployed Resume and Timeout functions.
+//
+//	var fns = gasync.MustFunctions(cfg, workflows)
+//
+//	func Resume(w http.ResponseWriter, r *http.Request) { fns.Resume(w, r) }
+type Functions struct {
+	Server *Server
+}
+
+func NewFunctions(cfg Config, workflows map[string]func() async.WorkflowState) (*Functions, error) {
+	srv, err := NewServer(cfg, workflows)
+	if err != nil {
+		return nil, err
+	}
+	return &Functions{Server: srv}, nil
+}
+
+// MustFunctions is like NewFunctions, but panics on error. Useful for package-level initialization.
+func MustFunctions(cfg Config, workflows map[string]func() async.WorkflowState) *Functions {
+	f, err := NewFunctions(cfg, workflows)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// Resume handles resume requests sent by Cloud Tasks. CallbackAuth, body size and timeout limits apply as on the server.
+func (f *Functions) Resume(w http.ResponseWriter, r *http.Request) {
+	f.Server.resumeHandler(w, r)
+}
+
+// Timeout handles timeout callbacks sent by Cloud Tasks. CallbackAuth, body size and timeout limits apply as on the server.
+func (f *Functions) Timeout(w http.ResponseWriter, r *http.Request) {
+	f.Server.timeoutHandler(w, r)
+}
+
+// Workflows handles workflow creation, status and event requests.
+// Function path is treated as /wf path of the server, i.e. /{name}/{id}/{event}.
+func (f *Functions) Workflows(w http.ResponseWriter, r *http.Request) {
+	r.URL.Path = "/wf" + r.URL.Path
+	r.URL.RawPath = ""
+	f.Server.Router.ServeHTTP(w, r)
+}
@@ -0,0 +1,264 @@
+package gasyncload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorchestrate/async"
+	"golang.org/x/sync/errgroup"
+)
+
+// Config is a load profile
+type Config struct {
+	URL         string // base URL of the server under test
+	Header      http.Header
+	Client      *http.Client
+	Workflows   int // total number of workflows to run
+	Concurrency int // workflows running at the same time
+	Timeout     time.Duration
+
+	// Workflow shape. Min and max are inclusive, each workflow picks random value in range.
+	MinSteps, MaxSteps   int
+	MinEvents, MaxEvents int // events sent concurrently to the same workflow
+	MinTimers, MaxTimers int
+	TimerDelay           time.Duration
+
+	PollInterval time.Duration // interval of polling workflow status until it's finished
+}
+
+// Latency is a latency distribution of an operation
+type Latency struct {
+	Count int
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// Report is a result of the load test
+type Report struct {
+	Duration   time.Duration
+	Finished   int
+	Failed     int
+	Throughput float64 // finished workflows per second
+	Latency    map[string]Latency
+	Errors     map[string]int // number of failed workflows by error
+}
+
+// operations measured by Run
+const (
+	OpCreate   = "create"
+	OpEvent    = "event"
+	OpComplete = "complete" // from creation till workflow is finished
+)
+
+type recorder struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func (r *recorder) observe(op string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies[op] = append(r.latencies[op], d)
+}
+
+func (r *recorder) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors[err.Error()]++
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+func (r *recorder) report(d time.Duration) Report {
+	ret := Report{
+		Duration: d,
+		Latency:  map[string]Latency{},
+		Errors:   r.errors,
+	}
+	for op, l := range r.latencies {
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		ret.Latency[op] = Latency{
+			Count: len(l),
+			P50:   percentile(l, 0.5),
+			P90:   percentile(l, 0.9),
+			P99:   percentile(l, 0.99),
+			Max:   l[len(l)-1],
+		}
+	}
+	ret.Finished = len(r.latencies[OpComplete])
+	for _, n := range r.errors {
+		ret.Failed += n
+	}
+	if d > 0 {
+		ret.Throughput = float64(ret.Finished) / d.Seconds()
+	}
+	return ret
+}
+
+func between(min, max int) int {
+	if max <= min {
+		return min
+	}
+	return min + rand.Intn(max-min+1)
+}
+
+// Run runs synthetic workflows against the server until all of them are finished or failed.
+// Errors of individual workflows are counted in the report, error is returned only if load can't be generated.
+func Run(ctx context.Context, cfg Config) (Report, error) {
+	if cfg.URL == "" {
+		return Report{}, fmt.Errorf("target URL is required")
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Minute
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Millisecond * 200
+	}
+	cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+	rec := &recorder{
+		latencies: map[string][]time.Duration{},
+		errors:    map[string]int{},
+	}
+	start := time.Now()
+	run := fmt.Sprintf("%x", start.UnixNano())
+	ids := make(chan string)
+	g, gctx := errgroup.WithContext(ctx)
+	for i := 0; i < cfg.Concurrency; i++ {
+		g.Go(func() error {
+			for id := range ids {
+				err := runWorkflow(gctx, cfg, rec, id)
+				if err != nil {
+					rec.fail(err)
+				}
+			}
+			return nil
+		})
+	}
+	g.Go(func() error {
+		defer close(ids)
+		for i := 0; i < cfg.Workflows; i++ {
+			select {
+			case ids <- fmt.Sprintf("load-%v-%d", run, i):
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+		}
+		return nil
+	})
+	err := g.Wait()
+	return rec.report(time.Since(start)), err
+}
+
+func runWorkflow(ctx context.Context, cfg Config, rec *recorder, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	wf := Workflow{
+		Steps:      between(cfg.MinSteps, cfg.MaxSteps),
+		Events:     between(cfg.MinEvents, cfg.MaxEvents),
+		Timers:     between(cfg.MinTimers, cfg.MaxTimers),
+		TimerDelay: cfg.TimerDelay,
+	}
+	start := time.Now()
+	// wait until steps are executed and workflow is waiting for events
+	err := call(ctx, cfg, "POST", fmt.Sprintf("/wf/%v/%v?wait=true&timeout=%v", WorkflowName, id, cfg.Timeout), wf, nil)
+	if err != nil {
+		return fmt.Errorf("err creating workflow: %v", err)
+	}
+	rec.observe(OpCreate, time.Since(start))
+
+	g, gctx := errgroup.WithContext(ctx)
+	for i := 0; i < wf.Events; i++ {
+		i := i
+		g.Go(func() error {
+			eventStart := time.Now()
+			err := call(gctx, cfg, "POST", fmt.Sprintf("/wf/%v/%v/%v", WorkflowName, id, EventName(i)), Event{Payload: id}, nil)
+			if err != nil {
+				return fmt.Errorf("err sending event: %v", err)
+			}
+			rec.observe(OpEvent, time.Since(eventStart))
+			return nil
+		})
+	}
+	err = g.Wait()
+	if err != nil {
+		return err
+	}
+
+	for {
+		var status struct {
+			Meta async.State
+		}
+		err = call(ctx, cfg, "GET", fmt.Sprintf("/wf/%v/%v", WorkflowName, id), nil, &status)
+		if err != nil {
+			return fmt.Errorf("err getting workflow: %v", err)
+		}
+		if status.Meta.Status == async.WorkflowFinished {
+			rec.observe(OpComplete, time.Since(start))
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("workflow is not finished: %v", ctx.Err())
+		case <-time.After(cfg.PollInterval):
+		}
+	}
+}
+
+func call(ctx context.Context, cfg Config, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cfg.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range cfg.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	d, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%v %v: %v", method, resp.StatusCode, strings.TrimSpace(string(d)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(d, out)
+}
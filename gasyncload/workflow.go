@@ -0,0 +1,83 @@
+// Package gasyncload generates synthetic load against a gasync server.
+//
+// Server under test registers synthetic workflow with Register, and Run creates workflows,
+// sends events and waits for workflows to finish, reporting throughput and latency percentiles.
+package gasyncload
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorchestrate/async"
+	"github.com/gorchestrate/gasync"
+)
+
+// WorkflowName is a name synthetic workflow is registered with
+const WorkflowName = "gasyncload"
+
+// Workflow is a synthetic workflow. Shape of the workflow is defined by parameters supplied on creation:
+// Steps are executed sequentially, then Events are awaited in parallel threads (fan-in),
+// then Timers are awaited one after another.
+type Workflow struct {
+	Steps      int
+	Events     int
+	Timers     int
+	TimerDelay time.Duration
+
+	StepsDone      int
+	EventsReceived int
+	TimersFired    int
+
+	server *gasync.Server
+}
+
+// Event is a payload of synthetic event
+type Event struct {
+	Payload string
+}
+
+// Register registers synthetic workflow on the server under test
+func Register(s *gasync.Server) error {
+	return s.RegisterWorkflow(WorkflowName, func() async.WorkflowState {
+		return &Workflow{server: s}
+	})
+}
+
+// EventName is a name of i-th event awaited by the workflow
+func EventName(i int) string {
+	return fmt.Sprintf("event%d", i)
+}
+
+func (wf *Workflow) Definition() async.Section {
+	events := async.Section{}
+	for i := 0; i < wf.Events; i++ {
+		events = append(events, async.Go(fmt.Sprintf("fan-in %d", i),
+			async.Wait(fmt.Sprintf("wait event %d", i),
+				async.OnEvent(EventName(i), func(in Event) (Event, error) {
+					wf.EventsReceived++
+					return in, nil
+				}),
+			),
+		))
+	}
+	return async.S(
+		async.For("steps", wf.StepsDone < wf.Steps,
+			async.Step("step", func() error {
+				wf.StepsDone++
+				return nil
+			}),
+		),
+		events,
+		async.WaitFor("all events received", wf.EventsReceived >= wf.Events, func() {}),
+		async.For("timers", wf.TimersFired < wf.Timers,
+			async.Wait("wait timer",
+				wf.server.Timeout("timer", wf.TimerDelay,
+					async.Step("timer fired", func() error {
+						wf.TimersFired++
+						return nil
+					}),
+				),
+			),
+		),
+	)
+}
@@ -0,0 +1,255 @@
+// Package gasynctest helps testing servers and workflows built with gasync.
+package gasynctest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/rpcreplay"
+	"github.com/gorchestrate/gasync"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+	firestorepb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/protobuf/runtime/protoiface"
+)
+
+// Fixtures record GCP API interactions of the server into files and replay them,
+// so that handlers get integration-level test coverage in CI without live credentials.
+// Firestore gRPC calls are recorded with rpcreplay into Name.grpc, Cloud Tasks REST calls - into Name.http.json.
+//
+//	f, err := gasynctest.OpenFixtures("testdata", "create", os.Getenv("RECORD") != "")
+//	err = f.Apply(ctx, &cfg)
+//	s, err := gasync.NewServer(cfg, workflows)
+//	... // use f.Seed() in workflow IDs, so that they are the same on replay
+//	err = f.Close()
+//
+// Commit requests are matched by written documents and field paths, since field values contain timestamps.
+// Queries and reads are matched exactly, so they should not depend on current time.
+// Request bodies and response headers of http calls are not stored, since they contain signed callbacks and credentials.
+type Fixtures struct {
+	Dir    string
+	Name   string
+	Record bool // call live services and record interactions, otherwise replay recorded ones
+
+	seed  string
+	rec   *rpcreplay.Recorder
+	rep   *rpcreplay.Replayer
+	tasks *RecordingTransport
+}
+
+// OpenFixtures prepares recording or loads recorded fixture
+func OpenFixtures(dir, name string, record bool) (*Fixtures, error) {
+	f := &Fixtures{
+		Dir:    dir,
+		Name:   name,
+		Record: record,
+		tasks:  &RecordingTransport{Record: record},
+	}
+	if record {
+		f.seed = strconv.FormatInt(time.Now().UnixNano(), 36)
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("err creating fixtures dir: %v", err)
+		}
+		f.rec, err = rpcreplay.NewRecorder(f.path(".grpc"), []byte(f.seed))
+		if err != nil {
+			return nil, fmt.Errorf("err creating grpc recorder: %v", err)
+		}
+		f.rec.BeforeFunc = scrubFirestore
+		return f, nil
+	}
+	var err error
+	f.rep, err = rpcreplay.NewReplayer(f.path(".grpc"))
+	if err != nil {
+		return nil, fmt.Errorf("err reading grpc fixture: %v", err)
+	}
+	f.rep.BeforeFunc = scrubFirestore
+	f.seed = string(f.rep.Initial())
+	d, err := ioutil.ReadFile(f.path(".http.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("err reading http fixture: %v", err)
+	}
+	if err == nil {
+		err = json.Unmarshal(d, &f.tasks.Calls)
+		if err != nil {
+			return nil, fmt.Errorf("err unmarshaling http fixture: %v", err)
+		}
+	}
+	return f, nil
+}
+
+func (f *Fixtures) path(ext string) string {
+	return filepath.Join(f.Dir, f.Name+ext)
+}
+
+// Seed is a random value generated on recording and stored in fixture.
+// Values that would differ between runs, i.e. workflow IDs, should be derived from it.
+func (f *Fixtures) Seed() string {
+	return f.seed
+}
+
+// Apply sets Firestore and Cloud Tasks client options of the config.
+// Application default credentials are used for recording.
+func (f *Fixtures) Apply(ctx context.Context, cfg *gasync.Config) error {
+	if f.Record {
+		for _, o := range f.rec.DialOptions() {
+			cfg.FirestoreOptions = append(cfg.FirestoreOptions, option.WithGRPCDialOption(o))
+		}
+		base, err := htransport.NewTransport(ctx, http.DefaultTransport, append(cfg.CloudTasksOptions,
+			option.WithScopes("https://www.googleapis.com/auth/cloud-platform"))...)
+		if err != nil {
+			return fmt.Errorf("err creating cloud tasks transport: %v", err)
+		}
+		f.tasks.Base = base
+	} else {
+		conn, err := f.rep.Connection()
+		if err != nil {
+			return fmt.Errorf("err creating replay connection: %v", err)
+		}
+		cfg.FirestoreOptions = append(cfg.FirestoreOptions, option.WithGRPCConn(conn))
+	}
+	cfg.CloudTasksOptions = append(cfg.CloudTasksOptions, option.WithHTTPClient(&http.Client{Transport: f.tasks}))
+	return nil
+}
+
+// Close writes recorded fixtures
+func (f *Fixtures) Close() error {
+	if !f.Record {
+		return f.rep.Close()
+	}
+	err := f.rec.Close()
+	if err != nil {
+		return fmt.Errorf("err writing grpc fixture: %v", err)
+	}
+	d, err := json.MarshalIndent(f.tasks.Calls, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.path(".http.json"), d, 0644)
+}
+
+// scrubFirestore drops field values of written documents, so that commits with different timestamps are matched on replay
+func scrubFirestore(method string, m protoiface.MessageV1) error {
+	req, ok := m.(*firestorepb.CommitRequest)
+	if !ok {
+		return nil
+	}
+	for _, w := range req.Writes {
+		if doc := w.GetUpdate(); doc != nil {
+			doc.Fields = nil
+		}
+	}
+	return nil
+}
+
+// RecordedCall is an http interaction stored in fixture
+type RecordedCall struct {
+	Method      string
+	URL         string
+	RequestHash string // sha256 of request body for debugging, not used for matching
+	Status      int
+	Header      http.Header // only recordedHeaders are kept
+	Response    string
+}
+
+// recordedHeaders are response headers stored in fixture, others may contain cookies or tokens
+var recordedHeaders = []string{"Content-Type"}
+
+func scrubHeader(h http.Header) http.Header {
+	ret := http.Header{}
+	for _, k := range recordedHeaders {
+		if v, ok := h[k]; ok {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// RecordingTransport records http calls made via Base or replays recorded calls.
+// Calls are matched by method and URL in the order they were recorded.
+type RecordingTransport struct {
+	Record bool
+	Base   http.RoundTripper // live transport used for recording, http.DefaultTransport by default
+
+	mu    sync.Mutex
+	Calls []RecordedCall
+	used  map[int]bool
+}
+
+func (t *RecordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if t.Record {
+		return t.record(r, body)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.used == nil {
+		t.used = map[int]bool{}
+	}
+	for i, c := range t.Calls {
+		if t.used[i] || c.Method != r.Method || c.URL != r.URL.String() {
+			continue
+		}
+		t.used[i] = true
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", c.Status, http.StatusText(c.Status)),
+			StatusCode: c.Status,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     c.Header,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte(c.Response))),
+			Request:    r,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded call for %v %v", r.Method, r.URL)
+}
+
+func (t *RecordingTransport) record(r *http.Request, body []byte) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(r)
+	if err != nil {
+		return nil, err
+	}
+	d, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(d))
+	t.mu.Lock()
+	hash := sha256.Sum256(body)
+	t.Calls = append(t.Calls, RecordedCall{
+		Method:      r.Method,
+		URL:         r.URL.String(),
+		RequestHash: hex.EncodeToString(hash[:]),
+		Status:      resp.StatusCode,
+		Header:      scrubHeader(resp.Header),
+		Response:    string(d),
+	})
+	t.mu.Unlock()
+	return resp, nil
+}
@@ -0,0 +1,259 @@
+package gasync
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// GCSObject is metadata of GCS object, as sent in bucket notifications
+type GCSObject struct {
+	Bucket      string            `json:"bucket"`
+	Name        string            `json:"name"`
+	ContentType string            `json:"contentType"`
+	Size        string            `json:"size"`
+	MD5Hash     string            `json:"md5Hash"`
+	Generation  string            `json:"generation"`
+	Updated     time.Time         `json:"updated"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// DBGCSWatch is interest of waiting workflow in GCS object. Stored in Collection+"_gcs_watches".
+type DBGCSWatch struct {
+	Bucket string
+	Object string // object name or prefix
+	Prefix bool
+	Req    async.CallbackRequest
+}
+
+// GCSObjectHandler resumes workflow when object is created in GCS bucket.
+// Bucket should have Pub/Sub notification config for OBJECT_FINALIZE events (or Eventarc trigger),
+// delivering them to Server.GCSPushURL().
+type GCSObjectHandler struct {
+	Bucket string
+	Object string // exact object name, or prefix if it ends with "*"
+	// Metadata receives metadata of created object. Optional.
+	Metadata *GCSObject
+
+	engine  *FirestoreEngine
+	storage *storage.Service
+	timers  TimerScheduler
+}
+
+// GCSObject waits until object is created in the bucket. Objects that already exist when workflow starts waiting are delivered immediately.
+func (s *Server) GCSObject(name, bucket, object string, metadata *GCSObject, stmts ...async.Stmt) async.Event {
+	return async.On(name, &GCSObjectHandler{
+		Bucket:   bucket,
+		Object:   object,
+		Metadata: metadata,
+		engine:   s.Engine,
+		storage:  s.storage,
+		timers:   s.timers,
+	}, stmts...)
+}
+
+func (h GCSObjectHandler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type   string
+		Bucket string
+		Object string
+	}{
+		Type:   "gcs_object",
+		Bucket: h.Bucket,
+		Object: h.Object,
+	})
+}
+
+func (fs FirestoreEngine) gcsWatches() *firestore.CollectionRef {
+	return fs.DB.Collection(fs.Collection + "_gcs_watches")
+}
+
+func gcsWatchID(req async.CallbackRequest) string {
+	return fmt.Sprintf("%v_%v_%v", req.WorkflowID, req.ThreadID, req.PC)
+}
+
+func (h *GCSObjectHandler) Setup(ctx context.Context, req async.CallbackRequest) (string, error) {
+	defer logTime("gcs watch setup")()
+	w := DBGCSWatch{
+		Bucket: h.Bucket,
+		Object: strings.TrimSuffix(h.Object, "*"),
+		Prefix: strings.HasSuffix(h.Object, "*"),
+		Req:    req,
+	}
+	_, err := h.engine.gcsWatches().Doc(gcsWatchID(req)).Set(ctx, w)
+	if err != nil {
+		return "", fmt.Errorf("err registering gcs watch: %v", err)
+	}
+	if w.Prefix || h.storage == nil {
+		return "", nil
+	}
+	// object may be created before workflow started waiting for it
+	_, err = h.storage.Objects.Get(h.Bucket, h.Object).Context(ctx).Do()
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) && gErr.Code == http.StatusNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("err checking gcs object: %v", err)
+	}
+	_, err = h.timers.Setup(ctx, req, 0)
+	if err != nil {
+		return "", fmt.Errorf("err delivering existing gcs object: %v", err)
+	}
+	return "", nil
+}
+
+// Handle receives object metadata from notification, or fetches it if callback was delivered for existing object
+func (h *GCSObjectHandler) Handle(ctx context.Context, req async.CallbackRequest, input interface{}) (interface{}, error) {
+	var obj GCSObject
+	switch d := input.(type) {
+	case []byte:
+		err := json.Unmarshal(d, &obj)
+		if err != nil {
+			return nil, fmt.Errorf("err unmarshaling gcs object: %v", err)
+		}
+	case nil:
+		if h.storage == nil {
+			return nil, fmt.Errorf("gcs object metadata is not delivered")
+		}
+		o, err := h.storage.Objects.Get(h.Bucket, h.Object).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("err getting gcs object: %v", err)
+		}
+		meta, err := o.MarshalJSON()
+		if err == nil {
+			err = json.Unmarshal(meta, &obj)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("err converting gcs object: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected gcs input type %T", input)
+	}
+	if h.Metadata != nil {
+		*h.Metadata = obj
+	}
+	return obj, nil
+}
+
+func (h *GCSObjectHandler) Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error {
+	_, err := h.engine.gcsWatches().Doc(gcsWatchID(req)).Delete(ctx)
+	if err != nil {
+		return fmt.Errorf("err deleting gcs watch: %v", err)
+	}
+	return nil
+}
+
+// matchGCSWatches returns watches interested in the object
+func (fs FirestoreEngine) matchGCSWatches(ctx context.Context, obj GCSObject) ([]DBGCSWatch, error) {
+	exact, err := fs.gcsWatches().Where("Bucket", "==", obj.Bucket).Where("Object", "==", obj.Name).Where("Prefix", "==", false).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	prefixes, err := fs.gcsWatches().Where("Bucket", "==", obj.Bucket).Where("Prefix", "==", true).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	ret := []DBGCSWatch{}
+	for _, doc := range append(exact, prefixes...) {
+		var w DBGCSWatch
+		err = doc.DataTo(&w)
+		if err != nil {
+			return nil, fmt.Errorf("err unmarshaling gcs watch %v: %v", doc.Ref.ID, err)
+		}
+		if w.Prefix && !strings.HasPrefix(obj.Name, w.Object) {
+			continue
+		}
+		ret = append(ret, w)
+	}
+	return ret, nil
+}
+
+// gcsToken authenticates push requests, it's passed in GCSPushURL
+func gcsToken(secret string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte("gcs"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// GCSPushURL is an endpoint for Pub/Sub push subscription or Eventarc trigger delivering bucket notifications
+func (s *Server) GCSPushURL() string {
+	return fmt.Sprintf("%v/events/gcs?token=%v", strings.Trim(s.baseURL, "/"), gcsToken(s.Scheduler.Secret))
+}
+
+// gcsHandler accepts Pub/Sub push messages and Eventarc CloudEvents about created objects
+func gcsHandler(engine *FirestoreEngine, secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hmac.Equal([]byte(r.URL.Query().Get("token")), []byte(gcsToken(secret))) {
+			jsonErr(w, fmt.Errorf("token invalid"), 403)
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		if ce := r.Header.Get("Ce-Type"); ce != "" {
+			if ce != "google.cloud.storage.object.v1.finalized" {
+				return // other events are acknowledged and ignored
+			}
+		} else {
+			var push struct {
+				Message struct {
+					Attributes map[string]string
+					Data       string
+				}
+			}
+			err = json.Unmarshal(body, &push)
+			if err != nil {
+				jsonErr(w, err, 400)
+				return
+			}
+			if push.Message.Attributes["eventType"] != "OBJECT_FINALIZE" {
+				return
+			}
+			body, err = base64.StdEncoding.DecodeString(push.Message.Data)
+			if err != nil {
+				jsonErr(w, err, 400)
+				return
+			}
+		}
+		var obj GCSObject
+		err = json.Unmarshal(body, &obj)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		watches, err := engine.matchGCSWatches(r.Context(), obj)
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		failed := 0
+		for _, wt := range watches {
+			_, err = engine.HandleCallback(r.Context(), wt.Req.WorkflowID, wt.Req, body)
+			if err != nil {
+				log.Printf("err delivering gcs object %v/%v to workflow %v: %v", obj.Bucket, obj.Name, wt.Req.WorkflowID, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			// Pub/Sub redelivers the message, workflows that already handled it reject duplicate callback
+			jsonErr(w, fmt.Errorf("gcs object was not delivered to %v of %v workflows", failed, len(watches)), 500)
+		}
+	}
+}
@@ -0,0 +1,512 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/jsonschema"
+	"github.com/gorchestrate/async"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// JSONScalar passes arbitrary JSON values through GraphQL as is.
+var JSONScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "arbitrary JSON value",
+	Serialize: func(v interface{}) interface{} {
+		if d, ok := v.(json.RawMessage); ok {
+			return pjson(d)
+		}
+		return v
+	},
+	ParseValue: func(v interface{}) interface{} {
+		return v
+	},
+	ParseLiteral: parseJSONLiteral,
+})
+
+func parseJSONLiteral(v ast.Value) interface{} {
+	switch x := v.(type) {
+	case *ast.StringValue:
+		return x.Value
+	case *ast.BooleanValue:
+		return x.Value
+	case *ast.IntValue:
+		i, _ := strconv.ParseInt(x.Value, 10, 64)
+		return i
+	case *ast.FloatValue:
+		f, _ := strconv.ParseFloat(x.Value, 64)
+		return f
+	case *ast.ListValue:
+		ret := []interface{}{}
+		for _, v := range x.Values {
+			ret = append(ret, parseJSONLiteral(v))
+		}
+		return ret
+	case *ast.ObjectValue:
+		ret := map[string]interface{}{}
+		for _, f := range x.Fields {
+			ret[f.Name.Value] = parseJSONLiteral(f.Value)
+		}
+		return ret
+	}
+	return nil
+}
+
+var graphqlWorkflow = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Workflow",
+	Fields: graphql.Fields{
+		"id": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*DBWorkflow).Meta.ID, nil
+			},
+		},
+		"name": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*DBWorkflow).Meta.Workflow, nil
+			},
+		},
+		"status": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return string(p.Source.(*DBWorkflow).Meta.Status), nil
+			},
+		},
+		"priority": &graphql.Field{
+			Type: graphql.Int,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*DBWorkflow).Priority, nil
+			},
+		},
+		"labels": &graphql.Field{
+			Type: JSONScalar,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(*DBWorkflow).Labels, nil
+			},
+		},
+		"meta": &graphql.Field{
+			Type: JSONScalar,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return jsonValue(p.Source.(*DBWorkflow).Meta)
+			},
+		},
+		"state": &graphql.Field{
+			Type: JSONScalar,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return jsonValue(p.Source.(*DBWorkflow).State)
+			},
+		},
+	},
+})
+
+// jsonValue converts Go value to generic JSON value, so that it's rendered using JSON field names
+func jsonValue(in interface{}) (interface{}, error) {
+	d, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(d, &out)
+	return out, err
+}
+
+var graphqlName = regexp.MustCompile(`[^_a-zA-Z0-9]`)
+
+// schemaInputs generates GraphQL input types from event JSON schemas
+type schemaInputs struct {
+	types map[string]*graphql.InputObject
+}
+
+func (si *schemaInputs) input(name string, t *jsonschema.Type, defs jsonschema.Definitions) graphql.Input {
+	if strings.HasPrefix(t.Ref, "#/definitions/") {
+		ref := strings.TrimPrefix(t.Ref, "#/definitions/")
+		def, ok := defs[ref]
+		if !ok {
+			return JSONScalar
+		}
+		return si.input(ref, def, defs)
+	}
+	switch t.Type {
+	case "string":
+		return graphql.String
+	case "integer":
+		return graphql.Int
+	case "number":
+		return graphql.Float
+	case "boolean":
+		return graphql.Boolean
+	case "array":
+		if t.Items == nil {
+			return graphql.NewList(JSONScalar)
+		}
+		return graphql.NewList(si.input(name+"Item", t.Items, defs))
+	case "object":
+		if t.Properties == nil || len(t.Properties.Keys()) == 0 {
+			return JSONScalar
+		}
+		name = graphqlName.ReplaceAllString(name, "_") + "Input"
+		if in, ok := si.types[name]; ok {
+			return in
+		}
+		required := map[string]bool{}
+		for _, v := range t.Required {
+			required[v] = true
+		}
+		fields := graphql.InputObjectConfigFieldMap{}
+		in := graphql.NewInputObject(graphql.InputObjectConfig{
+			Name:   name,
+			Fields: fields,
+		})
+		si.types[name] = in
+		for _, k := range t.Properties.Keys() {
+			v, _ := t.Properties.Get(k)
+			pt, ok := v.(*jsonschema.Type)
+			if !ok {
+				continue
+			}
+			var ft graphql.Input = si.input(name+"_"+k, pt, defs)
+			if required[k] {
+				ft = graphql.NewNonNull(ft)
+			}
+			fields[graphqlName.ReplaceAllString(k, "_")] = &graphql.InputObjectFieldConfig{
+				Type:        ft,
+				Description: pt.Description,
+			}
+		}
+		return in
+	}
+	return JSONScalar
+}
+
+// GraphQLConfig applies the same rules to GraphQL requests as to REST endpoints
+type GraphQLConfig struct {
+	IDRules      IDRules
+	EventAliases EventAliases
+	Quotas       *Quotas
+	AdminAuth    func(r *http.Request) error // required for cancel and for event payloads in history
+}
+
+func (cfg GraphQLConfig) admin(ctx context.Context) bool {
+	r, ok := RequestFromContext(ctx)
+	return ok && cfg.AdminAuth != nil && cfg.AdminAuth(r) == nil
+}
+
+// GraphQLSchema builds GraphQL schema for the workflows.
+// Each event handled via ReflectEvent gets a separate typed mutation named {workflow}_{event}.
+func GraphQLSchema(engine *FirestoreEngine, cfg GraphQLConfig) (graphql.Schema, error) {
+	getWorkflow := func(p graphql.ResolveParams, id string) (interface{}, error) {
+		wf, err := engine.Get(p.Context, id)
+		if err != nil {
+			return nil, err
+		}
+		return engine.Redact(wf)
+	}
+	query := graphql.Fields{
+		"workflow": &graphql.Field{
+			Type: graphqlWorkflow,
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return getWorkflow(p, p.Args["id"].(string))
+			},
+		},
+		"history": &graphql.Field{
+			Type:        graphql.NewList(JSONScalar),
+			Description: "history entries, oldest first. Event payloads are returned only to admins",
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				entries, err := engine.ReadHistory(p.Context, p.Args["id"].(string))
+				if err != nil {
+					return nil, err
+				}
+				admin := cfg.admin(p.Context)
+				ret := []interface{}{}
+				for _, l := range entries {
+					wf, err := engine.Redact(&DBWorkflow{Meta: l.Meta, State: l.State})
+					if err != nil {
+						return nil, err
+					}
+					l.State = wf.State
+					if !admin {
+						l.Input = nil
+						l.Output = nil
+					}
+					v, err := jsonValue(l)
+					if err != nil {
+						return nil, err
+					}
+					ret = append(ret, v)
+				}
+				return ret, nil
+			},
+		},
+		"workflows": &graphql.Field{
+			Type: graphql.NewList(graphqlWorkflow),
+			Args: graphql.FieldConfigArgument{
+				"name":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"labels": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.String), Description: "labels in key:value format"},
+				"limit":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 100},
+				"order":  &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				labelArgs := []string{}
+				if ll, ok := p.Args["labels"].([]interface{}); ok {
+					for _, l := range ll {
+						labelArgs = append(labelArgs, fmt.Sprint(l))
+					}
+				}
+				labels, err := parseLabels(labelArgs)
+				if err != nil {
+					return nil, err
+				}
+				order, _ := p.Args["order"].(string)
+				wfs, err := engine.List(p.Context, p.Args["name"].(string), ListQuery{
+					Labels:  labels,
+					Limit:   p.Args["limit"].(int),
+					OrderBy: order,
+				})
+				if err != nil {
+					return nil, err
+				}
+				ret := []*DBWorkflow{}
+				for i := range wfs {
+					wf, err := engine.Redact(&wfs[i])
+					if err != nil {
+						return nil, err
+					}
+					ret = append(ret, wf)
+				}
+				return ret, nil
+			},
+		},
+	}
+	sendEvent := func(p graphql.ResolveParams, wfName, id, event string) (interface{}, error) {
+		err := cfg.IDRules.Validate(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(cfg.EventAliases) > 0 {
+			if wfName == "" {
+				wf, err := engine.Get(p.Context, id)
+				if err != nil {
+					return nil, err
+				}
+				wfName = wf.Meta.Workflow
+			}
+			if alias, ok := cfg.EventAliases.get(wfName, event); ok {
+				engine.Metrics.deprecatedEvent(p.Context, wfName, event)
+				log.Printf("deprecated event %v/%v is used, should be %v", wfName, event, alias.Event)
+				event = alias.Event
+			}
+		}
+		input := p.Args["input"]
+		if input == nil {
+			input = map[string]interface{}{}
+		}
+		d, err := json.Marshal(input)
+		if err != nil {
+			return nil, err
+		}
+		return engine.HandleEvent(p.Context, id, event, d)
+	}
+	mutation := graphql.Fields{
+		"create": &graphql.Field{
+			Type: graphqlWorkflow,
+			Args: graphql.FieldConfigArgument{
+				"name":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"id":       &graphql.ArgumentConfig{Type: graphql.String, Description: "generated if not set"},
+				"labels":   &graphql.ArgumentConfig{Type: graphql.NewList(graphql.String), Description: "labels in key:value format"},
+				"priority": &graphql.ArgumentConfig{Type: graphql.Int},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				name := p.Args["name"].(string)
+				wf, _, ok := engine.Workflows.Get(name)
+				if !ok {
+					return nil, fmt.Errorf("workflow %v not found", name)
+				}
+				id, _ := p.Args["id"].(string)
+				if id == "" {
+					id = newID()
+				}
+				err := cfg.IDRules.Validate(id)
+				if err != nil {
+					return nil, err
+				}
+				labelArgs := []string{}
+				if ll, ok := p.Args["labels"].([]interface{}); ok {
+					for _, l := range ll {
+						labelArgs = append(labelArgs, fmt.Sprint(l))
+					}
+				}
+				labels, err := parseLabels(labelArgs)
+				if err != nil {
+					return nil, err
+				}
+				stripQuotaLabel(labels)
+				if r, ok := RequestFromContext(p.Context); ok && cfg.Quotas != nil {
+					key := cfg.Quotas.Key(r)
+					err = checkConcurrentQuota(p.Context, cfg.Quotas, engine, key)
+					if err != nil {
+						return nil, err
+					}
+					if key != "" {
+						labels[QuotaLabel] = quotaKeyID(key)
+					}
+				}
+				priority, _ := p.Args["priority"].(int)
+				err = engine.ScheduleAndCreate(p.Context, id, name, wf(), CreateOptions{
+					Labels:   labels,
+					Priority: priority,
+				})
+				if err != nil {
+					return nil, err
+				}
+				err = engine.ResumeOrSchedule(p.Context, id)
+				if err != nil {
+					return nil, err
+				}
+				return getWorkflow(p, id)
+			},
+		},
+		"sendEvent": &graphql.Field{
+			Type: JSONScalar,
+			Args: graphql.FieldConfigArgument{
+				"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"event": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"input": &graphql.ArgumentConfig{Type: JSONScalar},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return sendEvent(p, "", p.Args["id"].(string), p.Args["event"].(string))
+			},
+		},
+		"cancel": &graphql.Field{
+			Type: graphqlWorkflow,
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if !cfg.admin(p.Context) {
+					return nil, fmt.Errorf("%w: cancel requires admin auth", ErrForbidden)
+				}
+				err := engine.Cancel(p.Context, p.Args["id"].(string))
+				if err != nil {
+					return nil, err
+				}
+				return getWorkflow(p, p.Args["id"].(string))
+			},
+		},
+	}
+	si := &schemaInputs{types: map[string]*graphql.InputObject{}}
+	for _, wfName := range engine.Workflows.Names() {
+		wfName := wfName
+		wf, _, ok := engine.Workflows.Get(wfName)
+		if !ok {
+			continue
+		}
+		_, err := async.Walk(wf().Definition(), func(s async.Stmt) bool {
+			x, ok := s.(async.WaitEventsStmt)
+			if !ok {
+				return false
+			}
+			for _, v := range x.Cases {
+				h, ok := reflectEvent(v.Handler)
+				if !ok {
+					continue
+				}
+				in, _, err := h.Schemas()
+				if err != nil {
+					continue
+				}
+				event := v.Callback.Name
+				mutation[graphqlName.ReplaceAllString(wfName+"_"+event, "_")] = &graphql.Field{
+					Type: JSONScalar,
+					Args: graphql.FieldConfigArgument{
+						"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+						"input": &graphql.ArgumentConfig{Type: si.input(in.Ref, in.Type, in.Definitions)},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return sendEvent(p, wfName, p.Args["id"].(string), event)
+					},
+				}
+			}
+			return false
+		})
+		if err != nil {
+			return graphql.Schema{}, fmt.Errorf("err walking workflow %v: %v", wfName, err)
+		}
+	}
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: query}),
+		Mutation: graphql.NewObject(graphql.ObjectConfig{Name: "Mutation", Fields: mutation}),
+	})
+}
+
+// isMutation checks if the operation of the query is a mutation. Invalid queries are reported by graphql.Do.
+func isMutation(query, operationName string) bool {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return false
+	}
+	for _, d := range doc.Definitions {
+		op, ok := d.(*ast.OperationDefinition)
+		if !ok || op.Operation != ast.OperationTypeMutation {
+			continue
+		}
+		if operationName == "" || (op.Name != nil && op.Name.Value == operationName) {
+			return true
+		}
+	}
+	return false
+}
+
+// GraphQLHandler serves GraphQL requests in standard {query, variables, operationName} format.
+// Mutations are accepted only via POST with JSON body, so that they can't be triggered cross-site by links or forms.
+func GraphQLHandler(schema graphql.Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query         string                 `json:"query"`
+			Variables     map[string]interface{} `json:"variables"`
+			OperationName string                 `json:"operationName"`
+		}
+		if r.Method == "GET" {
+			req.Query = r.URL.Query().Get("query")
+			req.OperationName = r.URL.Query().Get("operationName")
+			if isMutation(req.Query, req.OperationName) {
+				jsonErr(w, fmt.Errorf("mutations are allowed only via POST"), http.StatusMethodNotAllowed)
+				return
+			}
+		} else {
+			if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+				jsonErr(w, fmt.Errorf("content type should be application/json"), http.StatusUnsupportedMediaType)
+				return
+			}
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				jsonErr(w, fmt.Errorf("json parse: %v", err), 400)
+				return
+			}
+		}
+		res := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			VariableValues: req.Variables,
+			OperationName:  req.OperationName,
+			Context:        withRequest(r.Context(), r), // event middleware, i.e. EventRoles, applies to mutations
+		})
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
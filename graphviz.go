@@ -1,34 +1,120 @@
 package gasync
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net/url"
 	"reflect"
 	"strconv"
+	"sync"
 
 	"github.com/awalterschulze/gographviz"
+	"github.com/goccy/go-graphviz"
 
 	"github.com/gorchestrate/async"
 )
 
+// Grapher renders workflow definition to graphviz dot format.
+// Output is deterministic for the same definition, so it can be cached by its hash.
 type Grapher struct {
+	Theme GraphTheme
+
 	g *gographviz.Graph
+	n int // counter for anonymous nodes
+}
+
+// GraphTheme customizes graph look, i.e. for embedding graphs in docs. Zero values use graphviz defaults.
+type GraphTheme struct {
+	RankDir   string // TB or LR
+	FontName  string
+	FontSize  string
+	Color     string // color of node outlines and edges
+	FillColor string
+	BgColor   string
+	// Shapes override node shapes by kind: terminal, step, wait, event, parallel, loop
+	Shapes map[string]string
+	Legend bool // add legend explaining glyphs
+}
+
+var defaultShapes = map[string]string{
+	"terminal": "circle",
+	"step":     "box",
+	"wait":     "hexagon",
+	"event":    "component",
+	"parallel": "ellipse",
+	"loop":     "hexagon",
+}
+
+// legend explains glyphs used in node labels
+var legend = [][2]string{
+	{"⚙️", "step"},
+	{"⏸", "wait"},
+	{"▶️", "event via API"},
+	{"🕑", "timeout"},
+	{"🔁", "poll"},
+	{"⚡", "other event"},
+	{"↺", "loop"},
+}
+
+func (t GraphTheme) shape(kind string) string {
+	if s, ok := t.Shapes[kind]; ok {
+		return s
+	}
+	return defaultShapes[kind]
+}
+
+// attrs returns non-empty attributes quoted for dot
+func attrs(kv ...string) map[string]string {
+	ret := map[string]string{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] != "" {
+			ret[kv[i]] = strconv.Quote(kv[i+1])
+		}
+	}
+	return ret
+}
+
+func (g *Grapher) edgeAttrs() map[string]string {
+	return attrs("color", g.Theme.Color)
 }
 
 func (g *Grapher) Dot(s async.Stmt) string {
 	g.g = gographviz.NewGraph()
+	g.n = 0
 	g.g.Directed = true
+	for k, v := range attrs("rankdir", g.Theme.RankDir, "bgcolor", g.Theme.BgColor, "fontname", g.Theme.FontName) {
+		_ = g.g.AddAttr("", k, v)
+	}
 	ctx := GraphCtx{}
-	start := ctx.node(g, "start", "start", "circle")
-	end := ctx.node(g, "", "end", "circle")
+	start := ctx.node(g, "start", "start", "terminal")
+	end := ctx.node(g, "", "end", "terminal")
 	ctx.Prev = []string{start}
 	octx := g.Walk(s, ctx)
 	g.AddEdges(octx.Prev, end)
+	if g.Theme.Legend {
+		g.addLegend()
+	}
 	return g.g.String()
 }
 
+func (g *Grapher) addLegend() {
+	_ = g.g.AddSubGraph("", "cluster_legend", attrs("label", "Legend", "fontname", g.Theme.FontName))
+	prev := ""
+	for i, l := range legend {
+		id := fmt.Sprintf("legend_%v", i)
+		_ = g.g.AddNode("cluster_legend", id, attrs("label", l[0]+" "+l[1], "shape", "plaintext", "fontname", g.Theme.FontName, "fontsize", g.Theme.FontSize))
+		if prev != "" {
+			_ = g.g.AddEdge(prev, id, true, attrs("style", "invis"))
+		}
+		prev = id
+	}
+}
+
 func (g *Grapher) AddEdges(from []string, to string) {
 	for _, v := range from {
-		_ = g.g.AddEdge(v, to, true, nil)
+		_ = g.g.AddEdge(v, to, true, g.edgeAttrs())
 	}
 }
 
@@ -36,7 +122,7 @@ func (g *Grapher) AddEdge(from string, to string) {
 	if from == "" || to == "" {
 		return
 	}
-	_ = g.g.AddEdge(from, to, true, nil)
+	_ = g.g.AddEdge(from, to, true, g.edgeAttrs())
 }
 
 type GraphCtx struct {
@@ -45,19 +131,19 @@ type GraphCtx struct {
 	Break  []string
 }
 
-var ncount int
-
-func (ctx *GraphCtx) node(g *Grapher, id, name string, shape string) string {
+func (ctx *GraphCtx) node(g *Grapher, id, name string, kind string) string {
 	if id == "" {
-		ncount++
-		id = fmt.Sprint(ncount)
+		g.n++
+		id = fmt.Sprint(g.n)
 	} else {
 		id = strconv.Quote(id)
 	}
-	_ = g.g.AddNode("", id, map[string]string{
-		"label": strconv.Quote(name),
-		"shape": shape,
-	})
+	a := attrs("label", name, "shape", g.Theme.shape(kind), "fontname", g.Theme.FontName, "fontsize", g.Theme.FontSize,
+		"color", g.Theme.Color, "fillcolor", g.Theme.FillColor)
+	if g.Theme.FillColor != "" {
+		a["style"] = "filled"
+	}
+	_ = g.g.AddNode("", id, a)
 	return id
 }
 
@@ -66,7 +152,7 @@ func (g *Grapher) Walk(s async.Stmt, ctx GraphCtx) GraphCtx {
 	case nil:
 		return GraphCtx{}
 	case async.ReturnStmt:
-		n := ctx.node(g, "", "end", "circle")
+		n := ctx.node(g, "", "end", "terminal")
 		g.AddEdges(ctx.Prev, n)
 		return GraphCtx{}
 	case async.BreakStmt:
@@ -74,30 +160,33 @@ func (g *Grapher) Walk(s async.Stmt, ctx GraphCtx) GraphCtx {
 	case async.ContinueStmt:
 		return GraphCtx{}
 	case async.StmtStep:
-		id := ctx.node(g, x.Name, "⚙️ "+x.Name+"  ", "box")
+		id := ctx.node(g, x.Name, "⚙️ "+x.Name+"  ", "step")
 		g.AddEdges(ctx.Prev, id)
 		return GraphCtx{Prev: []string{id}}
 	case async.WaitCondStmt:
-		id := ctx.node(g, x.Name, "⏸ wait for "+x.Name, "hexagon")
+		id := ctx.node(g, x.Name, "⏸ wait for "+x.Name, "wait")
 		g.AddEdges(ctx.Prev, id)
 		return GraphCtx{Prev: []string{id}}
 	case async.WaitEventsStmt:
-		id := ctx.node(g, x.Name, "⏸ wait "+x.Name, "hexagon")
+		id := ctx.node(g, x.Name, "⏸ wait "+x.Name, "wait")
 		g.AddEdges(ctx.Prev, id)
 		prev := []string{}
 		breaks := []string{}
 		for _, v := range x.Cases {
 			var cid string
-			_, ok := v.Handler.(*async.ReflectEvent)
+			_, ok := reflectEvent(v.Handler)
 			_, ok2 := v.Handler.(*TimeoutHandler)
+			_, ok3 := v.Handler.(*PollHandler)
 			if ok {
-				cid = ctx.node(g, v.Callback.Name, "▶️ /"+v.Callback.Name+"  ", "component")
+				cid = ctx.node(g, v.Callback.Name, "▶️ /"+v.Callback.Name+"  ", "event")
 			} else if ok2 {
-				cid = ctx.node(g, v.Callback.Name, "🕑"+v.Callback.Name+"  ", "component")
+				cid = ctx.node(g, v.Callback.Name, "🕑"+v.Callback.Name+"  ", "event")
+			} else if ok3 {
+				cid = ctx.node(g, v.Callback.Name, "🔁"+v.Callback.Name+"  ", "event")
 			} else {
-				cid = ctx.node(g, v.Callback.Name, "⚡"+v.Callback.Name+"  ", "component")
+				cid = ctx.node(g, v.Callback.Name, "⚡"+v.Callback.Name+"  ", "event")
 			}
-			_ = g.g.AddEdge(id, cid, true, nil)
+			_ = g.g.AddEdge(id, cid, true, g.edgeAttrs())
 			octx := g.Walk(v.Stmt, GraphCtx{
 				Prev: []string{cid},
 			})
@@ -106,18 +195,18 @@ func (g *Grapher) Walk(s async.Stmt, ctx GraphCtx) GraphCtx {
 		}
 		return GraphCtx{Prev: prev}
 	case *async.GoStmt:
-		id := ctx.node(g, x.Name, x.Name, "ellipse")
+		id := ctx.node(g, x.Name, x.Name, "parallel")
 
 		for _, v := range ctx.Prev {
-			_ = g.g.AddEdge(v, id, true, map[string]string{
-				"style": "dashed",
-				"label": "parallel",
-			})
+			a := g.edgeAttrs()
+			a["style"] = "dashed"
+			a["label"] = "parallel"
+			_ = g.g.AddEdge(v, id, true, a)
 		}
 		_ = g.Walk(x.Stmt, GraphCtx{Prev: []string{id}})
 		return GraphCtx{Prev: ctx.Prev}
 	case async.ForStmt:
-		id := ctx.node(g, x.Name, "↺ while "+x.Name, "hexagon")
+		id := ctx.node(g, x.Name, "↺ while "+x.Name, "loop")
 		g.AddEdges(ctx.Prev, id)
 		breaks := []string{}
 		curCtx := GraphCtx{Prev: []string{id}}
@@ -150,3 +239,67 @@ func (g *Grapher) Walk(s async.Stmt, ctx GraphCtx) GraphCtx {
 		panic(reflect.TypeOf(s))
 	}
 }
+
+// graphCache caches rendered graphs by hash of dot definition, so that graphs are re-rendered only when definition changes
+type graphCache struct {
+	mu    sync.Mutex
+	items map[string][]byte
+}
+
+// render renders dot graph to svg or jpg
+func (c *graphCache) render(key, dot, format string) ([]byte, error) {
+	c.mu.Lock()
+	body, ok := c.items[key]
+	c.mu.Unlock()
+	if ok {
+		return body, nil
+	}
+	defer logTime("render graph")()
+	gd, err := graphviz.ParseBytes([]byte(dot))
+	if err != nil {
+		return nil, fmt.Errorf(" %v \n %v", dot, err)
+	}
+	var buf bytes.Buffer
+	switch format {
+	case "svg":
+		err = graphviz.New().Render(gd, graphviz.SVG, &buf)
+	default:
+		err = graphviz.New().Render(gd, graphviz.JPG, &buf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.items == nil {
+		c.items = map[string][]byte{}
+	}
+	c.items[key] = buf.Bytes()
+	c.mu.Unlock()
+	return buf.Bytes(), nil
+}
+
+// graphKey identifies rendered graph by definition and format
+func graphKey(dot, format string) string {
+	h := sha256.Sum256([]byte(dot))
+	return hex.EncodeToString(h[:16]) + "." + format
+}
+
+// themeFromQuery overrides theme with query params: rankdir, font, fontsize, color, fill, bg, legend
+func themeFromQuery(t GraphTheme, q url.Values) GraphTheme {
+	for param, field := range map[string]*string{
+		"rankdir":  &t.RankDir,
+		"font":     &t.FontName,
+		"fontsize": &t.FontSize,
+		"color":    &t.Color,
+		"fill":     &t.FillColor,
+		"bg":       &t.BgColor,
+	} {
+		if v := q.Get(param); v != "" {
+			*field = v
+		}
+	}
+	if v := q.Get("legend"); v != "" {
+		t.Legend = v == "true"
+	}
+	return t
+}
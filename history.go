@@ -0,0 +1,249 @@
+package gasync
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"golang.org/x/sync/errgroup"
+)
+
+// HistorySink receives workflow history entries as they are produced.
+type HistorySink interface {
+	Write(ctx context.Context, l DBWorkflowLog) error
+}
+
+// FirestoreHistory stores history entries in Firestore collection, one document per change.
+// Used by default with Collection+"_log" collection.
+type FirestoreHistory struct {
+	DB         *firestore.Client
+	Collection string
+	// Shards spread entries across Collection/{shard}/entries subcollections, i.e. for very hot workflows
+	// hitting Firestore write-rate limits. Entries are stored in Collection itself if it's not set.
+	Shards HistoryShards
+}
+
+// HistoryShards selects shard of history entry. Changing it makes existing entries unreadable.
+type HistoryShards interface {
+	Shard(workflowID string, pc int) string
+	All(workflowID string) []string // shards entries of the workflow may be stored in
+}
+
+// PCShards spreads entries of each workflow across N shards by hash of workflow ID and PC,
+// so that the same PC of different workflows doesn't land in the same shard
+type PCShards int
+
+func (n PCShards) Shard(workflowID string, pc int) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(workflowID))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(strconv.Itoa(pc)))
+	return strconv.Itoa(int(h.Sum32() % uint32(n)))
+}
+
+func (n PCShards) All(workflowID string) []string {
+	ret := []string{}
+	for i := 0; i < int(n); i++ {
+		ret = append(ret, strconv.Itoa(i))
+	}
+	return ret
+}
+
+// eventShards returns sharding of event records if more than one shard is configured
+func eventShards(n int) HistoryShards {
+	if n <= 1 {
+		return nil
+	}
+	return PCShards(n)
+}
+
+func (h *FirestoreHistory) col(shard string) *firestore.CollectionRef {
+	if h.Shards == nil {
+		return h.DB.Collection(h.Collection)
+	}
+	return h.DB.Collection(h.Collection).Doc(shard).Collection("entries")
+}
+
+// adminCallbackPrefix marks history entries of admin changes, i.e. state patches
+const adminCallbackPrefix = "admin:"
+
+// entryID identifies history entry in sinks. Entries that don't change PC get a suffix,
+// so that they don't overwrite the step they were recorded after.
+func (l DBWorkflowLog) entryID() string {
+	id := fmt.Sprintf("%v_%v", l.Meta.ID, l.Meta.PC)
+	if l.SLABreach != nil {
+		id += "_sla_" + l.SLABreach.SLA
+	}
+	if l.Callback != nil && strings.HasPrefix(l.Callback.Name, adminCallbackPrefix) {
+		// workflow may be patched several times between steps
+		id += "_" + strings.TrimPrefix(l.Callback.Name, adminCallbackPrefix) + "_" + strconv.FormatInt(l.Time.UnixNano(), 36)
+	}
+	return id
+}
+
+func (h *FirestoreHistory) Write(ctx context.Context, l DBWorkflowLog) error {
+	id := l.entryID()
+	shard := ""
+	if h.Shards != nil {
+		shard = h.Shards.Shard(l.Meta.ID, l.Meta.PC)
+	}
+	_, err := h.col(shard).Doc(id).Set(ctx, l)
+	return err
+}
+
+// HistoryReader returns history of the workflow, oldest entries first
+type HistoryReader interface {
+	Read(ctx context.Context, id string) ([]DBWorkflowLog, error)
+}
+
+func (h *FirestoreHistory) Read(ctx context.Context, id string) ([]DBWorkflowLog, error) {
+	shards := []string{""}
+	if h.Shards != nil {
+		shards = h.Shards.All(id)
+	}
+	// shards are read in parallel and merged
+	var g errgroup.Group
+	results := make([][]*firestore.DocumentSnapshot, len(shards))
+	for i, shard := range shards {
+		i, shard := i, shard
+		g.Go(func() error {
+			docs, err := h.col(shard).Where("Meta.ID", "==", id).Documents(ctx).GetAll()
+			results[i] = docs
+			return err
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		return nil, err
+	}
+	ret := []DBWorkflowLog{}
+	for _, docs := range results {
+		for _, d := range docs {
+			var l DBWorkflowLog
+			err = d.DataTo(&l)
+			if err != nil {
+				return nil, fmt.Errorf("err unmarshaling history: %v", err)
+			}
+			ret = append(ret, l)
+		}
+	}
+	// sorted here to avoid composite index on Meta.ID and Meta.PC
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Meta.PC != ret[j].Meta.PC {
+			return ret[i].Meta.PC < ret[j].Meta.PC
+		}
+		return ret[i].Time.Before(ret[j].Time) // admin changes and SLA breaches after the step
+	})
+	return ret, nil
+}
+
+// ReadHistory returns workflow history from the first sink that can be read
+func (fs FirestoreEngine) ReadHistory(ctx context.Context, id string) ([]DBWorkflowLog, error) {
+	for _, s := range fs.History {
+		if r, ok := s.(HistoryReader); ok {
+			return r.Read(ctx, id)
+		}
+	}
+	return nil, fmt.Errorf("history is not readable")
+}
+
+// writeHistory sends history entry to all sinks. Errors are logged, since history should not block workflow execution.
+func (fs FirestoreEngine) writeHistory(ctx context.Context, wf *DBWorkflow, state interface{}, start time.Time, cb *async.CallbackRequest, input, output interface{}) {
+	if len(fs.History) == 0 || fs.NoHistory[wf.Meta.Workflow] {
+		return
+	}
+	defer logTime("history")()
+	l := DBWorkflowLog{
+		Meta:         wf.Meta,
+		State:        state,
+		Time:         time.Now(),
+		ExecDuration: time.Since(start),
+		Output:       redactPayload(fs.Redactor, output),
+		Callback:     cb,
+	}
+	l.Input, l.InputRedacted = redactInput(fs.Redactor, input)
+	if id, ok := IdentityFromContext(ctx); ok {
+		l.Identity = &id
+	}
+	l.Operator = operatorFromContext(ctx)
+	fs.sendHistory(ctx, wf, l)
+}
+
+// sendHistory redacts state of the entry once and sends it to all sinks,
+// so that sensitive fields never reach Firestore history, BigQuery or other sinks.
+// Entry is dropped if state can't be redacted.
+func (fs FirestoreEngine) sendHistory(ctx context.Context, wf *DBWorkflow, l DBWorkflowLog) {
+	redacted, err := fs.Redact(&DBWorkflow{Meta: wf.Meta, State: l.State, Version: wf.Version})
+	if err != nil {
+		log.Printf("history entry of %v is not written: %v", wf.Meta.ID, err)
+		return
+	}
+	l.State = redacted.State
+	for _, s := range fs.History {
+		err := s.Write(ctx, l)
+		if _, ok := s.(*FirestoreHistory); ok {
+			fs.Costs.write(ctx, wf.Meta.Workflow, 1)
+		}
+		if err != nil {
+			log.Printf("err writing history of %v to %T: %v", wf.Meta.ID, s, err)
+		}
+	}
+}
+
+// HistoricState is workflow state as of history entry
+type HistoricState struct {
+	Index    int // index of history entry, oldest is 0
+	Time     time.Time
+	Meta     async.State
+	Callback *async.CallbackRequest
+	State    interface{} // redacted
+}
+
+// StateAt reconstructs redacted workflow state from history as of log index or RFC3339 timestamp.
+// Timestamp selects the last entry written at or before it.
+func (fs FirestoreEngine) StateAt(ctx context.Context, id, at string) (*HistoricState, error) {
+	defer logTime("state at")()
+	index, idxErr := strconv.Atoi(at)
+	ts, tsErr := time.Parse(time.RFC3339Nano, at)
+	if idxErr != nil && tsErr != nil {
+		return nil, ValidationError{Path: "at", Msg: "should be history index or RFC3339 timestamp"}
+	}
+	wf, _, err := fs.getFields(ctx, id, "Meta.Workflow", "Version")
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadHistory(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if idxErr != nil {
+		index = -1
+		for i, l := range entries {
+			if !l.Time.After(ts) {
+				index = i
+			}
+		}
+	}
+	if index < 0 || index >= len(entries) {
+		return nil, fmt.Errorf("%w: no history entry at %v", ErrNotFound, at)
+	}
+	l := entries[index]
+	redacted, err := fs.Redact(&DBWorkflow{Meta: l.Meta, State: l.State, Version: wf.Version})
+	if err != nil {
+		return nil, err
+	}
+	return &HistoricState{
+		Index:    index,
+		Time:     l.Time,
+		Meta:     l.Meta,
+		Callback: l.Callback,
+		State:    redacted.State,
+	}, nil
+}
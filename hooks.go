@@ -0,0 +1,50 @@
+package gasync
+
+import (
+	"context"
+
+	"github.com/gorchestrate/async"
+)
+
+// Hooks are called on workflow transitions with snapshots of workflow Meta and state.
+// Hooks are called synchronously, so slow work (i.e. publishing events) should be done in background.
+// Hooks must not modify the state.
+type Hooks struct {
+	OnCreated       func(ctx context.Context, meta async.State, state interface{})
+	OnStepCompleted func(ctx context.Context, meta async.State, state interface{})
+	OnWaiting       func(ctx context.Context, meta async.State, state interface{})
+	OnFinished      func(ctx context.Context, meta async.State, state interface{})
+	OnError         func(ctx context.Context, meta async.State, state interface{}, err error)
+}
+
+func (h Hooks) created(ctx context.Context, meta async.State, state interface{}) {
+	if h.OnCreated != nil {
+		h.OnCreated(ctx, meta, state)
+	}
+}
+
+// checkpoint is used as a Checkpoint func during resume to report completed steps
+func (h Hooks) checkpoint(ctx context.Context, meta *async.State, state interface{}) async.Checkpoint {
+	return func(t async.CheckpointType) error {
+		if t == async.CheckpointAfterStep && h.OnStepCompleted != nil {
+			h.OnStepCompleted(ctx, *meta, state)
+		}
+		return nil // don't checkpoint for performance reasons
+	}
+}
+
+// resumed reports workflow status after resume
+func (h Hooks) resumed(ctx context.Context, meta async.State, state interface{}) {
+	switch {
+	case meta.Status == async.WorkflowFinished && h.OnFinished != nil:
+		h.OnFinished(ctx, meta, state)
+	case meta.Status == async.WorkflowWaiting && h.OnWaiting != nil:
+		h.OnWaiting(ctx, meta, state)
+	}
+}
+
+func (h Hooks) failed(ctx context.Context, meta async.State, state interface{}, err error) {
+	if h.OnError != nil {
+		h.OnError(ctx, meta, state, err)
+	}
+}
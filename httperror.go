@@ -0,0 +1,42 @@
+package gasync
+
+import (
+	"errors"
+	"strings"
+)
+
+// HTTPError is a business error returned by event handlers, i.e. "out of stock".
+// It's returned to the caller as is with its status code. Errors with status below 500 are not counted as event failures.
+type HTTPError interface {
+	error
+	StatusCode() int
+	Body() interface{} // response body, its type is documented in swagger
+}
+
+// EventErrors documents errors events can return, keyed by event name or "workflow/event"
+type EventErrors map[string][]HTTPError
+
+func (e EventErrors) get(wfName, event string) []HTTPError {
+	if errs, ok := e[wfName+"/"+event]; ok {
+		return errs
+	}
+	return e[event]
+}
+
+// businessError returns HTTPError caused by invalid request rather than by failure of workflow
+func businessError(err error) (HTTPError, bool) {
+	var hErr HTTPError
+	if errors.As(err, &hErr) && hErr.StatusCode() < 500 {
+		return hErr, true
+	}
+	return nil, false
+}
+
+// errorDescription joins messages of errors returned with the same status code
+func errorDescription(errs []HTTPError) string {
+	msgs := []string{}
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
@@ -0,0 +1,47 @@
+package gasync
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// IDRules restricts workflow IDs accepted by the server.
+// Zero value accepts any ID that is a valid Firestore document ID.
+type IDRules struct {
+	Pattern          *regexp.Regexp
+	MaxLength        int
+	ReservedPrefixes []string
+}
+
+// ValidationError is returned when request data is invalid.
+// Path points to the invalid field.
+type ValidationError struct {
+	Path string
+	Msg  string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Path, e.Msg)
+}
+
+func (rules IDRules) Validate(id string) error {
+	if id == "" || id == "." || id == ".." {
+		return ValidationError{Path: "id", Msg: "id is empty"}
+	}
+	if strings.Contains(id, "/") {
+		return ValidationError{Path: "id", Msg: "id should not contain '/'"}
+	}
+	if rules.MaxLength > 0 && len(id) > rules.MaxLength {
+		return ValidationError{Path: "id", Msg: fmt.Sprintf("id is longer than %v", rules.MaxLength)}
+	}
+	for _, p := range rules.ReservedPrefixes {
+		if strings.HasPrefix(id, p) {
+			return ValidationError{Path: "id", Msg: fmt.Sprintf("id prefix %q is reserved", p)}
+		}
+	}
+	if rules.Pattern != nil && !rules.Pattern.MatchString(id) {
+		return ValidationError{Path: "id", Msg: fmt.Sprintf("id doesn't match %v", rules.Pattern)}
+	}
+	return nil
+}
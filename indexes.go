@@ -0,0 +1,93 @@
+package gasync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	admin "google.golang.org/api/firestore/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// IndexField is a field of Firestore composite index
+type IndexField struct {
+	Path string
+	Desc bool
+}
+
+// Index is a Firestore composite index of the collection
+type Index struct {
+	Collection string
+	Fields     []IndexField
+}
+
+// RequiredIndexes returns composite indexes used by list sorting and filtering.
+// Queries combining several filters or labels with sorting need additional indexes, they are reported by Firestore in query errors.
+func (fs FirestoreEngine) RequiredIndexes() []Index {
+	sorts := []string{}
+	for _, path := range listSorts {
+		sorts = append(sorts, path)
+	}
+	sort.Strings(sorts)
+	ret := []Index{}
+	for _, prefix := range [][]IndexField{
+		{{Path: "Meta.Workflow"}},
+		{{Path: "Meta.Workflow"}, {Path: "Meta.Status"}}, // filter[status]
+	} {
+		for _, path := range sorts {
+			if len(prefix) > 1 && prefix[1].Path == path {
+				continue
+			}
+			for _, desc := range []bool{false, true} {
+				fields := append(append([]IndexField{}, prefix...), IndexField{Path: path, Desc: desc})
+				// document id makes list order stable
+				fields = append(fields, IndexField{Path: firestore.DocumentID})
+				ret = append(ret, Index{Collection: fs.Collection, Fields: fields})
+			}
+		}
+	}
+	return ret
+}
+
+// EnsureIndexes creates RequiredIndexes via Firestore Admin API and returns number of indexes that were created.
+// Existing indexes are skipped. Indexes are built in background, which may take several minutes.
+func (fs FirestoreEngine) EnsureIndexes(ctx context.Context, opts ...option.ClientOption) (int, error) {
+	defer logTime("ensure indexes")()
+	svc, err := admin.NewService(ctx, opts...)
+	if err != nil {
+		return 0, fmt.Errorf("err creating firestore admin client: %v", err)
+	}
+	// document path is projects/{project}/databases/{database}/documents/...
+	db := strings.Split(fs.DB.Collection(fs.Collection).Path, "/documents/")[0]
+	created := 0
+	for _, idx := range fs.RequiredIndexes() {
+		fields := []*admin.GoogleFirestoreAdminV1IndexField{}
+		for _, f := range idx.Fields {
+			order := "ASCENDING"
+			if f.Desc {
+				order = "DESCENDING"
+			}
+			fields = append(fields, &admin.GoogleFirestoreAdminV1IndexField{FieldPath: f.Path, Order: order})
+		}
+		_, err := svc.Projects.Databases.CollectionGroups.Indexes.Create(fmt.Sprintf("%v/collectionGroups/%v", db, idx.Collection), &admin.GoogleFirestoreAdminV1Index{
+			QueryScope: "COLLECTION",
+			Fields:     fields,
+		}).Context(ctx).Do()
+		var gErr *googleapi.Error
+		if errors.As(err, &gErr) && gErr.Code == http.StatusConflict {
+			continue
+		}
+		if err != nil {
+			return created, fmt.Errorf("err creating index %v: %v", idx, err)
+		}
+		log.Printf("creating index %v", idx)
+		created++
+	}
+	return created, nil
+}
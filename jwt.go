@@ -0,0 +1,301 @@
+package gasync
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// ErrUnauthenticated is returned when request has no valid identity
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// ErrForbidden is returned when identity doesn't have required role
+var ErrForbidden = errors.New("forbidden")
+
+// Identity is an authenticated caller. It's recorded in workflow history.
+type Identity struct {
+	Subject string
+	Issuer  string
+	Roles   []string
+}
+
+// HasRole checks if identity has the role
+func (id Identity) HasRole(role string) bool {
+	for _, r := range id.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type identityCtxKey struct{}
+
+// IdentityFromContext returns identity of the caller authenticated by JWTAuth
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityCtxKey{}).(Identity)
+	return id, ok
+}
+
+// JWTAuth validates bearer JWTs signed by keys from JWKS URL.
+// Roles are taken from RolesClaim (string or list) and space-separated "scope" claim.
+type JWTAuth struct {
+	Issuer     string
+	Audience   string // not checked if empty
+	JWKSURL    string
+	RolesClaim string // "roles" by default
+	AdminRole  string // role required for admin endpoints, "admin" by default
+
+	RefreshInterval time.Duration // JWKS is refreshed with this interval, 1 hour by default
+
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+func (a *JWTAuth) adminRole() string {
+	if a.AdminRole == "" {
+		return "admin"
+	}
+	return a.AdminRole
+}
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func b64int(s string) (*big.Int, error) {
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(d), nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %v", k.Crv)
+		}
+		x, err := b64int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %v", k.Kty)
+}
+
+// key returns signing key by id, refreshing JWKS if key is unknown or keys are stale
+func (a *JWTAuth) key(ctx context.Context, kid string) (interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	refresh := a.RefreshInterval
+	if refresh <= 0 {
+		refresh = time.Hour
+	}
+	k, ok := a.keys[kid]
+	if ok && time.Since(a.fetched) < refresh {
+		return k, nil
+	}
+	// unknown keys trigger refresh at most once a minute to avoid hammering JWKS endpoint
+	if !ok && time.Since(a.fetched) < time.Minute {
+		return nil, fmt.Errorf("unknown key %v", kid)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", a.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("err fetching jwks: %v", err)
+	}
+	defer resp.Body.Close()
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil {
+		return nil, fmt.Errorf("err parsing jwks: %v", err)
+	}
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		pk, err := k.publicKey()
+		if err != nil {
+			continue // skip keys we can't use
+		}
+		keys[k.Kid] = pk
+	}
+	a.keys = keys
+	a.fetched = time.Now()
+	k, ok = a.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %v", kid)
+	}
+	return k, nil
+}
+
+// Authenticate validates bearer token of the request
+func (a *JWTAuth) Authenticate(r *http.Request) (Identity, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return Identity{}, ErrUnauthenticated
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(strings.TrimPrefix(h, "Bearer "), claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return a.key(r.Context(), kid)
+	})
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+	}
+	if !claims.VerifyIssuer(a.Issuer, true) {
+		return Identity{}, fmt.Errorf("%w: invalid issuer", ErrUnauthenticated)
+	}
+	if a.Audience != "" && !claims.VerifyAudience(a.Audience, true) {
+		return Identity{}, fmt.Errorf("%w: invalid audience", ErrUnauthenticated)
+	}
+	id := Identity{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Issuer, _ = claims["iss"].(string)
+	rolesClaim := a.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	switch roles := claims[rolesClaim].(type) {
+	case string:
+		id.Roles = append(id.Roles, strings.Fields(roles)...)
+	case []interface{}:
+		for _, r := range roles {
+			if s, ok := r.(string); ok {
+				id.Roles = append(id.Roles, s)
+			}
+		}
+	}
+	if scope, ok := claims["scope"].(string); ok && rolesClaim != "scope" {
+		id.Roles = append(id.Roles, strings.Fields(scope)...)
+	}
+	return id, nil
+}
+
+// Middleware authenticates requests with bearer token and stores Identity in request context.
+// Requests without token pass through unauthenticated, endpoints requiring roles reject them.
+func (a *JWTAuth) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		id, err := a.Authenticate(r)
+		if err != nil {
+			jsonErr(w, err, http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityCtxKey{}, id)))
+	})
+}
+
+// RequireRole authorizes requests authenticated by JWTAuth middleware. Can be used as Config.AdminAuth.
+func RequireRole(role string) func(r *http.Request) error {
+	return func(r *http.Request) error {
+		id, ok := IdentityFromContext(r.Context())
+		if !ok {
+			return ErrUnauthenticated
+		}
+		if !id.HasRole(role) {
+			return fmt.Errorf("%w: role %v is required", ErrForbidden, role)
+		}
+		return nil
+	}
+}
+
+// EventRoles requires caller to have one of the roles to send event via http API.
+// Keys are event names or "workflow/event". Callbacks that don't come from http API (i.e. timeouts) are not checked.
+// Workflow type is taken from the stored workflow, not from the request URL, so that "workflow/event" roles
+// can't be bypassed by sending event via another route or workflow name.
+func EventRoles(roles map[string][]string, engine Engine) EventMiddleware {
+	scoped := map[string]bool{} // events that have roles for specific workflow types
+	for k := range roles {
+		if i := strings.LastIndex(k, "/"); i >= 0 {
+			scoped[k[i+1:]] = true
+		}
+	}
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, req EventRequest) (interface{}, error) {
+			if _, ok := RequestFromContext(ctx); !ok {
+				return next(ctx, req)
+			}
+			var required []string
+			ok := false
+			if scoped[req.Callback.Name] {
+				wf, err := engine.Get(ctx, req.WorkflowID)
+				if err != nil {
+					return nil, err
+				}
+				required, ok = roles[wf.Meta.Workflow+"/"+req.Callback.Name]
+			}
+			if !ok {
+				required, ok = roles[req.Callback.Name]
+			}
+			if !ok {
+				return next(ctx, req)
+			}
+			id, ok := IdentityFromContext(ctx)
+			if !ok {
+				return nil, ErrUnauthenticated
+			}
+			for _, role := range required {
+				if id.HasRole(role) {
+					return next(ctx, req)
+				}
+			}
+			return nil, fmt.Errorf("%w: one of roles %v is required for %v", ErrForbidden, required, req.Callback.Name)
+		}
+	}
+}
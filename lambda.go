@@ -0,0 +1,158 @@
+package gasync
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// ServeLambda runs http handler (usually Server.Router) as AWS Lambda function.
+// Both API Gateway REST (payload v1) and HTTP API / Function URL (payload v2) events are supported.
+func ServeLambda(h http.Handler) {
+	lambda.Start(NewLambdaHandler(h))
+}
+
+// ServeLambda runs server as AWS Lambda function. Timers are durable if Config.DueTimers is enabled:
+// they are stored in Firestore and fired by EventBridge schedule rule invoking the function, i.e. every minute.
+func (s *Server) ServeLambda() {
+	lambda.Start(s.NewLambdaHandler())
+}
+
+// NewLambdaHandler converts server to Lambda handler func, EventBridge scheduled events run due timers.
+func (s *Server) NewLambdaHandler() func(ctx context.Context, event json.RawMessage) (interface{}, error) {
+	return newLambdaHandler(s.Router, func(ctx context.Context) (interface{}, error) {
+		if s.Timers == nil {
+			return nil, fmt.Errorf("scheduled event received, but DueTimers are not enabled")
+		}
+		return s.Timers.RunDueTimers(ctx)
+	})
+}
+
+// NewLambdaHandler converts http handler to Lambda handler func.
+func NewLambdaHandler(h http.Handler) func(ctx context.Context, event json.RawMessage) (interface{}, error) {
+	return newLambdaHandler(h, nil)
+}
+
+func newLambdaHandler(h http.Handler, onSchedule func(ctx context.Context) (interface{}, error)) func(ctx context.Context, event json.RawMessage) (interface{}, error) {
+	return func(ctx context.Context, event json.RawMessage) (interface{}, error) {
+		var v struct {
+			Version    string `json:"version"`
+			DetailType string `json:"detail-type"`
+		}
+		err := json.Unmarshal(event, &v)
+		if err != nil {
+			return nil, err
+		}
+		if v.DetailType == "Scheduled Event" {
+			if onSchedule == nil {
+				return nil, fmt.Errorf("scheduled events are not supported by http handler")
+			}
+			return onSchedule(ctx)
+		}
+		if v.Version == "2.0" {
+			var req events.LambdaFunctionURLRequest
+			err = json.Unmarshal(event, &req)
+			if err != nil {
+				return nil, err
+			}
+			return serveLambdaV2(ctx, h, req)
+		}
+		var req events.APIGatewayProxyRequest
+		err = json.Unmarshal(event, &req)
+		if err != nil {
+			return nil, err
+		}
+		return serveLambdaV1(ctx, h, req)
+	}
+}
+
+func lambdaBody(body string, isBase64 bool) ([]byte, error) {
+	if isBase64 {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
+
+// lambdaResponseBody encodes binary responses (i.e. graph images) using base64
+func lambdaResponseBody(rec *httptest.ResponseRecorder) (string, bool) {
+	body := rec.Body.Bytes()
+	if utf8.Valid(body) {
+		return string(body), false
+	}
+	return base64.StdEncoding.EncodeToString(body), true
+}
+
+func serveLambdaV1(ctx context.Context, h http.Handler, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	body, err := lambdaBody(req.Body, req.IsBase64Encoded)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	q := url.Values{}
+	for k, v := range req.QueryStringParameters {
+		q.Set(k, v)
+	}
+	for k, vv := range req.MultiValueQueryStringParameters {
+		q[k] = vv
+	}
+	u := url.URL{Path: req.Path, RawQuery: q.Encode()}
+	r, err := http.NewRequestWithContext(ctx, req.HTTPMethod, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	for k, v := range req.Headers {
+		r.Header.Set(k, v)
+	}
+	for k, vv := range req.MultiValueHeaders {
+		r.Header[http.CanonicalHeaderKey(k)] = vv
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	respBody, isBase64 := lambdaResponseBody(rec)
+	return events.APIGatewayProxyResponse{
+		StatusCode:        rec.Code,
+		MultiValueHeaders: rec.Header(),
+		Body:              respBody,
+		IsBase64Encoded:   isBase64,
+	}, nil
+}
+
+func serveLambdaV2(ctx context.Context, h http.Handler, req events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+	body, err := lambdaBody(req.Body, req.IsBase64Encoded)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{}, err
+	}
+	u := url.URL{Path: req.RawPath, RawQuery: req.RawQueryString}
+	r, err := http.NewRequestWithContext(ctx, req.RequestContext.HTTP.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return events.LambdaFunctionURLResponse{}, err
+	}
+	for k, v := range req.Headers {
+		r.Header.Set(k, v)
+	}
+	if len(req.Cookies) > 0 {
+		r.Header.Set("Cookie", strings.Join(req.Cookies, "; "))
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	headers := map[string]string{}
+	for k, v := range rec.Header() {
+		headers[k] = strings.Join(v, ",")
+	}
+	respBody, isBase64 := lambdaResponseBody(rec)
+	return events.LambdaFunctionURLResponse{
+		StatusCode:      rec.Code,
+		Headers:         headers,
+		Body:            respBody,
+		IsBase64Encoded: isBase64,
+	}, nil
+}
@@ -0,0 +1,68 @@
+package gasync
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrConcurrencyLimit is returned when workflow can't be resumed because too many resumes are running.
+var ErrConcurrencyLimit = errors.New("concurrency limit reached")
+
+// ConcurrencyLimiter caps number of concurrently running resumes in this process.
+// Zero limit means no limit.
+type ConcurrencyLimiter struct {
+	Global      int
+	PerWorkflow map[string]int // workflow name -> limit
+
+	mu      sync.Mutex
+	total   int
+	running map[string]int
+}
+
+// TryAcquire reserves a slot for workflow type. Release should be called when resume is finished.
+func (l *ConcurrencyLimiter) TryAcquire(workflow string) (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running == nil {
+		l.running = map[string]int{}
+	}
+	if l.Global > 0 && l.total >= l.Global {
+		return nil, false
+	}
+	if limit := l.PerWorkflow[workflow]; limit > 0 && l.running[workflow] >= limit {
+		return nil, false
+	}
+	l.total++
+	l.running[workflow]++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.total--
+		l.running[workflow]--
+	}, true
+}
+
+// Running returns number of running resumes in total and per workflow type
+func (l *ConcurrencyLimiter) Running() (int, map[string]int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ret := map[string]int{}
+	for k, v := range l.running {
+		if v > 0 {
+			ret[k] = v
+		}
+	}
+	return l.total, ret
+}
+
+// setLimits replaces limits on config reload. Running resumes keep their slots.
+func (l *ConcurrencyLimiter) setLimits(global *int, perWorkflow map[string]int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if global != nil {
+		l.Global = *global
+	}
+	if perWorkflow != nil {
+		l.PerWorkflow = perWorkflow
+	}
+}
@@ -0,0 +1,139 @@
+package gasync
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultMaxBodySize is used when Config.MaxBodySize is not set
+const DefaultMaxBodySize = 1 << 20
+
+// ErrBodyTooLarge is returned when request body exceeds configured limit
+var ErrBodyTooLarge = errors.New("request body is too large")
+
+// ErrTimeout is returned when request was not handled within configured timeout
+var ErrTimeout = errors.New("request timed out")
+
+// limitRequest limits body size and handling time of the request
+func limitRequest(maxBody int64, timeout time.Duration, h http.HandlerFunc) http.HandlerFunc {
+	if maxBody == 0 {
+		maxBody = DefaultMaxBodySize
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if maxBody > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		}
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		h(w, r)
+	}
+}
+
+// bodyErr converts errors returned by MaxBytesReader to ErrBodyTooLarge
+func bodyErr(err error) error {
+	if err != nil && strings.Contains(err.Error(), "http: request body too large") {
+		return ErrBodyTooLarge
+	}
+	return err
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	d, err := ioutil.ReadAll(r.Body)
+	return d, bodyErr(err)
+}
+
+// isTimeout checks if err was caused by exceeded request deadline
+func isTimeout(err error) bool {
+	return errors.Is(err, ErrTimeout) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		status.Code(err) == codes.DeadlineExceeded ||
+		strings.Contains(err.Error(), context.DeadlineExceeded.Error())
+}
+
+// CallTimeouts bound single Firestore and Cloud Tasks calls, so that slow backend fails the call
+// instead of holding the request until its deadline. Zero values mean calls are bounded by the caller context only.
+type CallTimeouts struct {
+	Firestore  time.Duration
+	CloudTasks time.Duration
+}
+
+// Timeouts are separate call budgets for interactive requests (events, create, API) and
+// scheduler callbacks (/resume, /callback/timeout and in-process schedulers), which may wait longer.
+type Timeouts struct {
+	Interactive CallTimeouts
+	Callback    CallTimeouts
+}
+
+type callbackCtxKey struct{}
+
+// asCallback marks context of scheduler callback, so that Timeouts.Callback budget is used
+func asCallback(ctx context.Context) context.Context {
+	return context.WithValue(ctx, callbackCtxKey{}, true)
+}
+
+func (t Timeouts) budget(ctx context.Context) CallTimeouts {
+	if cb, _ := ctx.Value(callbackCtxKey{}).(bool); cb {
+		return t.Callback
+	}
+	return t.Interactive
+}
+
+// firestoreCall bounds single Firestore call
+func (t Timeouts) firestoreCall(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withOptionalTimeout(ctx, t.budget(ctx).Firestore)
+}
+
+// tasksCall bounds single Cloud Tasks call
+func (t Timeouts) tasksCall(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withOptionalTimeout(ctx, t.budget(ctx).CloudTasks)
+}
+
+func withOptionalTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// DefaultProcessingFloor is used when FirestoreEngine.ProcessingFloor is not set
+const DefaultProcessingFloor = 30 * time.Second
+
+// detachedCtx keeps values of the parent, but not its cancellation
+type detachedCtx struct {
+	context.Context
+}
+
+func (detachedCtx) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedCtx) Done() <-chan struct{}       { return nil }
+func (detachedCtx) Err() error                  { return nil }
+
+// detach returns context that is cancelled only after floor passes since ctx is done,
+// so that processing of locked workflow isn't interrupted by client disconnect in the middle of saving.
+func detach(ctx context.Context, floor time.Duration) (context.Context, context.CancelFunc) {
+	ret, cancel := context.WithCancel(detachedCtx{ctx})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-ret.Done():
+			return
+		}
+		t := time.NewTimer(floor)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			cancel()
+		case <-ret.Done():
+		}
+	}()
+	return ret, cancel
+}
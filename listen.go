@@ -0,0 +1,73 @@
+package gasync
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTPOptions configure http.Server started by Server.ListenAndServe. Zero values use defaults below.
+type HTTPOptions struct {
+	ReadTimeout       time.Duration // 30s by default
+	ReadHeaderTimeout time.Duration // 10s by default
+	WriteTimeout      time.Duration // 60s by default
+	IdleTimeout       time.Duration // 120s by default
+	MaxHeaderBytes    int           // 64KB by default
+
+	TLSCertFile string // serve TLS if both cert and key are set
+	TLSKeyFile  string
+	H2C         bool // serve HTTP/2 without TLS, for example behind Cloud Run or a load balancer
+}
+
+// HTTPServer returns http.Server serving Router with configured timeouts and limits
+func (s *Server) HTTPServer(addr string) *http.Server {
+	o := s.http
+	if o.ReadTimeout == 0 {
+		o.ReadTimeout = time.Second * 30
+	}
+	if o.ReadHeaderTimeout == 0 {
+		o.ReadHeaderTimeout = time.Second * 10
+	}
+	if o.WriteTimeout == 0 {
+		o.WriteTimeout = time.Second * 60
+	}
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = time.Second * 120
+	}
+	if o.MaxHeaderBytes == 0 {
+		o.MaxHeaderBytes = 64 << 10
+	}
+	var h http.Handler = s.Router
+	if o.H2C {
+		h = h2c.NewHandler(h, &http2.Server{IdleTimeout: o.IdleTimeout})
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadTimeout:       o.ReadTimeout,
+		ReadHeaderTimeout: o.ReadHeaderTimeout,
+		WriteTimeout:      o.WriteTimeout,
+		IdleTimeout:       o.IdleTimeout,
+		MaxHeaderBytes:    o.MaxHeaderBytes,
+	}
+	if s.clientCAs != nil {
+		// client certs are optional for public endpoints, callback endpoints require them
+		srv.TLSConfig = &tls.Config{
+			ClientCAs:  s.clientCAs,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+	return srv
+}
+
+// ListenAndServe serves Router on addr using Config.HTTP options
+func (s *Server) ListenAndServe(addr string) error {
+	srv := s.HTTPServer(addr)
+	if s.http.TLSCertFile != "" && s.http.TLSKeyFile != "" {
+		return srv.ListenAndServeTLS(s.http.TLSCertFile, s.http.TLSKeyFile)
+	}
+	return srv.ListenAndServe()
+}
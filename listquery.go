@@ -0,0 +1,220 @@
+package gasync
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+)
+
+// listFilter translates filter[name]=value to firestore condition
+type listFilter struct {
+	Path  string
+	Parse func(v string) (op string, val interface{}, err error)
+}
+
+var listFilters = map[string]listFilter{
+	"status": {Path: "Meta.Status", Parse: func(v string) (string, interface{}, error) {
+		switch strings.ToLower(v) {
+		case "running":
+			return "in", []interface{}{string(async.WorkflowResuming), string(async.WorkflowWaiting)}, nil
+		case "resuming":
+			return "==", string(async.WorkflowResuming), nil
+		case "waiting":
+			return "==", string(async.WorkflowWaiting), nil
+		case "finished":
+			return "==", string(async.WorkflowFinished), nil
+		}
+		return "", nil, fmt.Errorf("unknown status %q", v)
+	}},
+	"priority": {Path: "Priority", Parse: func(v string) (string, interface{}, error) {
+		p, err := strconv.Atoi(v)
+		return "==", p, err
+	}},
+	"quarantined": {Path: "Quarantined", Parse: func(v string) (string, interface{}, error) {
+		b, err := strconv.ParseBool(v)
+		return "==", b, err
+	}},
+	"sla_breached": {Path: "SLABreached", Parse: func(v string) (string, interface{}, error) {
+		b, err := strconv.ParseBool(v)
+		return "==", b, err
+	}},
+	"version": {Path: "Version", Parse: func(v string) (string, interface{}, error) {
+		return "==", v, nil
+	}},
+}
+
+// listSorts are fields list can be sorted by
+var listSorts = map[string]string{
+	"priority":  "Priority",
+	"createdAt": "Created",
+	"status":    "Meta.Status",
+}
+
+type listSort struct {
+	Field string // key of listSorts
+	Desc  bool
+}
+
+// sorts parses Sort, OrderBy="priority" is the same as Sort="-priority"
+func (lq ListQuery) sorts() ([]listSort, error) {
+	sort := lq.Sort
+	switch lq.OrderBy {
+	case "":
+	case "priority":
+		if sort == "" {
+			sort = "-priority"
+		}
+	default:
+		return nil, ValidationError{Path: "order", Msg: fmt.Sprintf("unsupported order %q", lq.OrderBy)}
+	}
+	ret := []listSort{}
+	for _, f := range strings.Split(sort, ",") {
+		if f == "" {
+			continue
+		}
+		s := listSort{Field: strings.TrimPrefix(f, "-"), Desc: strings.HasPrefix(f, "-")}
+		if _, ok := listSorts[s.Field]; !ok {
+			return nil, ValidationError{Path: "sort", Msg: fmt.Sprintf("unsupported sort field %q", s.Field)}
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+// value returns sort field value of the cursor
+func (c listCursor) value(field string) interface{} {
+	switch field {
+	case "priority":
+		return c.Priority
+	case "createdAt":
+		return c.Created
+	}
+	return c.Status
+}
+
+func newListCursor(query, id string, wf DBWorkflow) listCursor {
+	return listCursor{
+		Query:    query,
+		ID:       id,
+		Priority: wf.Priority,
+		Created:  wf.Created,
+		Status:   string(wf.Meta.Status),
+	}
+}
+
+// applyFilters adds filter conditions to the query. Filtering and sorting by several fields require composite indexes.
+func (lq ListQuery) applyFilters(q firestore.Query) (firestore.Query, error) {
+	for name, v := range lq.Filter {
+		f, ok := listFilters[name]
+		if !ok {
+			return q, ValidationError{Path: "filter[" + name + "]", Msg: "unsupported filter"}
+		}
+		op, val, err := f.Parse(v)
+		if err != nil {
+			return q, ValidationError{Path: "filter[" + name + "]", Msg: err.Error()}
+		}
+		q = q.Where(f.Path, op, val)
+	}
+	return q, nil
+}
+
+var dbWorkflowType = reflect.TypeOf(DBWorkflow{})
+
+// selectFields returns field mask for sparse fieldset. Fields needed for sorting and redaction are always selected.
+func (lq ListQuery) selectFields(sorts []listSort) ([]string, error) {
+	if len(lq.Fields) == 0 {
+		return nil, nil
+	}
+	paths := []string{}
+	for _, f := range lq.Fields {
+		if _, ok := dbWorkflowType.FieldByName(strings.Split(f, ".")[0]); !ok {
+			return nil, ValidationError{Path: "fields", Msg: fmt.Sprintf("unknown field %q", f)}
+		}
+		paths = append(paths, f)
+		if strings.Split(f, ".")[0] == "State" {
+			paths = append(paths, "Meta.Workflow", "Version")
+		}
+	}
+	for _, s := range sorts {
+		paths = append(paths, listSorts[s.Field])
+	}
+	return paths, nil
+}
+
+// listParams parses JSON:API style list parameters: filter[name]=value, sort=-createdAt,priority and fields=Meta.ID,Meta.Status
+func listParams(q url.Values, lq *ListQuery) {
+	for k, v := range q {
+		if strings.HasPrefix(k, "filter[") && strings.HasSuffix(k, "]") && len(v) > 0 {
+			if lq.Filter == nil {
+				lq.Filter = map[string]string{}
+			}
+			lq.Filter[strings.TrimSuffix(strings.TrimPrefix(k, "filter["), "]")] = v[0]
+		}
+	}
+	lq.Sort = q.Get("sort")
+	if f := q.Get("fields"); f != "" {
+		lq.Fields = strings.Split(f, ",")
+	}
+}
+
+// sparse leaves only requested fields in workflows
+func sparse(wfs []DBWorkflow, fields []string) ([]map[string]interface{}, error) {
+	ret := []map[string]interface{}{}
+	for _, wf := range wfs {
+		d, err := json.Marshal(wf)
+		if err != nil {
+			return nil, err
+		}
+		var full map[string]interface{}
+		err = json.Unmarshal(d, &full)
+		if err != nil {
+			return nil, err
+		}
+		out := map[string]interface{}{}
+		for _, f := range fields {
+			copyPath(full, out, strings.Split(f, "."))
+		}
+		ret = append(ret, out)
+	}
+	return ret, nil
+}
+
+func copyPath(from, to map[string]interface{}, path []string) {
+	v, ok := from[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		to[path[0]] = v
+		return
+	}
+	sub, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	next, ok := to[path[0]].(map[string]interface{})
+	if !ok {
+		next = map[string]interface{}{}
+		to[path[0]] = next
+	}
+	copyPath(sub, next, path[1:])
+}
+
+// hasField checks if field is requested in sparse fieldset
+func hasField(fields []string, name string) bool {
+	if len(fields) == 0 {
+		return true
+	}
+	for _, f := range fields {
+		if strings.Split(f, ".")[0] == name {
+			return true
+		}
+	}
+	return false
+}
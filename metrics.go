@@ -0,0 +1,213 @@
+package gasync
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Metrics records engine and scheduler metrics using OpenTelemetry.
+// MeterProvider is usually configured with OTLP exporter to push metrics to a collector or Cloud Monitoring.
+type Metrics struct {
+	resumes        metric.Int64Counter
+	resumeDuration metric.Float64Histogram
+	events         metric.Int64Counter
+	eventDuration  metric.Float64Histogram
+	schedules      metric.Int64Counter
+	failovers      metric.Int64Counter
+	failures       metric.Int64Counter
+	lag            metric.Float64Histogram
+	deprecated     metric.Int64Counter
+	slaBreaches    metric.Int64Counter
+	dedupHits      metric.Int64Counter
+	operations     metric.Int64Counter
+
+	meter metric.Meter
+}
+
+func NewMetrics(mp metric.MeterProvider) (*Metrics, error) {
+	m := mp.Meter("github.com/gorchestrate/gasync")
+	ret := Metrics{
+		meter: m,
+	}
+	var err error
+	ret.resumes, err = m.Int64Counter("gasync.resumes", metric.WithDescription("workflow resumes"))
+	if err != nil {
+		return nil, err
+	}
+	ret.resumeDuration, err = m.Float64Histogram("gasync.resume.duration", metric.WithUnit("ms"), metric.WithDescription("duration of workflow resume"))
+	if err != nil {
+		return nil, err
+	}
+	ret.events, err = m.Int64Counter("gasync.events", metric.WithDescription("handled events and callbacks"))
+	if err != nil {
+		return nil, err
+	}
+	ret.eventDuration, err = m.Float64Histogram("gasync.event.duration", metric.WithUnit("ms"), metric.WithDescription("duration of event handling"))
+	if err != nil {
+		return nil, err
+	}
+	ret.schedules, err = m.Int64Counter("gasync.schedules", metric.WithDescription("resumes scheduled via task queue"))
+	if err != nil {
+		return nil, err
+	}
+	ret.failovers, err = m.Int64Counter("gasync.schedule.failovers", metric.WithDescription("tasks created in fallback location"))
+	if err != nil {
+		return nil, err
+	}
+	ret.failures, err = m.Int64Counter("gasync.schedule.failures", metric.WithDescription("failed task creations"))
+	if err != nil {
+		return nil, err
+	}
+	ret.lag, err = m.Float64Histogram("gasync.delivery.lag", metric.WithUnit("ms"), metric.WithDescription("delay between scheduled time and delivery of the task"))
+	if err != nil {
+		return nil, err
+	}
+	ret.deprecated, err = m.Int64Counter("gasync.events.deprecated", metric.WithDescription("events sent using deprecated aliases"))
+	if err != nil {
+		return nil, err
+	}
+	ret.slaBreaches, err = m.Int64Counter("gasync.sla.breaches", metric.WithDescription("workflows that breached their SLAs"))
+	if err != nil {
+		return nil, err
+	}
+	ret.dedupHits, err = m.Int64Counter("gasync.events.deduplicated", metric.WithDescription("duplicate events acknowledged without handling"))
+	if err != nil {
+		return nil, err
+	}
+	ret.operations, err = m.Int64Counter("gasync.cost.operations", metric.WithDescription("billable Firestore and Cloud Tasks operations by workflow"))
+	if err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// ObserveAwaitingResume reports number of workflows waiting to be resumed, as returned by count.
+// Count is called on every metrics collection.
+func (m *Metrics) ObserveAwaitingResume(count func(ctx context.Context) (int64, error)) error {
+	_, err := m.meter.Int64ObservableGauge("gasync.awaiting_resume",
+		metric.WithDescription("workflows waiting to be resumed"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			n, err := count(ctx)
+			if err != nil {
+				return err
+			}
+			o.Observe(n)
+			return nil
+		}))
+	return err
+}
+
+// AwaitingResumeLimit caps gasync.awaiting_resume, every counted workflow is a billable document read.
+// Count aggregation is not available in the Firestore client, so workflows are counted by reading their ids.
+const AwaitingResumeLimit = 1000
+
+// AwaitingResumeRefresh is how often gasync.awaiting_resume is recounted, cached value is reported in between
+const AwaitingResumeRefresh = 5 * time.Minute
+
+// cachedCount calls count at most once per interval and returns the last value in between, so that frequent
+// metric collections don't multiply reads
+func cachedCount(interval time.Duration, count func(ctx context.Context) (int64, error)) func(ctx context.Context) (int64, error) {
+	var mu sync.Mutex
+	var last int64
+	var fetched time.Time
+	return func(ctx context.Context) (int64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !fetched.IsZero() && time.Since(fetched) < interval {
+			return last, nil
+		}
+		n, err := count(ctx)
+		if err != nil {
+			return 0, err
+		}
+		last, fetched = n, time.Now()
+		return n, nil
+	}
+}
+
+func result(err error) attribute.KeyValue {
+	if err != nil {
+		return attribute.String("result", "error")
+	}
+	return attribute.String("result", "ok")
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (m *Metrics) resumed(ctx context.Context, workflow string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	attrs := metric.WithAttributes(attribute.String("workflow", workflow), result(err))
+	m.resumes.Add(ctx, 1, attrs)
+	m.resumeDuration.Record(ctx, ms(time.Since(start)), attrs)
+}
+
+func (m *Metrics) handled(ctx context.Context, workflow, event string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	attrs := metric.WithAttributes(attribute.String("workflow", workflow), attribute.String("event", event), result(err))
+	m.events.Add(ctx, 1, attrs)
+	m.eventDuration.Record(ctx, ms(time.Since(start)), attrs)
+}
+
+func (m *Metrics) scheduled(ctx context.Context, queue string, err error) {
+	if m == nil {
+		return
+	}
+	m.schedules.Add(ctx, 1, metric.WithAttributes(attribute.String("queue", queue), result(err)))
+	if err != nil {
+		m.failures.Add(ctx, 1, metric.WithAttributes(attribute.String("queue", queue)))
+	}
+}
+
+// delivered records lag of the task delivery. Kind is either "resume" or "callback".
+func (m *Metrics) delivered(ctx context.Context, kind string, scheduled time.Time) {
+	if m == nil || scheduled.IsZero() {
+		return
+	}
+	m.lag.Record(ctx, ms(time.Since(scheduled)), metric.WithAttributes(attribute.String("kind", kind)))
+}
+
+func (m *Metrics) failedOver(ctx context.Context, queue, location string, err error) {
+	if m == nil {
+		return
+	}
+	m.failovers.Add(ctx, 1, metric.WithAttributes(attribute.String("queue", queue), attribute.String("location", location), result(err)))
+}
+
+func (m *Metrics) slaBreached(ctx context.Context, workflow, sla string) {
+	if m == nil {
+		return
+	}
+	m.slaBreaches.Add(ctx, 1, metric.WithAttributes(attribute.String("workflow", workflow), attribute.String("sla", sla)))
+}
+
+func (m *Metrics) deduplicated(ctx context.Context, event string) {
+	if m == nil {
+		return
+	}
+	m.dedupHits.Add(ctx, 1, metric.WithAttributes(attribute.String("event", event)))
+}
+
+func (m *Metrics) costed(ctx context.Context, workflow string, cost WorkflowCost) {
+	if m == nil {
+		return
+	}
+	for op, n := range map[string]int64{
+		"firestore_read":  cost.FirestoreReads,
+		"firestore_write": cost.FirestoreWrites,
+		"task_create":     cost.TasksCreated,
+	} {
+		if n > 0 {
+			m.operations.Add(ctx, n, metric.WithAttributes(attribute.String("workflow", workflow), attribute.String("operation", op)))
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package gasync
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorchestrate/async"
+)
+
+// EventRequest is an incoming event or callback for workflow.
+type EventRequest struct {
+	WorkflowID string
+	Callback   async.CallbackRequest
+	Input      interface{}
+}
+
+// EventHandler handles incoming event and returns handler output.
+type EventHandler func(ctx context.Context, req EventRequest) (interface{}, error)
+
+// EventMiddleware wraps event handling, i.e. to check auth, collect metrics or log payloads.
+// Middleware may modify the request or skip calling next handler by returning error.
+type EventMiddleware func(next EventHandler) EventHandler
+
+// withMiddleware wraps handler with engine middleware. First middleware is the outermost one.
+func (fs FirestoreEngine) withMiddleware(h EventHandler) EventHandler {
+	for i := len(fs.Middleware) - 1; i >= 0; i-- {
+		h = fs.Middleware[i](h)
+	}
+	return h
+}
+
+type requestCtxKey struct{}
+
+// RequestFromContext returns http request that delivered the event, if event came via http API.
+func RequestFromContext(ctx context.Context) (*http.Request, bool) {
+	r, ok := ctx.Value(requestCtxKey{}).(*http.Request)
+	return r, ok
+}
+
+func withRequest(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, requestCtxKey{}, r)
+}
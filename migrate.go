@@ -0,0 +1,220 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrMigrated is set as LastError of source workflows after migration. They are quarantined, so that only
+// the copy is resumed. Source can be released if migration should be reverted.
+var ErrMigrated = errors.New("workflow was migrated")
+
+// Migration copies workflow instances between engines, i.e. from one collection or GCP project to another.
+// Timers are re-created in destination via To.Callbacks with the remaining delay and deleted in source.
+type Migration struct {
+	From *FirestoreEngine
+	To   *FirestoreEngine
+	// FromTasks reads and deletes source timers. Timers are not migrated if it's nil.
+	FromTasks *GTasksScheduler
+	Workflow  string // migrate only instances of this workflow, all by default
+	// DeleteSource deletes source instances after verification instead of quarantining them
+	DeleteSource bool
+}
+
+// MigrationStats describes migration results
+type MigrationStats struct {
+	Migrated int
+	Skipped  int               // already exist in destination
+	Failed   map[string]string // errors by workflow id
+	Duration time.Duration
+}
+
+// Run migrates all active instances. Finished ones are migrated too, since their history may be needed.
+func (m Migration) Run(ctx context.Context) (MigrationStats, error) {
+	start := time.Now()
+	stats := MigrationStats{Failed: map[string]string{}}
+	q := m.From.DB.Collection(m.From.Collection).Query
+	if m.Workflow != "" {
+		q = q.Where("Meta.Workflow", "==", m.Workflow)
+	}
+	it := q.Select().Documents(ctx)
+	defer it.Stop()
+	for {
+		doc, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("err listing workflows: %v", err)
+		}
+		err = m.Migrate(ctx, doc.Ref.ID)
+		switch {
+		case errors.Is(err, ErrAlreadyExists):
+			stats.Skipped++
+		case err != nil:
+			log.Printf("migration: err migrating %v: %v", doc.Ref.ID, err)
+			stats.Failed[doc.Ref.ID] = err.Error()
+		default:
+			stats.Migrated++
+		}
+	}
+	stats.Duration = time.Since(start)
+	return stats, nil
+}
+
+// Migrate copies single workflow instance with its history. Source is locked during migration.
+func (m Migration) Migrate(ctx context.Context, id string) error {
+	defer logTime("migrate")()
+	wf, err := m.From.Lock(ctx, id)
+	if err != nil {
+		return fmt.Errorf("err locking source: %w", err)
+	}
+	src := m.From.DB.Collection(m.From.Collection).Doc(id)
+	doc, err := src.Get(ctx)
+	if err != nil {
+		_ = m.From.Unlock(ctx, id)
+		return fmt.Errorf("err getting source: %v", err)
+	}
+	data := doc.Data()
+	oldTimers := []string{}
+	for _, t := range wf.Meta.Threads {
+		for i, evt := range t.WaitEvents {
+			if evt.Status != async.EventSetup {
+				continue
+			}
+			setup, old, err := m.moveTimer(ctx, evt.Req)
+			if err != nil {
+				_ = m.From.Unlock(ctx, id)
+				return fmt.Errorf("err moving timer %v: %v", evt.Req.Name, err)
+			}
+			if old != "" {
+				t.WaitEvents[i].Req.SetupData = setup
+				oldTimers = append(oldTimers, old)
+			}
+		}
+	}
+	data["Meta"] = wf.Meta
+	data["LockTill"] = time.Time{}
+	dst := m.To.DB.Collection(m.To.Collection).Doc(id)
+	_, err = dst.Create(ctx, data)
+	if status.Code(err) == codes.AlreadyExists {
+		_ = m.From.Unlock(ctx, id)
+		return ErrAlreadyExists
+	}
+	if err != nil {
+		_ = m.From.Unlock(ctx, id)
+		return fmt.Errorf("err creating destination: %v", err)
+	}
+	err = m.copyHistory(ctx, id)
+	if err == nil {
+		err = m.verify(ctx, id, doc)
+	}
+	if err != nil {
+		// source stays authoritative
+		_, _ = dst.Delete(ctx)
+		_ = m.From.Unlock(ctx, id)
+		return err
+	}
+	for _, name := range oldTimers {
+		_, err := m.FromTasks.C.Projects.Locations.Queues.Tasks.Delete(name).Context(ctx).Do()
+		if err != nil {
+			log.Printf("migration: err deleting source timer %v: %v", name, err)
+		}
+	}
+	if m.DeleteSource {
+		_, err = src.Delete(ctx)
+	} else {
+		_, err = src.Update(ctx, []firestore.Update{
+			{Path: "Quarantined", Value: true},
+			{Path: "LastError", Value: ErrMigrated.Error()},
+			{Path: "LockTill", Value: time.Time{}},
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("err retiring source: %v", err)
+	}
+	if runnable(wf.Meta) && m.To.Scheduler != nil {
+		return m.To.Scheduler.ScheduleWithPriority(ctx, id, 0, wf.Priority)
+	}
+	return nil
+}
+
+// moveTimer creates timer in destination with the remaining delay. Returns new setup data and name of source task.
+func (m Migration) moveTimer(ctx context.Context, req async.CallbackRequest) (string, string, error) {
+	if m.FromTasks == nil || m.To.Callbacks == nil {
+		return "", "", nil
+	}
+	var data GTasksSchedulerData
+	err := json.Unmarshal([]byte(req.SetupData), &data)
+	if err != nil || data.ID == "" {
+		return "", "", nil // not a timer
+	}
+	task, err := m.FromTasks.C.Projects.Locations.Queues.Tasks.Get(data.ID).Context(ctx).Do()
+	if err != nil {
+		return "", "", fmt.Errorf("err getting source task: %v", err)
+	}
+	at, err := time.Parse(time.RFC3339, task.ScheduleTime)
+	if err != nil {
+		return "", "", fmt.Errorf("err parsing schedule time: %v", err)
+	}
+	delay := time.Until(at)
+	if delay < 0 {
+		delay = 0
+	}
+	setup, err := m.To.Callbacks.Setup(ctx, req, delay)
+	if err != nil {
+		return "", "", err
+	}
+	return setup, data.ID, nil
+}
+
+func (m Migration) copyHistory(ctx context.Context, id string) error {
+	if len(m.To.History) == 0 {
+		return nil
+	}
+	entries, err := m.From.ReadHistory(ctx, id)
+	if err != nil {
+		log.Printf("migration: history of %v is not copied: %v", id, err)
+		return nil
+	}
+	for _, l := range entries {
+		for _, s := range m.To.History {
+			err := s.Write(ctx, l)
+			if err != nil {
+				return fmt.Errorf("err copying history: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// verify checks that destination has the same state and progress as source
+func (m Migration) verify(ctx context.Context, id string, src *firestore.DocumentSnapshot) error {
+	doc, err := m.To.DB.Collection(m.To.Collection).Doc(id).Get(ctx)
+	if err != nil {
+		return fmt.Errorf("err reading destination: %v", err)
+	}
+	var a, b DBWorkflow
+	err = src.DataTo(&a)
+	if err == nil {
+		err = doc.DataTo(&b)
+	}
+	if err != nil {
+		return fmt.Errorf("err unmarshaling workflow: %v", err)
+	}
+	if a.Meta.PC != b.Meta.PC || a.Meta.Status != b.Meta.Status || !reflect.DeepEqual(src.Data()["State"], doc.Data()["State"]) {
+		return fmt.Errorf("verification failed: destination differs from source")
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package gasync
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Note is an operator annotation of workflow instance, i.e. link to support ticket.
+// Stored in Collection+"_notes".
+type Note struct {
+	ID         string
+	WorkflowID string
+	Author     string
+	Text       string
+	Time       time.Time
+}
+
+func (fs FirestoreEngine) notes() *firestore.CollectionRef {
+	return fs.DB.Collection(fs.Collection + "_notes")
+}
+
+// AddNote annotates workflow. Author is taken from identity of the caller if it's authenticated.
+func (fs FirestoreEngine) AddNote(ctx context.Context, id string, n Note) (Note, error) {
+	_, err := fs.DB.Collection(fs.Collection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return Note{}, ErrNotFound
+	}
+	if err != nil {
+		return Note{}, fmt.Errorf("err getting workflow: %v", err)
+	}
+	if caller, ok := IdentityFromContext(ctx); ok {
+		n.Author = caller.Subject
+	}
+	doc := fs.notes().NewDoc()
+	n.ID = doc.ID
+	n.WorkflowID = id
+	n.Time = time.Now()
+	_, err = doc.Create(ctx, n)
+	if err != nil {
+		return Note{}, fmt.Errorf("err saving note: %v", err)
+	}
+	return n, nil
+}
+
+// Notes returns workflow notes, oldest first
+func (fs FirestoreEngine) Notes(ctx context.Context, id string) ([]Note, error) {
+	docs, err := fs.notes().Where("WorkflowID", "==", id).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	ret := []Note{}
+	for _, d := range docs {
+		var n Note
+		err = d.DataTo(&n)
+		if err != nil {
+			return nil, fmt.Errorf("err unmarshaling note: %v", err)
+		}
+		ret = append(ret, n)
+	}
+	// sorted here to avoid composite index on WorkflowID and Time
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Time.Before(ret[j].Time) })
+	return ret, nil
+}
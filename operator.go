@@ -0,0 +1,108 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/gorchestrate/async"
+)
+
+// Operator actions recorded in history
+const (
+	OperatorSkip   = "skip"
+	OperatorInject = "inject"
+)
+
+// OperatorAction is recorded in history when awaited event is skipped or injected by operator,
+// i.e. to unblock instances waiting for defunct third party.
+type OperatorAction struct {
+	Action   string // OperatorSkip or OperatorInject
+	Operator string // subject of authenticated caller, if any
+	Reason   string
+}
+
+// OperatorEventRequest is a body of skip and inject endpoints
+type OperatorEventRequest struct {
+	Payload json.RawMessage // event data for inject, event output recorded for skip. {} by default
+	Reason  string
+}
+
+type operatorCtxKey struct{}
+
+func withOperator(ctx context.Context, a OperatorAction) context.Context {
+	if caller, ok := IdentityFromContext(ctx); ok {
+		a.Operator = caller.Subject
+	}
+	return context.WithValue(ctx, operatorCtxKey{}, &a)
+}
+
+func operatorFromContext(ctx context.Context) *OperatorAction {
+	a, _ := ctx.Value(operatorCtxKey{}).(*OperatorAction)
+	return a
+}
+
+func defaultPayload(payload json.RawMessage) json.RawMessage {
+	if len(payload) == 0 {
+		return json.RawMessage("{}")
+	}
+	return payload
+}
+
+// InjectEvent delivers synthetic event with operator-provided data to the workflow.
+// Event is handled by its handler as if it was sent by the caller, but middleware is bypassed.
+func (fs FirestoreEngine) InjectEvent(ctx context.Context, id, event string, payload json.RawMessage, reason string) (interface{}, error) {
+	defer logTime("inject event")()
+	ctx = withOperator(ctx, OperatorAction{Action: OperatorInject, Reason: reason})
+	return fs.handleEvent(ctx, id, event, []byte(defaultPayload(payload)))
+}
+
+// SkipEvent marks awaited event as handled without calling its handler and continues workflow after it.
+// Payload is recorded as event output. Handler is torn down as usual when workflow is resumed.
+func (fs FirestoreEngine) SkipEvent(ctx context.Context, id, event string, payload json.RawMessage, reason string) error {
+	defer logTime("skip event")()
+	ctx = withOperator(ctx, OperatorAction{Action: OperatorSkip, Reason: reason})
+	_, err := fs.handleEvent(ctx, id, event, []byte(defaultPayload(payload)))
+	return err
+}
+
+func eventSkipped(ctx context.Context) bool {
+	a := operatorFromContext(ctx)
+	return a != nil && a.Action == OperatorSkip
+}
+
+// operatorState replaces handler of skipped event, so that it's not called
+func operatorState(ctx context.Context, state async.WorkflowState, event string) async.WorkflowState {
+	if eventSkipped(ctx) {
+		return skippedState{WorkflowState: state, event: event}
+	}
+	return state
+}
+
+type skippedState struct {
+	async.WorkflowState
+	event string
+}
+
+func (s skippedState) Definition() async.Section {
+	return mapHandlers(s.WorkflowState.Definition(), func(e async.Event) async.Handler {
+		if e.Callback.Name == s.event {
+			return skipHandler{}
+		}
+		return e.Handler
+	}).(async.Section)
+}
+
+// skipHandler returns payload as event output without changing the state
+type skipHandler struct{}
+
+func (h skipHandler) Setup(ctx context.Context, req async.CallbackRequest) (string, error) {
+	return "", nil
+}
+
+func (h skipHandler) Handle(ctx context.Context, req async.CallbackRequest, input interface{}) (interface{}, error) {
+	return pjson(input), nil
+}
+
+func (h skipHandler) Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error {
+	return nil
+}
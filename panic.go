@@ -0,0 +1,94 @@
+package gasync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+)
+
+// DefaultMaxPanics is the number of panics after which workflow is quarantined
+const DefaultMaxPanics = 3
+
+// ErrQuarantined is returned for workflows that were quarantined after panicking repeatedly.
+var ErrQuarantined = errors.New("workflow is quarantined")
+
+// PanicError is returned when workflow code panics. Ref can be used to find the stack trace in logs.
+type PanicError struct {
+	Ref   string
+	Value interface{}
+	Stack []byte
+}
+
+func (e PanicError) Error() string {
+	return fmt.Sprintf("workflow panicked (ref %v): %v", e.Ref, e.Value)
+}
+
+// recoverPanic converts panic into PanicError. Should be deferred.
+func recoverPanic(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	*err = PanicError{
+		Ref:   newID(),
+		Value: r,
+		Stack: debug.Stack(),
+	}
+}
+
+func safeResume(ctx context.Context, state async.WorkflowState, meta *async.State, save async.Checkpoint) (err error) {
+	defer recoverPanic(&err)
+	return async.Resume(ctx, state, meta, save)
+}
+
+func safeHandleCallback(ctx context.Context, req async.CallbackRequest, state async.WorkflowState, meta *async.State, input interface{}) (out interface{}, err error) {
+	defer recoverPanic(&err)
+	return async.HandleCallback(ctx, req, state, meta, input)
+}
+
+func (fs FirestoreEngine) maxPanics() int {
+	if fs.MaxPanics == 0 {
+		return DefaultMaxPanics
+	}
+	return fs.MaxPanics
+}
+
+// unlockAfter unlocks workflow after failed processing. Panics are persisted and workflow is quarantined
+// when it panics too many times, so that it won't be resumed again.
+func (fs FirestoreEngine) unlockAfter(ctx context.Context, wf *DBWorkflow, err error) error {
+	var pErr PanicError
+	if !errors.As(err, &pErr) {
+		return fs.Unlock(ctx, wf.Meta.ID)
+	}
+	wf.Panics++
+	wf.LastError = pErr.Error()
+	wf.Quarantined = wf.Panics >= fs.maxPanics()
+	_, err = fs.DB.Collection(fs.Collection).Doc(wf.Meta.ID).Update(ctx,
+		[]firestore.Update{
+			{Path: "LockTill", Value: time.Time{}},
+			{Path: "Panics", Value: wf.Panics},
+			{Path: "LastError", Value: wf.LastError},
+			{Path: "Quarantined", Value: wf.Quarantined},
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("err saving panic: %v", err)
+	}
+	return nil
+}
+
+// Release removes workflow from quarantine, so it can be resumed again. Should be called after fixing workflow definition.
+func (fs FirestoreEngine) Release(ctx context.Context, id string) error {
+	_, err := fs.DB.Collection(fs.Collection).Doc(id).Update(ctx,
+		[]firestore.Update{
+			{Path: "Panics", Value: 0},
+			{Path: "Quarantined", Value: false},
+		},
+	)
+	return err
+}
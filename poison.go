@@ -0,0 +1,158 @@
+package gasync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultMaxEventFailures is the number of failed attempts after which event payload is quarantined
+const DefaultMaxEventFailures = 3
+
+// ErrEventQuarantined is returned for events that were quarantined after failing repeatedly.
+var ErrEventQuarantined = errors.New("event is quarantined")
+
+// DBFailedEvent is an event payload that failed to be handled.
+// Failed events are stored in "quarantine" subcollection of the workflow.
+type DBFailedEvent struct {
+	Key         string
+	Callback    async.CallbackRequest
+	Input       interface{}
+	Error       string
+	Failures    int
+	Quarantined bool // event is not handled anymore until it's retried or discarded
+	FirstFailed time.Time
+	LastFailed  time.Time
+}
+
+func (fs FirestoreEngine) quarantine(id string) *firestore.CollectionRef {
+	return fs.DB.Collection(fs.Collection).Doc(id).Collection("quarantine")
+}
+
+func (fs FirestoreEngine) maxEventFailures() int {
+	if fs.MaxEventFailures == 0 {
+		return DefaultMaxEventFailures
+	}
+	return fs.MaxEventFailures
+}
+
+// eventKey identifies the same event payload delivered multiple times
+func eventKey(cb async.CallbackRequest, input interface{}) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%v/%v/%v/%v", cb.Name, cb.ThreadID, cb.PC, inputHash(input))))
+	return hex.EncodeToString(h[:16])
+}
+
+// checkQuarantine returns ErrEventQuarantined if event payload was quarantined.
+// failed is true if payload has failed before, so that its failure record is cleared once it succeeds.
+func (fs FirestoreEngine) checkQuarantine(ctx context.Context, id string, cb async.CallbackRequest, input interface{}) (failed bool, err error) {
+	doc, err := fs.quarantine(id).Doc(eventKey(cb, input)).Get(ctx)
+	fs.Costs.read(ctx, "", 1) // missing documents are billed as well
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("err checking quarantine: %v", err)
+	}
+	var e DBFailedEvent
+	err = doc.DataTo(&e)
+	if err != nil {
+		return true, fmt.Errorf("err unmarshaling failed event: %v", err)
+	}
+	if e.Quarantined {
+		return true, fmt.Errorf("%w: %v (%v failures): %v", ErrEventQuarantined, e.Key, e.Failures, e.Error)
+	}
+	return true, nil
+}
+
+// clearFailure removes failure record of the payload that was handled successfully,
+// so that failures separated by successful deliveries don't add up to quarantine
+func (fs FirestoreEngine) clearFailure(ctx context.Context, id string, cb async.CallbackRequest, input interface{}) {
+	_, err := fs.quarantine(id).Doc(eventKey(cb, input)).Delete(ctx)
+	if err != nil {
+		log.Printf("err clearing failed event of %v: %v", id, err)
+		return
+	}
+	fs.Costs.write(ctx, "", 1)
+}
+
+// recordFailure stores failed event payload and quarantines it after too many failures
+func (fs FirestoreEngine) recordFailure(ctx context.Context, id string, cb async.CallbackRequest, input interface{}, failure error) error {
+	key := eventKey(cb, input)
+	ref := fs.quarantine(id).Doc(key)
+	return fs.DB.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		e := DBFailedEvent{
+			Key:         key,
+			Callback:    cb,
+			Input:       input,
+			FirstFailed: time.Now(),
+		}
+		doc, err := tx.Get(ref)
+		if err == nil {
+			err = doc.DataTo(&e)
+		}
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		e.Failures++
+		e.Error = failure.Error()
+		e.LastFailed = time.Now()
+		e.Quarantined = e.Failures >= fs.maxEventFailures()
+		fs.Costs.read(ctx, "", 1)
+		fs.Costs.write(ctx, "", 1)
+		return tx.Set(ref, e)
+	})
+}
+
+// FailedEvents returns failed events of the workflow, including quarantined ones
+func (fs FirestoreEngine) FailedEvents(ctx context.Context, id string) ([]DBFailedEvent, error) {
+	docs, err := fs.quarantine(id).OrderBy("LastFailed", firestore.Desc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	ret := []DBFailedEvent{}
+	for _, d := range docs {
+		var e DBFailedEvent
+		err = d.DataTo(&e)
+		if err != nil {
+			return nil, fmt.Errorf("err unmarshaling failed event %v: %v", d.Ref.ID, err)
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+// RetryEvent removes event from quarantine and handles it again
+func (fs FirestoreEngine) RetryEvent(ctx context.Context, id, key string) (interface{}, error) {
+	doc, err := fs.quarantine(id).Doc(key).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var e DBFailedEvent
+	err = doc.DataTo(&e)
+	if err != nil {
+		return nil, fmt.Errorf("err unmarshaling failed event: %v", err)
+	}
+	_, err = doc.Ref.Delete(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return fs.HandleCallback(ctx, id, e.Callback, e.Input)
+}
+
+// DiscardEvent removes event from quarantine without handling it
+func (fs FirestoreEngine) DiscardEvent(ctx context.Context, id, key string) error {
+	_, err := fs.quarantine(id).Doc(key).Delete(ctx)
+	return err
+}
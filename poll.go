@@ -0,0 +1,120 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+)
+
+// ErrPollPending is returned by handlers when condition is not met yet, i.e. by PollHandler or FanOutHandler.
+// Workflow is left unchanged and keeps waiting for the event.
+var ErrPollPending = errors.New("poll condition is not met yet")
+
+// PollChecker checks external system. When done is true - result is returned as event output.
+type PollChecker func(ctx context.Context) (result interface{}, done bool, err error)
+
+// PollUntil waits until checker reports done, calling it every interval.
+// Checker is called with workflow locked, but workflow state is saved only when it's done,
+// so checker should not modify workflow state - result should be handled by event statements instead.
+func (s *Server) PollUntil(name string, interval time.Duration, checker PollChecker, stmts ...async.Stmt) async.Event {
+	return async.On(name, &PollHandler{
+		Interval:  interval,
+		Checker:   checker,
+		scheduler: s.timers,
+	}, stmts...)
+}
+
+type PollHandler struct {
+	Interval  time.Duration
+	Checker   PollChecker
+	scheduler TimerScheduler
+}
+
+func (h PollHandler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type     string
+		Interval string
+	}{
+		Type:     "poll",
+		Interval: fmt.Sprintf("%v sec", h.Interval.Seconds()),
+	})
+}
+
+func (h *PollHandler) Handle(ctx context.Context, req async.CallbackRequest, input interface{}) (interface{}, error) {
+	defer logTime("poll")()
+	result, done, err := h.Checker(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if done {
+		return result, nil
+	}
+	data, err := h.scheduler.Setup(ctx, req, h.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("err scheduling next poll: %v", err)
+	}
+	return nil, PollPending{SetupData: data}
+}
+
+// PollPending is ErrPollPending with setup data of the next check, i.e. Cloud Task name.
+// Engine stores it on the awaited callback, so that Teardown and reaper use the live task.
+type PollPending struct {
+	SetupData string
+}
+
+func (e PollPending) Error() string {
+	return ErrPollPending.Error()
+}
+
+func (e PollPending) Is(target error) bool {
+	return target == ErrPollPending
+}
+
+// unlockPending unlocks workflow that keeps waiting for the callback, storing setup data of the next check
+func (fs FirestoreEngine) unlockPending(ctx context.Context, wf *DBWorkflow, cb async.CallbackRequest, err error) error {
+	var p PollPending
+	if !errors.As(err, &p) || p.SetupData == "" {
+		return fs.Unlock(ctx, wf.Meta.ID)
+	}
+	found := false
+	for _, t := range wf.Meta.Threads {
+		if cb.ThreadID != "" && cb.ThreadID != t.ID {
+			continue
+		}
+		for i, evt := range t.WaitEvents {
+			if evt.Req.Name == cb.Name {
+				t.WaitEvents[i].Req.SetupData = p.SetupData
+				found = true
+			}
+		}
+	}
+	if !found {
+		return fs.Unlock(ctx, wf.Meta.ID)
+	}
+	// HandleCallback doesn't modify threads if handler fails, so only setup data is changed
+	_, uErr := fs.DB.Collection(fs.Collection).Doc(wf.Meta.ID).Update(ctx,
+		[]firestore.Update{
+			{Path: "Meta.Threads", Value: wf.Meta.Threads},
+			{Path: "LockTill", Value: time.Time{}},
+		},
+	)
+	fs.Costs.write(ctx, wf.Meta.Workflow, 1)
+	if uErr != nil {
+		return fmt.Errorf("err saving poll setup data: %v", uErr)
+	}
+	return nil
+}
+
+// Setup schedules first check. Checks are delivered the same way as timeouts.
+func (h *PollHandler) Setup(ctx context.Context, req async.CallbackRequest) (string, error) {
+	return h.scheduler.Setup(ctx, req, h.Interval)
+}
+
+func (h *PollHandler) Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error {
+	return h.scheduler.Teardown(ctx, req, handled)
+}
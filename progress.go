@@ -0,0 +1,121 @@
+package gasync
+
+import (
+	"time"
+
+	"github.com/gorchestrate/async"
+)
+
+// Progress is a human-readable summary of workflow execution derived from Meta
+type Progress struct {
+	Waiting   []string // steps workflow is waiting on
+	Events    []string // events workflow is waiting for
+	Threads   []ThreadProgress
+	Percent   int // percent of definition steps completed
+	LastError string
+}
+
+type ThreadProgress struct {
+	ID      string
+	Status  async.ThreadStatus
+	Step    string
+	Elapsed string // time since thread was started
+}
+
+// WorkflowStatus is a workflow with derived progress information
+type WorkflowStatus struct {
+	*DBWorkflow
+	Progress Progress
+}
+
+// trackThreads records start time of new threads
+func (wf *DBWorkflow) trackThreads() {
+	started := map[string]time.Time{}
+	for _, t := range wf.Meta.Threads {
+		started[t.ID] = wf.ThreadsStarted[t.ID]
+		if started[t.ID].IsZero() {
+			started[t.ID] = time.Now()
+		}
+	}
+	wf.ThreadsStarted = started
+}
+
+// definitionSteps returns names of steps in definition order
+func definitionSteps(def async.Section) []string {
+	steps := []string{}
+	_, _ = async.Walk(def, func(s async.Stmt) bool {
+		switch x := s.(type) {
+		case async.StmtStep:
+			steps = append(steps, x.Name)
+		case async.WaitCondStmt:
+			steps = append(steps, x.Name)
+		case async.WaitEventsStmt:
+			steps = append(steps, x.Name)
+		}
+		return false
+	})
+	return steps
+}
+
+// Progress derives progress of the workflow by comparing Meta with workflow definition
+func (fs FirestoreEngine) Progress(wf *DBWorkflow) Progress {
+	p := Progress{
+		Waiting:   []string{},
+		Events:    []string{},
+		Threads:   []ThreadProgress{},
+		LastError: wf.LastError,
+	}
+	index := map[string]int{}
+	total := 0
+	if w, ok := resolve(fs.Workflows, wf.Meta.Workflow, wf.Version); ok {
+		steps := definitionSteps(w().Definition())
+		total = len(steps)
+		for i, s := range steps {
+			index[s] = i + 1
+		}
+	}
+	furthest := 0
+	for _, t := range wf.Meta.Threads {
+		tp := ThreadProgress{
+			ID:     t.ID,
+			Status: t.Status,
+			Step:   t.CurStep,
+		}
+		if started, ok := wf.ThreadsStarted[t.ID]; ok {
+			tp.Elapsed = time.Since(started).Truncate(time.Second).String()
+		}
+		p.Threads = append(p.Threads, tp)
+		if t.Status == async.ThreadWaitingEvent || t.Status == async.ThreadWaitingCondition {
+			p.Waiting = append(p.Waiting, t.CurStep)
+		}
+		for _, e := range t.WaitEvents {
+			p.Events = append(p.Events, e.Req.Name)
+			if e.Error != "" {
+				p.LastError = e.Error
+			}
+		}
+		// step is completed once thread moved past it
+		done := index[t.CurStep] - 1
+		if done > furthest {
+			furthest = done
+		}
+	}
+	if total > 0 {
+		p.Percent = furthest * 100 / total
+	}
+	if wf.Meta.Status == async.WorkflowFinished {
+		p.Percent = 100
+	}
+	return p
+}
+
+// BatchGetRequest is a body of POST /wf/_batchGet
+type BatchGetRequest struct {
+	IDs []string
+}
+
+// BatchGetResponse contains redacted workflows by id and ids of workflows that don't exist
+type BatchGetResponse struct {
+	Workflows map[string]WorkflowStatus
+	NotFound  []string
+}
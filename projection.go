@@ -0,0 +1,197 @@
+package gasync
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+)
+
+// Projection maintains read model of workflows in secondary stores.
+// On every save trimmed view of the redacted workflow is upserted into all targets.
+type Projection struct {
+	Fields  []string // JSON paths of state fields to include, i.e. "Order.Total". All state is included if empty
+	Targets []ProjectionTarget
+}
+
+// ProjectionView is a queryable view of workflow
+type ProjectionView struct {
+	ID        string
+	Workflow  string
+	Status    async.WorkflowStatus
+	Labels    map[string]string
+	Priority  int
+	Fields    map[string]interface{}
+	UpdatedAt time.Time
+}
+
+type ProjectionTarget interface {
+	Upsert(ctx context.Context, v ProjectionView) error
+}
+
+// view builds projection view from the workflow
+func (p *Projection) view(wf *DBWorkflow, state interface{}) (ProjectionView, error) {
+	v := ProjectionView{
+		ID:        wf.Meta.ID,
+		Workflow:  wf.Meta.Workflow,
+		Status:    wf.Meta.Status,
+		Labels:    wf.Labels,
+		Priority:  wf.Priority,
+		Fields:    map[string]interface{}{},
+		UpdatedAt: time.Now(),
+	}
+	d, err := json.Marshal(state)
+	if err != nil {
+		return v, err
+	}
+	var all map[string]interface{}
+	err = json.Unmarshal(d, &all)
+	if err != nil {
+		return v, err
+	}
+	if len(p.Fields) == 0 {
+		v.Fields = all
+		return v, nil
+	}
+	for _, f := range p.Fields {
+		if val, ok := jsonPath(all, f); ok {
+			v.Fields[f] = val
+		}
+	}
+	return v, nil
+}
+
+// jsonPath returns value by dot-separated path
+func jsonPath(in map[string]interface{}, path string) (interface{}, bool) {
+	var cur interface{} = in
+	for _, p := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[p]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// project updates read models. Errors are logged, since projections can be rebuilt later.
+func (fs FirestoreEngine) project(ctx context.Context, wf *DBWorkflow, state interface{}) {
+	if fs.Projection == nil {
+		return
+	}
+	defer logTime("projection")()
+	// read models and search index are queried outside of the engine, so they never get sensitive fields
+	redacted, err := fs.Redact(&DBWorkflow{Meta: wf.Meta, State: state, Version: wf.Version})
+	if err != nil {
+		log.Printf("err redacting projection for %v: %v", wf.Meta.ID, err)
+		return
+	}
+	v, err := fs.Projection.view(wf, redacted.State)
+	if err != nil {
+		log.Printf("err building projection for %v: %v", wf.Meta.ID, err)
+		return
+	}
+	for _, t := range fs.Projection.Targets {
+		err := t.Upsert(ctx, v)
+		if err != nil {
+			log.Printf("err projecting %v to %T: %v", wf.Meta.ID, t, err)
+		}
+	}
+}
+
+// FirestoreProjection stores views in Firestore collection
+type FirestoreProjection struct {
+	DB         *firestore.Client
+	Collection string
+}
+
+func (p FirestoreProjection) Upsert(ctx context.Context, v ProjectionView) error {
+	_, err := p.DB.Collection(p.Collection).Doc(v.ID).Set(ctx, v)
+	return err
+}
+
+// SQLProjection stores views in Postgres table with the following schema:
+//
+//	CREATE TABLE workflows (
+//		id TEXT PRIMARY KEY,
+//		workflow TEXT,
+//		status TEXT,
+//		labels JSONB,
+//		priority INT,
+//		fields JSONB,
+//		updated_at TIMESTAMPTZ
+//	)
+type SQLProjection struct {
+	DB    *sql.DB
+	Table string
+}
+
+func (p SQLProjection) Upsert(ctx context.Context, v ProjectionView) error {
+	labels, err := json.Marshal(v.Labels)
+	if err != nil {
+		return err
+	}
+	fields, err := json.Marshal(v.Fields)
+	if err != nil {
+		return err
+	}
+	_, err = p.DB.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %v (id, workflow, status, labels, priority, fields, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET
+			workflow = EXCLUDED.workflow,
+			status = EXCLUDED.status,
+			labels = EXCLUDED.labels,
+			priority = EXCLUDED.priority,
+			fields = EXCLUDED.fields,
+			updated_at = EXCLUDED.updated_at`, p.Table),
+		v.ID, v.Workflow, string(v.Status), string(labels), v.Priority, string(fields), v.UpdatedAt)
+	return err
+}
+
+// ElasticsearchProjection stores views as documents in Elasticsearch index
+type ElasticsearchProjection struct {
+	URL    string // i.e. http://localhost:9200
+	Index  string
+	Client *http.Client
+}
+
+func (p ElasticsearchProjection) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return http.DefaultClient
+}
+
+func (p ElasticsearchProjection) Upsert(ctx context.Context, v ProjectionView) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	u := strings.TrimRight(p.URL, "/") + "/" + url.PathEscape(p.Index) + "/_doc/" + url.PathEscape(v.ID)
+	req, err := http.NewRequestWithContext(ctx, "PUT", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("elasticsearch responded with %v", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package gasync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+)
+
+// QuotaLabel is set on workflows created with API key, so that concurrent instances can be counted.
+// Its value is a hash of the key, since labels are visible to API clients.
+const QuotaLabel = "quota_key"
+
+// ErrQuotaExceeded is returned when tenant or API key exceeded its quota
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits usage of the API by single tenant or API key. Zero values mean unlimited.
+type Quota struct {
+	RequestsPerDay      int
+	ConcurrentInstances int // workflows that are not finished yet
+}
+
+// Quotas are enforced per tenant or API key
+type Quotas struct {
+	// Key identifies tenant or API key of the request, i.e. from X-API-Key header.
+	// Requests without key are not limited, i.e. internal calls from Cloud Tasks.
+	Key     func(r *http.Request) string
+	Keys    map[string]Quota
+	Default Quota // used for keys not present in Keys
+
+	// Shards is the number of daily counter documents per key, DefaultQuotaShards by default.
+	// Single Firestore document sustains about 1 write per second, so counters are sharded.
+	Shards int
+	// Refresh is how often daily usage is re-read from all shards, DefaultQuotaRefresh by default.
+	// Requests in between are counted locally, so requests served by other instances may exceed quota during this interval.
+	Refresh time.Duration
+
+	mu    sync.RWMutex
+	usage map[string]*quotaUsage
+}
+
+// DefaultQuotaShards is the number of daily request counters per key
+const DefaultQuotaShards = 20
+
+// DefaultQuotaRefresh is how often daily usage is re-read from counters
+const DefaultQuotaRefresh = 10 * time.Second
+
+type quotaUsage struct {
+	day     string
+	total   int // requests counted by all instances when fetched
+	local   int // requests counted by this instance since fetched
+	fetched time.Time
+}
+
+func (q *Quotas) shards() int {
+	if q.Shards <= 0 {
+		return DefaultQuotaShards
+	}
+	return q.Shards
+}
+
+func (q *Quotas) refresh() time.Duration {
+	if q.Refresh <= 0 {
+		return DefaultQuotaRefresh
+	}
+	return q.Refresh
+}
+
+// count counts request of the key and returns approximate daily usage, shards are read at most once per Refresh
+func (q *Quotas) count(ctx context.Context, engine *FirestoreEngine, key string, now time.Time) (int, error) {
+	err := engine.CountRequest(ctx, key, now, q.shards())
+	if err != nil {
+		return 0, err
+	}
+	day := quotaDay(now)
+	q.mu.Lock()
+	if q.usage == nil {
+		q.usage = map[string]*quotaUsage{}
+	}
+	u := q.usage[key]
+	if u == nil || u.day != day {
+		u = &quotaUsage{day: day}
+		q.usage[key] = u
+	}
+	u.local++
+	n := u.total + u.local
+	stale := time.Since(u.fetched) > q.refresh()
+	q.mu.Unlock()
+	if !stale {
+		return n, nil
+	}
+	total, err := engine.RequestsCount(ctx, key, now, q.shards())
+	if err != nil {
+		return 0, err
+	}
+	q.mu.Lock()
+	u.total, u.local, u.fetched = total, 0, time.Now()
+	q.mu.Unlock()
+	return total, nil
+}
+
+func (q *Quotas) quota(key string) Quota {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if v, ok := q.Keys[key]; ok {
+		return v
+	}
+	return q.Default
+}
+
+// set replaces quotas on config reload
+func (q *Quotas) set(keys map[string]Quota, def *Quota) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if keys != nil {
+		q.Keys = keys
+	}
+	if def != nil {
+		q.Default = *def
+	}
+}
+
+// DBQuotaUsage is a shard of daily usage counter. Stored in Collection+"_quota" with {key hash}_{date}_{shard} id.
+type DBQuotaUsage struct {
+	Key      string // hash of the key
+	Day      string
+	Shard    int
+	Requests int
+}
+
+func (fs FirestoreEngine) quotaUsage() *firestore.CollectionRef {
+	return fs.DB.Collection(fs.Collection + "_quota")
+}
+
+func quotaDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// quotaKeyID identifies quota key in labels and documents. Keys are secrets and may contain characters
+// not allowed in document ids, so they are never stored as is.
+func quotaKeyID(key string) string {
+	h := sha256.Sum256([]byte("gasync-quota:" + key))
+	return hex.EncodeToString(h[:16])
+}
+
+func (fs FirestoreEngine) quotaShard(key string, day time.Time, shard int) *firestore.DocumentRef {
+	return fs.quotaUsage().Doc(fmt.Sprintf("%v_%v_%v", quotaKeyID(key), quotaDay(day), shard))
+}
+
+// CountRequest increments random shard of daily request counter of the key
+func (fs FirestoreEngine) CountRequest(ctx context.Context, key string, day time.Time, shards int) error {
+	shard := rand.Intn(shards)
+	_, err := fs.quotaShard(key, day, shard).Set(ctx, map[string]interface{}{
+		"Key":      quotaKeyID(key),
+		"Day":      quotaDay(day),
+		"Shard":    shard,
+		"Requests": firestore.Increment(1),
+	}, firestore.MergeAll)
+	if err != nil {
+		return fmt.Errorf("err counting request: %v", err)
+	}
+	return nil
+}
+
+// RequestsCount sums daily request counters of the key
+func (fs FirestoreEngine) RequestsCount(ctx context.Context, key string, day time.Time, shards int) (int, error) {
+	refs := []*firestore.DocumentRef{}
+	for i := 0; i < shards; i++ {
+		refs = append(refs, fs.quotaShard(key, day, i))
+	}
+	docs, err := fs.DB.GetAll(ctx, refs)
+	if err != nil {
+		return 0, fmt.Errorf("err reading request counters: %v", err)
+	}
+	n := 0
+	for _, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		var u DBQuotaUsage
+		err = doc.DataTo(&u)
+		if err != nil {
+			return 0, fmt.Errorf("err unmarshaling request counter: %v", err)
+		}
+		n += u.Requests
+	}
+	return n, nil
+}
+
+// stripQuotaLabel removes QuotaLabel from user-supplied labels, it can only be set from quota key of the request
+func stripQuotaLabel(labels map[string]string) {
+	delete(labels, QuotaLabel)
+}
+
+// CountActive counts unfinished workflows created with the key, up to the limit
+func (fs FirestoreEngine) CountActive(ctx context.Context, key string, limit int) (int, error) {
+	docs, err := fs.DB.Collection(fs.Collection).
+		WherePath(firestore.FieldPath{"Labels", QuotaLabel}, "==", quotaKeyID(key)).
+		Where("Meta.Status", "in", []string{string(async.WorkflowResuming), string(async.WorkflowWaiting)}).
+		Select().Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return 0, fmt.Errorf("err counting active workflows: %v", err)
+	}
+	return len(docs), nil
+}
+
+// quotaMiddleware enforces daily request quota and reports it in X-RateLimit-* headers
+func quotaMiddleware(q *Quotas, engine *FirestoreEngine) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := q.Key(r)
+			limit := q.quota(key).RequestsPerDay
+			if key == "" || limit <= 0 {
+				h.ServeHTTP(w, r)
+				return
+			}
+			now := time.Now().UTC()
+			n, err := q.count(r.Context(), engine, key, now)
+			if err != nil {
+				jsonErr(w, err, 500)
+				return
+			}
+			reset := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+			remaining := limit - n
+			if remaining < 0 {
+				remaining = 0
+			}
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			if n > limit {
+				w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+				jsonErr(w, fmt.Errorf("%w: %v requests per day", ErrQuotaExceeded, limit), http.StatusTooManyRequests)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// checkConcurrentQuota returns ErrQuotaExceeded if key has too many unfinished workflows
+func checkConcurrentQuota(ctx context.Context, q *Quotas, engine *FirestoreEngine, key string) error {
+	limit := q.quota(key).ConcurrentInstances
+	if key == "" || limit <= 0 {
+		return nil
+	}
+	n, err := engine.CountActive(ctx, key, limit)
+	if err != nil {
+		return err
+	}
+	if n >= limit {
+		return fmt.Errorf("%w: %v concurrent workflows", ErrQuotaExceeded, limit)
+	}
+	return nil
+}
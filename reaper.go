@@ -0,0 +1,209 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Reaper periodically repairs workflows that got stuck due to infrastructure failures:
+// expired locks, timers that lost their Cloud Tasks and runnable workflows that were not resumed.
+// Only one Reaper instance is active at a time - leadership is held via lease document in Firestore.
+type Reaper struct {
+	Engine        *FirestoreEngine
+	Scheduler     *GTasksScheduler
+	HolderID      string        // unique id of this instance
+	Interval      time.Duration // how often to scan workflows
+	LeaseDuration time.Duration // should be longer than Interval
+	StaleAfter    time.Duration // runnable workflows not updated for this long are scheduled for resume
+	OnStats       func(ReaperStats)
+}
+
+// ReaperStats describes repairs done during single sweep
+type ReaperStats struct {
+	Scanned        int
+	ExpiredLocks   int
+	LostTimers     int
+	StaleWorkflows int
+	Errors         int
+	Duration       time.Duration
+}
+
+type reaperLease struct {
+	Holder  string
+	Expires time.Time
+}
+
+// Run blocks and sweeps workflows every Interval while this instance holds the lease.
+func (r *Reaper) Run(ctx context.Context) error {
+	if r.HolderID == "" {
+		r.HolderID = newID()
+	}
+	if r.Interval == 0 {
+		r.Interval = time.Minute
+	}
+	if r.LeaseDuration == 0 {
+		r.LeaseDuration = r.Interval * 3
+	}
+	if r.StaleAfter == 0 {
+		r.StaleAfter = time.Minute * 5
+	}
+	t := time.NewTicker(r.Interval)
+	defer t.Stop()
+	for {
+		leader, err := acquireLease(ctx, r.Engine, "reaper", r.HolderID, r.LeaseDuration)
+		if err != nil {
+			log.Printf("reaper: err acquiring lease: %v", err)
+		}
+		if leader {
+			stats := r.Sweep(ctx)
+			log.Printf("reaper: %+v", stats)
+			if r.OnStats != nil {
+				r.OnStats(stats)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+		}
+	}
+}
+
+// acquireLease acquires or extends lease, so that only one instance runs background job
+func acquireLease(ctx context.Context, engine *FirestoreEngine, name, holder string, duration time.Duration) (bool, error) {
+	ref := engine.DB.Collection(engine.Collection + "_leases").Doc(name)
+	acquired := false
+	err := engine.DB.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		acquired = false
+		doc, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			var lease reaperLease
+			err = doc.DataTo(&lease)
+			if err != nil {
+				return err
+			}
+			if lease.Holder != holder && time.Now().Before(lease.Expires) {
+				return nil
+			}
+		}
+		acquired = true
+		return tx.Set(ref, reaperLease{
+			Holder:  holder,
+			Expires: time.Now().Add(duration),
+		})
+	})
+	return acquired, err
+}
+
+// Sweep scans all active workflows once and repairs them.
+func (r *Reaper) Sweep(ctx context.Context) ReaperStats {
+	start := time.Now()
+	stats := ReaperStats{}
+	stale := []string{}
+	it := r.Engine.DB.Collection(r.Engine.Collection).
+		Where("Meta.Status", "in", []string{string(async.WorkflowResuming), string(async.WorkflowWaiting)}).
+		Documents(ctx)
+	defer it.Stop()
+	for {
+		doc, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			log.Printf("reaper: err scanning workflows: %v", err)
+			stats.Errors++
+			break
+		}
+		stats.Scanned++
+		var wf DBWorkflow
+		err = doc.DataTo(&wf)
+		if err != nil {
+			log.Printf("reaper: err unmarshaling workflow %v: %v", doc.Ref.ID, err)
+			stats.Errors++
+			continue
+		}
+		if !wf.LockTill.IsZero() && time.Now().After(wf.LockTill) {
+			err = r.Engine.Unlock(ctx, doc.Ref.ID)
+			if err != nil {
+				log.Printf("reaper: %v", err)
+				stats.Errors++
+			} else {
+				stats.ExpiredLocks++
+			}
+		}
+		if runnable(wf.Meta) && time.Since(doc.UpdateTime) > r.StaleAfter {
+			stale = append(stale, doc.Ref.ID)
+			continue
+		}
+		n, err := r.fireLostTimers(ctx, wf.Meta)
+		stats.LostTimers += n
+		if err != nil {
+			log.Printf("reaper: err firing lost timers for workflow %v: %v", doc.Ref.ID, err)
+			stats.Errors++
+		}
+	}
+	err := r.Engine.Scheduler.ScheduleBatch(ctx, stale)
+	stats.StaleWorkflows = len(stale)
+	var bErr BatchError
+	if errors.As(err, &bErr) {
+		for id, err := range bErr.Failed {
+			log.Printf("reaper: err scheduling workflow %v: %v", id, err)
+		}
+		stats.StaleWorkflows -= len(bErr.Failed)
+		stats.Errors += len(bErr.Failed)
+	} else if err != nil {
+		log.Printf("reaper: err scheduling workflows: %v", err)
+		stats.Errors++
+	}
+	stats.Duration = time.Since(start)
+	return stats
+}
+
+// fireLostTimers handles timeouts for which Cloud Task doesn't exist anymore
+func (r *Reaper) fireLostTimers(ctx context.Context, meta async.State) (int, error) {
+	if r.Scheduler == nil {
+		return 0, nil
+	}
+	n := 0
+	for _, t := range meta.Threads {
+		for _, evt := range t.WaitEvents {
+			if evt.Status != async.EventSetup || evt.Handled {
+				continue
+			}
+			var data GTasksSchedulerData
+			err := json.Unmarshal([]byte(evt.Req.SetupData), &data)
+			if err != nil || data.ID == "" {
+				continue // not a timer
+			}
+			_, err = r.Scheduler.C.Projects.Locations.Queues.Tasks.Get(data.ID).Context(ctx).Do()
+			var gErr *googleapi.Error
+			if !errors.As(err, &gErr) || gErr.Code != http.StatusNotFound {
+				continue
+			}
+			_, err = r.Engine.HandleCallback(ctx, meta.ID, evt.Req, nil)
+			if errors.Is(err, ErrPollPending) {
+				continue // next poll is scheduled
+			}
+			if err != nil {
+				return n, fmt.Errorf("event %v: %w", evt.Req.Name, err)
+			}
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,126 @@
+package gasync
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+
+	"github.com/gorchestrate/async"
+)
+
+// Redactor masks sensitive data in workflow state before it leaves the engine.
+// Redact may modify state in place.
+type Redactor interface {
+	Redact(state async.WorkflowState) error
+}
+
+// TagRedactor masks struct fields marked with `redact:"true"` tag.
+// Strings are replaced with "***", other fields are set to zero value. Empty fields are left as is.
+// It is used by default if no Redactor is configured.
+type TagRedactor struct{}
+
+func (r TagRedactor) Redact(state async.WorkflowState) error {
+	redactValue(reflect.ValueOf(state))
+	return nil
+}
+
+func redactValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			redactValue(v.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			redactValue(v.Index(i))
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			if !f.CanSet() {
+				continue
+			}
+			if t.Field(i).Tag.Get("redact") != "true" {
+				redactValue(f)
+				continue
+			}
+			if f.IsZero() {
+				continue
+			}
+			if f.Kind() == reflect.String {
+				f.SetString("***")
+			} else {
+				f.Set(reflect.Zero(f.Type()))
+			}
+		}
+	}
+}
+
+// Redact returns a copy of workflow with sensitive state fields masked.
+func (fs FirestoreEngine) Redact(wf *DBWorkflow) (*DBWorkflow, error) {
+	var r Redactor = TagRedactor{}
+	if fs.Redactor != nil {
+		r = fs.Redactor
+	}
+	state, err := fs.decodeState(wf)
+	if err != nil {
+		return nil, err
+	}
+	err = r.Redact(state)
+	if err != nil {
+		return nil, fmt.Errorf("err redacting workflow: %v", err)
+	}
+	ret := *wf
+	ret.State = state
+	return &ret, nil
+}
+
+// redactInput redacts event input for history and tells if anything was masked
+func redactInput(r Redactor, v interface{}) (interface{}, bool) {
+	redacted := redactPayload(r, v)
+	if v == nil {
+		return redacted, false
+	}
+	return redacted, !sameJSON(v, redacted)
+}
+
+// redactPayload returns redacted copy of event input or output for history.
+// Typed values are masked by the Redactor if they are workflow states, by `redact` tags otherwise.
+// Raw JSON payloads carry no type information, so they are stored as is.
+func redactPayload(r Redactor, v interface{}) interface{} {
+	switch v.(type) {
+	case nil, []byte, json.RawMessage:
+		return pjson(v)
+	}
+	t := reflect.TypeOf(v)
+	ptr := t.Kind() == reflect.Ptr
+	if ptr {
+		t = t.Elem()
+	}
+	d, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("err copying payload for redaction: %v", err)
+		return nil
+	}
+	c := reflect.New(t)
+	err = json.Unmarshal(d, c.Interface())
+	if err != nil {
+		log.Printf("err copying payload for redaction: %v", err)
+		return nil
+	}
+	if state, ok := c.Interface().(async.WorkflowState); ok && r != nil {
+		err = r.Redact(state)
+		if err != nil {
+			log.Printf("err redacting payload: %v", err)
+			return nil
+		}
+	} else {
+		redactValue(c)
+	}
+	if ptr {
+		return c.Interface()
+	}
+	return c.Elem().Interface()
+}
@@ -0,0 +1,106 @@
+package gasync
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/gorchestrate/async"
+)
+
+// Registry resolves workflow factories by name and version.
+// Implementations may load workflows lazily, i.e. from a database or plugin system.
+type Registry interface {
+	// Get returns latest version of the workflow
+	Get(name string) (w func() async.WorkflowState, version string, ok bool)
+
+	// GetVersion returns specific version of the workflow. It's used to resume instances created with older versions.
+	GetVersion(name, version string) (w func() async.WorkflowState, ok bool)
+
+	// Names returns names of all workflows available
+	Names() []string
+}
+
+// WorkflowRegistry is an in-memory Registry. It's safe for concurrent use,
+// so workflows can be registered while server is running.
+type WorkflowRegistry struct {
+	mu        sync.RWMutex
+	workflows map[string]map[string]func() async.WorkflowState // name -> version -> factory
+	latest    map[string]string                                // name -> latest version
+}
+
+// NewWorkflowRegistry creates registry with unversioned workflows
+func NewWorkflowRegistry(workflows map[string]func() async.WorkflowState) *WorkflowRegistry {
+	r := &WorkflowRegistry{
+		workflows: map[string]map[string]func() async.WorkflowState{},
+		latest:    map[string]string{},
+	}
+	for k, v := range workflows {
+		r.Set(k, v)
+	}
+	return r
+}
+
+func (r *WorkflowRegistry) Get(name string) (func() async.WorkflowState, string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, ok := r.latest[name]
+	if !ok {
+		return nil, "", false
+	}
+	return r.workflows[name][v], v, true
+}
+
+func (r *WorkflowRegistry) GetVersion(name, version string) (func() async.WorkflowState, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	w, ok := r.workflows[name][version]
+	return w, ok
+}
+
+// Names returns sorted names of registered workflows
+func (r *WorkflowRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ret := make([]string, 0, len(r.latest))
+	for k := range r.latest {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Set registers unversioned workflow
+func (r *WorkflowRegistry) Set(name string, w func() async.WorkflowState) {
+	r.SetVersion(name, "", w)
+}
+
+// SetVersion registers workflow version and makes it the latest one.
+// Previous versions are kept, so that old instances can be resumed.
+func (r *WorkflowRegistry) SetVersion(name, version string, w func() async.WorkflowState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.workflows[name] == nil {
+		r.workflows[name] = map[string]func() async.WorkflowState{}
+	}
+	r.workflows[name][version] = w
+	r.latest[name] = version
+}
+
+// Delete removes all versions of the workflow
+func (r *WorkflowRegistry) Delete(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.workflows, name)
+	delete(r.latest, name)
+}
+
+// resolve returns workflow factory for the instance.
+// Instances created before workflow was versioned are resumed using latest version.
+func resolve(r Registry, name, version string) (func() async.WorkflowState, bool) {
+	w, ok := r.GetVersion(name, version)
+	if ok || version != "" {
+		return w, ok
+	}
+	w, _, ok = r.Get(name)
+	return w, ok
+}
@@ -0,0 +1,202 @@
+package gasync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RuntimeConfig are Config values that can be changed without restarting the server.
+// Only set fields are applied, so config document may contain just the values that should be changed.
+// Changes affect new requests and resumes, resumes in flight are not interrupted.
+type RuntimeConfig struct {
+	Quotas       map[string]Quota // replaces Quotas.Keys, ignored if Config.Quotas is not set
+	DefaultQuota *Quota           // replaces Quotas.Default
+
+	ConcurrencyLimit       *int           // replaces ConcurrencyLimiter.Global, ignored if Config.Limiter is not set
+	ConcurrencyPerWorkflow map[string]int // replaces ConcurrencyLimiter.PerWorkflow
+
+	CORSOrigins []string // allowed origins, "*" allows all. Ignored if Config.CORS is not set
+	LogLevel    string   // "debug" logs timings of engine operations, "info" doesn't
+	Retention   string   // duration finished workflows are kept for, i.e. "720h". "0" keeps them forever
+}
+
+// LogLevel controls verbosity of engine logs
+type LogLevel int32
+
+const (
+	LogInfo  LogLevel = 0
+	LogDebug LogLevel = 1 // default
+)
+
+var logLevel = int32(LogDebug)
+
+// SetLogLevel changes verbosity of engine logs at runtime
+func SetLogLevel(l LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(l))
+}
+
+func parseLogLevel(v string) (LogLevel, error) {
+	switch v {
+	case "debug":
+		return LogDebug, nil
+	case "info":
+		return LogInfo, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", v)
+}
+
+// Retention is how long finished workflows are kept. It's written to ExpireAt field of finished workflows,
+// so Firestore TTL policy should be enabled for ExpireAt to delete them. Can be changed at runtime.
+type Retention struct {
+	d int64
+}
+
+// NewRetention returns retention policy with initial duration, zero keeps workflows forever
+func NewRetention(d time.Duration) *Retention {
+	return &Retention{d: int64(d)}
+}
+
+func (r *Retention) Get() time.Duration {
+	if r == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&r.d))
+}
+
+func (r *Retention) Set(d time.Duration) {
+	atomic.StoreInt64(&r.d, int64(d))
+}
+
+// originList is a list of allowed CORS origins that can be replaced at runtime
+type originList struct {
+	v atomic.Value
+}
+
+func newOriginList(origins []string) *originList {
+	if len(origins) == 0 {
+		origins = []string{"*"}
+	}
+	l := &originList{}
+	l.v.Store(origins)
+	return l
+}
+
+func (l *originList) allow(origin string) bool {
+	for _, o := range l.v.Load().([]string) {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload validates runtime config and applies it. Nothing is applied if config is invalid.
+func (s *Server) Reload(rc RuntimeConfig) error {
+	var level LogLevel
+	var err error
+	if rc.LogLevel != "" {
+		level, err = parseLogLevel(rc.LogLevel)
+		if err != nil {
+			return fmt.Errorf("err reloading config: %v", err)
+		}
+	}
+	var retention time.Duration
+	if rc.Retention != "" {
+		retention, err = time.ParseDuration(rc.Retention)
+		if err != nil || retention < 0 {
+			return fmt.Errorf("err reloading config: invalid retention %q", rc.Retention)
+		}
+	}
+	if rc.ConcurrencyLimit != nil && *rc.ConcurrencyLimit < 0 {
+		return fmt.Errorf("err reloading config: invalid concurrency limit %v", *rc.ConcurrencyLimit)
+	}
+
+	if rc.LogLevel != "" {
+		SetLogLevel(level)
+	}
+	if rc.Retention != "" && s.Engine.Retention != nil {
+		s.Engine.Retention.Set(retention)
+	}
+	if rc.CORSOrigins != nil && s.origins != nil {
+		s.origins.v.Store(append([]string{}, rc.CORSOrigins...))
+	}
+	if s.quotas != nil && (rc.Quotas != nil || rc.DefaultQuota != nil) {
+		s.quotas.set(rc.Quotas, rc.DefaultQuota)
+	}
+	if s.Engine.Limiter != nil && (rc.ConcurrencyLimit != nil || rc.ConcurrencyPerWorkflow != nil) {
+		s.Engine.Limiter.setLimits(rc.ConcurrencyLimit, rc.ConcurrencyPerWorkflow)
+	}
+	return nil
+}
+
+// loadRuntimeConfig reads runtime config from the document. Missing document is an empty config.
+func loadRuntimeConfig(ctx context.Context, doc *firestore.DocumentRef) (RuntimeConfig, error) {
+	var rc RuntimeConfig
+	snap, err := doc.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return rc, nil
+	}
+	if err != nil {
+		return rc, fmt.Errorf("err reading runtime config: %v", err)
+	}
+	err = snap.DataTo(&rc)
+	if err != nil {
+		return rc, fmt.Errorf("err unmarshaling runtime config: %v", err)
+	}
+	return rc, nil
+}
+
+// watchConfig reloads runtime config on SIGHUP and, if doc is set, when it's changed. Blocks until ctx is done.
+func (s *Server) watchConfig(ctx context.Context, doc *firestore.DocumentRef, load func(ctx context.Context) (RuntimeConfig, error)) {
+	reload := func(rc RuntimeConfig, err error) {
+		if err == nil {
+			err = s.Reload(rc)
+		}
+		if err != nil {
+			log.Printf("config reload: %v", err)
+			return
+		}
+		log.Printf("config reloaded")
+	}
+	if doc != nil {
+		go func() {
+			it := doc.Snapshots(ctx)
+			defer it.Stop()
+			for {
+				snap, err := it.Next()
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("config reload: err watching config: %v", err)
+					}
+					return
+				}
+				var rc RuntimeConfig
+				if snap.Exists() {
+					err = snap.DataTo(&rc)
+				}
+				reload(rc, err)
+			}
+		}()
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			reload(load(ctx))
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package gasync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorchestrate/async"
+)
+
+// ReplayReport describes replay of workflow history against workflow definition
+type ReplayReport struct {
+	WorkflowID string
+	Version    string // version of definition history was replayed against
+	Replayed   int    // history entries replayed without divergence
+	Total      int
+	Divergence *Divergence // first divergence, replay stops on it
+	// NotReplayable explains why replay was stopped without divergence, i.e. input of the entry was redacted
+	NotReplayable string `json:",omitempty"`
+}
+
+// Divergence is a difference between recorded and replayed execution
+type Divergence struct {
+	Index    int    // index of history entry
+	PC       int    // recorded PC
+	Callback string // event or callback of the entry, empty for resumes
+	Field    string // PC, Status, State, Output or Error
+	Expected interface{}
+	Actual   interface{}
+}
+
+// Replay re-executes workflow definition against inputs recorded in history, in memory.
+// Handler Setup and Teardown are stubbed, so timers, webhooks and other subscriptions are not created.
+// Steps are executed, so they should not have side effects besides changing the state.
+// Version of the definition to replay against can be set to verify that new version is compatible with the instance,
+// instance version is used by default. History should be complete - entries of resumes without progress overwrite
+// previous entries with the same PC, which is reported as divergence.
+// History is redacted, so replayed state and outputs are redacted before comparison, and replay stops
+// at the first entry with redacted input, since it can't be applied faithfully.
+func (fs FirestoreEngine) Replay(ctx context.Context, id, version string) (ReplayReport, error) {
+	defer logTime("replay")()
+	wf, err := fs.Get(ctx, id)
+	if err != nil {
+		return ReplayReport{}, err
+	}
+	entries, err := fs.ReadHistory(ctx, id)
+	if err != nil {
+		return ReplayReport{}, err
+	}
+	return fs.replay(ctx, wf, entries, version)
+}
+
+// replay runs recorded history entries of the workflow against definition of the version
+func (fs FirestoreEngine) replay(ctx context.Context, wf *DBWorkflow, entries []DBWorkflowLog, version string) (ReplayReport, error) {
+	if version == "" {
+		version = wf.Version
+	}
+	factory, ok := resolve(fs.Workflows, wf.Meta.Workflow, version)
+	if !ok {
+		return ReplayReport{}, fmt.Errorf("workflow not found: %v %v", wf.Meta.Workflow, version)
+	}
+	r := ReplayReport{
+		WorkflowID: wf.Meta.ID,
+		Version:    version,
+		Total:      len(entries),
+	}
+	state := factory()
+	meta := async.NewState(wf.Meta.ID, wf.Meta.Workflow)
+	sandbox := replayState{state}
+	var err error
+	for i, l := range entries {
+		if l.InputRedacted {
+			r.NotReplayable = fmt.Sprintf("input of history entry %v is redacted", i)
+			return r, nil
+		}
+		var out interface{}
+		cb := ""
+		switch {
+		case i == 0:
+			// initial state supplied by caller is recorded as input of the first entry
+			if l.Input != nil {
+				err = recode(l.Input, state)
+				if err != nil {
+					return r, fmt.Errorf("err decoding initial state: %v", err)
+				}
+			}
+			err = safeResume(ctx, sandbox, &meta, noCheckpoint)
+		case l.Callback != nil:
+			cb = l.Callback.Name
+			var input interface{}
+			if l.Input != nil {
+				input, err = json.Marshal(l.Input)
+				if err != nil {
+					return r, err
+				}
+			}
+			var cbState async.WorkflowState = sandbox
+			if l.Operator != nil && l.Operator.Action == OperatorSkip {
+				cbState = skippedState{WorkflowState: sandbox, event: cb}
+			}
+			out, err = safeHandleCallback(ctx, *l.Callback, cbState, &meta, input)
+		default:
+			err = safeResume(ctx, sandbox, &meta, noCheckpoint)
+		}
+		d := Divergence{Index: i, PC: l.Meta.PC, Callback: cb}
+		if err != nil {
+			d.Field, d.Actual = "Error", err.Error()
+			r.Divergence = &d
+			return r, nil
+		}
+		if l.Callback != nil && l.Output != nil && !sameJSON(l.Output, redactPayload(fs.Redactor, out)) {
+			d.Field, d.Expected, d.Actual = "Output", l.Output, redactPayload(fs.Redactor, out)
+			r.Divergence = &d
+			return r, nil
+		}
+		if meta.PC != l.Meta.PC {
+			d.Field, d.Expected, d.Actual = "PC", l.Meta.PC, meta.PC
+			r.Divergence = &d
+			return r, nil
+		}
+		if meta.Status != l.Meta.Status {
+			d.Field, d.Expected, d.Actual = "Status", l.Meta.Status, meta.Status
+			r.Divergence = &d
+			return r, nil
+		}
+		expected, err := fs.decodeState(&DBWorkflow{Meta: l.Meta, State: l.State, Version: wf.Version})
+		if err != nil {
+			return r, fmt.Errorf("err decoding history entry %v: %v", i, err)
+		}
+		actual, err := fs.Redact(&DBWorkflow{Meta: meta, State: state, Version: version})
+		if err != nil {
+			return r, fmt.Errorf("err redacting replayed state: %v", err)
+		}
+		if !sameJSON(expected, actual.State) {
+			d.Field, d.Expected, d.Actual = "State", expected, actual.State
+			r.Divergence = &d
+			return r, nil
+		}
+		r.Replayed++
+	}
+	return r, nil
+}
+
+func noCheckpoint(t async.CheckpointType) error {
+	return nil
+}
+
+func recode(from, to interface{}) error {
+	d, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(d, to)
+}
+
+func sameJSON(a, b interface{}) bool {
+	da, errA := json.Marshal(pjson(a))
+	db, errB := json.Marshal(pjson(b))
+	if errA != nil || errB != nil {
+		return false
+	}
+	var va, vb interface{}
+	if json.Unmarshal(da, &va) != nil || json.Unmarshal(db, &vb) != nil {
+		return false
+	}
+	na, _ := json.Marshal(va)
+	nb, _ := json.Marshal(vb)
+	return bytes.Equal(na, nb)
+}
+
+// replayState replaces handlers in workflow definition with stubs that don't have side effects
+type replayState struct {
+	async.WorkflowState
+}
+
+func (s replayState) Definition() async.Section {
+	return mapHandlers(s.WorkflowState.Definition(), func(e async.Event) async.Handler {
+		return stubHandler{e.Handler}
+	}).(async.Section)
+}
+
+// mapHandlers returns copy of definition with handlers of all events replaced by f
+func mapHandlers(s async.Stmt, f func(async.Event) async.Handler) async.Stmt {
+	switch x := s.(type) {
+	case async.Section:
+		ret := async.Section{}
+		for _, v := range x {
+			ret = append(ret, mapHandlers(v, f))
+		}
+		return ret
+	case async.WaitEventsStmt:
+		ret := async.WaitEventsStmt{Name: x.Name}
+		for _, c := range x.Cases {
+			c.Handler = f(c)
+			c.Stmt = mapHandlers(c.Stmt, f)
+			ret.Cases = append(ret.Cases, c)
+		}
+		return ret
+	case async.ForStmt:
+		x.Section = mapHandlers(x.Section, f).(async.Section)
+		return x
+	case *async.SwitchStmt:
+		ret := &async.SwitchStmt{}
+		for _, c := range x.Cases {
+			c.Stmt = mapHandlers(c.Stmt, f)
+			ret.Cases = append(ret.Cases, c)
+		}
+		return ret
+	case *async.GoStmt:
+		ret := *x
+		ret.Stmt = mapHandlers(x.Stmt, f)
+		return &ret
+	}
+	return s
+}
+
+// stubHandler applies recorded input with original handler, but doesn't set up or tear down anything
+type stubHandler struct {
+	h async.Handler
+}
+
+func (h stubHandler) Setup(ctx context.Context, req async.CallbackRequest) (string, error) {
+	return "", nil
+}
+
+func (h stubHandler) Handle(ctx context.Context, req async.CallbackRequest, input interface{}) (interface{}, error) {
+	if input == nil {
+		return nil, nil // timers and other callbacks without payload
+	}
+	return h.h.Handle(ctx, req, input)
+}
+
+func (h stubHandler) Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error {
+	return nil
+}
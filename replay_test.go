@@ -0,0 +1,77 @@
+package gasync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gorchestrate/async"
+)
+
+type replayGreeting struct {
+	Name     string
+	Token    string `redact:"true"`
+	Greeting string
+}
+
+func (wf *replayGreeting) Definition() async.Section {
+	return async.S(
+		async.Step("greet", func() error {
+			wf.Greeting = "Hello, " + wf.Name
+			wf.Token = "token-" + wf.Name
+			return nil
+		}),
+	)
+}
+
+// replayHistory records history of the workflow the way writeHistory does
+func replayHistory(t *testing.T, input interface{}) (*DBWorkflow, []DBWorkflowLog) {
+	state := &replayGreeting{}
+	err := recode(input, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := async.NewState("wf", "greeting")
+	err = async.Resume(context.Background(), state, &meta, noCheckpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redacted := *state
+	err = TagRedactor{}.Redact(&redacted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := DBWorkflowLog{Meta: meta, State: &redacted}
+	l.Input, l.InputRedacted = redactInput(nil, input)
+	return &DBWorkflow{Meta: meta, State: state}, []DBWorkflowLog{l}
+}
+
+func TestReplayRedacted(t *testing.T) {
+	fs := FirestoreEngine{
+		Workflows: NewWorkflowRegistry(map[string]func() async.WorkflowState{
+			"greeting": func() async.WorkflowState { return &replayGreeting{} },
+		}),
+	}
+	t.Run("RedactedState", func(t *testing.T) {
+		wf, entries := replayHistory(t, &replayGreeting{Name: "World"})
+		r, err := fs.replay(context.Background(), wf, entries, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Divergence != nil || r.NotReplayable != "" || r.Replayed != 1 {
+			t.Fatalf("expected redacted state to match history, got %+v %+v", r, r.Divergence)
+		}
+	})
+	t.Run("RedactedInput", func(t *testing.T) {
+		wf, entries := replayHistory(t, &replayGreeting{Name: "World", Token: "secret"})
+		if !entries[0].InputRedacted {
+			t.Fatalf("expected input to be marked as redacted")
+		}
+		r, err := fs.replay(context.Background(), wf, entries, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Divergence != nil || r.NotReplayable == "" || r.Replayed != 0 {
+			t.Fatalf("expected workflow to be reported as not replayable, got %+v %+v", r, r.Divergence)
+		}
+	})
+}
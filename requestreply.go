@@ -0,0 +1,184 @@
+package gasync
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorchestrate/async"
+	"github.com/gorilla/mux"
+)
+
+// HTTPRequestSpec describes outbound request made by RequestReply
+type HTTPRequestSpec struct {
+	Method string // POST by default
+	URL    string
+	Header map[string]string
+	Body   interface{} // marshaled as json
+	// CallbackHeader is a header the callback URL is sent in, X-Callback-URL by default
+	CallbackHeader string
+	// Response receives body of the outbound request response. Optional.
+	Response *json.RawMessage
+	// Reply receives body of the asynchronous reply. Optional.
+	Reply *json.RawMessage
+	// Client is used for outbound request, http.DefaultClient by default
+	Client *http.Client
+}
+
+// RequestReplyHandler calls partner API and waits for the reply posted to the signed callback URL
+type RequestReplyHandler struct {
+	Spec HTTPRequestSpec
+
+	baseURL string
+	secret  string
+}
+
+// RequestReplyData is setup data of RequestReplyHandler
+type RequestReplyData struct {
+	StatusCode int
+}
+
+// RequestReply performs outbound request in Setup and waits for the asynchronous reply.
+// Reply is correlated with the awaited event by signed callback URL, so it's accepted only once.
+// Request carries Idempotency-Key header, since it's repeated if resume is retried.
+func (s *Server) RequestReply(name string, spec HTTPRequestSpec, stmts ...async.Stmt) async.Event {
+	return async.On(name, &RequestReplyHandler{
+		Spec:    spec,
+		baseURL: s.baseURL,
+		secret:  s.Scheduler.Secret,
+	}, stmts...)
+}
+
+func (h RequestReplyHandler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type   string
+		Method string
+		URL    string
+	}{
+		Type:   "request_reply",
+		Method: h.method(),
+		URL:    h.Spec.URL,
+	})
+}
+
+func (h RequestReplyHandler) method() string {
+	if h.Spec.Method == "" {
+		return "POST"
+	}
+	return h.Spec.Method
+}
+
+// replyURL builds callback URL signed the same way as timeouts
+func replyURL(baseURL, secret, workflow string, req async.CallbackRequest) string {
+	sig := TimeoutReq{Req: req}.HMAC([]byte(secret))
+	q := url.Values{}
+	q.Set("thread", req.ThreadID)
+	q.Set("pc", strconv.Itoa(req.PC))
+	q.Set("sig", sig)
+	return fmt.Sprintf("%v/callback/reply/%v/%v/%v?%v", strings.Trim(baseURL, "/"), workflow, req.WorkflowID, req.Name, q.Encode())
+}
+
+func (h *RequestReplyHandler) Setup(ctx context.Context, req async.CallbackRequest) (string, error) {
+	defer logTime("request reply setup")()
+	var body []byte
+	if h.Spec.Body != nil {
+		var err error
+		body, err = json.Marshal(h.Spec.Body)
+		if err != nil {
+			return "", fmt.Errorf("err marshaling request: %v", err)
+		}
+	}
+	r, err := http.NewRequestWithContext(ctx, h.method(), h.Spec.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range h.Spec.Header {
+		r.Header.Set(k, v)
+	}
+	header := h.Spec.CallbackHeader
+	if header == "" {
+		header = "X-Callback-URL"
+	}
+	name, _ := ctx.Value(workflowCtxKey{}).(string)
+	r.Header.Set(header, replyURL(h.baseURL, h.secret, name, req))
+	r.Header.Set("Idempotency-Key", fmt.Sprintf("%v_%v_%v", req.WorkflowID, req.ThreadID, req.PC))
+	client := h.Spec.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return "", fmt.Errorf("err calling %v: %v", h.Spec.URL, err)
+	}
+	defer resp.Body.Close()
+	d, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("err reading response of %v: %v", h.Spec.URL, err)
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("unexpected status %v from %v: %s", resp.StatusCode, h.Spec.URL, d)
+	}
+	if h.Spec.Response != nil && len(d) > 0 {
+		*h.Spec.Response = append(json.RawMessage{}, d...)
+	}
+	data, err := json.Marshal(RequestReplyData{StatusCode: resp.StatusCode})
+	return string(data), err
+}
+
+func (h *RequestReplyHandler) Handle(ctx context.Context, req async.CallbackRequest, input interface{}) (interface{}, error) {
+	d, ok := input.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply input type %T", input)
+	}
+	if h.Spec.Reply != nil {
+		*h.Spec.Reply = append(json.RawMessage{}, d...)
+	}
+	return nil, nil
+}
+
+func (h *RequestReplyHandler) Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error {
+	return nil
+}
+
+// replyHandler accepts replies posted to callback URLs of RequestReply
+func replyHandler(engine *FirestoreEngine, secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		pc, err := strconv.Atoi(r.URL.Query().Get("pc"))
+		if err != nil {
+			jsonErr(w, fmt.Errorf("invalid pc: %v", err), 400)
+			return
+		}
+		req := async.CallbackRequest{
+			WorkflowID: vars["id"],
+			ThreadID:   r.URL.Query().Get("thread"),
+			Name:       vars["event"],
+			PC:         pc,
+		}
+		if !hmac.Equal([]byte(TimeoutReq{Req: req}.HMAC([]byte(secret))), []byte(r.URL.Query().Get("sig"))) {
+			jsonErr(w, fmt.Errorf("signature invalid"), 403)
+			return
+		}
+		d, err := readBody(r)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		_, err = engine.HandleCallback(withRequest(r.Context(), r), req.WorkflowID, req, d)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,63 @@
+package gasync
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RetryPolicy retries failed activities with exponential backoff
+type RetryPolicy struct {
+	MaxAttempts int           // 1 by default, i.e. no retries
+	Backoff     time.Duration // delay before first retry, 1 sec by default
+	MaxBackoff  time.Duration // max delay between retries, 1 min by default
+	Multiplier  float64       // 2 by default
+}
+
+// Delay returns delay before the retry after specified attempt (starting from 1)
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	d := p.Backoff
+	if d <= 0 {
+		d = time.Second
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = time.Minute
+	}
+	mul := p.Multiplier
+	if mul <= 1 {
+		mul = 2
+	}
+	for i := 1; i < attempt && d < max; i++ {
+		d = time.Duration(float64(d) * mul)
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Attempts returns max number of attempts
+func (p RetryPolicy) Attempts() int {
+	if p.MaxAttempts <= 0 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// Do calls fn until it succeeds, attempts are exhausted or ctx is done
+func (p RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn(ctx)
+		if err == nil || attempt >= p.Attempts() {
+			return err
+		}
+		log.Printf("attempt %v failed, retrying: %v", attempt, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(p.Delay(attempt)):
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package gasync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorchestrate/async"
+)
+
+// Scheduler resumes workflows in the background after the delay.
+// GTasksScheduler is used on Google Cloud. Other implementations allow to run engine outside of it.
+type Scheduler interface {
+	Schedule(ctx context.Context, id string, delay time.Duration) error
+	ScheduleWithPriority(ctx context.Context, id string, delay time.Duration, priority int) error
+	// ScheduleBatch schedules immediate resume of many workflows. BatchError is returned if some of them failed.
+	ScheduleBatch(ctx context.Context, ids []string) error
+}
+
+// TimerScheduler delivers callbacks after the delay, i.e. timeouts and polls.
+// Teardown cancels callback that was not delivered yet.
+type TimerScheduler interface {
+	Setup(ctx context.Context, req async.CallbackRequest, delay time.Duration) (string, error)
+	Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error
+}
+
+// DefaultBatchParallelism is the number of concurrent schedule calls made by ScheduleBatch
+const DefaultBatchParallelism = 10
+
+// BatchError reports workflows that failed to be scheduled
+type BatchError struct {
+	Failed map[string]error
+}
+
+func (e BatchError) Error() string {
+	ids := make([]string, 0, len(e.Failed))
+	for id := range e.Failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	msgs := []string{}
+	for _, id := range ids {
+		msgs = append(msgs, fmt.Sprintf("%v: %v", id, e.Failed[id]))
+	}
+	return fmt.Sprintf("failed to schedule %v workflows: %v", len(ids), strings.Join(msgs, "; "))
+}
+
+// scheduleBatch calls schedule for every id with bounded parallelism
+func scheduleBatch(ctx context.Context, ids []string, parallelism int, schedule func(ctx context.Context, id string) error) error {
+	if parallelism <= 0 {
+		parallelism = DefaultBatchParallelism
+	}
+	var mu sync.Mutex
+	failed := map[string]error{}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+	for _, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := schedule(ctx, id)
+			if err != nil {
+				mu.Lock()
+				failed[id] = err
+				mu.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return BatchError{Failed: failed}
+	}
+	return nil
+}
+
+// LocalScheduler resumes workflows in-process using timers, i.e. for local dev and tests.
+// Scheduled resumes are lost if process exits or is frozen between invocations (as on AWS Lambda),
+// so in production it should be used together with Reaper or Watcher. Use DueTimers for durable timers.
+type LocalScheduler struct {
+	Engine Engine
+}
+
+func (s *LocalScheduler) Schedule(ctx context.Context, id string, delay time.Duration) error {
+	return s.ScheduleWithPriority(ctx, id, delay, 0)
+}
+
+func (s *LocalScheduler) ScheduleWithPriority(ctx context.Context, id string, delay time.Duration, priority int) error {
+	time.AfterFunc(delay, func() {
+		// request context may be already cancelled when timer fires
+		err := s.Engine.Resume(asCallback(context.Background()), id)
+		if err != nil {
+			log.Printf("local scheduler: err resuming workflow %v: %v", id, err)
+		}
+	})
+	return nil
+}
+
+func (s *LocalScheduler) ScheduleBatch(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		_ = s.ScheduleWithPriority(ctx, id, 0, 0)
+	}
+	return nil
+}
+
+// ScheduleError is returned when event was applied and workflow was saved, but its resume was not scheduled.
+// Such workflows are resumed by Reaper.
+type ScheduleError struct {
+	WorkflowID string
+	Err        error
+}
+
+func (e ScheduleError) Error() string {
+	return fmt.Sprintf("workflow %v was saved, but resume was not scheduled: %v", e.WorkflowID, e.Err)
+}
+
+func (e ScheduleError) Unwrap() error {
+	return e.Err
+}
+
+type skipScheduleCtxKey struct{}
+
+// WithoutSchedule tells event handling not to schedule resume, i.e. because caller resumes workflow inline.
+// Workflow stays waiting for resume until it's resumed by caller or Reaper.
+func WithoutSchedule(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipScheduleCtxKey{}, true)
+}
+
+func scheduleSkipped(ctx context.Context) bool {
+	skip, _ := ctx.Value(skipScheduleCtxKey{}).(bool)
+	return skip
+}
+
+type noLockWaitCtxKey struct{}
+
+// WithoutLockWait makes Lock fail with LockedError instead of waiting for locked workflow,
+// i.e. for interactive clients preferring quick failure.
+func WithoutLockWait(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noLockWaitCtxKey{}, true)
+}
+
+func lockWaitSkipped(ctx context.Context) bool {
+	skip, _ := ctx.Value(noLockWaitCtxKey{}).(bool)
+	return skip
+}
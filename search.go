@@ -0,0 +1,102 @@
+package gasync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Searcher finds workflows by the text query over the state.
+// Workflows are indexed by Projection, so searcher should query the same store projection writes to.
+type Searcher interface {
+	Search(ctx context.Context, q SearchQuery) ([]SearchHit, error)
+}
+
+type SearchQuery struct {
+	Query    string
+	Workflow string // search across all workflow types if empty
+	Limit    int
+}
+
+type SearchHit struct {
+	ID         string
+	Workflow   string
+	Score      float64
+	Highlights map[string][]string // field -> matched fragments
+}
+
+// Search uses Elasticsearch query string syntax, i.e. "Fields.Items.SKU:X123".
+func (p ElasticsearchProjection) Search(ctx context.Context, q SearchQuery) ([]SearchHit, error) {
+	query := map[string]interface{}{
+		"query_string": map[string]interface{}{
+			"query": q.Query,
+		},
+	}
+	if q.Workflow != "" {
+		query = map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": query,
+				"filter": map[string]interface{}{
+					"match": map[string]interface{}{
+						"Workflow": q.Workflow,
+					},
+				},
+			},
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"size":    q.Limit,
+		"_source": []string{"Workflow"},
+		"query":   query,
+		"highlight": map[string]interface{}{
+			"fields": map[string]interface{}{
+				"*": map[string]interface{}{},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	u := strings.TrimRight(p.URL, "/") + "/" + url.PathEscape(p.Index) + "/_search"
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("elasticsearch responded with %v", resp.Status)
+	}
+	var res struct {
+		Hits struct {
+			Hits []struct {
+				ID        string              `json:"_id"`
+				Score     float64             `json:"_score"`
+				Source    ProjectionView      `json:"_source"`
+				Highlight map[string][]string `json:"highlight"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("err parsing elasticsearch response: %v", err)
+	}
+	hits := []SearchHit{}
+	for _, h := range res.Hits.Hits {
+		hits = append(hits, SearchHit{
+			ID:         h.ID,
+			Workflow:   h.Source.Workflow,
+			Score:      h.Score,
+			Highlights: h.Highlight,
+		})
+	}
+	return hits, nil
+}
@@ -1,24 +1,37 @@
 package gasync
 
 import (
+	"bytes"
 	"context"
+	crand "crypto/rand"
+	"crypto/x509"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/goccy/go-graphviz"
 	"github.com/rs/cors"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 
 	"cloud.google.com/go/firestore"
 	"github.com/alecthomas/jsonschema"
 	"github.com/gorchestrate/async"
 	"github.com/gorilla/mux"
+	"github.com/graphql-go/graphql"
 	cloudtasks "google.golang.org/api/cloudtasks/v2beta3"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
 )
 
 type Config struct {
@@ -27,42 +40,337 @@ type Config struct {
 	GCloudTasksQueueName string
 	BasePublicURL        string
 	CORS                 bool
+	CORSOrigins          []string // allowed CORS origins, all by default
 	Collection           string
 	SignSecret           string
+	IDRules              IDRules
+	Redactor             Redactor
+	Codec                Codec
+	Cache                Cache
+	Limiter              *ConcurrencyLimiter
+	AsyncResume          bool // never resume workflows inside http handlers, respond with 202 instead
+	InlineResumeLimit    int  // max resumes running inside http handlers, others are left to the scheduler
+	// InlineEventResume resumes workflow inside event handler instead of scheduling a task for it.
+	// Task is scheduled only if inline resume fails, which saves Cloud Tasks volume.
+	InlineEventResume bool
+
+	CheckpointEvery    int           // save workflow every N steps during long resumes
+	CheckpointInterval time.Duration // save workflow with this interval during long resumes
+
+	OutputValidation OutputValidation // validate event outputs against schemas, OutputValidationStrict is useful in dev mode
+
+	Flags FlagProvider // resolves FeatureGate flags, "flags" document in Collection+"_config" by default
+
+	Digest *Digest // periodic status report, started by NewServer. Schedule is validated on start
+
+	GCloudTasksHighPriorityQueueName string
+	HighPriority                     int
+
+	GCloudFallbackLocationID string // Cloud Tasks location used if task creation in GCloudLocationID fails
+
+	Middleware []EventMiddleware
+	Hooks      Hooks
+	Projection *Projection
+	Search     Searcher      // enables /search endpoint
+	History    []HistorySink // Firestore Collection+"_log" by default
+	NoHistory  []string      // workflows history is not written for
+	// DisableHistory disables history for all workflows
+	DisableHistory bool
+	// HistoryShards spreads default history and dedup records of each workflow across that many subcollections
+	HistoryShards int
+
+	ErrorReporter ErrorReporter
+	MaxPanics     int // workflow is quarantined after this number of panics
+
+	MaxEventFailures int // event payload is quarantined after this number of failures
+
+	MaxBodySize    int64         // max request body size for event, resume and create endpoints. DefaultMaxBodySize by default, -1 disables the limit
+	RequestTimeout time.Duration // timeout for event, resume and create endpoints
+	Timeouts       Timeouts      // timeouts of single Firestore and Cloud Tasks calls
+
+	HTTP HTTPOptions // used by Server.ListenAndServe
+
+	Throttler Throttler // used by Server.Throttle, Firestore token bucket by default
+
+	Templates map[string]Template // served at POST /template/{tmpl}/{id}
+
+	// AdminAuth authorizes admin endpoints. Admin endpoints are disabled if it's not set.
+	AdminAuth func(r *http.Request) error
+
+	// MeterProvider enables OpenTelemetry metrics, i.e. pushed via OTLP exporter
+	MeterProvider metric.MeterProvider
+	// TracerProvider enables spans for resumes and events. If MeterProvider supports exemplars,
+	// resume duration and event metrics carry trace ids of the workflows they were recorded for.
+	TracerProvider trace.TracerProvider
+
+	// Debug mounts pprof and engine diagnostics under /debug. Requires AdminAuth.
+	Debug bool
+
+	// Registry overrides workflows passed to NewServer
+	Registry Registry
+
+	// ResumeURL and TimeoutURL override URLs called by Cloud Tasks.
+	// By default they are served by the Router under BasePublicURL, using paths of CallbackPathVersion.
+	// Paths of older versions (i.e. /resume and /callback/timeout) keep working for tasks created before deploy.
+	ResumeURL  string
+	TimeoutURL string
+	// LegacyCallbackPrefixes keep callbacks working after the Router was moved under another path,
+	// i.e. "/api" accepts tasks created for BasePublicURL+"/api/resume". When BasePublicURL host changes,
+	// the old host should keep routing to the server until queued tasks are drained.
+	LegacyCallbackPrefixes []string
+
+	// DatastoreMode stores workflows via DatastoreEngine, for projects with Firestore in Datastore mode.
+	// Collection is used as entity kind and FirestoreOptions are passed to Datastore client.
+	// Only create, get, event and callback endpoints are served, Server.Engine is nil.
+	DatastoreMode bool
+
+	// FirestoreOptions and CloudTasksOptions are passed to GCP clients, i.e. credentials, impersonation or custom endpoints.
+	// Application Default Credentials are used if not set.
+	FirestoreOptions  []option.ClientOption
+	CloudTasksOptions []option.ClientOption
+	StorageOptions    []option.ClientOption // used by GCSObject to check existing objects
+
+	// Firestore is used instead of creating client from FirestoreOptions, i.e. with credentials of workload identity federation.
+	Firestore *firestore.Client
+	// Scheduler resumes workflows and Timers delivers timeouts and polls instead of Cloud Tasks, i.e. outside of Google Cloud.
+	// Cloud Tasks client is not created if both of them are set or DueTimers is enabled.
+	// Timers should be durable: LocalScheduler loses timers when process exits or is frozen, as on AWS Lambda.
+	Scheduler Scheduler
+	Timers    TimerScheduler
+
+	SQLDB *sql.DB // database pool used by Server.SQLActivity
+
+	// WorkerAuth authorizes external activity workers. Activity endpoints are disabled if it's not set.
+	WorkerAuth func(r *http.Request) error
+
+	Quotas *Quotas // per tenant or API key quotas
+
+	// JWT authenticates requests with bearer tokens. If AdminAuth is not set - admin role of JWT is required for admin endpoints.
+	JWT *JWTAuth
+	// EventRoles are roles required to send events, keyed by event name or "workflow/event"
+	EventRoles map[string][]string
+
+	EventErrors  EventErrors  // business errors returned by events, documented in swagger
+	EventAliases EventAliases // deprecated event names
+
+	CallbackAuth CallbackAuth // mTLS and IP allowlist for resume and timeout callbacks
+
+	GraphTheme GraphTheme // default theme of /graph, can be overridden by query params
+
+	// DueTimers stores resumes and timers in Firestore instead of Cloud Tasks, i.e. for Kubernetes clusters without
+	// Cloud Tasks access. They are fired by POST /timers/run, which should be called by CronJob with admin credentials.
+	DueTimers bool
+	// Outbox stores resumes that failed to be scheduled via Cloud Tasks in Firestore, they are fired by POST /timers/run.
+	// Without outbox such events fail with ScheduleError, though they are applied, and workflows are resumed by Reaper.
+	Outbox bool
+
+	SLAs map[string][]SLA // SLAs by workflow name, breached instances are listed with filter[sla_breached]=true
+
+	// Cardinality limits running instances sharing the same key by workflow name. Creation of extra instances fails with 409.
+	Cardinality map[string]Cardinality
+
+	// DedupWindows acknowledge duplicate events (same workflow, event and payload) without applying them again,
+	// by event name or "*" for all events. Output of the original event is returned.
+	DedupWindows map[string]time.Duration
+
+	// ProcessingFloor is how long workflow processing continues after client disconnects, see FirestoreEngine.ProcessingFloor.
+	// Handlers created with OnContextEvent observe cancellation of the request.
+	ProcessingFloor time.Duration
+
+	// Retention is how long finished workflows are kept, Firestore TTL policy on ExpireAt field should be enabled.
+	Retention time.Duration
+
+	// HotReload applies RuntimeConfig from Collection+"_config"/runtime document when it changes and on SIGHUP
+	HotReload bool
+	// LoadRuntimeConfig replaces config document as a source of RuntimeConfig, i.e. to reread config file on SIGHUP
+	LoadRuntimeConfig func(ctx context.Context) (RuntimeConfig, error)
+
+	// StatusTransformers map status of workflows returned by GET /wf/{name}/{id} to public representation, by workflow name.
+	// DBWorkflow with Progress is returned for workflows without transformer.
+	StatusTransformers map[string]StatusTransformer
 }
 
 type Server struct {
-	Router    *mux.Router
-	Engine    *FirestoreEngine
-	Scheduler *GTasksScheduler
+	Router          *mux.Router
+	Engine          *FirestoreEngine
+	Datastore       *DatastoreEngine // set instead of Engine if Config.DatastoreMode is enabled
+	Scheduler       *GTasksScheduler // handles timeouts
+	ResumeScheduler *GTasksScheduler // handles resumes
+	Timers          *DueTimers       // set if Config.DueTimers or Config.Outbox is enabled
+
+	cache     Cache
+	baseURL   string
+	clientCAs *x509.CertPool
+	sqlDB     *sql.DB
+	flags     FlagProvider
+	timers    TimerScheduler
+	storage   *storage.Service
+	http      HTTPOptions
+	throttler Throttler
+	origins   *originList
+	quotas    *Quotas
+	mu        sync.RWMutex
+	schema    graphql.Schema
+	graphql   GraphQLConfig
+
+	resumeHandler  http.HandlerFunc // guarded and limited the same way as routed callbacks
+	timeoutHandler http.HandlerFunc
+}
+
+// ErrWorkflowInUse is returned when workflow can't be unregistered because it has running instances
+var ErrWorkflowInUse = errors.New("workflow has running instances")
+
+type mutableRegistry interface {
+	Set(name string, w func() async.WorkflowState)
+	Delete(name string)
+}
+
+// RegisterWorkflow adds or replaces workflow definition while server is running.
+func (s *Server) RegisterWorkflow(name string, factory func() async.WorkflowState) error {
+	err := async.Validate(factory().Definition())
+	if err != nil {
+		return fmt.Errorf("invalid workflow %v: %w", name, err)
+	}
+	reg, ok := s.Engine.Workflows.(mutableRegistry)
+	if !ok {
+		return fmt.Errorf("registry %T doesn't support registration", s.Engine.Workflows)
+	}
+	reg.Set(name, factory)
+	return s.refresh(name)
+}
+
+// UnregisterWorkflow removes workflow definition while server is running.
+// Workflows with running instances are not removed unless force is set - such instances will fail to resume.
+func (s *Server) UnregisterWorkflow(ctx context.Context, name string, force bool) error {
+	if !force {
+		active, err := s.Engine.HasActive(ctx, name)
+		if err != nil {
+			return err
+		}
+		if active {
+			return fmt.Errorf("%w: %v", ErrWorkflowInUse, name)
+		}
+	}
+	reg, ok := s.Engine.Workflows.(mutableRegistry)
+	if !ok {
+		return fmt.Errorf("registry %T doesn't support registration", s.Engine.Workflows)
+	}
+	reg.Delete(name)
+	return s.refresh(name)
+}
+
+// refresh drops cached docs of the workflow and rebuilds API schema after registry was changed
+func (s *Server) refresh(name string) error {
+	if s.cache != nil {
+		for _, key := range []string{"graph/" + name + "/", "graph/" + name + "/svg", "definition/" + name, "swagger/" + name, "client/" + name, "analysis/" + name} {
+			s.cache.Delete(key)
+		}
+	}
+	schema, err := GraphQLSchema(s.Engine, s.graphql)
+	if err != nil {
+		return fmt.Errorf("err building graphql schema: %v", err)
+	}
+	s.mu.Lock()
+	s.schema = schema
+	s.mu.Unlock()
+	return nil
 }
 
 func NewServer(cfg Config, workflows map[string]func() async.WorkflowState) (*Server, error) {
 	jsonschema.Version = ""
 	rand.Seed(time.Now().Unix())
+	if cfg.DatastoreMode {
+		var registry Registry = NewWorkflowRegistry(workflows)
+		if cfg.Registry != nil {
+			registry = cfg.Registry
+		}
+		return newDatastoreServer(cfg, registry)
+	}
 	ctx := context.Background()
-	db, err := firestore.NewClient(ctx, cfg.GCloudProjectID)
-	if err != nil {
-		panic(err)
+	db := cfg.Firestore
+	if db == nil {
+		c, err := firestore.NewClient(ctx, cfg.GCloudProjectID, cfg.FirestoreOptions...)
+		if err != nil {
+			return nil, fmt.Errorf("err creating firestore client: %v", err)
+		}
+		db = c
 	}
-	cTasks, err := cloudtasks.NewService(ctx)
+	var cTasks *cloudtasks.Service
+	if !cfg.DueTimers && (cfg.Scheduler == nil || cfg.Timers == nil) {
+		c, err := cloudtasks.NewService(ctx, cfg.CloudTasksOptions...)
+		if err != nil {
+			return nil, fmt.Errorf("err creating cloud tasks client: %v", err)
+		}
+		cTasks = c
+	}
+	gcs, err := storage.NewService(ctx, cfg.StorageOptions...)
 	if err != nil {
-		panic(err)
+		// existing objects are not checked by GCSObject, i.e. outside of Google Cloud
+		log.Printf("err creating storage client: %v", err)
+		gcs = nil
 	}
 
 	mr := mux.NewRouter()
+	var origins *originList
 	if cfg.CORS {
+		origins = newOriginList(cfg.CORSOrigins)
 		c := cors.New(cors.Options{
-			AllowedOrigins: []string{"*"},
-			AllowedMethods: []string{"GET", "POST"},
+			AllowOriginFunc: origins.allow,
+			AllowedMethods:  []string{"GET", "POST"},
 		})
 		mr.Use(c.Handler)
 	}
+	// admin auth is resolved before any adminOnly route is registered
+	if cfg.JWT != nil {
+		mr.Use(cfg.JWT.Middleware)
+		if cfg.AdminAuth == nil {
+			cfg.AdminAuth = RequireRole(cfg.JWT.adminRole())
+		}
+	}
+
+	resumePath, timeoutPath := callbackPaths(CallbackPathVersion)
+	resumeURL := strings.Trim(cfg.BasePublicURL, "/") + resumePath
+	if cfg.ResumeURL != "" {
+		resumeURL = cfg.ResumeURL
+	}
+	timeoutURL := strings.Trim(cfg.BasePublicURL, "/") + timeoutPath
+	if cfg.TimeoutURL != "" {
+		timeoutURL = cfg.TimeoutURL
+	}
+
+	var registry Registry = NewWorkflowRegistry(workflows)
+	if cfg.Registry != nil {
+		registry = cfg.Registry
+	}
 
 	engine := &FirestoreEngine{
-		DB:         db,
-		Collection: cfg.Collection,
-		Workflows:  workflows,
+		DB:               db,
+		Collection:       cfg.Collection,
+		Workflows:        registry,
+		Redactor:         cfg.Redactor,
+		Codec:            cfg.Codec,
+		Cache:            cfg.Cache,
+		Limiter:          cfg.Limiter,
+		Middleware:       cfg.Middleware,
+		Hooks:            cfg.Hooks,
+		Projection:       cfg.Projection,
+		History:          cfg.History,
+		NoHistory:        map[string]bool{},
+		ErrorReporter:    cfg.ErrorReporter,
+		MaxPanics:        cfg.MaxPanics,
+		MaxEventFailures: cfg.MaxEventFailures,
+		CursorSecret:     cfg.SignSecret,
+
+		CheckpointEvery:    cfg.CheckpointEvery,
+		CheckpointInterval: cfg.CheckpointInterval,
+		OutputValidation:   cfg.OutputValidation,
+		Retention:          NewRetention(cfg.Retention),
+		Timeouts:           cfg.Timeouts,
+		SLAs:               cfg.SLAs,
+		Cardinality:        cfg.Cardinality,
+		DedupWindows:       cfg.DedupWindows,
+		EventShards:        eventShards(cfg.HistoryShards),
+		ProcessingFloor:    cfg.ProcessingFloor,
 	}
 
 	s := &GTasksScheduler{
@@ -71,10 +379,18 @@ func NewServer(cfg Config, workflows map[string]func() async.WorkflowState) (*Se
 		ProjectID:  cfg.GCloudProjectID,
 		LocationID: cfg.GCloudLocationID,
 		QueueName:  cfg.GCloudTasksQueueName,
-		ResumeURL:  strings.Trim(cfg.BasePublicURL, "/") + "/resume",
+		ResumeURL:  resumeURL,
 		Secret:     cfg.SignSecret,
+
+		HighPriority:          cfg.HighPriority,
+		HighPriorityQueueName: cfg.GCloudTasksHighPriorityQueueName,
+		FallbackLocationID:    cfg.GCloudFallbackLocationID,
+		Timeouts:              cfg.Timeouts,
+	}
+	guard, err := newCallbackGuard(cfg.CallbackAuth)
+	if err != nil {
+		return nil, err
 	}
-	mr.HandleFunc("/resume", s.ResumeHandler)
 
 	engine.Scheduler = s
 	gTaskMgr := &GTasksScheduler{
@@ -83,131 +399,1226 @@ func NewServer(cfg Config, workflows map[string]func() async.WorkflowState) (*Se
 		ProjectID:   cfg.GCloudProjectID,
 		LocationID:  cfg.GCloudLocationID,
 		QueueName:   cfg.GCloudTasksQueueName,
-		CallbackURL: strings.Trim(cfg.BasePublicURL, "/") + "/callback/timeout",
+		CallbackURL: timeoutURL,
 		Secret:      cfg.SignSecret,
+
+		FallbackLocationID: cfg.GCloudFallbackLocationID,
+		Timeouts:           cfg.Timeouts,
+	}
+	engine.Callbacks = gTaskMgr
+	var timers TimerScheduler = gTaskMgr
+	var dueTimers *DueTimers
+	if cfg.DueTimers || cfg.Outbox {
+		dueTimers = &DueTimers{Engine: engine}
+	}
+	if cfg.DueTimers {
+		engine.Scheduler = dueTimers
+		engine.Callbacks = dueTimers
+		timers = dueTimers
+	} else if cfg.Outbox {
+		engine.Outbox = dueTimers
+	}
+	if cfg.Scheduler != nil {
+		engine.Scheduler = cfg.Scheduler
 	}
-	mr.HandleFunc("/callback/timeout", gTaskMgr.TimeoutHandler)
+	if cfg.Timers != nil {
+		engine.Callbacks = cfg.Timers
+		timers = cfg.Timers
+	}
+	if dueTimers != nil {
+		mr.HandleFunc("/timers/run", adminOnly(cfg.AdminAuth, func(w http.ResponseWriter, r *http.Request) {
+			stats, err := dueTimers.RunDueTimers(r.Context())
+			if err != nil {
+				jsonErr(w, err, 500)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(stats)
+		})).Methods("POST")
+	}
+	if cfg.Quotas != nil {
+		mr.Use(quotaMiddleware(cfg.Quotas, engine))
+	}
+	if len(cfg.EventRoles) > 0 {
+		// roles are checked before other middleware
+		engine.Middleware = append([]EventMiddleware{EventRoles(cfg.EventRoles, engine)}, engine.Middleware...)
+	}
+	if cfg.TracerProvider != nil {
+		engine.Tracer = NewTracer(cfg.TracerProvider)
+	}
+	if cfg.MeterProvider != nil {
+		m, err := NewMetrics(cfg.MeterProvider)
+		if err != nil {
+			return nil, fmt.Errorf("err creating metrics: %v", err)
+		}
+		engine.Metrics = m
+		s.Metrics = m
+		gTaskMgr.Metrics = m
+		err = m.ObserveAwaitingResume(cachedCount(AwaitingResumeRefresh, func(ctx context.Context) (int64, error) {
+			return engine.CountAwaitingResume(ctx, AwaitingResumeLimit)
+		}))
+		if err != nil {
+			return nil, fmt.Errorf("err creating metrics: %v", err)
+		}
+	}
+	costs := NewCosts(engine.Metrics)
+	engine.Costs = costs
+	gTaskMgr.Costs = costs
+	if cfg.Digest != nil {
+		if cfg.Digest.Engine == nil {
+			cfg.Digest.Engine = engine
+		}
+		_, err = parseCron(cfg.Digest.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("err parsing digest schedule: %v", err)
+		}
+	}
+	for _, name := range cfg.NoHistory {
+		engine.NoHistory[name] = true
+	}
+	if engine.History == nil && !cfg.DisableHistory {
+		h := &FirestoreHistory{
+			DB:         db,
+			Collection: cfg.Collection + "_log",
+		}
+		if cfg.HistoryShards > 1 {
+			h.Shards = PCShards(cfg.HistoryShards)
+		}
+		engine.History = []HistorySink{h}
+	}
+	if cfg.DisableHistory {
+		engine.History = nil
+	}
+	mr.HandleFunc("/events/gcs", limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, gcsHandler(engine, cfg.SignSecret))).Methods("POST")
+	// replies are posted by partners, so CallbackAuth is not applied
+	mr.HandleFunc("/callback/reply/{name}/{id}/{event}", limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, replyHandler(engine, cfg.SignSecret))).Methods("POST")
+	mr.HandleFunc("/event/by-key/{key}/{event}", limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, correlatedEventHandler(engine))).Methods("POST")
+	// callback handlers are shared with Functions, so that they are guarded the same way
+	resumeHandler := guard.wrap(limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, s.ResumeHandler))
+	timeoutHandler := guard.wrap(limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, gTaskMgr.TimeoutHandler))
+	routeCallbacks(mr, cfg.LegacyCallbackPrefixes, resumeHandler, timeoutHandler)
 
-	mr.HandleFunc("/wf/{name}/{id}", func(w http.ResponseWriter, r *http.Request) {
+	var inflight int64 // number of resumes running inside http handlers
+	// inlineResume decides whether workflow should be resumed inside http handler or only by the scheduler
+	inlineResume := func(r *http.Request) bool {
+		if cfg.AsyncResume || r.Header.Get("Prefer") == "respond-async" {
+			return false
+		}
+		return cfg.InlineResumeLimit == 0 || atomic.LoadInt64(&inflight) < int64(cfg.InlineResumeLimit)
+	}
+
+	create := func(w http.ResponseWriter, r *http.Request, id string, tmpl Template) {
+		err := cfg.IDRules.Validate(id)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
 		wfName := mux.Vars(r)["name"]
-		wf, ok := workflows[wfName]
+		if tmpl.Workflow != "" {
+			wfName = tmpl.Workflow
+		}
+		wf, _, ok := engine.Workflows.Get(wfName)
 		if !ok {
 			jsonErr(w, fmt.Errorf(" workflow  %v not found", wfName), 404)
 			return
 		}
-		err := engine.ScheduleAndCreate(r.Context(), mux.Vars(r)["id"], wfName, wf()) // TODO: how to create workflow with params!?
+		if tmpl.State != nil {
+			wf = tmpl.State
+		}
+		state := wf()
+		body, err := readBody(r)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		if len(bytes.TrimSpace(body)) > 0 {
+			err = decodeInitialState(body, state)
+			if err != nil {
+				jsonErr(w, err, 400)
+				return
+			}
+		}
+		labels, err := parseLabels(r.URL.Query()["label"])
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		stripQuotaLabel(labels)
+		for k, v := range tmpl.Labels {
+			if _, ok := labels[k]; !ok {
+				labels[k] = v
+			}
+		}
+		if cfg.Quotas != nil {
+			key := cfg.Quotas.Key(r)
+			err = checkConcurrentQuota(r.Context(), cfg.Quotas, engine, key)
+			if errors.Is(err, ErrQuotaExceeded) {
+				jsonErr(w, err, http.StatusTooManyRequests)
+				return
+			}
+			if err != nil {
+				jsonErr(w, err, 500)
+				return
+			}
+			if key != "" {
+				labels[QuotaLabel] = quotaKeyID(key)
+			}
+		}
+		opts := CreateOptions{
+			Labels:   labels,
+			Version:  r.URL.Query().Get("version"),
+			Priority: tmpl.Priority,
+			Deadline: tmpl.Deadline,
+		}
+		if d := r.URL.Query().Get("deadline"); d != "" {
+			opts.Deadline, err = time.ParseDuration(d)
+			if err != nil {
+				jsonErr(w, ValidationError{Path: "deadline", Msg: err.Error()}, 400)
+				return
+			}
+		}
+		if p := r.URL.Query().Get("priority"); p != "" {
+			opts.Priority, err = strconv.Atoi(p)
+			if err != nil {
+				jsonErr(w, ValidationError{Path: "priority", Msg: err.Error()}, 400)
+				return
+			}
+		}
+		// idempotent create returns existing workflow instead of conflict error
+		idempotent := r.URL.Query().Get("idempotent") == "true"
+		if r.URL.Query().Get("wait") == "true" {
+			timeout := time.Second * 10
+			if t := r.URL.Query().Get("timeout"); t != "" {
+				timeout, err = time.ParseDuration(t)
+				if err != nil {
+					jsonErr(w, fmt.Errorf("invalid timeout: %v", err), 400)
+					return
+				}
+			}
+			out, err := engine.CreateAndWait(r.Context(), id, wfName, state, opts, timeout)
+			if errors.Is(err, ErrAlreadyExists) && idempotent {
+				out, err = engine.Get(r.Context(), id)
+			}
+			if err == nil {
+				out, err = engine.Redact(out)
+			}
+			if errors.Is(err, ErrAlreadyExists) {
+				jsonErr(w, err, 409)
+				return
+			}
+			if err != nil {
+				jsonErr(w, err, 500)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(out)
+			return
+		}
+		err = engine.ScheduleAndCreate(r.Context(), id, wfName, state, opts)
+		if errors.Is(err, ErrAlreadyExists) && idempotent {
+			existing, err := engine.Get(r.Context(), id)
+			if err == nil {
+				existing, err = engine.Redact(existing)
+			}
+			if err != nil {
+				jsonErr(w, err, 500)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(existing)
+			return
+		}
+		if errors.Is(err, ErrAlreadyExists) {
+			jsonErr(w, err, 409)
+			return
+		}
 		if err != nil {
 			jsonErr(w, err, 400)
 			return
 		}
-		// after callback is handled - we wait for resume process
-		err = engine.Resume(r.Context(), mux.Vars(r)["id"])
+		code := http.StatusOK
+		if inlineResume(r) {
+			// after callback is handled - we wait for resume process
+			atomic.AddInt64(&inflight, 1)
+			err = engine.ResumeOrSchedule(r.Context(), id)
+			atomic.AddInt64(&inflight, -1)
+		} else {
+			code = http.StatusAccepted
+			err = engine.Scheduler.ScheduleWithPriority(r.Context(), id, 0, opts.Priority)
+		}
 		if err != nil {
 			jsonErr(w, err, 500)
 			return
 		}
-	}).Methods("POST")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(struct {
+			ID string
+		}{
+			ID: id,
+		})
+	}
+	// registered before /wf/{name}, so that it's not treated as workflow creation
+	mr.HandleFunc("/wf/_batchGet", limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		var req BatchGetRequest
+		err := bodyErr(json.NewDecoder(r.Body).Decode(&req))
+		if errors.Is(err, ErrBodyTooLarge) {
+			jsonErr(w, err, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		if len(req.IDs) > MaxGetMany {
+			jsonErr(w, fmt.Errorf("can't get more than %v workflows at once", MaxGetMany), 400)
+			return
+		}
+		wfs, err := engine.GetMany(r.Context(), req.IDs)
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		resp := BatchGetResponse{
+			Workflows: map[string]WorkflowStatus{},
+			NotFound:  []string{},
+		}
+		for _, id := range req.IDs {
+			wf, ok := wfs[id]
+			if !ok {
+				resp.NotFound = append(resp.NotFound, id)
+				continue
+			}
+			wf, err = engine.Redact(wf)
+			if err != nil {
+				jsonErr(w, err, 500)
+				return
+			}
+			resp.Workflows[id] = WorkflowStatus{
+				DBWorkflow: wf,
+				Progress:   engine.Progress(wf),
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})).Methods("POST")
+	mr.HandleFunc("/wf/{name}/{id}", limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		create(w, r, mux.Vars(r)["id"], Template{})
+	})).Methods("POST")
+	mr.HandleFunc("/wf/{name}", limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		id := newID()
+		w.Header().Set("Location", "/wf/"+mux.Vars(r)["name"]+"/"+id)
+		create(w, r, id, Template{})
+	})).Methods("POST")
+	mr.HandleFunc("/template/{tmpl}/{id}", limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		tmpl, ok := cfg.Templates[mux.Vars(r)["tmpl"]]
+		if !ok {
+			jsonErr(w, fmt.Errorf("template %v not found", mux.Vars(r)["tmpl"]), 404)
+			return
+		}
+		create(w, r, mux.Vars(r)["id"], tmpl)
+	})).Methods("POST")
 	mr.HandleFunc("/wf/{name}/{id}", func(w http.ResponseWriter, r *http.Request) {
-		wf, err := engine.Get(r.Context(), mux.Vars(r)["id"])
+		id := mux.Vars(r)["id"]
+		// status is cached together with transformer version, so that Status-Version is returned on cache hits too
+		var entry statusCacheEntry
+		var cached []byte
+		ok := false
+		if cfg.Cache != nil {
+			cached, ok = cfg.Cache.Get(workflowCacheKey(id))
+		}
+		if ok {
+			ok = json.Unmarshal(cached, &entry) == nil
+		}
+		if !ok {
+			var err error
+			entry, err = renderStatus(r.Context(), engine, cfg.StatusTransformers, id)
+			if err != nil {
+				jsonErr(w, err, 500)
+				return
+			}
+			if cfg.Cache != nil {
+				if d, err := json.Marshal(entry); err == nil {
+					cfg.Cache.Set(workflowCacheKey(id), d)
+				}
+			}
+		}
+		if entry.Version != "" {
+			w.Header().Set("Status-Version", entry.Version)
+		}
+		writeETagged(w, r, "application/json", entry.Body)
+	}).Methods("GET")
+	mr.HandleFunc("/wf/{name}/{id}/history", func(w http.ResponseWriter, r *http.Request) {
+		entries, err := engine.ReadHistory(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		// raw event payloads are stored unredacted, so they are shown only to admins. State is redacted again for entries written before history was redacted
+		admin := cfg.AdminAuth != nil && cfg.AdminAuth(r) == nil
+		for i, l := range entries {
+			wf, err := engine.Redact(&DBWorkflow{Meta: l.Meta, State: l.State})
+			if err != nil {
+				jsonErr(w, err, 500)
+				return
+			}
+			entries[i].State = wf.State
+			if !admin {
+				entries[i].Input = nil
+				entries[i].Output = nil
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		include := r.URL.Query().Get("include")
+		if include == "" {
+			_ = json.NewEncoder(w).Encode(entries)
+			return
+		}
+		// notes and side effects are for operators
+		if !admin {
+			jsonErr(w, fmt.Errorf("%w: %v are visible only to admins", ErrForbidden, include), http.StatusForbidden)
+			return
+		}
+		res := struct {
+			History []DBWorkflowLog
+			Notes   []Note         `json:",omitempty"`
+			Effects []EffectMarker `json:",omitempty"`
+		}{
+			History: entries,
+		}
+		for _, inc := range strings.Split(include, ",") {
+			switch inc {
+			case "notes":
+				res.Notes, err = engine.Notes(r.Context(), mux.Vars(r)["id"])
+			case "effects":
+				res.Effects, err = engine.Effects(r.Context(), mux.Vars(r)["id"])
+			default:
+				err = ValidationError{Path: "include", Msg: fmt.Sprintf("unknown include %q", inc)}
+			}
+			var vErr ValidationError
+			if errors.As(err, &vErr) {
+				jsonErr(w, err, 400)
+				return
+			}
+			if err != nil {
+				jsonErr(w, err, 500)
+				return
+			}
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}).Methods("GET")
+	mr.HandleFunc("/wf/{name}/{id}/_notes", adminOnly(cfg.AdminAuth, limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		var n Note
+		err := json.NewDecoder(r.Body).Decode(&n)
+		if err != nil {
+			jsonErr(w, bodyErr(err), 400)
+			return
+		}
+		if n.Text == "" {
+			jsonErr(w, ValidationError{Path: "Text", Msg: "note is empty"}, 400)
+			return
+		}
+		n, err = engine.AddNote(r.Context(), mux.Vars(r)["id"], n)
+		if errors.Is(err, ErrNotFound) {
+			jsonErr(w, err, 404)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(n)
+	}))).Methods("POST")
+	mr.HandleFunc("/wf/{name}/{id}/_notes", adminOnly(cfg.AdminAuth, func(w http.ResponseWriter, r *http.Request) {
+		notes, err := engine.Notes(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(notes)
+	})).Methods("GET")
+	mr.HandleFunc("/wf/{name}/{id}/_replay", adminOnly(cfg.AdminAuth, func(w http.ResponseWriter, r *http.Request) {
+		report, err := engine.Replay(r.Context(), mux.Vars(r)["id"], r.URL.Query().Get("version"))
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if report.Divergence != nil {
+			w.WriteHeader(http.StatusConflict)
+		}
+		_ = json.NewEncoder(w).Encode(report)
+	})).Methods("POST")
+	mr.HandleFunc("/wf/{name}/{id}/{action:skip|inject}/{event}", adminOnly(cfg.AdminAuth, limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		var req OperatorEventRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			jsonErr(w, bodyErr(err), 400)
+			return
+		}
+		if req.Reason == "" {
+			jsonErr(w, ValidationError{Path: "Reason", Msg: "reason is required for audit"}, 400)
+			return
+		}
+		vars := mux.Vars(r)
+		var out interface{}
+		if vars["action"] == OperatorSkip {
+			err = engine.SkipEvent(r.Context(), vars["id"], vars["event"], req.Payload, req.Reason)
+		} else {
+			out, err = engine.InjectEvent(r.Context(), vars["id"], vars["event"], req.Payload, req.Reason)
+		}
+		if errors.Is(err, ErrNotFound) {
+			jsonErr(w, err, 404)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(out)
+	}))).Methods("POST")
+	mr.HandleFunc("/wf/{name}/{id}/meta", func(w http.ResponseWriter, r *http.Request) {
+		meta, err := engine.GetMeta(r.Context(), mux.Vars(r)["id"])
+		if errors.Is(err, ErrNotFound) {
+			jsonErr(w, err, 404)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		// PC is incremented on every change, so it's enough to identify Meta version
+		etag := fmt.Sprintf(`"%v"`, meta.PC)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(meta)
+	}).Methods("GET")
+	mr.HandleFunc("/wf/{name}/{id}/state", func(w http.ResponseWriter, r *http.Request) {
+		if at := r.URL.Query().Get("at"); at != "" {
+			// state as of history entry, it can't be patched, so ETag is not returned
+			hs, err := engine.StateAt(r.Context(), mux.Vars(r)["id"], at)
+			var vErr ValidationError
+			switch {
+			case errors.As(err, &vErr):
+				jsonErr(w, err, 400)
+			case errors.Is(err, ErrNotFound):
+				jsonErr(w, err, 404)
+			case err != nil:
+				jsonErr(w, err, 500)
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(hs)
+			}
+			return
+		}
+		state, etag, err := engine.GetStateETag(r.Context(), mux.Vars(r)["id"])
+		if errors.Is(err, ErrNotFound) {
+			jsonErr(w, err, 404)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag)
+		_ = json.NewEncoder(w).Encode(state)
+	}).Methods("GET")
+	mr.HandleFunc("/wf/{name}/{id}/state", adminOnly(cfg.AdminAuth, func(w http.ResponseWriter, r *http.Request) {
+		etag := r.Header.Get("If-Match")
+		if etag == "" {
+			jsonErr(w, fmt.Errorf("If-Match header is required"), http.StatusPreconditionRequired)
+			return
+		}
+		patch, err := readBody(r)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		etag, err = engine.PatchState(r.Context(), mux.Vars(r)["id"], etag, patch)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			jsonErr(w, err, 404)
+		case errors.Is(err, ErrETagMismatch):
+			jsonErr(w, err, http.StatusPreconditionFailed)
+		case errors.Is(err, ErrLocked):
+			jsonErr(w, err, 409)
+		case err != nil:
+			var vErr ValidationError
+			if errors.As(err, &vErr) {
+				jsonErr(w, err, 400)
+				return
+			}
+			jsonErr(w, err, 500)
+		default:
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})).Methods("PATCH")
+	mr.HandleFunc("/wf/{name}", func(w http.ResponseWriter, r *http.Request) {
+		labels, err := parseLabels(r.URL.Query()["label"])
 		if err != nil {
 			jsonErr(w, err, 400)
 			return
 		}
+		limit := 100
+		if l := r.URL.Query().Get("limit"); l != "" {
+			limit, err = strconv.Atoi(l)
+			if err != nil {
+				jsonErr(w, fmt.Errorf("invalid limit: %v", err), 400)
+				return
+			}
+		}
+		lq := ListQuery{
+			Labels:  labels,
+			Limit:   limit,
+			OrderBy: r.URL.Query().Get("order"),
+			Cursor:  r.URL.Query().Get("cursor"),
+		}
+		listParams(r.URL.Query(), &lq)
+		wfs, next, err := engine.ListPage(r.Context(), mux.Vars(r)["name"], lq)
+		var vErr ValidationError
+		if errors.As(err, &vErr) {
+			jsonErr(w, err, 400)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		for i := range wfs {
+			if !hasField(lq.Fields, "State") {
+				break
+			}
+			wf, err := engine.Redact(&wfs[i])
+			if err != nil {
+				jsonErr(w, err, 500)
+				return
+			}
+			wfs[i] = *wf
+		}
+		if next != "" {
+			// pass as ?cursor= to get the next page
+			w.Header().Set("X-Next-Cursor", next)
+		}
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(wf)
+		if len(lq.Fields) > 0 {
+			out, err := sparse(wfs, lq.Fields)
+			if err != nil {
+				jsonErr(w, err, 500)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(out)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(wfs)
+	}).Methods("GET")
+	mr.HandleFunc("/wf/{name}/{id}/quarantine", adminOnly(cfg.AdminAuth, limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		events, err := engine.FailedEvents(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(events)
+	}))).Methods("GET")
+	mr.HandleFunc("/wf/{name}/{id}/quarantine/{key}/retry", adminOnly(cfg.AdminAuth, limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		out, err := engine.RetryEvent(r.Context(), mux.Vars(r)["id"], mux.Vars(r)["key"])
+		if errors.Is(err, ErrNotFound) {
+			jsonErr(w, err, 404)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	}))).Methods("POST")
+	mr.HandleFunc("/wf/{name}/{id}/quarantine/{key}", adminOnly(cfg.AdminAuth, limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		err := engine.DiscardEvent(r.Context(), mux.Vars(r)["id"], mux.Vars(r)["key"])
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))).Methods("DELETE")
+	mr.HandleFunc("/admin/resume-all", adminOnly(cfg.AdminAuth, func(w http.ResponseWriter, r *http.Request) {
+		q := ResumeAllQuery{
+			Workflow:   r.URL.Query().Get("name"),
+			Status:     r.URL.Query().Get("status"),
+			StaleAfter: time.Minute * 5,
+			RatePerSec: 50,
+		}
+		var err error
+		if v := r.URL.Query().Get("stale"); v != "" {
+			q.StaleAfter, err = time.ParseDuration(v)
+			if err != nil {
+				jsonErr(w, ValidationError{Path: "stale", Msg: err.Error()}, 400)
+				return
+			}
+		}
+		if v := r.URL.Query().Get("rate"); v != "" {
+			q.RatePerSec, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				jsonErr(w, ValidationError{Path: "rate", Msg: err.Error()}, 400)
+				return
+			}
+		}
+		n, err := engine.ResumeAll(r.Context(), q)
+		var vErr ValidationError
+		if errors.As(err, &vErr) {
+			jsonErr(w, err, 400)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Scheduled int
+		}{
+			Scheduled: n,
+		})
+	})).Methods("POST")
+	mr.HandleFunc("/stats", adminOnly(cfg.AdminAuth, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(costs.Stats())
+	})).Methods("GET")
+	if cfg.Debug {
+		mountDebug(mr, cfg.AdminAuth, func(ctx context.Context) (Diagnostics, error) {
+			d := Diagnostics{
+				InlineResumes: atomic.LoadInt64(&inflight),
+			}
+			if engine.Limiter != nil {
+				d.LimitedResumes, d.LimitedPerWorkflow = engine.Limiter.Running()
+			}
+			var err error
+			d.Locks, err = engine.ActiveLocks(ctx)
+			if err != nil {
+				return d, err
+			}
+			d.Queues, err = s.QueueStats(ctx)
+			return d, err
+		})
+	}
+	mr.HandleFunc("/activity/poll", adminOnly(cfg.WorkerAuth, func(w http.ResponseWriter, r *http.Request) {
+		task, err := engine.PollActivity(r.Context(), r.URL.Query().Get("type"), r.URL.Query().Get("worker"))
+		if errors.Is(err, ErrNoActivity) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(task)
+	})).Methods("POST")
+	mr.HandleFunc("/activity/{id}/complete", adminOnly(cfg.WorkerAuth, limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		var res ActivityResult
+		err := bodyErr(json.NewDecoder(r.Body).Decode(&res))
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		err = engine.CompleteActivity(r.Context(), mux.Vars(r)["id"], res)
+		if errors.Is(err, ErrNotFound) {
+			jsonErr(w, err, 404)
+			return
+		}
+		if errors.Is(err, ErrActivityToken) {
+			jsonErr(w, err, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+	}))).Methods("POST")
+	mr.HandleFunc("/activity/{id}/heartbeat", adminOnly(cfg.WorkerAuth, limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		var hb ActivityHeartbeat
+		err := bodyErr(json.NewDecoder(r.Body).Decode(&hb))
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		err = engine.HeartbeatActivity(r.Context(), mux.Vars(r)["id"], hb)
+		if errors.Is(err, ErrNotFound) {
+			jsonErr(w, err, 404)
+			return
+		}
+		if errors.Is(err, ErrActivityToken) {
+			// attempt was cancelled, timed out or retried - worker should stop
+			jsonErr(w, err, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+	}))).Methods("POST")
+	// search matches any indexed field and returns highlights, so it's admin only
+	mr.HandleFunc("/search", adminOnly(cfg.AdminAuth, limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Search == nil {
+			jsonErr(w, fmt.Errorf("search is not configured"), 404)
+			return
+		}
+		q := SearchQuery{
+			Query:    r.URL.Query().Get("q"),
+			Workflow: r.URL.Query().Get("workflow"),
+			Limit:    20,
+		}
+		if q.Query == "" {
+			jsonErr(w, ValidationError{Path: "q", Msg: "query is empty"}, 400)
+			return
+		}
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			q.Limit, err = strconv.Atoi(l)
+			if err != nil {
+				jsonErr(w, ValidationError{Path: "limit", Msg: err.Error()}, 400)
+				return
+			}
+		}
+		hits, err := cfg.Search.Search(r.Context(), q)
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(hits)
+	}))).Methods("GET")
+	mr.HandleFunc("/labels/{id}", adminOnly(cfg.AdminAuth, limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		err := cfg.IDRules.Validate(id)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		var labels map[string]string
+		err = bodyErr(json.NewDecoder(r.Body).Decode(&labels))
+		if errors.Is(err, ErrBodyTooLarge) {
+			jsonErr(w, err, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			jsonErr(w, fmt.Errorf("json parse: %v", err), 400)
+			return
+		}
+		stripQuotaLabel(labels)
+		err = engine.SetLabels(r.Context(), id, labels)
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+	}))).Methods("POST")
+	graphs := &graphCache{}
+	mr.HandleFunc("/graph/{name}/view", func(w http.ResponseWriter, r *http.Request) {
+		wfName := mux.Vars(r)["name"]
+		if _, _, ok := engine.Workflows.Get(wfName); !ok {
+			jsonErr(w, fmt.Errorf(" workflow  %v not found", wfName), 404)
+			return
+		}
+		serveViewer(w, wfName, r.URL.Query().Get("id"))
 	}).Methods("GET")
 	mr.HandleFunc("/graph/{name}", func(w http.ResponseWriter, r *http.Request) {
 		wfName := mux.Vars(r)["name"]
-		wf, ok := workflows[wfName]
+		wf, _, ok := engine.Workflows.Get(wfName)
 		if !ok {
 			fmt.Fprintf(w, " workflow  %v not found", wfName)
 			return
 		}
-		g := Grapher{}
-		def := g.Dot(wf().Definition())
-		gv := graphviz.New()
-		gd, err := graphviz.ParseBytes([]byte(def))
-		if err != nil {
-			fmt.Fprintf(w, " %v \n %v", def, err)
+		format := r.URL.Query().Get("format")
+		contentType := "image/jpg"
+		if format != "svg" {
+			format = "jpg"
+		} else {
+			contentType = "image/svg+xml"
+		}
+		g := Grapher{Theme: themeFromQuery(cfg.GraphTheme, r.URL.Query())}
+		dot := g.Dot(wf().Definition())
+		key := graphKey(dot, format)
+		// graph changes only with definition, so ETag is derived from it without rendering
+		etag := `"` + key + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
 			return
 		}
-		switch r.URL.Query().Get("format") {
-		case "svg":
-			w.Header().Add("Content-Type", "image/svg+xml")
-			gv.Render(gd, graphviz.SVG, w)
-		default:
-			w.Header().Add("Content-Type", "image/jpg")
-			gv.Render(gd, graphviz.JPG, w)
+		body, err := graphs.render(key, dot, format)
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
 		}
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(body)
 	})
 	mr.HandleFunc("/definition/{name}", func(w http.ResponseWriter, r *http.Request) {
 		wfName := mux.Vars(r)["name"]
-		wf, ok := workflows[wfName]
+		wf, _, ok := engine.Workflows.Get(wfName)
 		if !ok {
 			jsonErr(w, fmt.Errorf(" workflow  %v not found", wfName), 404)
 			return
 		}
-		w.Header().Add("Content-Type", "application/json")
-
-		defs := struct {
-			Stmts async.Section
-			State *jsonschema.Schema
-		}{
-			Stmts: wf().Definition(),
-			State: jsonschema.Reflect(wf()),
+		serveCached(w, r, cfg.Cache, "definition/"+wfName, "application/json", func() ([]byte, error) {
+			defs := struct {
+				Stmts   async.Section
+				State   *jsonschema.Schema
+				Example interface{} // example of initial state, i.e. to prefill creation form
+				Steps   []StepMeta
+			}{
+				Stmts:   wf().Definition(),
+				State:   jsonschema.Reflect(wf()),
+				Example: exampleState(wf()),
+				Steps:   definitionMeta(wf().Definition()),
+			}
+			return json.Marshal(defs)
+		})
+	})
+	mr.HandleFunc("/analysis/{name}", func(w http.ResponseWriter, r *http.Request) {
+		wfName := mux.Vars(r)["name"]
+		wf, _, ok := engine.Workflows.Get(wfName)
+		if !ok {
+			jsonErr(w, fmt.Errorf(" workflow  %v not found", wfName), 404)
+			return
 		}
-		_ = json.NewEncoder(w).Encode(defs)
+		serveCached(w, r, cfg.Cache, "analysis/"+wfName, "application/json", func() ([]byte, error) {
+			events := []string{}
+			for k := range cfg.EventRoles {
+				if strings.HasPrefix(k, wfName+"/") {
+					events = append(events, strings.TrimPrefix(k, wfName+"/"))
+				}
+			}
+			sort.Strings(events)
+			findings := append(Analyze(wf().Definition()), AnalyzeEvents(wf().Definition(), events)...)
+			return json.Marshal(struct {
+				Findings []Finding
+			}{
+				Findings: findings,
+			})
+		})
 	})
 	mr.HandleFunc("/swagger/{name}", func(w http.ResponseWriter, r *http.Request) {
 		wfName := mux.Vars(r)["name"]
-		wf, ok := workflows[wfName]
+		wf, _, ok := engine.Workflows.Get(wfName)
 		if !ok {
 			jsonErr(w, fmt.Errorf(" workflow  %v not found", wfName), 404)
 			return
 		}
-		docs, err := SwaggerDoc(cfg.BasePublicURL, wfName, wf)
-		if err != nil {
-			jsonErr(w, err, 500)
+		role := r.URL.Query().Get("role")
+		cache := cfg.Cache
+		if role != "" {
+			cache = nil // role-scoped docs are rare, so they are not cached to keep invalidation simple
+		}
+		serveCached(w, r, cache, "swagger/"+wfName, "application/json", func() ([]byte, error) {
+			docs, err := SwaggerDoc(cfg.BasePublicURL, wfName, wf, SwaggerOptions{
+				Errors:  cfg.EventErrors,
+				Aliases: cfg.EventAliases,
+				Role:    role,
+				Roles:   cfg.EventRoles,
+			})
+			if err != nil {
+				return nil, err
+			}
+			return json.MarshalIndent(docs, "", " ")
+		})
+	})
+	mr.HandleFunc("/client/{name}.ts", func(w http.ResponseWriter, r *http.Request) {
+		wfName := mux.Vars(r)["name"]
+		wf, _, ok := engine.Workflows.Get(wfName)
+		if !ok {
+			jsonErr(w, fmt.Errorf(" workflow  %v not found", wfName), 404)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		e := json.NewEncoder(w)
-		e.SetIndent("", " ")
-		_ = e.Encode(docs)
+		serveCached(w, r, cfg.Cache, "client/"+wfName, "application/typescript", func() ([]byte, error) {
+			ts, err := TypeScriptClient(wfName, wf)
+			return []byte(ts), err
+		})
 	})
 	ret := &Server{
-		Router:    mr,
-		Engine:    engine,
-		Scheduler: gTaskMgr,
+		Router:          mr,
+		Engine:          engine,
+		Scheduler:       gTaskMgr,
+		ResumeScheduler: s,
+		Timers:          dueTimers,
+		resumeHandler:   resumeHandler,
+		timeoutHandler:  timeoutHandler,
+		cache:           cfg.Cache,
+		baseURL:         cfg.BasePublicURL,
+		clientCAs:       guard.clients,
+		sqlDB:           cfg.SQLDB,
+		flags:           cfg.Flags,
+		timers:          timers,
+		storage:         gcs,
+		http:            cfg.HTTP,
+		throttler:       cfg.Throttler,
+		origins:         origins,
+		quotas:          cfg.Quotas,
 	}
-	mr.HandleFunc("/wf/{name}/{id}/{event}", func(w http.ResponseWriter, r *http.Request) {
-		d, err := ioutil.ReadAll(r.Body)
+	if ret.flags == nil {
+		ret.flags = FirestoreFlags{Doc: db.Collection(cfg.Collection + "_config").Doc("flags")}
+	}
+	if ret.throttler == nil {
+		ret.throttler = &FirestoreThrottler{
+			DB:         db,
+			Collection: cfg.Collection + "_throttle",
+		}
+	}
+	ret.graphql = GraphQLConfig{
+		IDRules:      cfg.IDRules,
+		EventAliases: cfg.EventAliases,
+		Quotas:       cfg.Quotas,
+		AdminAuth:    cfg.AdminAuth,
+	}
+	ret.schema, err = GraphQLSchema(engine, ret.graphql)
+	if err != nil {
+		return nil, fmt.Errorf("err building graphql schema: %v", err)
+	}
+	mr.HandleFunc("/graphql", limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		ret.mu.RLock()
+		schema := ret.schema
+		ret.mu.RUnlock()
+		GraphQLHandler(schema)(w, r)
+	})).Methods("GET", "POST")
+	mr.HandleFunc("/wf/{name}/{id}/{event}", limitRequest(cfg.MaxBodySize, cfg.RequestTimeout, func(w http.ResponseWriter, r *http.Request) {
+		err := cfg.IDRules.Validate(mux.Vars(r)["id"])
+		if err != nil {
+			jsonErr(w, err, 400)
+			return
+		}
+		d, err := readBody(r)
 		if err != nil {
 			jsonErr(w, err, 500)
 			return
 		}
-		out, err := s.Engine.HandleEvent(r.Context(), mux.Vars(r)["id"], mux.Vars(r)["event"], d)
+		ctx := withRequest(r.Context(), r)
+		if r.URL.Query().Get("nowait") == "true" {
+			// fail with 409 instead of waiting for locked workflow
+			ctx = WithoutLockWait(ctx)
+		}
+		resumeInline := inlineResume(r)
+		inline := cfg.InlineEventResume && resumeInline
+		if inline {
+			ctx = WithoutSchedule(ctx)
+		}
+		event := mux.Vars(r)["event"]
+		if resolved := cfg.EventAliases.resolve(w, mux.Vars(r)["name"], event); resolved != event {
+			engine.Metrics.deprecatedEvent(r.Context(), mux.Vars(r)["name"], event)
+			log.Printf("deprecated event %v/%v is used, should be %v", mux.Vars(r)["name"], event, resolved)
+			event = resolved
+		}
+		out, err := engine.HandleEvent(ctx, mux.Vars(r)["id"], event, d)
 		if err != nil {
 			jsonErr(w, err, 400)
 			return
 		}
+		if inline {
+			atomic.AddInt64(&inflight, 1)
+			err = engine.ResumeVerified(r.Context(), mux.Vars(r)["id"])
+			atomic.AddInt64(&inflight, -1)
+			if err != nil {
+				log.Printf("err resuming %v after event: %v", mux.Vars(r)["id"], err)
+			}
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(out)
-	})
+		if !resumeInline {
+			// resume is already scheduled by HandleEvent
+			w.WriteHeader(http.StatusAccepted)
+			_ = json.NewEncoder(w).Encode(out)
+			return
+		}
+		if r.URL.Query().Get("include") != "state" {
+			_ = json.NewEncoder(w).Encode(out)
+			return
+		}
+		if !inline {
+			// resume inline, so that returned state reflects the effect of the event
+			atomic.AddInt64(&inflight, 1)
+			err = engine.ResumeOrSchedule(r.Context(), mux.Vars(r)["id"])
+			atomic.AddInt64(&inflight, -1)
+			if err != nil {
+				jsonErr(w, err, 500)
+				return
+			}
+		}
+		wf, err := engine.Get(r.Context(), mux.Vars(r)["id"])
+		if err == nil {
+			wf, err = engine.Redact(wf)
+		}
+		if err != nil {
+			jsonErr(w, err, 500)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(struct {
+			Output   interface{}
+			Workflow *DBWorkflow
+		}{
+			Output:   out,
+			Workflow: wf,
+		})
+	}))
+	if cfg.HotReload {
+		doc := db.Collection(cfg.Collection + "_config").Doc("runtime")
+		load := cfg.LoadRuntimeConfig
+		if load == nil {
+			load = func(ctx context.Context) (RuntimeConfig, error) {
+				return loadRuntimeConfig(ctx, doc)
+			}
+		} else {
+			doc = nil
+		}
+		go ret.watchConfig(context.Background(), doc, load)
+	}
+	if cfg.Digest != nil {
+		go func() {
+			err := cfg.Digest.Run(context.Background())
+			if err != nil {
+				log.Printf("digest stopped: %v", err)
+			}
+		}()
+	}
 	return ret, nil
 }
 
+// newID generates random UUID v4
+func newID() string {
+	b := make([]byte, 16)
+	_, err := crand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// parseLabels parses labels in "key:value" format
+func parseLabels(in []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, v := range in {
+		kv := strings.SplitN(v, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, ValidationError{Path: "label", Msg: fmt.Sprintf("invalid label %q, expected key:value", v)}
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// adminOnly allows request only if it's authorized by auth
+func adminOnly(auth func(r *http.Request) error, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth == nil {
+			jsonErr(w, fmt.Errorf("admin endpoints are disabled"), http.StatusForbidden)
+			return
+		}
+		err := auth(r)
+		if err != nil {
+			jsonErr(w, err, http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// ErrorResponse is a body of error responses, except for HTTPError returned by handlers
+type ErrorResponse struct {
+	Msg  string
+	Type string
+	Path string
+	Ref  string `json:",omitempty"` // reference to find panic stack trace in logs
+
+	Errors []ValidationError `json:",omitempty"` // all invalid fields
+}
+
 func jsonErr(w http.ResponseWriter, err error, code int) {
-	w.WriteHeader(code)
-	e := struct {
-		Msg  string
-		Type string
-		Path string
-	}{
+	var hErr HTTPError
+	if errors.As(err, &hErr) {
+		w.WriteHeader(hErr.StatusCode())
+		_ = json.NewEncoder(w).Encode(hErr.Body())
+		log.Printf("%v", err)
+		return
+	}
+	e := ErrorResponse{
 		Msg:  err.Error(),
 		Type: "general",
 	}
+	var vErr ValidationError
+	if errors.As(err, &vErr) {
+		e.Type = "validation"
+		e.Path = vErr.Path
+	}
+	var vErrs ValidationErrors
+	if errors.As(err, &vErrs) && len(vErrs) > 0 {
+		e.Type = "validation"
+		e.Path = vErrs[0].Path
+		e.Errors = vErrs
+	}
+	var pErr PanicError
+	if errors.As(err, &pErr) {
+		code = 500
+		e.Type = "panic"
+		e.Msg = "internal error"
+		e.Ref = pErr.Ref
+		log.Printf("panic %v: %v\n%s", pErr.Ref, pErr.Value, pErr.Stack)
+	}
+	if errors.Is(err, ErrQuarantined) || errors.Is(err, ErrEventQuarantined) {
+		code = 409
+		e.Type = "quarantined"
+	}
+	var sErr ScheduleError
+	if errors.As(err, &sErr) {
+		code = http.StatusServiceUnavailable
+		e.Type = "schedule"
+	}
+	if errors.Is(err, ErrDuplicateInFlight) {
+		code = http.StatusConflict
+		e.Type = "duplicate"
+	}
+	var lErr LockedError
+	if errors.As(err, &lErr) {
+		code = http.StatusConflict
+		e.Type = "locked"
+		retry := int(math.Ceil(time.Until(lErr.Until).Seconds()))
+		if retry < 1 {
+			retry = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+	}
+	if errors.Is(err, ErrUnauthenticated) {
+		code = http.StatusUnauthorized
+		e.Type = "unauthenticated"
+	}
+	if errors.Is(err, ErrForbidden) {
+		code = http.StatusForbidden
+		e.Type = "forbidden"
+	}
+	if errors.Is(err, ErrWebhookNotVerified) {
+		code = http.StatusUnauthorized
+		e.Type = "unauthorized"
+	}
+	if errors.Is(err, ErrBodyTooLarge) {
+		code = http.StatusRequestEntityTooLarge
+		e.Type = "too_large"
+	}
+	if isTimeout(err) {
+		code = http.StatusRequestTimeout
+		e.Type = "timeout"
+	}
+	w.WriteHeader(code)
 
 	_ = json.NewEncoder(w).Encode(e)
 	log.Printf("%v", e)
@@ -0,0 +1,101 @@
+package gasync_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorchestrate/async"
+	"github.com/gorchestrate/gasync"
+	"github.com/gorchestrate/gasync/gasynctest"
+	"google.golang.org/api/option"
+)
+
+// fixtures are recorded in this project with RECORD=1 and application default credentials
+const (
+	testProject  = "gasync-test"
+	testLocation = "us-central1"
+	testQueue    = "gasync-test"
+)
+
+type greeting struct {
+	Name     string
+	Greeting string
+}
+
+func (wf *greeting) Definition() async.Section {
+	return async.S(
+		async.Step("greet", func() error {
+			wf.Greeting = "Hello, " + wf.Name
+			return nil
+		}),
+	)
+}
+
+func newTestServer(t *testing.T, f *gasynctest.Fixtures) *gasync.Server {
+	t.Helper()
+	cfg := gasync.Config{
+		GCloudProjectID:      testProject,
+		GCloudLocationID:     testLocation,
+		GCloudTasksQueueName: testQueue,
+		BasePublicURL:        "https://gasync.example.com",
+		Collection:           "gasynctest",
+		SignSecret:           "test",
+		StorageOptions:       []option.ClientOption{option.WithoutAuthentication()},
+	}
+	err := f.Apply(context.Background(), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := gasync.NewServer(cfg, map[string]func() async.WorkflowState{
+		"greeting": func() async.WorkflowState { return &greeting{} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCreateAndGet(t *testing.T) {
+	f, err := gasynctest.OpenFixtures("testdata", "create_get", os.Getenv("RECORD") != "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, f)
+	id := "greeting_" + f.Seed()
+
+	// resume is scheduled via Cloud Tasks instead of running inline
+	req := httptest.NewRequest("POST", "/wf/greeting/"+id, strings.NewReader(`{"Name":"World"}`))
+	req.Header.Set("Prefer", "respond-async")
+	rec := httptest.NewRecorder()
+	s.Router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("create: got %v %v", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	s.Router.ServeHTTP(rec, httptest.NewRequest("GET", "/wf/greeting/"+id, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get: got %v %v", rec.Code, rec.Body.String())
+	}
+	var status struct {
+		Meta  async.State
+		State greeting
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Meta.Status != async.WorkflowFinished || status.State.Greeting != "Hello, World" {
+		t.Fatalf("unexpected status: %v", rec.Body.String())
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,144 @@
+package gasync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+)
+
+// SLA requires workflow to reach the step within the duration after creation
+type SLA struct {
+	Name    string
+	Step    string        // step or event name, empty Step means workflow should be finished
+	Within  time.Duration // measured from workflow creation
+	Webhook string        // optional URL SLABreach is posted to
+}
+
+// SLAStatus tracks SLA of single workflow instance
+type SLAStatus struct {
+	Due      time.Time
+	Reached  time.Time // zero until step is reached
+	Breached bool
+}
+
+// SLABreach is recorded in history and posted to SLA webhook
+type SLABreach struct {
+	WorkflowID string
+	Workflow   string
+	SLA        string
+	Step       string
+	Due        time.Time
+	Time       time.Time
+}
+
+// initSLAs sets due dates of workflow SLAs and schedules resumes to check them
+func (fs FirestoreEngine) initSLAs(wf *DBWorkflow) {
+	for _, sla := range fs.SLAs[wf.Meta.Workflow] {
+		if wf.SLAs == nil {
+			wf.SLAs = map[string]SLAStatus{}
+		}
+		wf.SLAs[sla.Name] = SLAStatus{Due: wf.Created.Add(sla.Within)}
+	}
+}
+
+func (fs FirestoreEngine) scheduleSLAs(ctx context.Context, wf *DBWorkflow) {
+	for _, sla := range fs.SLAs[wf.Meta.Workflow] {
+		if !wf.SLAs[sla.Name].Reached.IsZero() {
+			continue
+		}
+		err := fs.Scheduler.Schedule(ctx, wf.Meta.ID, time.Until(wf.SLAs[sla.Name].Due))
+		if err != nil {
+			fs.reportError(ctx, wf.Meta, "", nil, fmt.Errorf("err scheduling sla %v: %w", sla.Name, err))
+		}
+	}
+}
+
+// markReached records SLAs which steps are currently executed or awaited
+func (fs FirestoreEngine) markReached(wf *DBWorkflow) {
+	for _, sla := range fs.SLAs[wf.Meta.Workflow] {
+		s, ok := wf.SLAs[sla.Name]
+		if !ok || !s.Reached.IsZero() || !slaReached(sla, wf.Meta) {
+			continue
+		}
+		s.Reached = time.Now()
+		wf.SLAs[sla.Name] = s
+	}
+}
+
+func slaReached(sla SLA, meta async.State) bool {
+	if meta.Status == async.WorkflowFinished {
+		return true // steps that were not reached before finishing can't be breached anymore
+	}
+	if sla.Step == "" {
+		return false
+	}
+	for _, t := range meta.Threads {
+		if t.CurStep == sla.Step || t.CurCallback == sla.Step {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSLAs records breaches of SLAs that are due. Workflow should be locked.
+func (fs FirestoreEngine) checkSLAs(ctx context.Context, wf *DBWorkflow) error {
+	breaches := []SLABreach{}
+	for _, sla := range fs.SLAs[wf.Meta.Workflow] {
+		s, ok := wf.SLAs[sla.Name]
+		if !ok || s.Breached || !s.Reached.IsZero() || time.Now().Before(s.Due) {
+			continue
+		}
+		s.Breached = true
+		wf.SLAs[sla.Name] = s
+		wf.SLABreached = true
+		breaches = append(breaches, SLABreach{
+			WorkflowID: wf.Meta.ID,
+			Workflow:   wf.Meta.Workflow,
+			SLA:        sla.Name,
+			Step:       sla.Step,
+			Due:        s.Due,
+			Time:       time.Now(),
+		})
+	}
+	if len(breaches) == 0 {
+		return nil
+	}
+	_, err := fs.DB.Collection(fs.Collection).Doc(wf.Meta.ID).Update(ctx, []firestore.Update{
+		{Path: "SLAs", Value: wf.SLAs},
+		{Path: "SLABreached", Value: true},
+	})
+	if err != nil {
+		return fmt.Errorf("err recording sla breach: %v", err)
+	}
+	for _, b := range breaches {
+		log.Printf("workflow %v breached sla %v", b.WorkflowID, b.SLA)
+		fs.Metrics.slaBreached(ctx, b.Workflow, b.SLA)
+		fs.writeSLABreach(ctx, wf, b)
+		for _, sla := range fs.SLAs[wf.Meta.Workflow] {
+			if sla.Name == b.SLA && sla.Webhook != "" {
+				err := postJSON(ctx, sla.Webhook, b)
+				if err != nil {
+					log.Printf("err notifying about sla breach of %v: %v", b.WorkflowID, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (fs FirestoreEngine) writeSLABreach(ctx context.Context, wf *DBWorkflow, b SLABreach) {
+	if len(fs.History) == 0 || fs.NoHistory[wf.Meta.Workflow] {
+		return
+	}
+	l := DBWorkflowLog{
+		Meta:      wf.Meta,
+		State:     wf.State,
+		Time:      b.Time,
+		SLABreach: &b,
+	}
+	fs.sendHistory(ctx, wf, l)
+}
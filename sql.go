@@ -0,0 +1,126 @@
+package gasync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorchestrate/async"
+)
+
+// SQLActivity runs parameterized query against database pool.
+// Retries are done inline while workflow is locked, so keep them short.
+type SQLActivity struct {
+	DB    *sql.DB // Config.SQLDB by default
+	Query string
+	// Args are evaluated when step runs, so that they can reference workflow state
+	Args func() []interface{}
+	// Exec runs statement without returning rows. Into receives number of affected rows then.
+	Exec bool
+	// Into receives query results. Rows are converted to json objects keyed by column names and
+	// unmarshaled into it, i.e. *[]MyRow with json tags matching column names.
+	Into    interface{}
+	Retry   RetryPolicy
+	Timeout time.Duration // 30 sec by default
+}
+
+// SQLActivity creates step running SQL query
+func (s *Server) SQLActivity(name string, a SQLActivity) async.StmtStep {
+	if a.DB == nil {
+		a.DB = s.sqlDB
+	}
+	return async.Step(name, a.run)
+}
+
+func (a SQLActivity) run() error {
+	defer logTime("sql activity")()
+	if a.DB == nil {
+		return fmt.Errorf("sql database is not configured")
+	}
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = time.Second * 30
+	}
+	var args []interface{}
+	if a.Args != nil {
+		args = a.Args()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return a.Retry.Do(ctx, func(ctx context.Context) error {
+		if a.Exec {
+			res, err := a.DB.ExecContext(ctx, a.Query, args...)
+			if err != nil {
+				return fmt.Errorf("err executing sql: %v", err)
+			}
+			if a.Into == nil {
+				return nil
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return fmt.Errorf("err getting rows affected: %v", err)
+			}
+			return remarshal(n, a.Into)
+		}
+		rows, err := a.DB.QueryContext(ctx, a.Query, args...)
+		if err != nil {
+			return fmt.Errorf("err running sql query: %v", err)
+		}
+		defer rows.Close()
+		res, err := scanRows(rows)
+		if err != nil {
+			return err
+		}
+		if a.Into == nil {
+			return nil
+		}
+		return remarshal(res, a.Into)
+	})
+}
+
+// scanRows converts rows to json objects keyed by column name
+func scanRows(rows *sql.Rows) ([]map[string]interface{}, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("err getting sql columns: %v", err)
+	}
+	ret := []map[string]interface{}{}
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			return nil, fmt.Errorf("err scanning sql row: %v", err)
+		}
+		row := map[string]interface{}{}
+		for i, c := range cols {
+			if b, ok := vals[i].([]byte); ok {
+				vals[i] = string(b)
+			}
+			row[c] = vals[i]
+		}
+		ret = append(ret, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("err reading sql rows: %v", err)
+	}
+	return ret, nil
+}
+
+// remarshal converts value to the dest type through json
+func remarshal(v interface{}, dest interface{}) error {
+	d, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(d, dest)
+	if err != nil {
+		return fmt.Errorf("err unmarshaling sql results: %v", err)
+	}
+	return nil
+}
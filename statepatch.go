@@ -0,0 +1,155 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrETagMismatch is returned when workflow was modified after ETag was obtained
+var ErrETagMismatch = errors.New("workflow was modified, etag doesn't match")
+
+// ErrLocked is returned when workflow is being processed and can't be modified
+var ErrLocked = errors.New("workflow is locked")
+
+func stateETag(updated time.Time) string {
+	return `"` + strconv.FormatInt(updated.UnixNano(), 36) + `"`
+}
+
+// mergePatch applies JSON merge patch (RFC 7396) to target
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
+
+// PatchState applies JSON merge patch to workflow state if it wasn't modified since etag was obtained.
+// Patch is recorded in workflow history. Returns new ETag.
+func (fs FirestoreEngine) PatchState(ctx context.Context, id, etag string, patch []byte) (string, error) {
+	defer logTime("patch state")()
+	start := time.Now()
+	var p interface{}
+	err := json.Unmarshal(patch, &p)
+	if err != nil {
+		return "", ValidationError{Path: "body", Msg: fmt.Sprintf("invalid merge patch: %v", err)}
+	}
+	ref := fs.DB.Collection(fs.Collection).Doc(id)
+	doc, err := ref.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if stateETag(doc.UpdateTime) != etag {
+		return "", ErrETagMismatch
+	}
+	var wf DBWorkflow
+	err = doc.DataTo(&wf)
+	if err != nil {
+		return "", fmt.Errorf("err unmarshaling workflow: %v", err)
+	}
+	if time.Since(wf.LockTill) < 0 {
+		return "", ErrLocked
+	}
+	state, err := fs.decodeState(&wf)
+	if err != nil {
+		return "", err
+	}
+	d, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	var current interface{}
+	err = json.Unmarshal(d, &current)
+	if err != nil {
+		return "", err
+	}
+	d, err = json.Marshal(mergePatch(current, p))
+	if err != nil {
+		return "", err
+	}
+	w, ok := resolve(fs.Workflows, wf.Meta.Workflow, wf.Version)
+	if !ok {
+		return "", fmt.Errorf("workflow not found: %v %v", wf.Meta.Workflow, wf.Version)
+	}
+	state = w()
+	err = json.Unmarshal(d, state)
+	if err != nil {
+		return "", ValidationError{Path: "body", Msg: fmt.Sprintf("patched state is invalid: %v", err)}
+	}
+	encoded, err := fs.encodeState(state)
+	if err != nil {
+		return "", err
+	}
+	// precondition fails if workflow was modified or locked after it was read, new ETag is taken from the write itself
+	res, err := ref.Update(ctx, []firestore.Update{{Path: "State", Value: encoded}}, firestore.LastUpdateTime(doc.UpdateTime))
+	if status.Code(err) == codes.FailedPrecondition {
+		return "", ErrETagMismatch
+	}
+	if err != nil {
+		return "", err
+	}
+	fs.invalidate(id)
+	fs.project(ctx, &wf, state)
+	fs.writeHistory(ctx, &wf, state, start, &async.CallbackRequest{WorkflowID: id, Name: adminCallbackPrefix + "patch_state"}, fs.redactPatch(&wf, state, p), nil)
+	return stateETag(res.UpdateTime), nil
+}
+
+// redactPatch masks patched values of sensitive fields for audit: values are taken from redacted patched state
+func (fs FirestoreEngine) redactPatch(wf *DBWorkflow, state async.WorkflowState, p interface{}) interface{} {
+	redacted, err := fs.Redact(&DBWorkflow{Meta: wf.Meta, State: state, Version: wf.Version})
+	if err != nil {
+		log.Printf("err redacting patch of %v: %v", wf.Meta.ID, err)
+		return nil
+	}
+	d, err := json.Marshal(redacted.State)
+	if err != nil {
+		return nil
+	}
+	var r interface{}
+	err = json.Unmarshal(d, &r)
+	if err != nil {
+		return nil
+	}
+	return maskPatch(p, r)
+}
+
+func maskPatch(p, redacted interface{}) interface{} {
+	pm, ok := p.(map[string]interface{})
+	if !ok {
+		return redacted
+	}
+	rm, _ := redacted.(map[string]interface{})
+	ret := map[string]interface{}{}
+	for k, v := range pm {
+		if v == nil {
+			ret[k] = nil // field removal
+			continue
+		}
+		ret[k] = maskPatch(v, rm[k])
+	}
+	return ret
+}
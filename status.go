@@ -0,0 +1,97 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorchestrate/async"
+)
+
+// StatusTransformer maps workflow into public status representation returned by GET /wf/{name}/{id},
+// so that refactoring of async.State or DBWorkflow doesn't break API consumers.
+// Version is returned in Status-Version header and should be changed on incompatible changes of representation.
+type StatusTransformer struct {
+	Version   string
+	Transform func(ctx context.Context, wf WorkflowStatus) (interface{}, error)
+}
+
+// statusCacheEntry is rendered status of workflow and version of transformer used for it
+type statusCacheEntry struct {
+	Version string `json:",omitempty"`
+	Body    json.RawMessage
+}
+
+// renderStatus renders redacted status of workflow. Transformer is selected by stored workflow type instead of URL,
+// so that status cached by id is the same whatever workflow name was requested.
+func renderStatus(ctx context.Context, engine *FirestoreEngine, transformers map[string]StatusTransformer, id string) (statusCacheEntry, error) {
+	wf, err := engine.Get(ctx, id)
+	if err != nil {
+		return statusCacheEntry{}, err
+	}
+	wf, err = engine.Redact(wf)
+	if err != nil {
+		return statusCacheEntry{}, err
+	}
+	status := WorkflowStatus{
+		DBWorkflow: wf,
+		Progress:   engine.Progress(wf),
+	}
+	tr, ok := transformers[wf.Meta.Workflow]
+	if !ok {
+		body, err := json.Marshal(status)
+		return statusCacheEntry{Body: body}, err
+	}
+	public, err := tr.Transform(ctx, status)
+	if err != nil {
+		return statusCacheEntry{}, fmt.Errorf("err transforming status: %v", err)
+	}
+	body, err := json.Marshal(public)
+	return statusCacheEntry{Version: tr.Version, Body: body}, err
+}
+
+// PublicStatusV1 is a stable status representation that doesn't expose Meta
+type PublicStatusV1 struct {
+	Version   string
+	ID        string
+	Workflow  string
+	Status    string // Resuming, Waiting or Finished
+	Created   time.Time
+	Waiting   []string // steps workflow is waiting on
+	Events    []string // events workflow is waiting for
+	Percent   int
+	LastError string `json:",omitempty"`
+	Labels    map[string]string
+	State     interface{} // redacted
+}
+
+// PublicStatus is a StatusTransformer producing PublicStatusV1
+var PublicStatus = StatusTransformer{
+	Version: "v1",
+	Transform: func(ctx context.Context, wf WorkflowStatus) (interface{}, error) {
+		// internal status names may change, so they are mapped explicitly
+		status := "Unknown"
+		switch wf.Meta.Status {
+		case async.WorkflowResuming:
+			status = "Resuming"
+		case async.WorkflowWaiting:
+			status = "Waiting"
+		case async.WorkflowFinished:
+			status = "Finished"
+		}
+		return PublicStatusV1{
+			Version:   "v1",
+			ID:        wf.Meta.ID,
+			Workflow:  wf.Meta.Workflow,
+			Status:    status,
+			Created:   wf.Created,
+			Waiting:   wf.Progress.Waiting,
+			Events:    wf.Progress.Events,
+			Percent:   wf.Progress.Percent,
+			LastError: wf.Progress.LastError,
+			Labels:    wf.Labels,
+			State:     wf.State,
+		}, nil
+	},
+}
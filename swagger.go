@@ -3,16 +3,56 @@ package gasync
 import (
 	"fmt"
 	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/alecthomas/jsonschema"
 
 	"github.com/gorchestrate/async"
 )
 
-func SwaggerDoc(baseurl string, wfName string, wf func() async.WorkflowState) (interface{}, error) {
+// SwaggerOptions document parts of API configured outside of workflow definition
+type SwaggerOptions struct {
+	Errors  EventErrors  // documented as responses of events
+	Aliases EventAliases // documented as deprecated endpoints
+
+	// Role limits documented events to ones that can be sent by the role according to Roles, i.e. for partners.
+	// Events without roles can be sent by anyone and are always documented.
+	Role  string
+	Roles map[string][]string // same as Config.EventRoles
+}
+
+// documented checks if event is available to the role
+func (o SwaggerOptions) documented(wfName, event string) bool {
+	if o.Role == "" {
+		return true
+	}
+	roles, ok := o.Roles[wfName+"/"+event]
+	if !ok {
+		roles, ok = o.Roles[event]
+	}
+	if !ok {
+		return true
+	}
+	for _, r := range roles {
+		if r == o.Role {
+			return true
+		}
+	}
+	return false
+}
+
+// SwaggerDoc documents workflow API
+func SwaggerDoc(baseurl string, wfName string, wf func() async.WorkflowState, opts SwaggerOptions) (interface{}, error) {
 	url, err := url.Parse(baseurl)
 	if err != nil {
 		return nil, err
 	}
 	definitions := map[string]interface{}{}
+	errSchema := jsonschema.Reflect(&ErrorResponse{})
+	for name, def := range errSchema.Definitions {
+		definitions[name] = def
+	}
 	endpoints := map[string]interface{}{}
 	docs := map[string]interface{}{
 		"definitions": definitions,
@@ -53,8 +93,8 @@ func SwaggerDoc(baseurl string, wfName string, wf func() async.WorkflowState) (i
 		switch x := s.(type) {
 		case async.WaitEventsStmt:
 			for _, v := range x.Cases {
-				h, ok := v.Handler.(*async.ReflectEvent)
-				if !ok {
+				h, ok := reflectEvent(v.Handler)
+				if !ok || !opts.documented(wfName, v.Callback.Name) {
 					continue
 				}
 				in, out, err := h.Schemas()
@@ -68,39 +108,110 @@ func SwaggerDoc(baseurl string, wfName string, wf func() async.WorkflowState) (i
 				for name, def := range out.Definitions {
 					definitions[name] = def
 				}
-				endpoints["/wf/"+wfName+"/{id}/"+v.Callback.Name] = map[string]interface{}{
-					"post": map[string]interface{}{
-						"consumes": []string{"application/json"},
-						"produces": []string{"application/json"},
-						"tags":     []string{wfName},
-						"parameters": []map[string]interface{}{
-							{
-								"name":        "id",
-								"in":          "path",
-								"description": "workflow id",
-								"required":    true,
-								"type":        "string",
-							},
-							{
-								"name":        "body",
-								"in":          "body",
-								"description": "event data",
-								"required":    true,
-								"schema": map[string]interface{}{
-									"$ref": in.Ref,
-								},
-							},
+				params := []map[string]interface{}{
+					{
+						"name":        "id",
+						"in":          "path",
+						"description": "workflow id",
+						"required":    true,
+						"type":        "string",
+					},
+					{
+						"name":        "body",
+						"in":          "body",
+						"description": "event data",
+						"required":    true,
+						"schema": map[string]interface{}{
+							"$ref": in.Ref,
 						},
-						"responses": map[string]interface{}{
-							"200": map[string]interface{}{
-								"description": "success",
-								"schema": map[string]interface{}{
-									"$ref": out.Ref,
-								},
-							},
+					},
+				}
+				post := map[string]interface{}{
+					"consumes": []string{"application/json"},
+					"produces": []string{"application/json"},
+					"tags":     []string{wfName},
+				}
+				if ve, ok := v.Handler.(*VersionedEvent); ok {
+					schemas, err := ve.VersionSchemas()
+					if err != nil {
+						oErr = err
+						panic(err)
+					}
+					versions := map[string]interface{}{}
+					post["x-event-versions"] = versions
+					enum := []string{ve.Latest}
+					versions[ve.Latest] = map[string]interface{}{"$ref": in.Ref}
+					for version, schema := range schemas {
+						for name, def := range schema.Definitions {
+							definitions[name] = def
+						}
+						versions[version] = map[string]interface{}{"$ref": schema.Ref}
+						enum = append(enum, version)
+					}
+					sort.Strings(enum)
+					params = append(params, map[string]interface{}{
+						"name":        EventVersionHeader,
+						"in":          "header",
+						"description": "version of event data, body should match schema from x-event-versions. Latest version is " + ve.Latest,
+						"required":    false,
+						"type":        "string",
+						"enum":        enum,
+					})
+				}
+				post["parameters"] = params
+				responses := map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "success",
+						"schema": map[string]interface{}{
+							"$ref": out.Ref,
+						},
+					},
+					"default": map[string]interface{}{
+						"description": "error",
+						"schema": map[string]interface{}{
+							"$ref": errSchema.Ref,
 						},
 					},
 				}
+				byCode := map[int][]HTTPError{}
+				for _, e := range opts.Errors.get(wfName, v.Callback.Name) {
+					byCode[e.StatusCode()] = append(byCode[e.StatusCode()], e)
+				}
+				for code, codeErrs := range byCode {
+					// swagger 2.0 has no oneOf, so first error documents body of the status code
+					body := jsonschema.Reflect(codeErrs[0].Body())
+					for name, def := range body.Definitions {
+						definitions[name] = def
+					}
+					responses[strconv.Itoa(code)] = map[string]interface{}{
+						"description": errorDescription(codeErrs),
+						"schema": map[string]interface{}{
+							"$ref": body.Ref,
+						},
+					}
+				}
+				post["responses"] = responses
+				endpoints["/wf/"+wfName+"/{id}/"+v.Callback.Name] = map[string]interface{}{
+					"post": post,
+				}
+				for name, alias := range opts.Aliases.forEvent(wfName, v.Callback.Name) {
+					deprecated := map[string]interface{}{}
+					for k, v := range post {
+						deprecated[k] = v
+					}
+					deprecated["deprecated"] = true
+					desc := "Deprecated, use " + alias.Event + " instead."
+					if !alias.Sunset.IsZero() {
+						desc += " Will be removed on " + alias.Sunset.Format("2006-01-02") + "."
+					}
+					if alias.Message != "" {
+						desc += " " + alias.Message
+					}
+					deprecated["description"] = desc
+					endpoints["/wf/"+wfName+"/{id}/"+name] = map[string]interface{}{
+						"post": deprecated,
+					}
+				}
 			}
 		}
 		return false
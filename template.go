@@ -0,0 +1,17 @@
+package gasync
+
+import (
+	"time"
+
+	"github.com/gorchestrate/async"
+)
+
+// Template is a named preset for creating workflows via POST /template/{tmpl}/{id}.
+// Labels, priority and deadline passed in query parameters override template defaults.
+type Template struct {
+	Workflow string
+	State    func() async.WorkflowState // default initial state. Empty workflow state is used if nil
+	Labels   map[string]string
+	Priority int
+	Deadline time.Duration // workflow is cancelled if it's not finished within deadline
+}
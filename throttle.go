@@ -0,0 +1,113 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Throttler reserves a slot in rate limit shared across instances and returns how long to wait for it.
+type Throttler interface {
+	Reserve(ctx context.Context, key string, ratePerSec float64) (time.Duration, error)
+}
+
+// FirestoreThrottler is a token bucket stored in Firestore. Bucket capacity is 1 second worth of tokens.
+type FirestoreThrottler struct {
+	DB         *firestore.Client
+	Collection string
+}
+
+type throttleBucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+func (t *FirestoreThrottler) Reserve(ctx context.Context, key string, ratePerSec float64) (time.Duration, error) {
+	if ratePerSec <= 0 {
+		return 0, fmt.Errorf("invalid rate %v for %v", ratePerSec, key)
+	}
+	ref := t.DB.Collection(t.Collection).Doc(key)
+	var wait time.Duration
+	err := t.DB.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		now := time.Now()
+		b := throttleBucket{
+			Tokens:  ratePerSec,
+			Updated: now,
+		}
+		doc, err := tx.Get(ref)
+		if err == nil {
+			err = doc.DataTo(&b)
+		}
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		b.Tokens += now.Sub(b.Updated).Seconds() * ratePerSec
+		if b.Tokens > ratePerSec {
+			b.Tokens = ratePerSec
+		}
+		b.Updated = now
+		// tokens can go negative - negative balance is a queue of reservations
+		b.Tokens--
+		wait = 0
+		if b.Tokens < 0 {
+			wait = time.Duration(-b.Tokens / ratePerSec * float64(time.Second))
+		}
+		return tx.Set(ref, b)
+	})
+	return wait, err
+}
+
+// ThrottleHandler waits for a slot in rate limit before continuing workflow
+type ThrottleHandler struct {
+	Key        string
+	RatePerSec float64
+
+	throttler Throttler
+	scheduler TimerScheduler
+}
+
+// Throttle waits until call to key is allowed by global rate limit, shared by all workflows.
+func (s *Server) Throttle(name, key string, ratePerSec float64) async.WaitEventsStmt {
+	return async.Wait(name, async.On(name, &ThrottleHandler{
+		Key:        key,
+		RatePerSec: ratePerSec,
+		throttler:  s.throttler,
+		scheduler:  s.timers,
+	}))
+}
+
+func (h ThrottleHandler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type       string
+		Key        string
+		RatePerSec float64
+	}{
+		Type:       "throttle",
+		Key:        h.Key,
+		RatePerSec: h.RatePerSec,
+	})
+}
+
+// Setup reserves slot and schedules callback when it's available
+func (h *ThrottleHandler) Setup(ctx context.Context, req async.CallbackRequest) (string, error) {
+	defer logTime("throttle setup")()
+	wait, err := h.throttler.Reserve(ctx, h.Key, h.RatePerSec)
+	if err != nil {
+		return "", fmt.Errorf("err reserving %v: %v", h.Key, err)
+	}
+	return h.scheduler.Setup(ctx, req, wait)
+}
+
+func (h *ThrottleHandler) Handle(ctx context.Context, req async.CallbackRequest, input interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (h *ThrottleHandler) Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error {
+	return h.scheduler.Teardown(ctx, req, handled)
+}
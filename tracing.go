@@ -0,0 +1,42 @@
+package gasync
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewTracer returns tracer used by the engine for resume and event spans
+func NewTracer(tp trace.TracerProvider) trace.Tracer {
+	return tp.Tracer("github.com/gorchestrate/gasync")
+}
+
+// startSpan starts span of workflow processing. Metrics are recorded with context of this span,
+// so MeterProvider with exemplars enabled links latency and error metrics to the trace of the workflow.
+// Span continues trace of the http request that delivered the event, if request carries trace context.
+func (fs FirestoreEngine) startSpan(ctx context.Context, name, id string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return startSpan(ctx, fs.Tracer, name, id, attrs...)
+}
+
+func startSpan(ctx context.Context, tracer trace.Tracer, name, id string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if tracer == nil {
+		return ctx, trace.SpanFromContext(context.Background()) // no-op span
+	}
+	if r, ok := RequestFromContext(ctx); ok && !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(append(attrs, attribute.String("workflow.id", id))...))
+}
+
+// endSpan records error of workflow processing and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,203 @@
+package gasync
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/jsonschema"
+	"github.com/gorchestrate/async"
+)
+
+var nonIdent = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// tsIdent converts name to valid TypeScript identifier
+func tsIdent(name string) string {
+	parts := strings.FieldsFunc(nonIdent.ReplaceAllString(name, "_"), func(r rune) bool { return r == '_' })
+	for i := range parts {
+		if i > 0 {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	ret := strings.Join(parts, "")
+	if ret == "" || (ret[0] >= '0' && ret[0] <= '9') {
+		ret = "_" + ret
+	}
+	return ret
+}
+
+func tsRef(ref string) string {
+	return tsIdent(strings.TrimPrefix(ref, "#/definitions/"))
+}
+
+// tsType converts json schema to TypeScript type expression
+func tsType(t *jsonschema.Type) string {
+	if t == nil {
+		return "any"
+	}
+	if t.Ref != "" {
+		return tsRef(t.Ref)
+	}
+	if len(t.Enum) > 0 {
+		vals := []string{}
+		for _, v := range t.Enum {
+			d, _ := json.Marshal(v)
+			vals = append(vals, string(d))
+		}
+		return strings.Join(vals, " | ")
+	}
+	if len(t.OneOf) > 0 || len(t.AnyOf) > 0 {
+		vals := []string{}
+		for _, v := range append(t.OneOf, t.AnyOf...) {
+			vals = append(vals, tsType(v))
+		}
+		return strings.Join(vals, " | ")
+	}
+	switch t.Type {
+	case "string":
+		return "string"
+	case "integer", "number":
+		return "number"
+	case "boolean":
+		return "boolean"
+	case "null":
+		return "null"
+	case "array":
+		return "Array<" + tsType(t.Items) + ">"
+	case "object":
+		if t.Properties == nil || len(t.Properties.Keys()) == 0 {
+			if len(t.PatternProperties) == 1 {
+				for _, v := range t.PatternProperties {
+					return "Record<string, " + tsType(v) + ">"
+				}
+			}
+			return "Record<string, any>"
+		}
+		return tsObject(t, "")
+	}
+	return "any"
+}
+
+func tsObject(t *jsonschema.Type, indent string) string {
+	required := map[string]bool{}
+	for _, r := range t.Required {
+		required[r] = true
+	}
+	b := strings.Builder{}
+	b.WriteString("{\n")
+	for _, k := range t.Properties.Keys() {
+		v, _ := t.Properties.Get(k)
+		p, _ := v.(*jsonschema.Type)
+		opt := "?"
+		if required[k] {
+			opt = ""
+		}
+		fmt.Fprintf(&b, "%v  %q%v: %v;\n", indent, k, opt, tsType(p))
+	}
+	b.WriteString(indent + "}")
+	return b.String()
+}
+
+// TypeScriptClient generates typed TypeScript client for the workflow with a function per event
+func TypeScriptClient(wfName string, wf func() async.WorkflowState) (string, error) {
+	definitions := jsonschema.Definitions{}
+	state := jsonschema.Reflect(wf())
+	for name, def := range state.Definitions {
+		definitions[name] = def
+	}
+	type method struct {
+		Event   string
+		In, Out string
+	}
+	methods := []method{}
+	var oErr error
+	_, err := async.Walk(wf().Definition(), func(s async.Stmt) bool {
+		x, ok := s.(async.WaitEventsStmt)
+		if !ok {
+			return false
+		}
+		for _, v := range x.Cases {
+			h, ok := reflectEvent(v.Handler)
+			if !ok {
+				continue
+			}
+			in, out, err := h.Schemas()
+			if err != nil {
+				oErr = err
+				return true
+			}
+			for name, def := range in.Definitions {
+				definitions[name] = def
+			}
+			for name, def := range out.Definitions {
+				definitions[name] = def
+			}
+			methods = append(methods, method{
+				Event: v.Callback.Name,
+				In:    tsType(&jsonschema.Type{Ref: in.Ref}),
+				Out:   tsType(&jsonschema.Type{Ref: out.Ref}),
+			})
+		}
+		return false
+	})
+	if oErr != nil {
+		return "", fmt.Errorf("err reflecting events of workflow %v: %v", wfName, oErr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("err walking workflow %v: %v", wfName, err)
+	}
+	names := []string{}
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "// Code generated by gasync for workflow %q. DO NOT EDIT.\n\n", wfName)
+	for _, name := range names {
+		def := definitions[name]
+		if def.Type == "object" && def.Properties != nil && len(def.Properties.Keys()) > 0 {
+			fmt.Fprintf(&b, "export interface %v %v\n\n", tsIdent(name), tsObject(def, ""))
+			continue
+		}
+		fmt.Fprintf(&b, "export type %v = %v;\n\n", tsIdent(name), tsType(def))
+	}
+	client := tsIdent(wfName)
+	client = strings.ToUpper(client[:1]) + client[1:] + "Client"
+	fmt.Fprintf(&b, `export class %v {
+  constructor(private baseURL: string, private init: RequestInit = {}) {}
+
+  private async call<T>(method: string, path: string, body?: unknown): Promise<T> {
+    const resp = await fetch(this.baseURL + path, {
+      ...this.init,
+      method,
+      headers: { "Content-Type": "application/json", ...(this.init.headers || {}) },
+      body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    if (!resp.ok) {
+      throw new Error(%v + resp.status + ": " + (await resp.text()));
+    }
+    const text = await resp.text();
+    return (text ? JSON.parse(text) : undefined) as T;
+  }
+
+  create(id: string, state?: %v): Promise<unknown> {
+    return this.call("POST", "/wf/%v/" + encodeURIComponent(id), state);
+  }
+
+  get(id: string): Promise<unknown> {
+    return this.call("GET", "/wf/%v/" + encodeURIComponent(id));
+  }
+`, client, `"gasync request failed with status "`, tsType(&jsonschema.Type{Ref: state.Ref}), wfName, wfName)
+	for _, m := range methods {
+		fmt.Fprintf(&b, `
+  %v(id: string, body: %v): Promise<%v> {
+    return this.call("POST", "/wf/%v/" + encodeURIComponent(id) + "/%v", body);
+  }
+`, tsIdent(m.Event), m.In, m.Out, wfName, m.Event)
+	}
+	b.WriteString("}\n")
+	return b.String(), nil
+}
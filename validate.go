@@ -0,0 +1,133 @@
+package gasync
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/alecthomas/jsonschema"
+	"github.com/gorchestrate/async"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ValidationErrors are returned when several fields of request data are invalid
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := []string{}
+	for _, v := range e {
+		msgs = append(msgs, v.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// stateReflector honors `jsonschema:"required"` tags instead of requiring all fields without omitempty
+var stateReflector = jsonschema.Reflector{RequiredFromJSONSchemaTags: true}
+
+// decodeInitialState validates initial state sent by client against workflow state schema and unmarshals it to state.
+// Fields tagged `jsonschema:"readOnly"` are managed by workflow and can't be set by clients.
+func decodeInitialState(body []byte, state async.WorkflowState) error {
+	schema, err := json.Marshal(stateReflector.Reflect(state))
+	if err != nil {
+		return fmt.Errorf("err marshaling state schema: %v", err)
+	}
+	res, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(schema), gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return ValidationError{Path: "body", Msg: err.Error()}
+	}
+	errs := ValidationErrors{}
+	for _, e := range res.Errors() {
+		errs = append(errs, ValidationError{Path: e.Field(), Msg: e.Description()})
+	}
+	var doc map[string]interface{}
+	if json.Unmarshal(body, &doc) == nil {
+		errs = append(errs, readOnlyErrs(reflect.TypeOf(state), doc, "")...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	err = json.Unmarshal(body, state)
+	if err != nil {
+		return ValidationError{Path: "body", Msg: err.Error()}
+	}
+	return nil
+}
+
+// readOnlyErrs reports readOnly fields set in the document
+func readOnlyErrs(t reflect.Type, doc map[string]interface{}, prefix string) []ValidationError {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	ret := []ValidationError{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		if f.Anonymous && f.Tag.Get("json") == "" {
+			ret = append(ret, readOnlyErrs(f.Type, doc, prefix)...)
+			continue
+		}
+		v, ok := doc[name]
+		if !ok {
+			continue
+		}
+		for _, t := range strings.Split(f.Tag.Get("jsonschema"), ",") {
+			if t == "readOnly" {
+				ret = append(ret, ValidationError{Path: prefix + name, Msg: "field is read only"})
+			}
+		}
+		if sub, ok := v.(map[string]interface{}); ok {
+			ret = append(ret, readOnlyErrs(f.Type, sub, prefix+name+".")...)
+		}
+	}
+	return ret
+}
+
+// OutputValidation controls validation of event handler outputs against reflected output schema
+type OutputValidation string
+
+const (
+	OutputValidationOff    OutputValidation = ""
+	OutputValidationLog    OutputValidation = "log"    // invalid outputs are logged and returned as is
+	OutputValidationStrict OutputValidation = "strict" // event fails and workflow is not saved, i.e. for dev mode
+)
+
+// validateOutput checks that event output round-trips through json and matches handler output schema
+func validateOutput(state async.WorkflowState, name string, out interface{}) error {
+	h, err := async.FindHandler(async.CallbackRequest{Name: name}, state.Definition())
+	if err != nil {
+		return nil // checked by handler itself
+	}
+	re, ok := reflectEvent(h)
+	if !ok {
+		return nil
+	}
+	_, schema, err := re.Schemas()
+	if err != nil {
+		return fmt.Errorf("err reflecting output schema of %v: %v", name, err)
+	}
+	s, err := json.Marshal(schema)
+	if err != nil {
+		return fmt.Errorf("err marshaling output schema of %v: %v", name, err)
+	}
+	d, err := json.Marshal(out)
+	if err != nil {
+		return fmt.Errorf("output of %v can't be marshaled: %v", name, err)
+	}
+	res, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(s), gojsonschema.NewBytesLoader(d))
+	if err != nil {
+		return fmt.Errorf("err validating output of %v: %v", name, err)
+	}
+	if !res.Valid() {
+		return fmt.Errorf("output of %v doesn't match schema: %v", name, res.Errors())
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/alecthomas/jsonschema"
+	"github.com/gorchestrate/async"
+)
+
+// EventVersionHeader selects version of event payload.
+// If header is not set - "version" field of the payload is used. Latest version is used by default.
+const EventVersionHeader = "X-Event-Version"
+
+// EventVersion is an older version of event payload.
+// Upgrade has the form func(OldInput) (LatestInput, error).
+type EventVersion struct {
+	Version string
+	Upgrade interface{}
+}
+
+// VersionedEvent is an event accepting multiple versions of payload.
+// Older payloads are upgraded to the latest version before calling the handler.
+type VersionedEvent struct {
+	async.ReflectEvent
+	Latest   string
+	Versions []EventVersion
+}
+
+// OnVersionedEvent is the same as async.OnEvent, but accepts older payload versions as well.
+func OnVersionedEvent(name, latest string, h interface{}, versions []EventVersion, stmts ...async.Stmt) async.Event {
+	return async.Event{
+		Callback: async.CallbackRequest{
+			Name: name,
+		},
+		Handler: &VersionedEvent{
+			ReflectEvent: async.ReflectEvent{Handler: h},
+			Latest:       latest,
+			Versions:     versions,
+		},
+		Stmt: async.Section(stmts),
+	}
+}
+
+// reflectEvent returns reflect handler for events accepting json payloads
+func reflectEvent(h async.Handler) (*async.ReflectEvent, bool) {
+	switch x := h.(type) {
+	case *async.ReflectEvent:
+		return x, true
+	case *VersionedEvent:
+		return &x.ReflectEvent, true
+	case *ContextEvent:
+		return &x.ReflectEvent, true
+	case *CorrelatedEvent:
+		return &x.ReflectEvent, true
+	}
+	return nil, false
+}
+
+func (h *VersionedEvent) version(ctx context.Context, input []byte) string {
+	if r, ok := RequestFromContext(ctx); ok && r.Header.Get(EventVersionHeader) != "" {
+		return r.Header.Get(EventVersionHeader)
+	}
+	var v struct {
+		Version string `json:"version"`
+	}
+	_ = json.Unmarshal(input, &v)
+	return v.Version
+}
+
+// VersionSchemas returns input schemas of older versions
+func (h *VersionedEvent) VersionSchemas() (map[string]*jsonschema.Schema, error) {
+	r := jsonschema.Reflector{
+		FullyQualifyTypeNames: true,
+	}
+	ret := map[string]*jsonschema.Schema{}
+	for _, v := range h.Versions {
+		ft := reflect.TypeOf(v.Upgrade)
+		if ft == nil || ft.Kind() != reflect.Func || ft.NumIn() != 1 || ft.In(0).Kind() != reflect.Struct {
+			return nil, fmt.Errorf("upgrade of version %v should be a func with 1 struct input", v.Version)
+		}
+		ret[v.Version] = r.ReflectFromType(ft.In(0))
+	}
+	return ret, nil
+}
+
+func (h *VersionedEvent) upgrade(v EventVersion, input []byte) ([]byte, error) {
+	fv := reflect.ValueOf(v.Upgrade)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 1 || ft.NumOut() != 2 {
+		return nil, fmt.Errorf("upgrade of version %v should have 1 input and 2 outputs", v.Version)
+	}
+	in := reflect.New(ft.In(0))
+	err := json.Unmarshal(input, in.Interface())
+	if err != nil {
+		return nil, ValidationError{Path: "body", Msg: fmt.Sprintf("can't unmarshal input of version %v: %v", v.Version, err)}
+	}
+	res := fv.Call([]reflect.Value{in.Elem()})
+	if err, ok := res[1].Interface().(error); ok && err != nil {
+		return nil, fmt.Errorf("err upgrading input of version %v: %w", v.Version, err)
+	}
+	return json.Marshal(res[0].Interface())
+}
+
+func (h *VersionedEvent) Handle(ctx context.Context, req async.CallbackRequest, input interface{}) (interface{}, error) {
+	d, ok := input.([]byte)
+	if !ok {
+		return h.ReflectEvent.Handle(ctx, req, input)
+	}
+	version := h.version(ctx, d)
+	if version == "" || version == h.Latest {
+		return h.ReflectEvent.Handle(ctx, req, input)
+	}
+	for _, v := range h.Versions {
+		if v.Version != version {
+			continue
+		}
+		d, err := h.upgrade(v, d)
+		if err != nil {
+			return nil, err
+		}
+		return h.ReflectEvent.Handle(ctx, req, d)
+	}
+	return nil, ValidationError{Path: "version", Msg: fmt.Sprintf("unsupported event version %q", version)}
+}
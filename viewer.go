@@ -0,0 +1,128 @@
+package gasync
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// viewerTmpl is an interactive graph viewer: pan with drag, zoom with wheel, click on node to see step details.
+// If instance id is specified - steps are linked to history entries of the instance.
+var viewerTmpl = template.Must(template.New("viewer").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}{{if .ID}} / {{.ID}}{{end}}</title>
+<style>
+  body { margin: 0; font-family: sans-serif; display: flex; height: 100vh; }
+  #graph { flex: 1; overflow: hidden; cursor: grab; background: #fafafa; }
+  #graph svg { width: 100%; height: 100%; }
+  #graph .node { cursor: pointer; }
+  #graph .node.selected polygon, #graph .node.selected ellipse { stroke: #d33; stroke-width: 3; }
+  #graph .node.visited polygon, #graph .node.visited ellipse { fill: #e3f2e1; }
+  #panel { width: 380px; overflow: auto; border-left: 1px solid #ddd; padding: 12px; font-size: 13px; }
+  pre { background: #f4f4f4; padding: 6px; overflow: auto; }
+</style>
+</head>
+<body>
+<div id="graph"></div>
+<div id="panel"><h3>{{.Name}}</h3><p>Click on a step to see details.</p></div>
+<script>
+const name = {{.Name}}, id = {{.ID}};
+const graph = document.getElementById("graph"), panel = document.getElementById("panel");
+let steps = {}, history = [];
+
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, c => ({"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c]));
+}
+
+function entryStep(e) {
+  if (e.Callback && e.Callback.Name) return e.Callback.Name;
+  return ((e.Meta && e.Meta.Threads) || []).map(t => t.CurStep);
+}
+
+function show(step) {
+  graph.querySelectorAll(".node.selected").forEach(n => n.classList.remove("selected"));
+  graph.querySelectorAll(".node").forEach(n => { if (n.querySelector("title").textContent === step) n.classList.add("selected"); });
+  const meta = steps[step];
+  let html = "<h3>" + esc(step) + "</h3>";
+  if (meta) {
+    html += "<p>Type: " + esc(meta.Type) + "</p>";
+    if (meta.Events) html += "<p>Events: " + meta.Events.map(e => "<code>POST /wf/" + esc(name) + "/{id}/" + esc(e) + "</code>").join("<br>") + "</p>";
+  }
+  html += '<p><a href="/swagger/' + encodeURIComponent(name) + '">API docs</a></p>';
+  if (id) {
+    const entries = history.filter(e => [].concat(entryStep(e)).indexOf(step) >= 0);
+    html += "<h4>History (" + entries.length + ")</h4>";
+    entries.forEach(e => {
+      html += '<details id="pc-' + e.Meta.PC + '"><summary>#' + e.Meta.PC + " " + esc(e.Time) + " (" + (e.ExecDuration / 1e6).toFixed(1) + " ms)</summary>";
+      if (e.Input !== undefined && e.Input !== null) html += "<p>Input</p><pre>" + esc(JSON.stringify(e.Input, null, 2)) + "</pre>";
+      if (e.Output !== undefined && e.Output !== null) html += "<p>Output</p><pre>" + esc(JSON.stringify(e.Output, null, 2)) + "</pre>";
+      html += "<p>State</p><pre>" + esc(JSON.stringify(e.State, null, 2)) + "</pre></details>";
+    });
+  }
+  panel.innerHTML = html;
+}
+
+function panZoom(svg) {
+  const vb = svg.viewBox.baseVal;
+  let drag = null;
+  svg.addEventListener("wheel", ev => {
+    ev.preventDefault();
+    const k = ev.deltaY > 0 ? 1.1 : 1 / 1.1;
+    const r = svg.getBoundingClientRect();
+    const x = vb.x + (ev.clientX - r.left) / r.width * vb.width;
+    const y = vb.y + (ev.clientY - r.top) / r.height * vb.height;
+    vb.x = x - (x - vb.x) * k; vb.y = y - (y - vb.y) * k;
+    vb.width *= k; vb.height *= k;
+  });
+  svg.addEventListener("mousedown", ev => { drag = {x: ev.clientX, y: ev.clientY}; graph.style.cursor = "grabbing"; });
+  window.addEventListener("mouseup", () => { drag = null; graph.style.cursor = "grab"; });
+  window.addEventListener("mousemove", ev => {
+    if (!drag) return;
+    const r = svg.getBoundingClientRect();
+    vb.x -= (ev.clientX - drag.x) / r.width * vb.width;
+    vb.y -= (ev.clientY - drag.y) / r.height * vb.height;
+    drag = {x: ev.clientX, y: ev.clientY};
+  });
+}
+
+async function load() {
+  const svg = await (await fetch("/graph/" + encodeURIComponent(name) + "?format=svg")).text();
+  graph.innerHTML = svg.slice(svg.indexOf("<svg"));
+  const el = graph.querySelector("svg");
+  el.removeAttribute("width"); el.removeAttribute("height");
+  panZoom(el);
+  const def = await (await fetch("/definition/" + encodeURIComponent(name))).json();
+  (def.Steps || []).forEach(s => steps[s.Name] = s);
+  if (id) {
+    const resp = await fetch("/wf/" + encodeURIComponent(name) + "/" + encodeURIComponent(id) + "/history");
+    if (resp.ok) history = await resp.json();
+    const visited = new Set();
+    history.forEach(e => [].concat(entryStep(e)).forEach(s => visited.add(s)));
+    graph.querySelectorAll(".node").forEach(n => { if (visited.has(n.querySelector("title").textContent)) n.classList.add("visited"); });
+  }
+  graph.querySelectorAll(".node").forEach(n => n.addEventListener("click", ev => {
+    ev.stopPropagation();
+    show(n.querySelector("title").textContent);
+  }));
+}
+load();
+</script>
+</body>
+</html>
+`))
+
+// serveViewer serves interactive graph viewer for workflow definition and optionally instance
+func serveViewer(w http.ResponseWriter, name, id string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := viewerTmpl.Execute(w, struct {
+		Name string
+		ID   string
+	}{
+		Name: name,
+		ID:   id,
+	})
+	if err != nil {
+		jsonErr(w, err, 500)
+	}
+}
@@ -0,0 +1,110 @@
+package gasync
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gorchestrate/async"
+)
+
+// Watcher listens for workflow changes in Firestore and resumes workflows that have runnable threads,
+// but weren't resumed during GracePeriod. It's a safety net for cases when resume couldn't be scheduled.
+type Watcher struct {
+	Engine      *FirestoreEngine
+	GracePeriod time.Duration
+
+	mu      sync.Mutex
+	pending map[string]time.Time // workflow id -> update time when it was seen as runnable
+}
+
+// runnable returns true if workflow has threads that can make progress without external events
+func runnable(meta async.State) bool {
+	if meta.Status == async.WorkflowResuming {
+		return true
+	}
+	if meta.Status == async.WorkflowFinished {
+		return false
+	}
+	for _, t := range meta.Threads {
+		if t.Status == async.ThreadResuming || t.Status == async.ThreadExecuting {
+			return true
+		}
+	}
+	return false
+}
+
+// Run blocks and watches workflows until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) error {
+	w.mu.Lock()
+	w.pending = map[string]time.Time{}
+	w.mu.Unlock()
+	grace := w.GracePeriod
+	if grace == 0 {
+		grace = time.Minute
+	}
+	it := w.Engine.DB.Collection(w.Engine.Collection).
+		Where("Meta.Status", "in", []string{string(async.WorkflowResuming), string(async.WorkflowWaiting)}).
+		Snapshots(ctx)
+	defer it.Stop()
+	for {
+		snap, err := it.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		for _, c := range snap.Changes {
+			if c.Kind == firestore.DocumentRemoved {
+				w.forget(c.Doc.Ref.ID)
+				continue
+			}
+			var wf DBWorkflow
+			err := c.Doc.DataTo(&wf)
+			if err != nil {
+				log.Printf("watcher: err unmarshaling workflow %v: %v", c.Doc.Ref.ID, err)
+				continue
+			}
+			if !runnable(wf.Meta) {
+				w.forget(c.Doc.Ref.ID)
+				continue
+			}
+			w.mu.Lock()
+			w.pending[c.Doc.Ref.ID] = c.Doc.UpdateTime
+			w.mu.Unlock()
+			id, updated := c.Doc.Ref.ID, c.Doc.UpdateTime
+			time.AfterFunc(grace, func() {
+				w.check(ctx, id, updated)
+			})
+		}
+	}
+}
+
+func (w *Watcher) forget(id string) {
+	w.mu.Lock()
+	delete(w.pending, id)
+	w.mu.Unlock()
+}
+
+// check resumes workflow if it wasn't changed since it was seen as runnable
+func (w *Watcher) check(ctx context.Context, id string, updated time.Time) {
+	w.mu.Lock()
+	last, ok := w.pending[id]
+	if !ok || !last.Equal(updated) {
+		w.mu.Unlock()
+		return
+	}
+	delete(w.pending, id)
+	w.mu.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	log.Printf("watcher: workflow %v was not resumed during grace period, resuming", id)
+	err := w.Engine.Resume(ctx, id)
+	if err != nil {
+		log.Printf("watcher: err resuming workflow %v: %v", id, err)
+	}
+}
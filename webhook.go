@@ -0,0 +1,100 @@
+package gasync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorchestrate/async"
+)
+
+// ErrWebhookNotVerified is returned when webhook request fails verification
+var ErrWebhookNotVerified = errors.New("webhook request is not verified")
+
+// WebhookHandler subscribes to external service when workflow starts waiting and unsubscribes when waiting is over.
+// External service should POST events to the callback URL: BasePublicURL/wf/{workflow}/{id}/{event}
+type WebhookHandler struct {
+	// Register subscribes callbackURL in external service and returns subscription ID
+	Register func(ctx context.Context, callbackURL string) (subscriptionID string, err error)
+	// Unregister removes subscription. Optional.
+	Unregister func(ctx context.Context, subscriptionID string) error
+	// Verify checks webhook request, i.e. its signature. Optional.
+	Verify func(r *http.Request, body []byte) error
+	// Payload receives webhook body. Optional.
+	Payload *json.RawMessage
+
+	baseURL string
+}
+
+type WebhookData struct {
+	SubscriptionID string
+}
+
+// Webhook waits for the webhook call from external service
+func (s *Server) Webhook(name string, h WebhookHandler, stmts ...async.Stmt) async.Event {
+	h.baseURL = s.baseURL
+	return async.On(name, &h, stmts...)
+}
+
+func (h WebhookHandler) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type string
+	}{
+		Type: "webhook",
+	})
+}
+
+func (h *WebhookHandler) Handle(ctx context.Context, req async.CallbackRequest, input interface{}) (interface{}, error) {
+	d, ok := input.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected webhook input type %T", input)
+	}
+	if h.Verify != nil {
+		r, ok := RequestFromContext(ctx)
+		if !ok {
+			return nil, fmt.Errorf("%w: no http request", ErrWebhookNotVerified)
+		}
+		err := h.Verify(r, d)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrWebhookNotVerified, err)
+		}
+	}
+	if h.Payload != nil {
+		*h.Payload = append(json.RawMessage{}, d...)
+	}
+	return nil, nil
+}
+
+func (h *WebhookHandler) Setup(ctx context.Context, req async.CallbackRequest) (string, error) {
+	defer logTime("webhook setup")()
+	name, _ := ctx.Value(workflowCtxKey{}).(string)
+	url := fmt.Sprintf("%v/wf/%v/%v/%v", strings.Trim(h.baseURL, "/"), name, req.WorkflowID, req.Name)
+	id, err := h.Register(ctx, url)
+	if err != nil {
+		return "", fmt.Errorf("err registering webhook: %v", err)
+	}
+	d, err := json.Marshal(WebhookData{
+		SubscriptionID: id,
+	})
+	return string(d), err
+}
+
+func (h *WebhookHandler) Teardown(ctx context.Context, req async.CallbackRequest, handled bool) error {
+	defer logTime("webhook teardown")()
+	if h.Unregister == nil {
+		return nil
+	}
+	var data WebhookData
+	err := json.Unmarshal([]byte(req.SetupData), &data)
+	if err != nil {
+		return err
+	}
+	err = h.Unregister(ctx, data.SubscriptionID)
+	if err != nil {
+		return fmt.Errorf("err unregistering webhook: %v", err)
+	}
+	return nil
+}